@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/cvmfs/ducc/lib"
+)
+
+var (
+	forceRemoveLayers bool
+)
+
+func init() {
+	removeLayersCmd.Flags().BoolVarP(&forceRemoveLayers, "force", "", false, "remove the layers of the plan even if their backlinks still list some image")
+	rootCmd.AddCommand(exportBacklinksCmd)
+	rootCmd.AddCommand(removeLayersCmd)
+}
+
+var exportBacklinksCmd = &cobra.Command{
+	Use:   "export-backlinks",
+	Short: "Print, as JSON, the images using each layer of the repository",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		graph, err := lib.ExportBacklinkGraph(args[0])
+		if err != nil {
+			lib.LogE(err).Fatal("Error in exporting the backlinks")
+		}
+		fmt.Println(string(graph))
+	},
+}
+
+var removeLayersCmd = &cobra.Command{
+	Use:   "remove-layers REPO PLAN",
+	Short: "Remove the layers listed in the JSON plan, in the form {\"repository\": REPO, \"remove\": [digests]}, - reads the plan from stdin",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		CVMFSRepo := args[0]
+		var plan []byte
+		var err error
+		if args[1] == "-" {
+			plan, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			plan, err = ioutil.ReadFile(args[1])
+		}
+		if err != nil {
+			lib.LogE(err).Fatal("Error in reading the removal plan")
+		}
+		digests, err := lib.ImportLayerRemovalPlan(CVMFSRepo, plan)
+		if err != nil {
+			lib.LogE(err).Fatal("Error in the removal plan")
+		}
+		// the plan may be older than the backlinks
+		if !forceRemoveLayers {
+			inUse, err := lib.LayersInUse(CVMFSRepo, digests)
+			if err != nil {
+				lib.LogE(err).Fatal("Error in checking the backlinks of the layers")
+			}
+			if len(inUse) > 0 {
+				lib.Log().WithFields(log.Fields{"repo": CVMFSRepo, "layers": strings.Join(inUse, ", ")}).Fatal(
+					"Layers of the removal plan still used by some image, not removing anything, use --force to remove them anyway")
+			}
+		}
+		if err = lib.RemoveLayers(CVMFSRepo, digests); err != nil {
+			lib.LogE(err).WithFields(log.Fields{"repo": CVMFSRepo}).Fatal("Error in removing the layers")
+		}
+		lib.Log().WithFields(log.Fields{"repo": CVMFSRepo, "layers": len(digests)}).Info("Layers removed")
+	},
+}
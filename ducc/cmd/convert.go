@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"crypto/sha256"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -20,14 +23,23 @@ var (
 
 var (
 	convertAgain, overwriteLayer, skipLayers, skipFlat, skipThinImage bool
+	dedupLayers                                                       bool
+	resumeFile                                                        string
+	imageAttempts                                                     int
 )
 
+// wait between the attempts of converting the same image
+const imageRetryDelay = 30 * time.Second
+
 func init() {
 	convertCmd.Flags().BoolVarP(&overwriteLayer, "overwrite-layers", "f", false, "overwrite the layer if they are already inside the CVMFS repository")
 	convertCmd.Flags().BoolVarP(&convertAgain, "convert-again", "g", false, "convert again images that are already successfull converted")
 	convertCmd.Flags().BoolVarP(&skipFlat, "skip-flat", "s", false, "do not create a flat image (compatible with singularity)")
 	convertCmd.Flags().BoolVarP(&skipLayers, "skip-layers", "d", false, "do not unpack the layers into the repository, implies --skip-thin-image")
 	convertCmd.Flags().BoolVarP(&skipThinImage, "skip-thin-image", "i", false, "do not create and push the docker thin image")
+	convertCmd.Flags().StringVarP(&resumeFile, "resume", "", "", "State file where to record the images converted, if the batch is interrupted the images already recorded are skipped when running again the same recipe with the same file, which is removed once the whole batch is converted")
+	convertCmd.Flags().IntVarP(&imageAttempts, "image-attempts", "", 1, "How many times to attempt the conversion of each image before to give up on it")
+	convertCmd.Flags().BoolVarP(&dedupLayers, "dedup-layers", "", false, "After the conversion replace the files with identical content in different layers with reflinks to a single copy, if the filesystem supports reflinks")
 	rootCmd.AddCommand(convertCmd)
 }
 
@@ -58,27 +70,52 @@ var convertCmd = &cobra.Command{
 			lib.LogE(err).Error("Impossible to parse the recipe file")
 			os.Exit(ParseRecipeFileError)
 		}
-		if !lib.RepositoryExists(recipe.Repo) {
-			lib.LogE(err).Error("The repository does not seems to exists.")
+		if err = lib.Preflight(recipe.Repo); err != nil {
+			lib.LogE(err).Error("The repository is not ready to be written")
 			os.Exit(RepoNotExistsError)
 		}
-		for wish := range recipe.Wishes {
+		var checkpoint *lib.Checkpoint
+		if resumeFile != "" {
+			// the records are valid only for the same recipe
+			batch := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+			checkpoint, err = lib.OpenCheckpoint(resumeFile, batch)
+			if err != nil {
+				lib.LogE(err).Error("Impossible to read the resume file")
+				os.Exit(GetRecipeFileError)
+			}
+		}
+		failed := lib.ConvertWishes(recipe.Wishes, checkpoint, imageAttempts, imageRetryDelay, func(wish lib.WishFriendly) (err error) {
 			fields := log.Fields{"input image": wish.InputName,
 				"repository":   wish.CvmfsRepo,
 				"output image": wish.OutputName}
 			lib.Log().WithFields(fields).Info("Start conversion of wish")
-			if !skipLayers {
-				err = lib.ConvertWishDocker(wish, convertAgain, overwriteLayer, !skipThinImage)
+			if !skipLayers && wish.Representations.Layers {
+				err = lib.ConvertWishDocker(wish, convertAgain, overwriteLayer, !skipThinImage && wish.Representations.Thin)
 				if err != nil {
-					lib.LogE(err).WithFields(fields).Error("Error in converting wish (docker), going on")
+					lib.LogE(err).WithFields(fields).Error("Error in converting wish (docker)")
 				}
 			}
-			if !skipFlat {
-				err = lib.ConvertWishSingularity(wish)
-				if err != nil {
-					lib.LogE(err).WithFields(fields).Error("Error in converting wish (singularity), going on")
+			if !skipFlat && wish.Representations.Flat {
+				errFlat := lib.ConvertWishSingularity(wish)
+				if errFlat != nil {
+					lib.LogE(errFlat).WithFields(fields).Error("Error in converting wish (singularity)")
+					if err == nil {
+						err = errFlat
+					}
 				}
 			}
+			return err
+		})
+		if dedupLayers {
+			if _, err = lib.DedupLayers(recipe.Repo); err != nil {
+				lib.LogE(err).Error("Error in deduplicating the layers")
+			}
+		}
+		// the next batch starts from scratch
+		if failed == 0 {
+			if err = checkpoint.Remove(); err != nil {
+				lib.LogE(err).Warning("Error in removing the resume file")
+			}
 		}
 	},
 }
@@ -51,8 +51,8 @@ var convertSingleImageCmd = &cobra.Command{
 			}
 		}
 
-		if !lib.RepositoryExists(cvmfsRepo) {
-			lib.Log().Error("The repository does not seems to exists.")
+		if err := lib.Preflight(cvmfsRepo); err != nil {
+			lib.LogE(err).Error("The repository is not ready to be written")
 			os.Exit(RepoNotExistsError)
 		}
 
@@ -3,9 +3,6 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"path/filepath"
-	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -79,73 +76,50 @@ var garbageCollectionCmd = &cobra.Command{
 		}
 
 		// we remove the prefix to the paths and we accumulate them in a single array
-		// we remove the prefix to pass them to `cvmfs_server ingest --delete $path_with_no_prefix CVMFSRepo`
-		prefix := filepath.Join("/", "cvmfs", CVMFSRepo) + "/"
-		today := time.Now()
-
 		pathShouldBeDeleted := func(path string) bool {
-			if !strings.HasPrefix(path, prefix) {
-				llog(lib.Log()).WithFields(log.Fields{"path": path, "prefix": prefix}).Warning("Path does not have the expected prefix")
+			if _, err := lib.TrimRepositoryRoot(CVMFSRepo, path); err != nil {
+				llog(lib.Log()).WithFields(log.Fields{"path": path, "err": err}).Warning("Path does not have the expected prefix")
 				return false
 			}
-			stat, err := os.Stat(path)
+			inGracePeriod, modTime, err := lib.PathInGracePeriod(path, lib.GarbageCollectionGracePeriod, lib.DefaultClock)
 			if err != nil {
 				llog(lib.Log()).WithFields(log.Fields{"path": path, "err": err}).Warning("Error in stating the path")
 				return false
 			}
-			modTime := stat.ModTime()
-			thirtyDays := 30 * 24 * time.Hour
-			if modTime.Add(thirtyDays).After(today) {
-				llog(lib.Log()).WithFields(log.Fields{"path": path, "grace period": "30 days", "path mod time": modTime}).Warning("Path still in its grace period")
+			if inGracePeriod {
+				llog(lib.Log()).WithFields(log.Fields{"path": path, "grace period": lib.GarbageCollectionGracePeriod, "path mod time": modTime}).Warning("Path still in its grace period")
 				return false
 			}
 			return true
 		}
 
 		pathsToDelete := make([]string, 0)
-		for _, path := range imagesToDelete {
-			if pathShouldBeDeleted(path) {
-				pathsToDelete = append(pathsToDelete, strings.TrimPrefix(path, prefix))
-			}
-		}
-		for _, path := range layersToDelete {
+		for _, path := range append(imagesToDelete, layersToDelete...) {
 			if pathShouldBeDeleted(path) {
-				pathsToDelete = append(pathsToDelete, strings.TrimPrefix(path, prefix))
+				relative, _ := lib.TrimRepositoryRoot(CVMFSRepo, path)
+				pathsToDelete = append(pathsToDelete, relative)
 			}
 		}
 
 		llog(lib.Log()).WithFields(log.Fields{"num. of path to delete": len(pathsToDelete)}).Info("Ready to delete paths")
 
-		// we send 50 folder to deletion at the time
-		commandPrefix := []string{"cvmfs_server", "ingest"}
-		commands := make([][]string, 0)
-		command := commandPrefix
-		j := 0
-		for i, path := range pathsToDelete {
-			j = i
-			if i%deleteBatch == 0 && i > 0 {
-				command = append(command, CVMFSRepo)
-				commands = append(commands, command)
-				command = commandPrefix
-				continue
-			}
-			command = append(command, "--delete", path)
-		}
-		if j%deleteBatch != 0 && j > 0 {
-			command = append(command, CVMFSRepo)
-			commands = append(commands, command)
-		}
-
 		if dryRun {
 			fmt.Printf("Dry run for garbage collection\n")
-			fmt.Printf("It would execute the following commands:\n\n")
-		}
-		for _, cmd := range commands {
-			if dryRun {
-				fmt.Printf("%v\n", cmd)
-			} else {
-				lib.ExecCommand(cmd...).Start()
+			fmt.Printf("It would remove the following paths, %d in each `cvmfs_server ingest --delete`:\n\n", deleteBatch)
+			for _, path := range pathsToDelete {
+				fmt.Printf("%s\n", path)
 			}
+			return
+		}
+		// we send 50 folders to `cvmfs_server ingest --delete` at the time,
+		// the removals are then recorded in the audit log
+		removed, err := lib.RemovePaths(CVMFSRepo, pathsToDelete, deleteBatch)
+		if err != nil {
+			llog(lib.LogE(err)).Error("Error in removing some of the paths")
+		}
+		llog(lib.Log()).WithFields(log.Fields{"num. of path removed": len(removed)}).Info("Garbage collection completed")
+		if err != nil {
+			os.Exit(1)
 		}
 	},
 }
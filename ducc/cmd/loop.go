@@ -47,6 +47,7 @@ var loopCmd = &cobra.Command{
 			}
 		}
 
+		preflightDone := false
 		for {
 			data, err := ioutil.ReadFile(args[0])
 			if err != nil {
@@ -58,7 +59,15 @@ var loopCmd = &cobra.Command{
 				lib.LogE(err).Fatal("Impossible to parse the recipe file")
 				os.Exit(1)
 			}
-			if !lib.RepositoryExists(recipe.Repo) {
+			// at startup we check thoroughly, later on a transaction may be
+			// open for legitimate reasons
+			if !preflightDone {
+				if err = lib.Preflight(recipe.Repo); err != nil {
+					lib.LogE(err).Error("The repository is not ready to be written")
+					os.Exit(RepoNotExistsError)
+				}
+				preflightDone = true
+			} else if !lib.RepositoryExists(recipe.Repo) {
 				lib.LogE(err).Error("The repository does not exists.")
 				os.Exit(RepoNotExistsError)
 			}
@@ -67,13 +76,13 @@ var loopCmd = &cobra.Command{
 					"repository":   wish.CvmfsRepo,
 					"output image": wish.OutputName}
 				lib.Log().WithFields(fields).Info("Start conversion of wish")
-				if !skipLayers {
-					err = lib.ConvertWishDocker(wish, convertAgain, overwriteLayer, !skipThinImage)
+				if !skipLayers && wish.Representations.Layers {
+					err = lib.ConvertWishDocker(wish, convertAgain, overwriteLayer, !skipThinImage && wish.Representations.Thin)
 					if err != nil {
 						lib.LogE(err).WithFields(fields).Error("Error in converting wish (docker), going on")
 					}
 				}
-				if !skipFlat {
+				if !skipFlat && wish.Representations.Flat {
 					err = lib.ConvertWishSingularity(wish)
 					if err != nil {
 						lib.LogE(err).WithFields(fields).Error("Error in converting wish (singularity), going on")
@@ -2,10 +2,13 @@ package cmd
 
 import (
 	"os"
+	"strings"
 	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	da "github.com/cvmfs/ducc/docker-api"
 	"github.com/cvmfs/ducc/lib"
 )
 
@@ -14,6 +17,181 @@ func init() {
 	if lib.TemporaryBaseDir == "" {
 		lib.TemporaryBaseDir = os.Getenv("DUCC_TMP_DIR")
 	}
+	rootCmd.PersistentFlags().StringSliceVarP(&registryMirrors, "registry-mirror", "", []string{}, "Mirror to try before to contact a registry, in the form `registry=mirror` (ex: registry.hub.docker.com=https://mirror.example.com). It can be repeated. If not set we read the comma separated list in $DUCC_REGISTRY_MIRRORS")
+	rootCmd.PersistentFlags().IntVarP(&lib.MaxConcurrentDownloads, "max-downloads", "", lib.MaxConcurrentDownloads, "Maximum number of concurrent downloads from the registries, 0 means unlimited")
+	rootCmd.PersistentFlags().IntVarP(&lib.MaxConcurrentDownloadsPerHost, "max-downloads-per-host", "", lib.MaxConcurrentDownloadsPerHost, "Maximum number of concurrent downloads from the same registry, 0 means unlimited")
+	rootCmd.PersistentFlags().Int64VarP(&lib.DownloadRateLimit, "download-rate-limit", "", 0, "Maximum throughput in bytes per second of all the layer downloads together, 0 means unlimited")
+	rootCmd.PersistentFlags().StringVarP(&copyMethod, "copy-method", "", "auto", "How to copy the files into the repository: auto (reflink if possible, otherwise copy), copy, reflink or hardlink")
+	rootCmd.PersistentFlags().StringVarP(&lib.DockerConfigPath, "docker-config", "", "", "Docker configuration file where to look for the credentials of the registries. If not set we use $DOCKER_CONFIG/config.json or ~/.docker/config.json")
+	rootCmd.PersistentFlags().BoolVarP(&lib.DefaultLayerLimits.SkipUnsupported, "skip-unsupported-entries", "", false, "Ingest the layers containing entries of unsupported types, skipping those entries with a warning, instead of rejecting the layers")
+	rootCmd.PersistentFlags().IntVarP(&lib.DefaultLayerLimits.MaxEntries, "max-layer-entries", "", 0, "Maximum number of entries of a layer, the layers with more entries are rejected, 0 means unlimited")
+	rootCmd.PersistentFlags().Int64VarP(&lib.DefaultLayerLimits.MaxEntrySize, "max-layer-entry-size", "", 0, "Maximum size in bytes of a single file of a layer, the layers with bigger files are rejected, 0 means unlimited")
+	rootCmd.PersistentFlags().Int64VarP(&lib.DefaultLayerLimits.MaxTotalSize, "max-layer-size", "", 0, "Maximum uncompressed size in bytes of a layer, the bigger layers are rejected, 0 means unlimited")
+	rootCmd.PersistentFlags().BoolVarP(&lib.SpoolLayers, "spool-layers", "", false, "Save each layer into a temporary file and validate it before the ingestion, instead of validating it while it is ingested and removing it after a partial ingestion if it violates the ingestion policy. It needs temporary space as big as the biggest uncompressed layer")
+	rootCmd.PersistentFlags().IntVarP(&lib.CatalogEntriesThreshold, "catalog-threshold", "", 0, "Create nested catalogs inside the layers so that each catalog holds at most about this many entries, 0 disables the nesting")
+	rootCmd.PersistentFlags().DurationVarP(&cleanTempOlderThan, "clean-temp-older-than", "", 0, "At startup remove the temporary files left by previous runs of DUCC older than this duration (ex: 24h), 0 disables the cleanup")
+	rootCmd.PersistentFlags().IntVarP(&lib.MaxIdleConnsPerHost, "max-idle-conns-per-host", "", lib.MaxIdleConnsPerHost, "Maximum number of idle connections kept open against each registry")
+	rootCmd.PersistentFlags().DurationVarP(&lib.IdleConnTimeout, "idle-conn-timeout", "", lib.IdleConnTimeout, "How long an idle connection to a registry is kept open")
+	rootCmd.PersistentFlags().BoolVarP(&lib.CompressMetadata, "compress-metadata", "", false, "Write the metadata files (origin.json, remove-schedule.json) gzip compressed, with the .gz suffix. The uncompressed files are always readable")
+	rootCmd.PersistentFlags().BoolVarP(&lib.VerifyIngestChecksum, "verify-ingest", "", false, "Verify, before to publish, that the content copied into the repository matches the source, aborting the transaction otherwise")
+	rootCmd.PersistentFlags().StringVarP(&tempStorage, "temp-storage", "", "disk", "Where to stage the temporary files: disk (in the temporary directory, that can be a tmpfs) or memory")
+	rootCmd.PersistentFlags().Int64VarP(&tempMemoryLimit, "temp-memory-limit", "", 256*1024*1024, "With --temp-storage=memory, the maximum size in bytes kept in memory by all the temporary files together, the files that do not fit are spilled on disk")
+	rootCmd.PersistentFlags().IntVarP(&lib.MaxLayers, "max-layers", "", 0, "Maximum number of layers of an image, 0 means unlimited")
+	rootCmd.PersistentFlags().StringVarP(&maxLayersPolicy, "max-layers-policy", "", "reject", "What to do with the images with more layers than --max-layers: reject (do not convert them) or flatten (create only the flat image)")
+	rootCmd.PersistentFlags().StringVarP(&symlinkCyclesPolicy, "symlink-cycles", "", "ignore", "What to do with the layers whose symlinks create cycles: ignore (do not look for them), warn (log them) or reject (remove the layer and fail the conversion)")
+	rootCmd.PersistentFlags().StringVarP(&ingestResultsFile, "results-file", "", "", "File where to append, one JSON object per line, the result of the conversion of each image, - for the standard output. If not set the results are not written")
+	rootCmd.PersistentFlags().DurationVarP(&lib.PullTimeout, "pull-timeout", "", 0, "Maximum time to pull an image, manifest and all the layers, before to give up (ex: 2h), 0 means no deadline")
+	rootCmd.PersistentFlags().IntVarP(&lib.PublishAttempts, "publish-attempts", "", lib.PublishAttempts, "How many times to attempt the publish of the metadata before to give up, with an exponential backoff between the attempts")
+	rootCmd.PersistentFlags().StringVarP(&lib.CvmfsServerBinary, "cvmfs-server", "", lib.CvmfsServerBinary, "The cvmfs_server binary to use, either a name looked up in $PATH or a full path")
+	rootCmd.PersistentFlags().StringVarP(&ociPlatform, "oci-platform", "", lib.OCIPlatformOS+"/"+lib.OCIPlatformArchitecture, "Platform, as os/architecture, to pick from the multi-arch images read from OCI layouts (oci:/path/to/layout:tag)")
+	rootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "", "info", "Minimum level of the log messages: debug, info, warning or error. At debug level the full command line of each cvmfs_server invocation is logged")
+	rootCmd.PersistentFlags().StringArrayVarP(&logSinks, "log-sink", "", []string{}, "Destination of the log messages, in the form `kind[:path][,level=LEVEL][,format=text|json][,max-size=BYTES]` where kind is stderr, file or syslog (ex: file:/var/log/ducc.log,level=debug,max-size=104857600). It can be repeated, the level defaults to --log-level. If not set the messages go to stderr")
+	cobra.OnInitialize(initLogLevel, initOCIPlatform, initRegistryMirrors, initDownloadScheduler, initRegistryClient, initCopyMethod, initTempStorage, initMaxLayersPolicy, initSymlinkCycles, initIngestResults, initCleanStaleTempFiles)
+}
+
+var (
+	ociPlatform string
+)
+
+func initOCIPlatform() {
+	platform := strings.SplitN(ociPlatform, "/", 2)
+	if len(platform) != 2 || platform[0] == "" || platform[1] == "" {
+		lib.Log().WithFields(log.Fields{"platform": ociPlatform}).Fatal("Impossible to parse the platform, expected os/architecture")
+	}
+	lib.OCIPlatformOS, lib.OCIPlatformArchitecture = platform[0], platform[1]
+}
+
+var (
+	logLevel string
+	logSinks []string
+)
+
+func initLogLevel() {
+	level, err := log.ParseLevel(logLevel)
+	if err != nil {
+		lib.LogE(err).Fatal("Impossible to parse the log level")
+	}
+	log.SetLevel(level)
+	if len(logSinks) == 0 {
+		return
+	}
+	sinks := make([]lib.LogSink, 0, len(logSinks))
+	for _, spec := range logSinks {
+		sink, err := lib.ParseLogSink(spec, level)
+		if err != nil {
+			lib.LogE(err).Fatal("Impossible to parse the log sink")
+		}
+		sinks = append(sinks, sink)
+	}
+	if err = lib.ConfigLogging(sinks); err != nil {
+		lib.LogE(err).Fatal("Impossible to configure the log sinks")
+	}
+}
+
+var (
+	ingestResultsFile string
+)
+
+func initIngestResults() {
+	switch ingestResultsFile {
+	case "":
+		return
+	case "-":
+		lib.IngestResults = os.Stdout
+	default:
+		file, err := os.OpenFile(ingestResultsFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			lib.LogE(err).Fatal("Impossible to open the results file")
+		}
+		lib.IngestResults = file
+	}
+}
+
+var (
+	maxLayersPolicy string
+)
+
+func initMaxLayersPolicy() {
+	policy, err := lib.ParseLayerLimitPolicy(maxLayersPolicy)
+	if err != nil {
+		lib.LogE(err).Fatal("Impossible to parse the policy for the images with too many layers")
+	}
+	lib.MaxLayersPolicy = policy
+}
+
+var (
+	symlinkCyclesPolicy string
+)
+
+func initSymlinkCycles() {
+	policy, err := lib.ParseSymlinkCyclePolicy(symlinkCyclesPolicy)
+	if err != nil {
+		lib.LogE(err).Fatal("Impossible to parse the policy for the symlink cycles")
+	}
+	lib.SymlinkCycles = policy
+}
+
+var (
+	tempStorage     string
+	tempMemoryLimit int64
+)
+
+func initTempStorage() {
+	storage, err := lib.ParseTempStorage(tempStorage, tempMemoryLimit)
+	if err != nil {
+		lib.LogE(err).Fatal("Impossible to parse the temporary storage")
+	}
+	lib.TempFiles = storage
+}
+
+var (
+	cleanTempOlderThan time.Duration
+)
+
+func initCleanStaleTempFiles() {
+	if cleanTempOlderThan <= 0 {
+		return
+	}
+	removed, err := lib.CleanStaleTempFiles(cleanTempOlderThan)
+	if err != nil {
+		lib.LogE(err).Warning("Error in cleaning up the stale temporary files")
+	}
+	lib.Log().WithFields(log.Fields{"removed": removed}).Info("Cleaned up stale temporary files")
+}
+
+var (
+	copyMethod string
+)
+
+func initCopyMethod() {
+	method, err := lib.ParseCopyMethod(copyMethod)
+	if err != nil {
+		lib.LogE(err).Fatal("Impossible to parse the copy method")
+	}
+	lib.DefaultCopyMethod = method
+}
+
+func initDownloadScheduler() {
+	lib.Downloads = lib.NewDownloadScheduler(lib.MaxConcurrentDownloads, lib.MaxConcurrentDownloadsPerHost)
+	lib.DownloadLimiter = da.NewRateLimiter(lib.DownloadRateLimit)
+}
+
+func initRegistryClient() {
+	lib.RegistryClient = lib.NewRegistryClient(lib.MaxIdleConnsPerHost, lib.IdleConnTimeout)
+}
+
+var (
+	registryMirrors []string
+)
+
+func initRegistryMirrors() {
+	if len(registryMirrors) == 0 && os.Getenv("DUCC_REGISTRY_MIRRORS") != "" {
+		registryMirrors = strings.Split(os.Getenv("DUCC_REGISTRY_MIRRORS"), ",")
+	}
+	err := lib.AddRegistryMirrors(registryMirrors)
+	if err != nil {
+		lib.LogE(err).Fatal("Impossible to parse the registry mirrors")
+	}
 }
 
 var rootCmd = &cobra.Command{
@@ -33,6 +211,12 @@ func AliveMessage() {
 	go func() {
 		for _ = range ticker.C {
 			lib.Log().Info("Process alive")
+			for repo, stats := range lib.RepositoryLockStats() {
+				lib.Log().WithFields(log.Fields{"repo": repo,
+					"waiters":      stats.Waiters,
+					"acquisitions": stats.Acquisitions,
+					"total wait":   stats.TotalWait}).Info("Repository lock contention")
+			}
 		}
 	}()
 }
@@ -0,0 +1,137 @@
+package dockerutil
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// ManifestCache is a bounded LRU cache of parsed manifests, whose entries
+// expire after a TTL, safe for concurrent use.
+// Concurrent requests for the same key wait for a single fetch.
+type ManifestCache struct {
+	size int
+	ttl  time.Duration
+	// only the tests replace it
+	now func() time.Time
+
+	mutex    sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	inflight map[string]*manifestFetch
+}
+
+type manifestCacheEntry struct {
+	key      string
+	manifest Manifest
+	expires  time.Time
+}
+
+type manifestFetch struct {
+	done     chan struct{}
+	manifest Manifest
+	err      error
+	// callers waiting for the fetch, when all of them give up the fetch is
+	// cancelled
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// size is the maximum number of manifests kept, a size of zero, or less,
+// disables the cache
+func NewManifestCache(size int, ttl time.Duration) *ManifestCache {
+	return &ManifestCache{
+		size:     size,
+		ttl:      ttl,
+		now:      time.Now,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*manifestFetch),
+	}
+}
+
+// return the manifest cached under key (ex: registry/repository@digest),
+// calling fetch if it is missing or expired, errors are not cached.
+// key must identify a single manifest, so a tag, that can be moved, is not a
+// valid key.
+// The fetch is shared by all the callers and does not depend on the context
+// of the one that started it, each caller waits until its own ctx is done.
+// The fetch is cancelled only when all the callers waiting for it are gone.
+func (c *ManifestCache) Get(ctx context.Context, key string, fetch func(context.Context) (Manifest, error)) (Manifest, error) {
+	if c == nil || c.size <= 0 {
+		return fetch(ctx)
+	}
+	c.mutex.Lock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*manifestCacheEntry)
+		if c.now().Before(entry.expires) {
+			c.lru.MoveToFront(element)
+			c.mutex.Unlock()
+			return entry.manifest, nil
+		}
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+	f, ok := c.inflight[key]
+	if !ok {
+		fetchCtx, cancel := context.WithCancel(context.Background())
+		f = &manifestFetch{done: make(chan struct{}), cancel: cancel}
+		c.inflight[key] = f
+		go c.fetch(fetchCtx, key, f, fetch)
+	}
+	f.waiters++
+	c.mutex.Unlock()
+
+	select {
+	case <-f.done:
+		return f.manifest, f.err
+	case <-ctx.Done():
+		c.mutex.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// nobody is interested anymore, the next caller starts a new
+			// fetch
+			f.cancel()
+			if c.inflight[key] == f {
+				delete(c.inflight, key)
+			}
+		}
+		c.mutex.Unlock()
+		return Manifest{}, ctx.Err()
+	}
+}
+
+func (c *ManifestCache) fetch(ctx context.Context, key string, f *manifestFetch, fetch func(context.Context) (Manifest, error)) {
+	manifest, err := fetch(ctx)
+	f.cancel()
+
+	c.mutex.Lock()
+	if c.inflight[key] == f {
+		delete(c.inflight, key)
+	}
+	if err == nil {
+		c.add(key, manifest)
+	}
+	f.manifest, f.err = manifest, err
+	c.mutex.Unlock()
+	close(f.done)
+}
+
+// must be called holding the mutex
+func (c *ManifestCache) add(key string, manifest Manifest) {
+	entry := &manifestCacheEntry{key: key, manifest: manifest, expires: c.now().Add(c.ttl)}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*manifestCacheEntry).key)
+	}
+}
+
+// number of manifests in the cache
+func (c *ManifestCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,129 @@
+package dockerutil
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManifestCacheConcurrentFetch(t *testing.T) {
+	cache := NewManifestCache(2, time.Minute)
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func(ctx context.Context) (Manifest, error) {
+		atomic.AddInt32(&fetches, 1)
+		// keep the first fetch in flight while the second request arrives
+		<-release
+		return Manifest{SchemaVersion: 2}, nil
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = cache.Get(context.Background(), "a", fetch)
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			t.Errorf("Error in getting the manifest: %s", err)
+		}
+	}
+	if fetches := atomic.LoadInt32(&fetches); fetches != 1 {
+		t.Errorf("Error, expected a single fetch of the manifest, got %d", fetches)
+	}
+}
+
+func TestManifestCacheDetachedFetch(t *testing.T) {
+	cache := NewManifestCache(2, time.Minute)
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+	fetch := func(ctx context.Context) (Manifest, error) {
+		select {
+		case <-release:
+			return Manifest{SchemaVersion: 2}, nil
+		case <-ctx.Done():
+			return Manifest{}, ctx.Err()
+		}
+	}
+
+	// the caller that starts the fetch gives up, the other one still gets
+	// the manifest
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error)
+	go func() {
+		_, err := cache.Get(first, "a", fetch)
+		firstErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	second := make(chan error)
+	go func() {
+		_, err := cache.Get(context.Background(), "a", fetch)
+		second <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("Error, the cancelled caller did not return: %v", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("Error, the fetch was cancelled with the first caller: %s", err)
+	}
+
+	// once all the callers are gone the fetch is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	blocked := func(ctx context.Context) (Manifest, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return Manifest{}, ctx.Err()
+	}
+	if _, err := cache.Get(ctx, "b", blocked); err != context.Canceled {
+		t.Errorf("Error, the caller was not released: %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Errorf("Error, the fetch was not cancelled")
+	}
+}
+
+func TestManifestCacheEvictionAndExpiration(t *testing.T) {
+	cache := NewManifestCache(2, time.Minute)
+	fetches := 0
+	fetch := func(ctx context.Context) (Manifest, error) {
+		fetches++
+		return Manifest{SchemaVersion: 2}, nil
+	}
+	for _, key := range []string{"a", "b", "a", "c", "a", "b"} {
+		if _, err := cache.Get(context.Background(), key, fetch); err != nil {
+			t.Fatalf("Error in getting %s from the cache: %s", key, err)
+		}
+	}
+	// "b" is evicted by "c", since "a" was used more recently
+	if fetches != 4 {
+		t.Errorf("Error, expected 4 fetches, got %d", fetches)
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Error, the cache holds %d manifests instead of 2", cache.Len())
+	}
+
+	expiring := NewManifestCache(2, -time.Second)
+	expiring.Get(context.Background(), "a", fetch)
+	expiring.Get(context.Background(), "a", fetch)
+	if fetches != 6 {
+		t.Errorf("Error, expired manifest served from the cache")
+	}
+}
@@ -0,0 +1,93 @@
+package dockerutil
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter caps the throughput of all the readers it wraps, together, to
+// a number of bytes per second, a nil *RateLimiter does not limit anything
+type RateLimiter struct {
+	bytesPerSecond int64
+
+	mutex sync.Mutex
+	// when the bytes already read are paid for
+	next time.Time
+}
+
+// a limit of zero, or less, means unlimited and returns a nil *RateLimiter
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// wrap r so that its reads share the limit with all the other wrapped readers,
+// the reads waiting for the limit fail as soon as ctx is done
+func (l *RateLimiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &rateLimitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+// reserve n bytes and wait until they are available, or until ctx is done,
+// in which case the reservation is given back
+func (l *RateLimiter) wait(ctx context.Context, n int) error {
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	reserved := time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond)
+	l.next = l.next.Add(reserved)
+	until := l.next
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(until.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mutex.Lock()
+		l.next = l.next.Add(-reserved)
+		l.mutex.Unlock()
+		return ctx.Err()
+	}
+}
+
+// the size of the chunks we read, small enough to keep the throughput smooth
+// even under tight limits
+func (l *RateLimiter) chunk() int {
+	chunk := l.bytesPerSecond / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	if chunk > 32*1024 {
+		chunk = 32 * 1024
+	}
+	return int(chunk)
+}
+
+type rateLimitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if chunk := r.limiter.chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if errWait := r.limiter.wait(r.ctx, n); errWait != nil {
+			return n, errWait
+		}
+	}
+	return n, err
+}
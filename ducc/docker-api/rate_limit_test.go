@@ -0,0 +1,67 @@
+package dockerutil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterSharedAcrossDownloads(t *testing.T) {
+	limiter := NewRateLimiter(4000)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := io.Copy(ioutil.Discard, limiter.Reader(context.Background(), bytes.NewReader(make([]byte, 1000))))
+			if err != nil || n != 1000 {
+				t.Errorf("Error in reading through the limiter: %d bytes, %v", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+	// 2000 bytes at 4000 bytes per second
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("Error, downloads too fast for the limit: %s", elapsed)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	limiter := NewRateLimiter(0)
+	if limiter != nil {
+		t.Errorf("Error, expected no limiter for a limit of 0")
+	}
+	r := bytes.NewReader(make([]byte, 10))
+	if limiter.Reader(context.Background(), r) != r {
+		t.Errorf("Error, the reader is wrapped without any limit")
+	}
+}
+
+func TestRateLimiterHonoursTheContext(t *testing.T) {
+	limiter := NewRateLimiter(100)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// 1000 bytes at 100 bytes per second would take 10 seconds
+	_, err := io.Copy(ioutil.Discard, limiter.Reader(ctx, bytes.NewReader(make([]byte, 1000))))
+	if err != context.DeadlineExceeded {
+		t.Errorf("Error, the read did not fail with the context: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Error, the read kept waiting after the context expired: %s", elapsed)
+	}
+
+	// the time reserved by the cancelled read is given back
+	start = time.Now()
+	if _, err = io.Copy(ioutil.Discard, limiter.Reader(context.Background(), bytes.NewReader(make([]byte, 10)))); err != nil {
+		t.Errorf("Error in reading through the limiter: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Error, the cancelled read still holds the limiter: %s", elapsed)
+	}
+}
@@ -0,0 +1,153 @@
+package dockerutil
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	DefaultRegistry = "docker.io"
+	DefaultTag      = "latest"
+	// the images without a namespace in the docker hub are in `library/`
+	officialNamespace = "library"
+	maxRepositoryLen  = 255
+)
+
+// the docker hub is known with several names, all normalized to DefaultRegistry
+var dockerHubAliases = map[string]bool{
+	"docker.io":               true,
+	"index.docker.io":         true,
+	"registry.hub.docker.com": true,
+	"registry-1.docker.io":    true,
+}
+
+var (
+	registryRegex  = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*|\[[0-9a-fA-F:]+\])(?::[0-9]+)?$`)
+	componentRegex = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagRegex       = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}$`)
+	digestRegex    = regexp.MustCompile(`^[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+	sha256HexRegex = regexp.MustCompile(`^[a-f0-9]{64}$`)
+)
+
+// the components of an image reference, normalized
+// ex: `ubuntu` is `docker.io/library/ubuntu:latest`
+type ImageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// the canonical form of the reference, the tag is omitted when the reference
+// is pinned only by digest
+func (r ImageReference) String() string {
+	name := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		name += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		name += "@" + r.Digest
+	}
+	return name
+}
+
+// from the many names of the docker hub to DefaultRegistry, the other
+// registries are returned as they are
+func NormalizeRegistry(registry string) string {
+	if dockerHubAliases[strings.ToLower(registry)] {
+		return DefaultRegistry
+	}
+	return registry
+}
+
+// parse and normalize an image reference in the docker syntax
+// [registry[:port]/]repository[:tag][@digest]
+// the registry defaults to docker.io, the official images of the docker hub
+// get the `library/` namespace and, unless the reference has a digest, the
+// tag defaults to latest.
+// A reference with the `https://` or `http://` scheme is a URL instead: the
+// first component is always the registry and neither the `library/`
+// namespace nor the tag are added, as for the URLs in the recipes
+func ParseImageReference(ref string) (ImageReference, error) {
+	original := ref
+	ref = strings.TrimSpace(ref)
+	isURL := false
+	for _, scheme := range []string{"https://", "http://"} {
+		if strings.HasPrefix(ref, scheme) {
+			ref = strings.TrimPrefix(ref, scheme)
+			isURL = true
+		}
+	}
+	if ref == "" {
+		return ImageReference{}, fmt.Errorf("Empty image reference")
+	}
+
+	var reference ImageReference
+	if i := strings.Index(ref, "@"); i >= 0 {
+		reference.Digest = ref[i+1:]
+		ref = ref[:i]
+		if err := validateDigest(reference.Digest); err != nil {
+			return ImageReference{}, fmt.Errorf("Invalid digest in the image reference %s: %s", original, err)
+		}
+	}
+	// the tag follows the last `:` after the last `/`, the others `:` are
+	// the port of the registry
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		reference.Tag = ref[i+1:]
+		ref = ref[:i]
+		if !tagRegex.MatchString(reference.Tag) {
+			return ImageReference{}, fmt.Errorf("Invalid tag in the image reference %s: %q", original, reference.Tag)
+		}
+	}
+
+	// the first component is the registry only if it looks like a host
+	reference.Registry = DefaultRegistry
+	if i := strings.Index(ref, "/"); i >= 0 {
+		first := ref[:i]
+		if isURL || strings.ContainsAny(first, ".:[") || first == "localhost" {
+			if !registryRegex.MatchString(first) {
+				return ImageReference{}, fmt.Errorf("Invalid registry in the image reference %s: %q", original, first)
+			}
+			reference.Registry = NormalizeRegistry(first)
+			ref = ref[i+1:]
+		}
+	} else if isURL {
+		return ImageReference{}, fmt.Errorf("Missing repository in the image reference %s", original)
+	}
+
+	if ref == "" {
+		return ImageReference{}, fmt.Errorf("Missing repository in the image reference %s", original)
+	}
+	if len(ref) > maxRepositoryLen {
+		return ImageReference{}, fmt.Errorf("Repository too long in the image reference %s", original)
+	}
+	if strings.ToLower(ref) != ref {
+		return ImageReference{}, fmt.Errorf("Repository must be lowercase in the image reference %s", original)
+	}
+	for _, component := range strings.Split(ref, "/") {
+		if !componentRegex.MatchString(component) {
+			return ImageReference{}, fmt.Errorf("Invalid repository in the image reference %s: %q", original, ref)
+		}
+	}
+	if !isURL && reference.Registry == DefaultRegistry && !strings.Contains(ref, "/") {
+		ref = officialNamespace + "/" + ref
+	}
+	reference.Repository = ref
+
+	if !isURL && reference.Tag == "" && reference.Digest == "" {
+		reference.Tag = DefaultTag
+	}
+	return reference, nil
+}
+
+func validateDigest(digest string) error {
+	if !digestRegex.MatchString(digest) {
+		return fmt.Errorf("malformed digest %q", digest)
+	}
+	parts := strings.SplitN(digest, ":", 2)
+	if parts[0] == "sha256" && !sha256HexRegex.MatchString(parts[1]) {
+		return fmt.Errorf("sha256 digest must be 64 lowercase hex characters: %q", digest)
+	}
+	return nil
+}
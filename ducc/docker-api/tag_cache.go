@@ -0,0 +1,87 @@
+package dockerutil
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// TagCache is a bounded LRU cache of the digests the tags point to, whose
+// entries expire after a TTL, safe for concurrent use.
+// A tag moved in the registry is seen only after its entry expires.
+type TagCache struct {
+	size int
+	ttl  time.Duration
+	// only the tests replace it
+	now func() time.Time
+
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type tagCacheEntry struct {
+	key     string
+	digest  string
+	expires time.Time
+}
+
+// size is the maximum number of tags kept, a size of zero, or less, disables
+// the cache
+func NewTagCache(size int, ttl time.Duration) *TagCache {
+	return &TagCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// return the digest cached under key (ex: registry/repository:tag), if it
+// is not expired
+func (c *TagCache) Get(key string) (digest string, ok bool) {
+	if c == nil || c.size <= 0 {
+		return "", false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	entry := element.Value.(*tagCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return "", false
+	}
+	c.lru.MoveToFront(element)
+	return entry.digest, true
+}
+
+// cache the digest the tag under key points to, for the TTL of the cache
+func (c *TagCache) Add(key, digest string) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.Remove(element)
+	}
+	entry := &tagCacheEntry{key: key, digest: digest, expires: c.now().Add(c.ttl)}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tagCacheEntry).key)
+	}
+}
+
+// number of tags in the cache
+func (c *TagCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
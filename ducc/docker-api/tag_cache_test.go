@@ -0,0 +1,46 @@
+package dockerutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTagCacheExpiration(t *testing.T) {
+	cache := NewTagCache(2, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	if _, ok := cache.Get("registry/repo:latest"); ok {
+		t.Errorf("Error, got a digest from the empty cache")
+	}
+	cache.Add("registry/repo:latest", "sha256:aaaa")
+	if digest, ok := cache.Get("registry/repo:latest"); !ok || digest != "sha256:aaaa" {
+		t.Errorf("Error, wrong digest from the cache: %s %v", digest, ok)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := cache.Get("registry/repo:latest"); ok {
+		t.Errorf("Error, expired tag served from the cache")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Error, the expired tag is still in the cache")
+	}
+}
+
+func TestTagCacheEviction(t *testing.T) {
+	cache := NewTagCache(2, time.Minute)
+	cache.Add("a", "sha256:aaaa")
+	cache.Add("b", "sha256:bbbb")
+	cache.Get("a")
+	cache.Add("c", "sha256:cccc")
+	// "b" is evicted by "c", since "a" was used more recently
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("Error, the least recently used tag was not evicted")
+	}
+	if _, ok := cache.Get("a"); !ok {
+		t.Errorf("Error, the most recently used tag was evicted")
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Error, the cache holds %d tags instead of 2", cache.Len())
+	}
+}
@@ -0,0 +1,138 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+const (
+	AuditActionScheduled = "scheduled"
+	AuditActionRemoved   = "removed"
+)
+
+// a single line of the audit log of the removals
+// each entry carries the sha256 of the previous line, so that changes to the
+// log, other than appending, are detected by ReadAuditLog
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	Reference string    `json:"reference"`
+	Previous  string    `json:"previous"`
+}
+
+// ErrAuditLogTampered is returned when the chain of hashes of the audit log is broken
+var ErrAuditLogTampered = fmt.Errorf("Audit log modified, the chain of hashes is broken")
+
+func AuditLogLocation(CVMFSRepo string) string {
+	return auditLogLocation(repositoryRoot(CVMFSRepo))
+}
+
+func auditLogLocation(repoRoot string) string {
+	return filepath.Join(repoRoot, ".metadata", "audit.jsonl")
+}
+
+func NewAuditEntry(action, reference string) AuditEntry {
+	return AuditEntry{
+		Time:      DefaultClock.Now().UTC(),
+		Actor:     auditActor(),
+		Action:    action,
+		Reference: reference,
+	}
+}
+
+// user@host running DUCC
+func auditActor() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return name + "@" + host
+}
+
+// read all the entries of the audit log of the repository, verifying the
+// chain of hashes
+func ReadAuditLog(CVMFSRepo string) ([]AuditEntry, error) {
+	return readAuditLog(AuditLogLocation(CVMFSRepo))
+}
+
+func readAuditLog(path string) ([]AuditEntry, error) {
+	entries, _, err := scanAuditLog(path)
+	return entries, err
+}
+
+// returns the entries and the hash of the last line
+func scanAuditLog(path string) ([]AuditEntry, string, error) {
+	var entries []AuditEntry
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, "", nil
+	}
+	if err != nil {
+		return entries, "", err
+	}
+	defer file.Close()
+
+	previous := ""
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var entry AuditEntry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			return entries, "", err
+		}
+		if entry.Previous != previous {
+			return entries, "", ErrAuditLogTampered
+		}
+		entries = append(entries, entry)
+		hash := sha256.Sum256(line)
+		previous = hex.EncodeToString(hash[:])
+	}
+	return entries, previous, scanner.Err()
+}
+
+// append the entries to the audit log at path, it must be called inside a transaction
+func appendAuditEntries(path string, entries ...AuditEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	_, previous, err := scanAuditLog(path)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), dirPermision)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePermision)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		entry.Previous = previous
+		line, err := json.Marshal(entry)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		if _, err = file.Write(append(line, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+		hash := sha256.Sum256(line)
+		previous = hex.EncodeToString(hash[:])
+	}
+	return file.Close()
+}
@@ -0,0 +1,149 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit_log")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(clock Clock) { DefaultClock = clock }(DefaultClock)
+	now := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	DefaultClock = &fakeClock{now: now}
+
+	path := filepath.Join(dir, ".metadata", "audit.jsonl")
+	entries, err := readAuditLog(path)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("Error in reading a missing audit log: %v %v", entries, err)
+	}
+
+	err = appendAuditEntries(path, NewAuditEntry(AuditActionScheduled, "sha256:aabb"))
+	if err != nil {
+		t.Fatalf("Error in appending the scheduled entry: %s", err)
+	}
+	err = appendAuditEntries(path,
+		NewAuditEntry(AuditActionRemoved, ".flat/aa/aabb"),
+		NewAuditEntry(AuditActionRemoved, ".layers/cc/ccdd"))
+	if err != nil {
+		t.Fatalf("Error in appending the removed entries: %s", err)
+	}
+
+	entries, err = readAuditLog(path)
+	if err != nil {
+		t.Fatalf("Error in reading the audit log: %s", err)
+	}
+	expected := []struct{ action, reference string }{
+		{AuditActionScheduled, "sha256:aabb"},
+		{AuditActionRemoved, ".flat/aa/aabb"},
+		{AuditActionRemoved, ".layers/cc/ccdd"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Error, expected %d entries, got %d", len(expected), len(entries))
+	}
+	for i, e := range expected {
+		if entries[i].Action != e.action || entries[i].Reference != e.reference || !entries[i].Time.Equal(now) || entries[i].Actor == "" {
+			t.Errorf("Error in the audit entry %d: %+v", i, entries[i])
+		}
+	}
+
+	// editing a past line breaks the chain
+	content, _ := ioutil.ReadFile(path)
+	tampered := strings.Replace(string(content), "sha256:aabb", "sha256:eeff", 1)
+	ioutil.WriteFile(path, []byte(tampered), 0644)
+	if _, err = readAuditLog(path); err != ErrAuditLogTampered {
+		t.Errorf("Error, tampered audit log not detected: %v", err)
+	}
+}
+
+func TestAuditLogScheduleAndExecute(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	repo := "test.cern.ch"
+	root := local.RepositoryRoot(repo)
+
+	// the layer is used only by the image scheduled for removal
+	layer := "ccdd"
+	os.MkdirAll(filepath.Join(root, ".layers", "cc", layer, "layerfs"), 0755)
+	os.MkdirAll(filepath.Join(root, ".layers", "cc", layer, ".metadata"), 0755)
+	ioutil.WriteFile(filepath.Join(root, ".layers", "cc", layer, ".metadata", "origin.json"), []byte(`{"origin":["sha256:aabb"]}`), 0644)
+	manifest := manifestWithConfig("sha256:aabb", "sha256:"+layer)
+
+	if err := AddManifestToRemoveScheduler(repo, manifest); err != nil {
+		t.Fatalf("Error in scheduling the removal: %s", err)
+	}
+	removals, errs := CollectRemoveSchedules([]string{repo})
+	if len(errs) != 0 || len(removals) != 1 {
+		t.Fatalf("Error in collecting the scheduled removals: %v %v", removals, errs)
+	}
+	if errs = ExecuteRemoveSchedules(removals); len(errs) != 0 {
+		t.Fatalf("Error in executing the scheduled removals: %v", errs)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".layers", "cc", layer)); !os.IsNotExist(err) {
+		t.Errorf("Error, layer not removed: %v", err)
+	}
+
+	entries, err := ReadAuditLog(repo)
+	if err != nil {
+		t.Fatalf("Error in reading the audit log: %s", err)
+	}
+	expected := []struct{ action, reference string }{
+		{AuditActionScheduled, "sha256:aabb"},
+		{AuditActionRemoved, filepath.Join(".layers", "cc", layer)},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Error, expected %d audit entries, got %+v", len(expected), entries)
+	}
+	for i, e := range expected {
+		if entries[i].Action != e.action || entries[i].Reference != e.reference {
+			t.Errorf("Error in the audit entry %d: %+v", i, entries[i])
+		}
+	}
+	// each audit entry is written in the transaction of its operation
+	if n := countOperations(local, "transaction"); n != 2 {
+		t.Errorf("Error, expected 2 transactions, got %v", local.Operations)
+	}
+}
+
+func TestRemovePathsAudit(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	repo := "test.cern.ch"
+	root := local.RepositoryRoot(repo)
+	for _, path := range []string{".flat/aa/aabb", ".flat/aa/aacc", ".layers/cc/ccdd"} {
+		os.MkdirAll(filepath.Join(root, path, "etc"), 0755)
+	}
+	// a symlink loop makes the removal of its directory fail
+	os.Symlink("second", filepath.Join(root, ".flat", "aa", "aacc", "first"))
+	os.Symlink("first", filepath.Join(root, ".flat", "aa", "aacc", "second"))
+
+	removed, err := RemovePaths(repo, []string{".flat/aa/aabb", ".flat/aa/aacc", ".layers/cc/ccdd", ".flat/aa/missing"}, 2)
+	if err == nil {
+		t.Errorf("Error, the failed removal was not reported")
+	}
+	if strings.Join(removed, " ") != ".flat/aa/aabb .layers/cc/ccdd" {
+		t.Errorf("Error in the paths removed: %v", removed)
+	}
+	// a removal for each batch, each followed by the publish of the audit log
+	if n := countOperations(local, "delete"); n != 2 {
+		t.Errorf("Error, expected 2 removals, got %v", local.Operations)
+	}
+	if n := countOperations(local, "publish"); n != 2 {
+		t.Errorf("Error, expected 2 publishes, got %v", local.Operations)
+	}
+
+	entries, err := ReadAuditLog(repo)
+	if err != nil {
+		t.Fatalf("Error in reading the audit log: %s", err)
+	}
+	if len(entries) != 2 || entries[0].Reference != ".flat/aa/aabb" || entries[1].Reference != ".layers/cc/ccdd" {
+		t.Errorf("Error, the audit log does not match the paths removed: %+v", entries)
+	}
+}
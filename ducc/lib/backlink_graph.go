@@ -0,0 +1,95 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// the backlinks of all the layers of a repository, for the external tools
+type BacklinkGraph struct {
+	Repository string `json:"repository"`
+	// from the digest of each layer, without the sha256: prefix, to the
+	// origins in its backlink, the layers without a backlink have no origins
+	Layers map[string][]string `json:"layers"`
+}
+
+// the layers that an external tool wants removed, the digests are the same
+// keys of BacklinkGraph.Layers
+type LayerRemovalPlan struct {
+	Repository string   `json:"repository"`
+	Remove     []string `json:"remove"`
+}
+
+// ExportBacklinkGraph reads, in a single pass over the layers, the backlinks
+// of all the layers in the repository and returns them as a JSON BacklinkGraph
+func ExportBacklinkGraph(CVMFSRepo string) ([]byte, error) {
+	graph, err := backlinkGraph(repositoryRoot(CVMFSRepo), CVMFSRepo)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(graph)
+}
+
+func backlinkGraph(repoRoot, CVMFSRepo string) (BacklinkGraph, error) {
+	graph := BacklinkGraph{Repository: CVMFSRepo, Layers: make(map[string][]string)}
+	layers, err := listDigestDirectories(filepath.Join(repoRoot, subDirInsideRepo))
+	if err != nil {
+		return graph, err
+	}
+	for _, layer := range layers {
+		backlink, err := readBacklink(filepath.Join(layer, ".metadata", "origin.json"))
+		if err != nil {
+			return graph, fmt.Errorf("Impossible to read the backlink of the layer %s: %s", filepath.Base(layer), err)
+		}
+		if backlink.Origin == nil {
+			backlink.Origin = []string{}
+		}
+		graph.Layers[filepath.Base(layer)] = backlink.Origin
+	}
+	return graph, nil
+}
+
+// ImportLayerRemovalPlan parses a JSON LayerRemovalPlan and returns the
+// digests, without the sha256: prefix, to pass to RemoveLayers
+// the plan must be for CVMFSRepo
+func ImportLayerRemovalPlan(CVMFSRepo string, plan []byte) ([]string, error) {
+	var removal LayerRemovalPlan
+	if err := json.Unmarshal(plan, &removal); err != nil {
+		return nil, fmt.Errorf("Impossible to parse the removal plan: %s", err)
+	}
+	if removal.Repository != CVMFSRepo {
+		return nil, fmt.Errorf("The removal plan is for the repository %q, not for %s", removal.Repository, CVMFSRepo)
+	}
+	digests := make([]string, 0, len(removal.Remove))
+	for _, digest := range removal.Remove {
+		digests = append(digests, strings.TrimPrefix(digest, "sha256:"))
+	}
+	return dedupStrings(digests), nil
+}
+
+// LayersInUse returns, among the digests, the layers whose current backlink
+// still lists some image: a removal plan may have been computed on a graph
+// since changed, by a new ingestion for instance
+func LayersInUse(CVMFSRepo string, digests []string) ([]string, error) {
+	return layersInUse(repositoryRoot(CVMFSRepo), digests)
+}
+
+func layersInUse(repoRoot string, digests []string) ([]string, error) {
+	inUse := make([]string, 0)
+	for _, digest := range digests {
+		if len(digest) < 2 {
+			// RemoveLayers refuses it anyway
+			continue
+		}
+		backlink, err := readBacklink(filepath.Join(repoRoot, subDirInsideRepo, digest[0:2], digest, ".metadata", "origin.json"))
+		if err != nil {
+			return nil, fmt.Errorf("Impossible to read the backlink of the layer %s: %s", digest, err)
+		}
+		if len(backlink.Origin) > 0 {
+			inUse = append(inUse, digest)
+		}
+	}
+	return inUse, nil
+}
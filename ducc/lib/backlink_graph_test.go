@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBacklinkGraph(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_backlink_graph")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	backlinks := map[string][]string{
+		"abcd": {"sha256:image1", "sha256:image2"},
+		"ab12": {"sha256:image2"},
+		"cdef": {},
+	}
+	for digest, origins := range backlinks {
+		metadata := filepath.Join(root, subDirInsideRepo, digest[0:2], digest, ".metadata")
+		os.MkdirAll(metadata, 0755)
+		content, _ := json.Marshal(Backlink{Origin: origins})
+		if err = writeMetadataFile(filepath.Join(metadata, "origin.json"), content, 0644); err != nil {
+			t.Fatalf("Error in writing the backlink: %s", err)
+		}
+	}
+	// a layer without backlink
+	os.MkdirAll(filepath.Join(root, subDirInsideRepo, "ef", "ef01", "layerfs"), 0755)
+
+	graph, err := backlinkGraph(root, "test.cern.ch")
+	if err != nil {
+		t.Fatalf("Error in building the backlink graph: %s", err)
+	}
+	if graph.Repository != "test.cern.ch" || len(graph.Layers) != 4 {
+		t.Fatalf("Error in the backlink graph: %+v", graph)
+	}
+	for digest, origins := range graph.Layers {
+		onDisk, err := readBacklink(filepath.Join(root, subDirInsideRepo, digest[0:2], digest, ".metadata", "origin.json"))
+		if err != nil {
+			t.Fatalf("Error in reading the backlink of %s: %s", digest, err)
+		}
+		if !reflect.DeepEqual(origins, onDisk.Origin) {
+			t.Errorf("Error, the exported backlink of %s does not match the one on disk: %v %v", digest, origins, onDisk.Origin)
+		}
+	}
+
+	// the exported JSON is what the external tools read
+	exported, _ := json.Marshal(graph)
+	var parsed BacklinkGraph
+	if err = json.Unmarshal(exported, &parsed); err != nil || !reflect.DeepEqual(parsed, graph) {
+		t.Errorf("Error in the exported backlink graph: %s %v", exported, err)
+	}
+	if parsed.Layers["ef01"] == nil {
+		t.Errorf("Error, the layers without backlink must have an empty list of origins: %s", exported)
+	}
+}
+
+func TestImportLayerRemovalPlan(t *testing.T) {
+	digests, err := ImportLayerRemovalPlan("test.cern.ch", []byte(`{"repository": "test.cern.ch", "remove": ["sha256:abcd", "cdef", "abcd"]}`))
+	if err != nil {
+		t.Fatalf("Error in importing the removal plan: %s", err)
+	}
+	if !reflect.DeepEqual(digests, []string{"abcd", "cdef"}) {
+		t.Errorf("Error in the digests of the removal plan: %v", digests)
+	}
+	if _, err = ImportLayerRemovalPlan("test.cern.ch", []byte(`{"repository": "other.cern.ch", "remove": ["abcd"]}`)); err == nil {
+		t.Errorf("Error, removal plan for another repository accepted")
+	}
+	if _, err = ImportLayerRemovalPlan("test.cern.ch", []byte(`not json`)); err == nil {
+		t.Errorf("Error, invalid removal plan accepted")
+	}
+}
+
+func TestLayersInUse(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	repo := "test.cern.ch"
+	root := local.RepositoryRoot(repo)
+	writeOrigin := func(layer, origin string) {
+		dir := filepath.Join(root, ".layers", layer[0:2], layer, ".metadata")
+		os.MkdirAll(dir, 0755)
+		ioutil.WriteFile(filepath.Join(dir, "origin.json"), []byte(origin), 0644)
+	}
+	writeOrigin("aa1111", `{"origin":[]}`)
+	// an image was ingested after the plan was computed
+	writeOrigin("bb2222", `{"origin":["sha256:redis"]}`)
+	os.MkdirAll(filepath.Join(root, ".layers", "cc", "cc3333"), 0755)
+
+	inUse, err := LayersInUse(repo, []string{"aa1111", "bb2222", "cc3333", "dd4444"})
+	if err != nil {
+		t.Fatalf("Error in checking the layers in use: %s", err)
+	}
+	if !reflect.DeepEqual(inUse, []string{"bb2222"}) {
+		t.Errorf("Error in the layers in use: %v", inUse)
+	}
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the empty file that marks the root of a nested catalog, it is an artifact
+// of the repository and not part of the images
+const catalogMarker = ".cvmfscatalog"
+
+// if greater than zero, after the ingestion of a layer we create a nested
+// catalog in every directory whose subtree, not already covered by a deeper
+// nested catalog, has at least this many entries
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var CatalogEntriesThreshold = 0
+
+// compute where to place the nested catalogs so that no catalog holds more
+// than threshold entries (unless a single directory has more entries).
+// entriesPerDirectory maps each directory, relative to the root of the layer,
+// to the number of entries directly inside it.
+// The directories are visited from the deepest, a directory that reaches the
+// threshold gets its own catalog, otherwise its entries are accounted to the
+// parent. The root of the layer is never returned, it has already a catalog.
+func CatalogSplitPoints(entriesPerDirectory map[string]int, threshold int) []string {
+	if threshold <= 0 {
+		return nil
+	}
+	remaining := make(map[string]int)
+	for dir, n := range entriesPerDirectory {
+		remaining[dir] += n
+		// make sure all the ancestors are visited
+		for d := dir; d != "." && d != "/"; d = filepath.Dir(d) {
+			if _, ok := remaining[filepath.Dir(d)]; !ok {
+				remaining[filepath.Dir(d)] = 0
+			}
+		}
+	}
+	dirs := make([]string, 0, len(remaining))
+	for dir := range remaining {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		di, dj := strings.Count(dirs[i], "/"), strings.Count(dirs[j], "/")
+		if di != dj {
+			return di > dj
+		}
+		return dirs[i] < dirs[j]
+	})
+
+	var splits []string
+	for _, dir := range dirs {
+		if dir == "." || dir == "/" {
+			continue
+		}
+		if remaining[dir] >= threshold {
+			splits = append(splits, dir)
+			continue
+		}
+		remaining[filepath.Dir(dir)] += remaining[dir]
+	}
+	sort.Strings(splits)
+	return splits
+}
+
+// create, in a single transaction, the nested catalogs in all the dirs,
+// relative to the root of the repository
+func CreateCatalogsIntoDirs(CVMFSRepo string, dirs []string) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "create nested catalogs", "repo": CVMFSRepo, "catalogs": len(dirs)})
+	}
+	err := currentPublisher().Transaction(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Error in opening the transaction")
+		return err
+	}
+	err = createCatalogFiles(repositoryRoot(CVMFSRepo), dirs)
+	if err != nil {
+		llog(LogE(err)).Error("Error in creating the catalog files, aborting the transaction")
+		currentPublisher().Abort(CVMFSRepo)
+		return err
+	}
+	err = currentPublisher().Publish(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Error in publishing the nested catalogs")
+		currentPublisher().Abort(CVMFSRepo)
+		return err
+	}
+	llog(Log()).Info("Created nested catalogs")
+	return nil
+}
+
+func createCatalogFiles(root string, dirs []string) error {
+	for _, dir := range dirs {
+		catalogPath := filepath.Join(root, dir, catalogMarker)
+		if _, err := os.Lstat(catalogPath); err == nil {
+			continue
+		}
+		err := ioutil.WriteFile(catalogPath, []byte{}, filePermision)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCatalogSplitPoints(t *testing.T) {
+	var headers []*tar.Header
+	addFiles := func(dir string, n int) {
+		headers = append(headers, &tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755})
+		for i := 0; i < n; i++ {
+			headers = append(headers, &tar.Header{Name: fmt.Sprintf("%s/f%d", dir, i), Typeflag: tar.TypeReg, Mode: 0644})
+		}
+	}
+	addFiles("usr", 1)
+	addFiles("usr/lib", 5)
+	addFiles("usr/lib/python", 120)
+	addFiles("usr/share", 30)
+	addFiles("usr/share/doc", 40)
+	addFiles("usr/share/man", 50)
+	addFiles("etc", 10)
+
+	stats, err := ValidateLayerTar(buildTestTar(t, headers...), Limits{})
+	if err != nil {
+		t.Fatalf("Error in scanning the layer: %s", err)
+	}
+	splits := CatalogSplitPoints(stats.EntriesPerDirectory, 100)
+	// python alone is over the threshold, share collects doc and man
+	expected := []string{"usr/lib/python", "usr/share"}
+	if !reflect.DeepEqual(splits, expected) {
+		t.Errorf("Error in the catalog split points, expected %v got %v", expected, splits)
+	}
+	if CatalogSplitPoints(stats.EntriesPerDirectory, 0) != nil {
+		t.Errorf("Error, nested catalogs with a disabled threshold")
+	}
+
+	root, err := ioutil.TempDir("", "catalogs")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+	for _, dir := range expected {
+		os.MkdirAll(filepath.Join(root, dir), 0755)
+	}
+	if err = createCatalogFiles(root, splits); err != nil {
+		t.Fatalf("Error in creating the catalogs: %s", err)
+	}
+	for _, dir := range expected {
+		if _, err = os.Stat(filepath.Join(root, dir, ".cvmfscatalog")); err != nil {
+			t.Errorf("Error, missing catalog in %s", dir)
+		}
+	}
+}
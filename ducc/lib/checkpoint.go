@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Checkpoint records, in a state file, the images of a batch already
+// converted, so that an interrupted batch can be resumed without converting
+// them again. The file holds a line for each image, with the batch and the
+// name of the image, separated by a space.
+// The batch identifies the content of the batch, ex: the digest of the recipe,
+// so that a state file left by a different batch, or by the same recipe
+// since modified, does not skip any image.
+type Checkpoint struct {
+	path  string
+	batch string
+
+	mutex sync.Mutex
+	done  map[string]bool
+}
+
+// open the checkpoint at path, loading the images already recorded for the
+// batch, if the file does not exist the checkpoint starts empty
+func OpenCheckpoint(path, batch string) (*Checkpoint, error) {
+	if batch == "" || strings.ContainsAny(batch, " \n") {
+		return nil, fmt.Errorf("Invalid batch for the checkpoint: %q", batch)
+	}
+	c := &Checkpoint{path: path, batch: batch, done: make(map[string]bool)}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ignored := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if image := strings.TrimPrefix(line, batch+" "); image != line {
+			c.done[image] = true
+		} else {
+			ignored++
+		}
+	}
+	if ignored > 0 {
+		Log().WithFields(log.Fields{"file": path, "batch": batch, "ignored": ignored}).Warning(
+			"Ignoring the images recorded in the checkpoint by a different batch")
+	}
+	return c, scanner.Err()
+}
+
+// a nil checkpoint has nothing recorded
+func (c *Checkpoint) Done(image string) bool {
+	if c == nil {
+		return false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.done[image]
+}
+
+// record the image as converted, the record is on disk when it returns
+func (c *Checkpoint) MarkDone(image string) error {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.done[image] {
+		return nil
+	}
+	file, err := os.OpenFile(c.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = fmt.Fprintln(file, c.batch, image); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	c.done[image] = true
+	return nil
+}
+
+// remove the state file, once the whole batch is converted
+func (c *Checkpoint) Remove() error {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.done = make(map[string]bool)
+	err := os.Remove(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ConvertWishes converts all the wishes with convert, skipping the ones
+// already recorded in the checkpoint, and records the ones converted
+// successfully. Each wish is attempted up to attempts times, waiting
+// retryDelay between the attempts. A nil checkpoint disables the resume.
+// It returns the number of wishes that failed.
+func ConvertWishes(wishes <-chan WishFriendly, checkpoint *Checkpoint, attempts int, retryDelay time.Duration, convert func(WishFriendly) error) (failed int) {
+	for wish := range wishes {
+		fields := log.Fields{"input image": wish.InputName, "repository": wish.CvmfsRepo}
+		if checkpoint.Done(wish.InputName) {
+			Log().WithFields(fields).Info("Image already converted in a previous run of the batch, skipping")
+			continue
+		}
+		var err error
+		for attempt := 1; ; attempt++ {
+			err = convert(wish)
+			if err == nil || attempt >= attempts {
+				break
+			}
+			LogE(err).WithFields(fields).WithFields(log.Fields{"attempt": attempt}).Warning("Error in converting the image, retrying")
+			retrySleep(retryDelay)
+		}
+		if err != nil {
+			LogE(err).WithFields(fields).Error("Error in converting the image, going on")
+			failed++
+			continue
+		}
+		if err = checkpoint.MarkDone(wish.InputName); err != nil {
+			LogE(err).WithFields(fields).Warning("Error in recording the image in the checkpoint")
+		}
+	}
+	return failed
+}
@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testWishes(names ...string) <-chan WishFriendly {
+	wishes := make(chan WishFriendly, len(names))
+	for _, name := range names {
+		wishes <- WishFriendly{InputName: name, CvmfsRepo: "test.cern.ch"}
+	}
+	close(wishes)
+	return wishes
+}
+
+func TestConvertWishesResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_checkpoint")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	state := filepath.Join(dir, "state")
+
+	// the first run is interrupted after the first image
+	checkpoint, err := OpenCheckpoint(state, "sha256:recipe")
+	if err != nil {
+		t.Fatalf("Error in opening the checkpoint: %s", err)
+	}
+	var converted []string
+	failed := ConvertWishes(testWishes("first", "second", "third"), checkpoint, 1, 0, func(wish WishFriendly) error {
+		if wish.InputName != "first" {
+			return fmt.Errorf("interrupted")
+		}
+		converted = append(converted, wish.InputName)
+		return nil
+	})
+	if failed != 2 || !reflect.DeepEqual(converted, []string{"first"}) {
+		t.Fatalf("Error in the interrupted batch: %d failed, converted %v", failed, converted)
+	}
+
+	// the second run, from a new process, resumes the batch
+	checkpoint, err = OpenCheckpoint(state, "sha256:recipe")
+	if err != nil {
+		t.Fatalf("Error in opening the checkpoint again: %s", err)
+	}
+	converted = nil
+	failed = ConvertWishes(testWishes("first", "second", "third"), checkpoint, 1, 0, func(wish WishFriendly) error {
+		converted = append(converted, wish.InputName)
+		return nil
+	})
+	if failed != 0 || !reflect.DeepEqual(converted, []string{"second", "third"}) {
+		t.Errorf("Error, resume did not skip the image already converted: %d failed, converted %v", failed, converted)
+	}
+
+	// a different recipe does not use the records of the first one
+	other, err := OpenCheckpoint(state, "sha256:modified")
+	if err != nil {
+		t.Fatalf("Error in opening the checkpoint of another batch: %s", err)
+	}
+	if other.Done("first") {
+		t.Errorf("Error, image skipped for a different batch")
+	}
+
+	if err = checkpoint.Remove(); err != nil {
+		t.Errorf("Error in removing the checkpoint: %s", err)
+	}
+	if _, err = os.Stat(state); !os.IsNotExist(err) {
+		t.Errorf("Error, state file not removed: %v", err)
+	}
+}
+
+func TestConvertWishesRetry(t *testing.T) {
+	defer func() { retrySleep = time.Sleep }()
+	var slept []time.Duration
+	retrySleep = func(d time.Duration) { slept = append(slept, d) }
+
+	calls := 0
+	failed := ConvertWishes(testWishes("flaky"), nil, 3, time.Second, func(wish WishFriendly) error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("transient")
+		}
+		return nil
+	})
+	if failed != 0 || calls != 3 || len(slept) != 2 {
+		t.Errorf("Error in retrying the conversion: %d failed, %d calls, slept %v", failed, calls, slept)
+	}
+}
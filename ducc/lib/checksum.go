@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TreeChecksum computes a fingerprint of a subpath of the repository, stable as
+// long as the names, sizes, modes, symlink targets and content of the files
+// inside do not change, the nested catalogs do not change it
+// CVMFSRepo: just the name of the repository (ex: unpacked.cern.ch)
+// subpath: the path inside the repository, without the prefix (ex: .layers/ab/abcd/layerfs)
+func TreeChecksum(CVMFSRepo, subpath string) (string, error) {
+	return treeChecksum(filepath.Join(repositoryRoot(CVMFSRepo), subpath))
+}
+
+func treeChecksum(root string) (string, error) {
+	return hashTree(root, true)
+}
+
+// checksum of the names, types, sizes of the regular files, symlink targets
+// and content of the files inside root, it does not depend on the permissions
+// nor on the filesystem where the tree lives
+func contentChecksum(root string) (string, error) {
+	return hashTree(root, false)
+}
+
+func hashTree(root string, withModes bool) (string, error) {
+	hash := sha256.New()
+	// filepath.Walk visits the files in lexical order, so the checksum is stable
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// the catalog markers depend on where the repository is nested, not
+		// on the content
+		if isCatalogMarker(info) {
+			return nil
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		// the size of a directory depends on the filesystem
+		if withModes && info.IsDir() {
+			fmt.Fprintf(hash, "%s\x00%o\x00", name, info.Mode())
+		} else if withModes {
+			fmt.Fprintf(hash, "%s\x00%o\x00%d\x00", name, info.Mode(), info.Size())
+		} else if info.Mode().IsRegular() {
+			fmt.Fprintf(hash, "%s\x00%d\x00", name, info.Size())
+		} else {
+			fmt.Fprintf(hash, "%s\x00%o\x00", name, info.Mode()&os.ModeType)
+		}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%s\x00", link)
+		case info.Mode().IsRegular():
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			content := sha256.New()
+			if _, err = io.Copy(content, file); err != nil {
+				return err
+			}
+			fmt.Fprintf(hash, "%x\x00", content.Sum(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func treeChecksumLocation(subpath string) string {
+	return filepath.Join(".metadata", "tree-checksums", strings.Trim(subpath, "/")+".sha256")
+}
+
+// the checksum of the subpath saved by StoreTreeChecksum, if any
+func CachedTreeChecksum(CVMFSRepo, subpath string) (string, error) {
+	content, err := readMetadataFile(filepath.Join(repositoryRoot(CVMFSRepo), treeChecksumLocation(subpath)))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// compute the checksum of the subpath and save it into the .metadata directory
+// of the repository, so that later it can be read with CachedTreeChecksum
+func StoreTreeChecksum(CVMFSRepo, subpath string) (string, error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "store tree checksum", "repo": CVMFSRepo, "subpath": subpath})
+	}
+	checksum, err := TreeChecksum(CVMFSRepo, subpath)
+	if err != nil {
+		llog(LogE(err)).Error("Impossible to compute the checksum")
+		return "", err
+	}
+	tmpFile, err := UserDefinedTempFile("", "checksum")
+	if err != nil {
+		llog(LogE(err)).Error("Impossible to create the temporary file")
+		return "", err
+	}
+	_, err = tmpFile.WriteString(checksum + "\n")
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		llog(LogE(err)).Error("Impossible to write the temporary file")
+		return "", err
+	}
+	err = IngestIntoCVMFS(CVMFSRepo, treeChecksumLocation(subpath), tmpFile.Name())
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		llog(LogE(err)).Error("Impossible to ingest the checksum")
+		return "", err
+	}
+	return checksum, nil
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTreeChecksum(t *testing.T) {
+	root, err := ioutil.TempDir("", "tree_checksum")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "bin", "tool"), []byte("tool"), 0755)
+	os.Symlink("bin/tool", filepath.Join(root, "tool"))
+
+	first, err := treeChecksum(root)
+	if err != nil {
+		t.Fatalf("Error in computing the checksum: %s", err)
+	}
+	second, _ := treeChecksum(root)
+	if first != second {
+		t.Errorf("Error, checksum not stable: %s != %s", first, second)
+	}
+
+	// same size, different content
+	ioutil.WriteFile(filepath.Join(root, "bin", "tool"), []byte("TOOL"), 0755)
+	changed, _ := treeChecksum(root)
+	if changed == first {
+		t.Errorf("Error, checksum did not change with the content of a file")
+	}
+
+	ioutil.WriteFile(filepath.Join(root, "bin", "tool"), []byte("tool"), 0755)
+	restored, _ := treeChecksum(root)
+	if restored != first {
+		t.Errorf("Error, checksum differs after restoring the content")
+	}
+
+	os.Chmod(filepath.Join(root, "bin", "tool"), 0700)
+	if chmoded, _ := treeChecksum(root); chmoded == first {
+		t.Errorf("Error, checksum did not change with the mode of a file")
+	}
+}
+
+func TestTreeChecksumIgnoresRepositoryLayout(t *testing.T) {
+	root, err := ioutil.TempDir("", "tree_checksum")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "lib"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "lib", "libc.so"), []byte("libc"), 0644)
+	first, err := treeChecksum(root)
+	if err != nil {
+		t.Fatalf("Error in computing the checksum: %s", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(root, ".cvmfscatalog"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(root, "lib", ".cvmfscatalog"), []byte{}, 0644)
+	if nested, _ := treeChecksum(root); nested != first {
+		t.Errorf("Error, checksum changed with the nested catalogs")
+	}
+
+	// the directory grows with the entries and may not shrink once they are
+	// removed
+	for i := 0; i < 500; i++ {
+		ioutil.WriteFile(filepath.Join(root, "lib", fmt.Sprintf("tmp-file-with-a-long-name-%d", i)), []byte{}, 0644)
+	}
+	for i := 0; i < 500; i++ {
+		os.Remove(filepath.Join(root, "lib", fmt.Sprintf("tmp-file-with-a-long-name-%d", i)))
+	}
+	if grown, _ := treeChecksum(root); grown != first {
+		t.Errorf("Error, checksum depends on the size of the directories")
+	}
+}
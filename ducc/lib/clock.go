@@ -0,0 +1,16 @@
+package lib
+
+import "time"
+
+// Clock abstracts the current time, so that the behaviours that depend on
+// time (grace periods, age of files) can be tested without sleeping
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// the clock used by DUCC, tests can replace it
+var DefaultClock Clock = realClock{}
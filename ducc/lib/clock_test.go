@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// a clock that moves only when asked
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestPathInGracePeriodWithFakeClock(t *testing.T) {
+	file, err := ioutil.TempFile("", "grace_period")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary file: %s", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	os.Chtimes(file.Name(), modified, modified)
+
+	clock := &fakeClock{now: modified.Add(time.Hour)}
+	inGracePeriod, _, err := PathInGracePeriod(file.Name(), 24*time.Hour, clock)
+	if err != nil || !inGracePeriod {
+		t.Errorf("Error, fresh path not in the grace period: %v", err)
+	}
+	clock.Advance(24 * time.Hour)
+	inGracePeriod, _, err = PathInGracePeriod(file.Name(), 24*time.Hour, clock)
+	if err != nil || inGracePeriod {
+		t.Errorf("Error, path still in the grace period after it expired: %v", err)
+	}
+}
+
+func TestCleanStaleTempFilesUsesDefaultClock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clean_temp_clock")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/"+tempPrefix+"fresh", []byte("data"), 0644)
+
+	defer func(base string, clock Clock) {
+		TemporaryBaseDir = base
+		DefaultClock = clock
+	}(TemporaryBaseDir, DefaultClock)
+	TemporaryBaseDir = dir
+	DefaultClock = &fakeClock{now: time.Now().Add(48 * time.Hour)}
+
+	removed, err := CleanStaleTempFiles(24 * time.Hour)
+	if err != nil || removed != 1 {
+		t.Errorf("Error, file not expired with the fake clock: %d %v", removed, err)
+	}
+}
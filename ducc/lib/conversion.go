@@ -91,7 +91,7 @@ func ConvertWishSingularity(wish WishFriendly) (err error) {
 		// Image ingested and up to date, pubSymPath and privatePath point to the same thing
 		// Image update but stale (old), pubSymPath and privatePath point to different things
 		publicSymlinkPath := inputImage.GetPublicSymlinkPath()
-		completePubSymPath := filepath.Join("/", "cvmfs", wish.CvmfsRepo, publicSymlinkPath)
+		completePubSymPath := filepath.Join(repositoryRoot(wish.CvmfsRepo), publicSymlinkPath)
 		pubDirInfo, errPub := os.Stat(completePubSymPath)
 
 		singularityPrivatePath, err := inputImage.GetSingularityPath()
@@ -101,7 +101,7 @@ func ConvertWishSingularity(wish WishFriendly) (err error) {
 			firstError = errF
 			continue
 		}
-		completeSingularityPriPath := filepath.Join("/", "cvmfs", wish.CvmfsRepo, singularityPrivatePath)
+		completeSingularityPriPath := filepath.Join(repositoryRoot(wish.CvmfsRepo), singularityPrivatePath)
 		priDirInfo, errPri := os.Stat(completeSingularityPriPath)
 
 		Log().WithFields(log.Fields{
@@ -153,6 +153,13 @@ func ConvertWishSingularity(wish WishFriendly) (err error) {
 			continue
 		}
 
+		if manifest, err := inputImage.GetManifest(); err == nil {
+			if _, err = checkLayerCount(manifest, MaxLayers, MaxLayersPolicy); err != nil {
+				firstError = err
+				continue
+			}
+		}
+
 		singularity, err := inputImage.DownloadSingularityDirectory(tmpDir)
 		if err != nil {
 			LogE(err).Error("Error in dowloading the singularity image")
@@ -213,7 +220,11 @@ func ConvertWishDocker(wish WishFriendly, convertAgain, forceDownload, createThi
 		} else {
 			outputWithTag.Tag = outputImage.Tag
 		}
-		err = convertInputOutput(expandedImgTag, outputWithTag, wish.CvmfsRepo, convertAgain, forceDownload, createThinImage)
+		result := IngestResult{Image: expandedImgTag.WholeName(), Repository: wish.CvmfsRepo}
+		start := DefaultClock.Now()
+		err = convertInputOutput(expandedImgTag, outputWithTag, wish.CvmfsRepo, convertAgain, forceDownload, createThinImage, &result)
+		result.finish(err, DefaultClock.Now().Sub(start))
+		RecordIngestResult(result)
 		if err != nil && firstError == nil {
 			firstError = err
 		}
@@ -221,28 +232,61 @@ func ConvertWishDocker(wish WishFriendly, convertAgain, forceDownload, createThi
 	return firstError
 }
 
-func convertInputOutput(inputImage *Image, outputImage Image, repo string, convertAgain, forceDownload, createThinImage bool) (err error) {
+func convertInputOutput(inputImage *Image, outputImage Image, repo string, convertAgain, forceDownload, createThinImage bool, result *IngestResult) (err error) {
+	ctx, cancel := PullContext(PullTimeout)
+	defer cancel()
+	defer func() {
+		err = pullError(ctx, inputImage.GetSimpleName(), PullTimeout, err)
+	}()
 
-	manifest, err := inputImage.GetManifest()
+	manifest, err := inputImage.GetManifestWithContext(ctx)
+	if err != nil {
+		return
+	}
+	skipLayers, err := checkLayerCount(manifest, MaxLayers, MaxLayersPolicy)
 	if err != nil {
 		return
 	}
+	if skipLayers {
+		result.Status = IngestStatusFlattened
+		return nil
+	}
 
-	manifestPath := filepath.Join("/", "cvmfs", repo, ".metadata", inputImage.GetSimpleName(), "manifest.json")
+	manifestPath := filepath.Join(repositoryRoot(repo), ".metadata", inputImage.GetSimpleName(), "manifest.json")
 	alreadyConverted := AlreadyConverted(manifestPath, manifest.Config.Digest)
 	Log().WithFields(log.Fields{"alreadyConverted": alreadyConverted}).Info(
 		"Already converted the image, skipping.")
 
 	if alreadyConverted == ConversionMatch {
 		if convertAgain == false {
+			result.Status = IngestStatusUpToDate
 			return nil
 		}
 	}
+	if alreadyConverted == ConversionNotMatch {
+		logManifestReuse(manifestPath, manifest)
+	}
+
+	// before to download anything, we check that the manifest is sound
+	config, err := inputImage.GetImageConfig(ctx)
+	if err != nil {
+		LogE(err).WithFields(log.Fields{"image": inputImage.GetSimpleName()}).Error("Impossible to retrieve the configuration of the image")
+		return
+	}
+	err = ValidateManifestAgainstConfig(manifest, config)
+	if err != nil {
+		LogE(err).WithFields(log.Fields{"image": inputImage.GetSimpleName()}).Error("Malformed manifest, not converting the image")
+		return
+	}
 
 	layersChanell := make(chan downloadedLayer, 3)
 	manifestChanell := make(chan string, 1)
 	stopGettingLayers := make(chan bool, 1)
 	noErrorInConversion := make(chan bool, 1)
+	// written only by the goroutine ingesting the layers, it can be read
+	// after noErrorInConversion
+	layersIngested := 0
+	var layersMetrics []LayerMetrics
 
 	type LayerRepoLocation struct {
 		Digest   string
@@ -262,16 +306,20 @@ func convertInputOutput(inputImage *Image, outputImage Image, repo string, conve
 			noErrorInConversion <- noErrors
 			stopGettingLayers <- true
 			close(stopGettingLayers)
+			// layers not ingested, because of an error, still hold their download
+			for layer := range layersChanell {
+				layer.Path.Close()
+			}
 		}()
 		cleanup := func(location string) {
 			Log().Info("Running clean up function deleting the last layer.")
 
-			err := ExecCommand("cvmfs_server", "abort", "-f", repo).Start()
+			err := currentPublisher().Abort(repo)
 			if err != nil {
 				LogE(err).Warning("Error in the abort command inside the cleanup function, this warning is usually normal")
 			}
 
-			err = ExecCommand("cvmfs_server", "ingest", "--delete", location, repo).Start()
+			err = currentPublisher().IngestDelete(repo, location)
 			if err != nil {
 				LogE(err).Error("Error in the cleanup command")
 			}
@@ -281,6 +329,13 @@ func convertInputOutput(inputImage *Image, outputImage Image, repo string, conve
 			Log().WithFields(log.Fields{"layer": layer.Name}).Info("Start Ingesting the file into CVMFS")
 			layerDigest := strings.Split(layer.Name, ":")[1]
 			layerPath := LayerRootfsPath(repo, layerDigest)
+			layerSubpath, err := TrimRepositoryRoot(repo, layerPath)
+			if err != nil {
+				LogE(err).WithFields(log.Fields{"layer": layer.Name}).Error("Impossible to find where to ingest the layer")
+				layer.Path.Close()
+				noErrors = false
+				return
+			}
 
 			var pathExists bool
 			if _, err := os.Stat(layerPath); os.IsNotExist(err) {
@@ -310,7 +365,7 @@ func convertInputOutput(inputImage *Image, outputImage Image, repo string, conve
 				// whole layer
 
 				for _, dir := range []string{
-					filepath.Dir(filepath.Dir(TrimCVMFSRepoPrefix(layerPath))),
+					filepath.Dir(filepath.Dir(layerSubpath)),
 					//TrimCVMFSRepoPrefix(layerPath)} {
 				} {
 
@@ -326,17 +381,45 @@ func convertInputOutput(inputImage *Image, outputImage Image, repo string, conve
 							"Created subcatalog in directory")
 					}
 				}
-				err = ExecCommand("cvmfs_server", "ingest", "--catalog", "-t", "-", "-b", TrimCVMFSRepoPrefix(layerPath), repo).StdIn(layer.Path).Start()
-
+				metrics, stats, err := ingestLayer(repo, layerSubpath, layer)
+				if stats.Skipped > 0 || stats.Sockets > 0 {
+					Log().WithFields(log.Fields{"layer": layer.Name, "skipped": stats.Skipped, "sockets": stats.Sockets}).Warning("Some entries of the layer were not ingested")
+				}
+				if _, rejected := err.(*LayerValidationError); rejected {
+					LogE(err).WithFields(log.Fields{"layer": layer.Name}).Error("Layer rejected")
+					noErrors = false
+					// a streamed layer is rejected only during the ingestion
+					if !SpoolLayers {
+						cleanup(layerSubpath)
+					}
+					return
+				}
 				if err != nil {
 					LogE(err).WithFields(log.Fields{"layer": layer.Name}).Error("Some error in ingest the layer")
 					noErrors = false
-					cleanup(TrimCVMFSRepoPrefix(layerPath))
+					cleanup(layerSubpath)
 					return
 				}
-				Log().WithFields(log.Fields{"layer": layer.Name}).Info("Finish Ingesting the file")
+				Log().WithFields(log.Fields{"layer": layer.Name,
+					"entries":            metrics.Entries,
+					"size":               metrics.Size,
+					"download seconds":   metrics.DownloadSeconds,
+					"extraction seconds": metrics.ExtractionSeconds}).Info("Finish Ingesting the file")
+				layersIngested++
+				layersMetrics = append(layersMetrics, metrics)
+				recordLayerMetrics(inputImage.GetSimpleName(), metrics)
+
+				splits := CatalogSplitPoints(stats.EntriesPerDirectory, CatalogEntriesThreshold)
+				for i, dir := range splits {
+					splits[i] = filepath.Join(layerSubpath, dir)
+				}
+				err = CreateCatalogsIntoDirs(repo, splits)
+				if err != nil {
+					LogE(err).WithFields(log.Fields{"layer": layer.Name}).Warning("Error in creating the nested catalogs of the layer")
+				}
 			} else {
 				Log().WithFields(log.Fields{"layer": layer.Name}).Info("Skipping ingestion of layer, already exists")
+				layer.Path.Close()
 			}
 			//os.Remove(layer.Path)
 		}
@@ -351,7 +434,7 @@ func convertInputOutput(inputImage *Image, outputImage Image, repo string, conve
 	defer os.RemoveAll(tmpDir)
 
 	// this wil start to feed the above goroutine by writing into layersChanell
-	err = inputImage.GetLayers(layersChanell, manifestChanell, stopGettingLayers, tmpDir)
+	err = inputImage.GetLayers(ctx, layersChanell, manifestChanell, stopGettingLayers, tmpDir)
 	if err != nil {
 		return err
 	}
@@ -387,6 +470,8 @@ func convertInputOutput(inputImage *Image, outputImage Image, repo string, conve
 	// we wait for the goroutines to finish
 	// and if there was no error we conclude everything writing the manifest into the repository
 	noErrorInConversionValue := <-noErrorInConversion
+	result.LayersIngested = layersIngested
+	result.Layers = layersMetrics
 
 	err = SaveLayersBacklink(repo, inputImage, layerDigests)
 	if err != nil {
@@ -458,6 +543,9 @@ func convertInputOutput(inputImage *Image, outputImage Image, repo string, conve
 		return
 	} else {
 		Log().Warn("Some error during the conversion, we are not storing it into the database")
+		if err == nil {
+			err = fmt.Errorf("Error in ingesting the layers of the image %s", inputImage.GetSimpleName())
+		}
 		return
 	}
 }
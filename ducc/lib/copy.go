@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// how the files are moved from the temporary directory into the repository
+type CopyMethod int
+
+const (
+	// try to reflink, fallback to a normal copy if the filesystem does not support it
+	CopyMethodAuto CopyMethod = iota
+	CopyMethodCopy
+	CopyMethodReflink
+	CopyMethodHardlink
+)
+
+// ioctl to clone (reflink) a file, from linux/fs.h
+const ficlone = 0x40049409
+
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var DefaultCopyMethod = CopyMethodAuto
+
+func (m CopyMethod) String() string {
+	switch m {
+	case CopyMethodAuto:
+		return "auto"
+	case CopyMethodCopy:
+		return "copy"
+	case CopyMethodReflink:
+		return "reflink"
+	case CopyMethodHardlink:
+		return "hardlink"
+	}
+	return fmt.Sprintf("unknown(%d)", int(m))
+}
+
+func ParseCopyMethod(method string) (CopyMethod, error) {
+	switch strings.ToLower(method) {
+	case "", "auto":
+		return CopyMethodAuto, nil
+	case "copy":
+		return CopyMethodCopy, nil
+	case "reflink":
+		return CopyMethodReflink, nil
+	case "hardlink":
+		return CopyMethodHardlink, nil
+	}
+	return CopyMethodAuto, fmt.Errorf("Unknown copy method: %s, expected one of auto, copy, reflink, hardlink", method)
+}
+
+// permissions forced on a copied tree, a zero value preserves the permissions
+// of the source
+type treeModes struct {
+	dir  os.FileMode
+	file os.FileMode
+}
+
+func (m treeModes) dirMode(src os.FileMode) os.FileMode {
+	if m.dir == 0 {
+		return src.Perm()
+	}
+	return m.dir.Perm()
+}
+
+// executable files stay executable for whoever can read them
+func (m treeModes) fileMode(src os.FileMode) os.FileMode {
+	if m.file == 0 {
+		return src.Perm()
+	}
+	mode := m.file.Perm()
+	if src&0111 != 0 {
+		mode |= (mode & 0444) >> 2
+	}
+	return mode
+}
+
+// copy the directory tree src into dest, preserving symlinks and, unless
+// overridden by modes, permissions, regular files are copied using method
+// every directory is created explicitly, so the empty ones, often used as
+// mount points by the images, are preserved as well
+func copyTree(src, dest string, method CopyMethod, modes treeModes) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case info.IsDir():
+			err = os.MkdirAll(target, modes.dirMode(info.Mode()))
+			if err != nil {
+				return err
+			}
+			return os.Chmod(target, modes.dirMode(info.Mode()))
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			os.Remove(target)
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, modes.fileMode(info.Mode()), method)
+		default:
+			// devices, fifos and sockets can not be created in the repository
+			Log().WithFields(log.Fields{"action": "copy tree", "src": src, "path": path, "mode": info.Mode()}).Warning(
+				"Skipping file that is neither a directory, a symlink or a regular file")
+			return nil
+		}
+	})
+}
+
+// copy the regular file src into dest, with the mode provided
+func copyFile(src, dest string, mode os.FileMode, method CopyMethod) error {
+	os.Remove(dest)
+	switch method {
+	case CopyMethodHardlink:
+		err := hardlinkFile(src, dest, mode)
+		if err == nil {
+			return nil
+		}
+		Log().WithFields(log.Fields{"src": src, "dest": dest, "error": err}).Debug(
+			"Impossible to hardlink the file, falling back to copy")
+		os.Remove(dest)
+	case CopyMethodReflink:
+		return reflinkFile(src, dest, mode)
+	case CopyMethodAuto:
+		err := reflinkFile(src, dest, mode)
+		if err == nil {
+			return nil
+		}
+		Log().WithFields(log.Fields{"src": src, "dest": dest, "error": err}).Debug(
+			"Impossible to reflink the file, falling back to copy")
+		os.Remove(dest)
+	}
+	return byteCopyFile(src, dest, mode)
+}
+
+// the link shares the inode, and so the mode, of src: if the mode is not
+// already the one requested we can not change it without changing src as well
+// the caller falls back to a copy, as it does when src and dest are on
+// different filesystems (EXDEV)
+func hardlinkFile(src, dest string, mode os.FileMode) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm() != mode.Perm() {
+		return fmt.Errorf("The mode of the source file is %v instead of %v", info.Mode().Perm(), mode.Perm())
+	}
+	return os.Link(src, dest)
+}
+
+func reflinkFile(src, dest string, mode os.FileMode) error {
+	from, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	err = unix.IoctlSetInt(int(to.Fd()), ficlone, int(from.Fd()))
+	if err != nil {
+		to.Close()
+		os.Remove(dest)
+		return err
+	}
+	return to.Close()
+}
+
+func byteCopyFile(src, dest string, mode os.FileMode) error {
+	from, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(to, from)
+	if err != nil {
+		to.Close()
+		return err
+	}
+	return to.Close()
+}
+
+// returns true if the filesystem of dir supports reflinks
+func supportsReflink(dir string) bool {
+	src, err := ioutil.TempFile(dir, "reflink_probe")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(src.Name())
+	src.Close()
+	dest := src.Name() + "_clone"
+	defer os.Remove(dest)
+	return reflinkFile(src.Name(), dest, 0600) == nil
+}
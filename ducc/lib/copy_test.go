@@ -0,0 +1,165 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func testCopyTree(t *testing.T, method CopyMethod) {
+	src, err := ioutil.TempDir("", "test_copy_src")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "test_copy_dest")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dest)
+
+	os.MkdirAll(filepath.Join(src, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "bin", "tool"), []byte("#!/bin/sh"), 0755)
+	os.Symlink("bin/tool", filepath.Join(src, "tool"))
+
+	err = copyTree(src, dest, method, treeModes{})
+	if err != nil {
+		t.Fatalf("Error in copying with method %s: %s", method, err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dest, "bin", "tool"))
+	if err != nil || string(content) != "#!/bin/sh" {
+		t.Errorf("Wrong content after copy with method %s: %s %v", method, content, err)
+	}
+	stat, err := os.Stat(filepath.Join(dest, "bin", "tool"))
+	if err != nil || stat.Mode().Perm() != 0755 {
+		t.Errorf("Mode not preserved with method %s: %v", method, stat.Mode())
+	}
+	link, err := os.Readlink(filepath.Join(dest, "tool"))
+	if err != nil || link != "bin/tool" {
+		t.Errorf("Symlink not preserved with method %s: %s %v", method, link, err)
+	}
+}
+
+func TestCopyTreeAutoFallback(t *testing.T) {
+	// works both where reflink is supported and where it falls back to copy
+	testCopyTree(t, CopyMethodAuto)
+	testCopyTree(t, CopyMethodCopy)
+}
+
+func TestCopyTreeReflink(t *testing.T) {
+	if !supportsReflink(os.TempDir()) {
+		t.Skip("The filesystem of the temporary directory does not support reflinks")
+	}
+	testCopyTree(t, CopyMethodReflink)
+}
+
+func TestParseCopyMethod(t *testing.T) {
+	for _, method := range []CopyMethod{CopyMethodAuto, CopyMethodCopy, CopyMethodReflink, CopyMethodHardlink} {
+		parsed, err := ParseCopyMethod(method.String())
+		if err != nil || parsed != method {
+			t.Errorf("Error in parsing the copy method %s: %v", method, err)
+		}
+	}
+	if _, err := ParseCopyMethod("move"); err == nil {
+		t.Errorf("Unknown copy method accepted")
+	}
+}
+
+func TestCopyTreeWithPermissions(t *testing.T) {
+	src, err := ioutil.TempDir("", "test_copy_src")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "test_copy_dest")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dest)
+
+	os.MkdirAll(filepath.Join(src, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "bin", "tool"), []byte("#!/bin/sh"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "README"), []byte("readme"), 0644)
+
+	err = copyTree(src, dest, CopyMethodCopy, treeModes{dir: 0750, file: 0640})
+	if err != nil {
+		t.Fatalf("Error in copying with custom permissions: %s", err)
+	}
+	for path, expected := range map[string]os.FileMode{
+		"bin":      0750,
+		"bin/tool": 0750,
+		"README":   0640,
+	} {
+		stat, err := os.Stat(filepath.Join(dest, path))
+		if err != nil {
+			t.Errorf("Error in stating %s: %s", path, err)
+			continue
+		}
+		if stat.Mode().Perm() != expected {
+			t.Errorf("Error in the permissions of %s, expected %v got %v", path, expected, stat.Mode().Perm())
+		}
+	}
+}
+
+func TestCopyTreeHardlink(t *testing.T) {
+	testCopyTree(t, CopyMethodHardlink)
+
+	src, err := ioutil.TempDir("", "test_copy_src")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "test_copy_dest")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dest)
+	ioutil.WriteFile(filepath.Join(src, "same"), []byte("same"), 0640)
+	ioutil.WriteFile(filepath.Join(src, "different"), []byte("different"), 0600)
+
+	err = copyTree(src, dest, CopyMethodHardlink, treeModes{file: 0640})
+	if err != nil {
+		t.Fatalf("Error in copying with hardlinks: %s", err)
+	}
+	srcStat, _ := os.Stat(filepath.Join(src, "same"))
+	destStat, _ := os.Stat(filepath.Join(dest, "same"))
+	if !os.SameFile(srcStat, destStat) {
+		t.Errorf("Error, file with the same mode not hardlinked")
+	}
+
+	// changing the mode of a link would change the source as well
+	srcStat, _ = os.Stat(filepath.Join(src, "different"))
+	destStat, _ = os.Stat(filepath.Join(dest, "different"))
+	if os.SameFile(srcStat, destStat) {
+		t.Errorf("Error, file with a different mode hardlinked")
+	}
+	if srcStat.Mode().Perm() != 0600 || destStat.Mode().Perm() != 0640 {
+		t.Errorf("Error in the modes, source %v destination %v", srcStat.Mode().Perm(), destStat.Mode().Perm())
+	}
+}
+
+func TestCopyTreeSkipsSpecialFiles(t *testing.T) {
+	src, err := ioutil.TempDir("", "test_copy_src")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(src)
+	dest, err := ioutil.TempDir("", "test_copy_dest")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dest)
+	if err = syscall.Mkfifo(filepath.Join(src, "fifo"), 0644); err != nil {
+		t.Skipf("Impossible to create the fifo: %s", err)
+	}
+
+	err = copyTree(src, dest, CopyMethodCopy, treeModes{})
+	if err != nil {
+		t.Fatalf("Error in copying a tree with a fifo: %s", err)
+	}
+	if _, err = os.Lstat(filepath.Join(dest, "fifo")); !os.IsNotExist(err) {
+		t.Errorf("Error, fifo copied: %v", err)
+	}
+}
@@ -3,13 +3,11 @@ package lib
 import (
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
-	copy "github.com/otiai10/copy"
 	log "github.com/sirupsen/logrus"
 
 	da "github.com/cvmfs/ducc/docker-api"
@@ -22,8 +20,83 @@ var filePermision = os.FileMode(0644)
 // CVMFSRepo: just the name of the repository (ex: unpacked.cern.ch)
 // path: the path inside the repository, without the prefix (ex: .foo/bar/baz), where to put the ingested target
 // target: the path of the target in the normal FS, the thing to ingest
+// directories are ingested whole, empty subdirectories included
+// a target that is a symlink is followed, see IngestOptions.TargetSymlink
 // if no error is returned, we remove the target from the FS
 func IngestIntoCVMFS(CVMFSRepo string, path string, target string) (err error) {
+	return IngestIntoCVMFSWithOptions(CVMFSRepo, path, target, DefaultIngestOptions())
+}
+
+// options that control how the target is ingested into the repository
+type IngestOptions struct {
+	// how to move the files from the target into the repository
+	CopyMethod CopyMethod
+	// permissions of the ingested directories and files, when zero the
+	// directories we create get dirPermision, a single ingested file gets
+	// filePermision and the content of an ingested directory keeps its
+	// own permissions
+	DirPermission  os.FileMode
+	FilePermission os.FileMode
+	// if true the content copied into the repository is checked against the
+	// target before to publish, on mismatch the transaction is aborted
+	VerifyChecksum bool
+	// what to do when the target itself is a symlink, by default
+	// (TargetSymlinkFollow) what the symlink points to is ingested
+	TargetSymlink TargetSymlinkPolicy
+}
+
+// how a target that is a symlink is ingested
+type TargetSymlinkPolicy int
+
+const (
+	// ingest the content the symlink points to, as if it was the target
+	TargetSymlinkFollow TargetSymlinkPolicy = iota
+	// ingest the symlink itself, with the same link, an existing symlink at
+	// the path is replaced atomically, anything else is not replaced
+	TargetSymlinkPreserve
+	// fail with ErrTargetIsSymlink
+	TargetSymlinkReject
+)
+
+// ErrTargetIsSymlink is returned when the target of the ingestion is a
+// symlink under the TargetSymlinkReject policy
+var ErrTargetIsSymlink = fmt.Errorf("The target to ingest is a symlink")
+
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var VerifyIngestChecksum = false
+
+// ErrChecksumMismatch is returned when the content copied into the repository
+// differs from the ingested target
+var ErrChecksumMismatch = fmt.Errorf("Content copied into the repository differs from the source")
+
+// called after the copy into the repository and before the verification,
+// only the tests replace it
+var afterIngestCopy = func(path string) {}
+
+func DefaultIngestOptions() IngestOptions {
+	return IngestOptions{CopyMethod: DefaultCopyMethod, VerifyChecksum: VerifyIngestChecksum}
+}
+
+func (o IngestOptions) dirPermission() os.FileMode {
+	if o.DirPermission == 0 {
+		return dirPermision
+	}
+	return o.DirPermission
+}
+
+func (o IngestOptions) filePermission() os.FileMode {
+	if o.FilePermission == 0 {
+		return filePermision
+	}
+	return o.FilePermission
+}
+
+// same as IngestIntoCVMFS, but the ingestion is controlled by the options
+func IngestIntoCVMFSWithOptions(CVMFSRepo string, path string, target string, options IngestOptions) (err error) {
+	return ingestIntoRepository(repositoryRoot(CVMFSRepo), CVMFSRepo, path, target, options)
+}
+
+func ingestIntoRepository(repoRoot, CVMFSRepo, path, target string, options IngestOptions) (err error) {
 	defer func() {
 		if err == nil {
 			Log().WithFields(log.Fields{"target": target, "action": "ingesting"}).Info("Deleting temporary directory")
@@ -32,17 +105,38 @@ func IngestIntoCVMFS(CVMFSRepo string, path string, target string) (err error) {
 	}()
 	Log().WithFields(log.Fields{"target": target, "action": "ingesting"}).Info("Start ingesting")
 
-	path = filepath.Join("/", "cvmfs", CVMFSRepo, path)
+	path = filepath.Join(repoRoot, path)
 
 	Log().WithFields(log.Fields{"target": target, "action": "ingesting"}).Info("Start transaction")
-	err = ExecCommand("cvmfs_server", "transaction", CVMFSRepo).Start()
+	err = currentPublisher().Transaction(CVMFSRepo)
 	if err != nil {
 		LogE(err).WithFields(log.Fields{"repo": CVMFSRepo}).Error("Error in opening the transaction")
-		ExecCommand("cvmfs_server", "abort", "-f", CVMFSRepo).Start()
+		currentPublisher().Abort(CVMFSRepo)
 		return err
 	}
+	// from now on any error aborts the transaction, so that nothing of a
+	// partial copy is ever published
+	defer func() {
+		if err != nil {
+			currentPublisher().Abort(CVMFSRepo)
+		}
+	}()
 
-	Log().WithFields(log.Fields{"target": target, "path": path, "action": "ingesting"}).Info("Copying target into path")
+	Log().WithFields(log.Fields{"target": target, "path": path, "action": "ingesting", "copy method": options.CopyMethod}).Info("Copying target into path")
+
+	targetLstat, err := os.Lstat(target)
+	if err != nil {
+		LogE(err).WithFields(log.Fields{"target": target}).Error("Impossible to obtain information about the target")
+		return err
+	}
+	if targetLstat.Mode()&os.ModeSymlink != 0 && options.TargetSymlink != TargetSymlinkFollow {
+		err = ingestSymlink(target, path, options)
+		if err != nil {
+			LogE(err).WithFields(log.Fields{"repo": CVMFSRepo, "target": target}).Error("Error in ingesting the target symlink")
+			return err
+		}
+		return publishIngestion(CVMFSRepo, target)
+	}
 
 	targetStat, err := os.Stat(target)
 	if err != nil {
@@ -50,53 +144,83 @@ func IngestIntoCVMFS(CVMFSRepo string, path string, target string) (err error) {
 		return err
 	}
 
+	var expectedChecksum string
+	if options.VerifyChecksum {
+		expectedChecksum, err = contentChecksum(target)
+		if err != nil {
+			LogE(err).WithFields(log.Fields{"target": target}).Error("Impossible to compute the checksum of the target")
+			return err
+		}
+	}
+
 	if targetStat.Mode().IsDir() {
 		os.RemoveAll(path)
-		err = os.MkdirAll(path, dirPermision)
+		err = os.MkdirAll(path, options.dirPermission())
 		if err != nil {
-			LogE(err).WithFields(log.Fields{"repo": CVMFSRepo}).Warning("Error in creating the directory where to copy the singularity")
+			LogE(err).WithFields(log.Fields{"repo": CVMFSRepo, "path": path}).Error("Error in creating the directory where to copy the target")
+			return err
 		}
-		err = copy.Copy(target, path)
+		err = copyTree(target, path, options.CopyMethod, treeModes{dir: options.DirPermission, file: options.FilePermission})
 
 	} else if targetStat.Mode().IsRegular() {
-		err = func() error {
-			os.MkdirAll(filepath.Dir(path), dirPermision)
-			os.Remove(path)
-
-			from, err := os.Open(target)
-			if err != nil {
-				return err
-			}
-			defer from.Close()
-
-			to, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, filePermision)
-			if err != nil {
-				return err
-			}
-			defer to.Close()
-
-			_, err = io.Copy(to, from)
+		err = os.MkdirAll(filepath.Dir(path), options.dirPermission())
+		if err != nil {
+			LogE(err).WithFields(log.Fields{"repo": CVMFSRepo, "path": path}).Error("Error in creating the directory where to copy the target")
 			return err
-		}()
+		}
+		err = copyFile(target, path, options.filePermission(), options.CopyMethod)
 	} else {
 		err = fmt.Errorf("Trying to ingest neither a file nor a directory")
 	}
 
 	if err != nil {
 		LogE(err).WithFields(log.Fields{"repo": CVMFSRepo, "target": target}).Error("Error in moving the target inside the CVMFS repo")
-		ExecCommand("cvmfs_server", "abort", "-f", CVMFSRepo).Start()
 		return err
 	}
 
+	if options.VerifyChecksum {
+		afterIngestCopy(path)
+		copiedChecksum, err := contentChecksum(path)
+		if err == nil && copiedChecksum != expectedChecksum {
+			err = ErrChecksumMismatch
+		}
+		if err != nil {
+			LogE(err).WithFields(log.Fields{"repo": CVMFSRepo, "target": target, "path": path}).Error("Error in verifying the copy inside the CVMFS repo, aborting")
+			return err
+		}
+	}
+
+	return publishIngestion(CVMFSRepo, target)
+}
+
+// the target is removed only after a successful publish
+func publishIngestion(CVMFSRepo, target string) error {
 	Log().WithFields(log.Fields{"target": target, "action": "ingesting"}).Info("Publishing")
-	err = ExecCommand("cvmfs_server", "publish", CVMFSRepo).Start()
+	err := publishWithRetry(CVMFSRepo)
 	if err != nil {
 		LogE(err).WithFields(log.Fields{"repo": CVMFSRepo}).Error("Error in publishing the repository")
-		ExecCommand("cvmfs_server", "abort", "-f", CVMFSRepo).Start()
 		return err
 	}
-	err = nil
-	return err
+	return nil
+}
+
+// ingest the symlink target at path according to the policy of the options,
+// the link is copied as it is, so the relative ones are now relative to path
+func ingestSymlink(target, path string, options IngestOptions) error {
+	if options.TargetSymlink == TargetSymlinkReject {
+		return ErrTargetIsSymlink
+	}
+	link, err := os.Readlink(target)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), options.dirPermission()); err != nil {
+		return err
+	}
+	if lstat, err := os.Lstat(path); err == nil && lstat.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("Error, trying to overwrite with a symlink something that is not a symlink: %s", path)
+	}
+	return swapSymlink(link, path)
 }
 
 // create a symbolic link inside the repository called `newLinkName`, the symlink will point to `toLinkPath`
@@ -104,8 +228,8 @@ func IngestIntoCVMFS(CVMFSRepo string, path string, target string) (err error) {
 // toLinkPath: comes without the /cvmfs/$REPO/ prefix
 func CreateSymlinkIntoCVMFS(CVMFSRepo, newLinkName, toLinkPath string) (err error) {
 	// add the necessary prefix
-	newLinkName = filepath.Join("/", "cvmfs", CVMFSRepo, newLinkName)
-	toLinkPath = filepath.Join("/", "cvmfs", CVMFSRepo, toLinkPath)
+	newLinkName = filepath.Join(repositoryRoot(CVMFSRepo), newLinkName)
+	toLinkPath = filepath.Join(repositoryRoot(CVMFSRepo), toLinkPath)
 
 	llog := func(l *log.Entry) *log.Entry {
 		return l.WithFields(log.Fields{"action": "save backlink",
@@ -129,10 +253,10 @@ func CreateSymlinkIntoCVMFS(CVMFSRepo, newLinkName, toLinkPath string) (err erro
 	linkChunks := strings.Split(relativePath, string(os.PathSeparator))
 	link := filepath.Join(linkChunks[1:]...)
 
-	err = ExecCommand("cvmfs_server", "transaction", CVMFSRepo).Start()
+	err = currentPublisher().Transaction(CVMFSRepo)
 	if err != nil {
 		llog(LogE(err)).Error("Error in opening the transaction")
-		ExecCommand("cvmfs_server", "abort", "-f", CVMFSRepo).Start()
+		currentPublisher().Abort(CVMFSRepo)
 		return err
 	}
 
@@ -144,38 +268,57 @@ func CreateSymlinkIntoCVMFS(CVMFSRepo, newLinkName, toLinkPath string) (err erro
 			"Error in creating the directory where to store the symlink")
 	}
 
-	// the symlink exists already, we delete it and replace it
+	// the symlink exists already, we replace it atomically
 	if lstat, err := os.Lstat(newLinkName); !os.IsNotExist(err) {
-		if lstat.Mode()&os.ModeSymlink != 0 {
-			// the file exists and it is a symlink, we overwrite it
-			err = os.Remove(newLinkName)
-			if err != nil {
-				err = fmt.Errorf("Error in removing existsing symlink: %s", err)
-				llog(LogE(err)).Error("Error in removing previous symlink")
-				return err
-			}
-		} else {
+		if lstat.Mode()&os.ModeSymlink == 0 {
 			// the file exists but is not a symlink
 			err = fmt.Errorf(
 				"Error, trying to overwrite with a symlink something that is not a symlink")
 			llog(LogE(err)).Error("Error in creating a symlink")
+			currentPublisher().Abort(CVMFSRepo)
 			return err
 		}
 	}
 
-	err = os.Symlink(link, newLinkName)
+	err = swapSymlink(link, newLinkName)
 	if err != nil {
 		llog(LogE(err)).Error(
 			"Error in creating the symlink")
-		ExecCommand("cvmfs_server", "abort", "-f", CVMFSRepo).Start()
+		currentPublisher().Abort(CVMFSRepo)
 		return err
 	}
 
-	err = ExecCommand("cvmfs_server", "publish", CVMFSRepo).Start()
+	err = currentPublisher().Publish(CVMFSRepo)
 	if err != nil {
 		llog(LogE(err)).WithFields(log.Fields{"repo": CVMFSRepo}).Error(
 			"Error in publishing the repository")
-		ExecCommand("cvmfs_server", "abort", "-f", CVMFSRepo).Start()
+		currentPublisher().Abort(CVMFSRepo)
+		return err
+	}
+	return nil
+}
+
+// create, or replace, the symlink `newLinkName` pointing to `link`
+// the symlink is first created with a temporary name in the same directory
+// and then renamed over `newLinkName`, since the rename is atomic readers
+// always find either the old or the new symlink, never a missing one
+// the temporary name has a `~`, that is not valid in the names of the images,
+// so it never collides with an actual path, and it is always the same, so a
+// stray temporary link, left by a run that died in the middle of the swap, is
+// removed by the next swap of the same symlink
+func swapSymlink(link, newLinkName string) error {
+	tmpLinkName := newLinkName + "~ducc-tmp"
+	if err := os.Remove(tmpLinkName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err := os.Symlink(link, tmpLinkName)
+	if err != nil {
+		os.Remove(tmpLinkName)
+		return err
+	}
+	err = os.Rename(tmpLinkName, newLinkName)
+	if err != nil {
+		os.Remove(tmpLinkName)
 		return err
 	}
 	return nil
@@ -190,39 +333,26 @@ func getBacklinkPath(CVMFSRepo, layerDigest string) string {
 }
 
 func getBacklinkFromLayer(CVMFSRepo, layerDigest string) (backlink Backlink, err error) {
-	backlinkPath := getBacklinkPath(CVMFSRepo, layerDigest)
+	return readBacklink(getBacklinkPath(CVMFSRepo, layerDigest))
+}
+
+func readBacklink(backlinkPath string) (backlink Backlink, err error) {
 	llog := func(l *log.Entry) *log.Entry {
 		return l.WithFields(log.Fields{"action": "get backlink from layer",
-			"repo":         CVMFSRepo,
-			"layer":        layerDigest,
 			"backlinkPath": backlinkPath})
 	}
 
-	if _, err := os.Stat(backlinkPath); os.IsNotExist(err) {
+	if !metadataFileExists(backlinkPath) {
 		return Backlink{Origin: []string{}}, nil
 	}
 
-	backlinkFile, err := os.Open(backlinkPath)
-	if err != nil {
-		llog(LogE(err)).Error(
-			"Error in opening the file for writing the backlinks, skipping...")
-		return
-	}
-
-	byteBackLink, err := ioutil.ReadAll(backlinkFile)
+	byteBackLink, err := readMetadataFile(backlinkPath)
 	if err != nil {
 		llog(LogE(err)).Error(
 			"Error in reading the bytes from the origin file, skipping...")
 		return
 	}
 
-	err = backlinkFile.Close()
-	if err != nil {
-		llog(LogE(err)).Error(
-			"Error in closing the file after reading, moving on...")
-		return
-	}
-
 	err = json.Unmarshal(byteBackLink, &backlink)
 	if err != nil {
 		llog(LogE(err)).Error(
@@ -233,52 +363,63 @@ func getBacklinkFromLayer(CVMFSRepo, layerDigest string) (backlink Backlink, err
 }
 
 func SaveLayersBacklink(CVMFSRepo string, img *Image, layerDigest []string) error {
+	imgManifest, err := img.GetManifest()
+	if err != nil {
+		LogE(err).WithFields(log.Fields{"action": "save backlink", "repo": CVMFSRepo, "image": img.GetSimpleName()}).Error(
+			"Error in getting the manifest from the image")
+		return err
+	}
+	return saveLayersBacklink(repositoryRoot(CVMFSRepo), CVMFSRepo, imgManifest.Config.Digest, layerDigest)
+}
+
+// the backlinks are read, updated and written back inside the transaction
+// while holding the lock of the repository, so that concurrent conversions
+// of images sharing a layer do not lose each other's update
+func saveLayersBacklink(repoRoot, CVMFSRepo, imgDigest string, layerDigest []string) error {
 	llog := func(l *log.Entry) *log.Entry {
 		return l.WithFields(log.Fields{"action": "save backlink",
 			"repo":  CVMFSRepo,
-			"image": img.GetSimpleName()})
+			"image": imgDigest})
 	}
 
 	llog(Log()).Info("Start saving backlinks")
 
-	backlinks := make(map[string][]byte)
+	unlock := lockRepository(CVMFSRepo)
+	defer unlock()
+
+	llog(Log()).Info("Start transaction")
+	err := currentPublisher().Transaction(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Error in opening the transaction")
+		return err
+	}
 
+	// the same layers are always written in the same order, whatever the
+	// order they were ingested
+	layerDigest = dedupStrings(layerDigest)
+	sort.Strings(layerDigest)
 	for _, layerDigest := range layerDigest {
-		imgManifest, err := img.GetManifest()
-		if err != nil {
-			llog(LogE(err)).Error(
-				"Error in getting the manifest from the image, skipping...")
-			continue
-		}
-		imgDigest := imgManifest.Config.Digest
+		path := filepath.Join(repoRoot, subDirInsideRepo, layerDigest[0:2], layerDigest, ".metadata", "origin.json")
 
-		backlink, err := getBacklinkFromLayer(CVMFSRepo, layerDigest)
+		backlink, err := readBacklink(path)
 		if err != nil {
 			llog(LogE(err)).WithFields(log.Fields{"layer": layerDigest}).Error(
 				"Error in obtaining the backlink from a layer digest, skipping...")
 			continue
 		}
-		backlink.Origin = append(backlink.Origin, imgDigest)
+		if stringInSlice(imgDigest, backlink.Origin) {
+			// already there, nothing to write
+			continue
+		}
+		backlink.Origin = dedupStrings(append(backlink.Origin, imgDigest))
 
-		backlinkBytesMarshal, err := json.Marshal(backlink)
+		fileContent, err := json.Marshal(backlink)
 		if err != nil {
 			llog(LogE(err)).WithFields(log.Fields{"layer": layerDigest}).Error(
 				"Error in Marshaling back the files, skipping...")
 			continue
 		}
 
-		backlinkPath := getBacklinkPath(CVMFSRepo, layerDigest)
-		backlinks[backlinkPath] = backlinkBytesMarshal
-	}
-
-	llog(Log()).Info("Start transaction")
-	err := ExecCommand("cvmfs_server", "transaction", CVMFSRepo).Start()
-	if err != nil {
-		llog(LogE(err)).Error("Error in opening the transaction")
-		return err
-	}
-
-	for path, fileContent := range backlinks {
 		// the path may not be there, check, and if it doesn't exists create it
 		dir := filepath.Dir(path)
 		if _, err := os.Stat(dir); os.IsNotExist(err) {
@@ -289,17 +430,17 @@ func SaveLayersBacklink(CVMFSRepo string, img *Image, layerDigest []string) erro
 				continue
 			}
 		}
-		err = ioutil.WriteFile(path, fileContent, filePermision)
+		err = writeMetadataFile(path, fileContent, filePermision)
 		if err != nil {
 			llog(LogE(err)).WithFields(log.Fields{"file": path}).Error(
 				"Error in writing the backlink file, skipping...")
 			continue
 		}
-		llog(LogE(err)).WithFields(log.Fields{"file": path}).Info(
+		llog(Log()).WithFields(log.Fields{"file": path}).Info(
 			"Wrote backlink")
 	}
 
-	err = ExecCommand("cvmfs_server", "publish", CVMFSRepo).Start()
+	err = currentPublisher().Publish(CVMFSRepo)
 	if err != nil {
 		llog(LogE(err)).Error("Error in publishing after adding the backlinks")
 		return err
@@ -308,8 +449,104 @@ func SaveLayersBacklink(CVMFSRepo string, img *Image, layerDigest []string) erro
 	return nil
 }
 
+// remove the duplicated origins from all the backlinks of the repository, as
+// left by older versions that appended the image again at every conversion,
+// it returns how many backlinks were rewritten
+func DeduplicateBacklinks(CVMFSRepo string) (int, error) {
+	return deduplicateBacklinks(repositoryRoot(CVMFSRepo), CVMFSRepo)
+}
+
+func deduplicateBacklinks(repoRoot, CVMFSRepo string) (int, error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "deduplicate backlinks", "repo": CVMFSRepo})
+	}
+	unlock := lockRepository(CVMFSRepo)
+	defer unlock()
+
+	backlinkPaths, err := filepath.Glob(filepath.Join(repoRoot, subDirInsideRepo, "*", "*", ".metadata", "origin.json*"))
+	if err != nil {
+		return 0, err
+	}
+	deduplicated := make(map[string][]byte)
+	for _, path := range backlinkPaths {
+		path = strings.TrimSuffix(path, compressedMetadataSuffix)
+		if _, done := deduplicated[path]; done {
+			continue
+		}
+		backlink, err := readBacklink(path)
+		if err != nil {
+			continue
+		}
+		origins := dedupStrings(backlink.Origin)
+		if len(origins) == len(backlink.Origin) {
+			continue
+		}
+		content, err := json.Marshal(Backlink{Origin: origins})
+		if err != nil {
+			return 0, err
+		}
+		deduplicated[path] = content
+	}
+	if len(deduplicated) == 0 {
+		return 0, nil
+	}
+
+	err = currentPublisher().Transaction(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Error in opening the transaction")
+		return 0, err
+	}
+	paths := make([]string, 0, len(deduplicated))
+	for path := range deduplicated {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		err = writeMetadataFile(path, deduplicated[path], filePermision)
+		if err != nil {
+			llog(LogE(err)).WithFields(log.Fields{"file": path}).Error("Error in writing the backlink, aborting")
+			currentPublisher().Abort(CVMFSRepo)
+			return 0, err
+		}
+	}
+	err = currentPublisher().Publish(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Error in publishing the deduplicated backlinks")
+		currentPublisher().Abort(CVMFSRepo)
+		return 0, err
+	}
+	llog(Log()).WithFields(log.Fields{"backlinks": len(deduplicated)}).Info("Deduplicated backlinks")
+	return len(deduplicated), nil
+}
+
+// keep the first occurrence of each string, preserving the order
+func dedupStrings(values []string) []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+func stringInSlice(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func RemoveScheduleLocation(CVMFSRepo string) string {
-	return filepath.Join("/", "cvmfs", CVMFSRepo, ".metadata", "remove-schedule.json")
+	return removeScheduleLocation(repositoryRoot(CVMFSRepo))
+}
+
+func removeScheduleLocation(repoRoot string) string {
+	return filepath.Join(repoRoot, ".metadata", "remove-schedule.json")
 }
 
 func AddManifestToRemoveScheduler(CVMFSRepo string, manifest da.Manifest) error {
@@ -322,26 +559,14 @@ func AddManifestToRemoveScheduler(CVMFSRepo string, manifest da.Manifest) error
 	var schedule []da.Manifest
 
 	// if the file exist, load from it
-	if _, err := os.Stat(schedulePath); !os.IsNotExist(err) {
+	if metadataFileExists(schedulePath) {
 
-		scheduleFileRO, err := os.OpenFile(schedulePath, os.O_RDONLY, filePermision)
-		if err != nil {
-			llog(LogE(err)).Error("Impossible to open the schedule file")
-			return err
-		}
-
-		scheduleBytes, err := ioutil.ReadAll(scheduleFileRO)
+		scheduleBytes, err := readMetadataFile(schedulePath)
 		if err != nil {
 			llog(LogE(err)).Error("Impossible to read the schedule file")
 			return err
 		}
 
-		err = scheduleFileRO.Close()
-		if err != nil {
-			llog(LogE(err)).Error("Impossible to close the schedule file")
-			return err
-		}
-
 		err = json.Unmarshal(scheduleBytes, &schedule)
 		if err != nil {
 			llog(LogE(err)).Error("Impossible to unmarshal the schedule file")
@@ -359,7 +584,7 @@ func AddManifestToRemoveScheduler(CVMFSRepo string, manifest da.Manifest) error
 		return schedule
 	}()
 
-	err := ExecCommand("cvmfs_server", "transaction", CVMFSRepo).Start()
+	err := currentPublisher().Transaction(CVMFSRepo)
 	if err != nil {
 		llog(LogE(err)).Error("Error in opening the transaction")
 		return err
@@ -377,15 +602,19 @@ func AddManifestToRemoveScheduler(CVMFSRepo string, manifest da.Manifest) error
 		llog(LogE(err)).Error("Error in marshaling the new schedule")
 	} else {
 
-		err = ioutil.WriteFile(schedulePath, bytes, filePermision)
+		err = writeMetadataFile(schedulePath, bytes, filePermision)
 		if err != nil {
 			llog(LogE(err)).Error("Error in writing the new schedule")
 		} else {
 			llog(Log()).Info("Wrote new remove schedule")
+			err = appendAuditEntries(AuditLogLocation(CVMFSRepo), NewAuditEntry(AuditActionScheduled, manifest.Config.Digest))
+			if err != nil {
+				llog(LogE(err)).Error("Error in writing the audit log")
+			}
 		}
 	}
 
-	err = ExecCommand("cvmfs_server", "publish", CVMFSRepo).Start()
+	err = currentPublisher().Publish(CVMFSRepo)
 	if err != nil {
 		llog(LogE(err)).Error("Error in publishing after adding the backlinks")
 		return err
@@ -395,12 +624,12 @@ func AddManifestToRemoveScheduler(CVMFSRepo string, manifest da.Manifest) error
 }
 
 func RemoveSingularityImageFromManifest(CVMFSRepo string, manifest da.Manifest) error {
-	dir := filepath.Join("/", "cvmfs", CVMFSRepo, GetSingularityPathFromManifest(manifest))
+	dir := filepath.Join(repositoryRoot(CVMFSRepo), GetSingularityPathFromManifest(manifest))
 	llog := func(l *log.Entry) *log.Entry {
 		return l.WithFields(log.Fields{
 			"action": "removing singularity directory", "directory": dir})
 	}
-	err := RemoveDirectory(dir)
+	err := removeDirectory(CVMFSRepo, dir)
 	if err != nil {
 		llog(LogE(err)).Error("Error in removing singularity direcotry")
 		return err
@@ -409,7 +638,7 @@ func RemoveSingularityImageFromManifest(CVMFSRepo string, manifest da.Manifest)
 }
 
 func LayerPath(CVMFSRepo, layerDigest string) string {
-	return filepath.Join("/", "cvmfs", CVMFSRepo, subDirInsideRepo, layerDigest[0:2], layerDigest)
+	return filepath.Join(repositoryRoot(CVMFSRepo), subDirInsideRepo, layerDigest[0:2], layerDigest)
 }
 
 func LayerRootfsPath(CVMFSRepo, layerDigest string) string {
@@ -420,9 +649,15 @@ func LayerMetadataPath(CVMFSRepo, layerDigest string) string {
 	return filepath.Join(LayerPath(CVMFSRepo, layerDigest), ".metadata")
 }
 
-//from /cvmfs/$REPO/foo/bar -> foo/bar
-func TrimCVMFSRepoPrefix(path string) string {
-	return strings.Join(strings.Split(path, string(os.PathSeparator))[3:], string(os.PathSeparator))
+// from /cvmfs/$REPO/foo/bar -> foo/bar
+// it fails if the path is not inside a repository, /cvmfs/$REPO -> ""
+func TrimCVMFSRepoPrefix(path string) (string, error) {
+	cleaned := filepath.Clean(path)
+	components := strings.Split(cleaned, string(os.PathSeparator))
+	if len(components) < 3 || components[0] != "" || components[1] != "cvmfs" || components[2] == "" {
+		return "", fmt.Errorf("Path %s is not inside a CVMFS repository (/cvmfs/$REPO/...)", path)
+	}
+	return strings.Join(components[3:], string(os.PathSeparator)), nil
 }
 
 func RemoveLayer(CVMFSRepo, layerDigest string) error {
@@ -431,7 +666,7 @@ func RemoveLayer(CVMFSRepo, layerDigest string) error {
 		return l.WithFields(log.Fields{
 			"action": "removing layer", "directory": dir, "layer": layerDigest})
 	}
-	err := RemoveDirectory(dir)
+	err := removeDirectory(CVMFSRepo, dir)
 	if err != nil {
 		llog(LogE(err)).Error("Error in deleting a layer")
 		return err
@@ -439,11 +674,150 @@ func RemoveLayer(CVMFSRepo, layerDigest string) error {
 	return nil
 }
 
+// maximum number of layers removed in a single transaction by RemoveLayers
+var MaxLayersPerTransaction = 100
+
+// RemoveLayersError collects, by digest, the layers that RemoveLayers was not
+// able to remove
+type RemoveLayersError struct {
+	Errors map[string]error
+}
+
+func (e *RemoveLayersError) Error() string {
+	digests := make([]string, 0, len(e.Errors))
+	for digest := range e.Errors {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+	for i, digest := range digests {
+		digests[i] = fmt.Sprintf("%s: %s", digest, e.Errors[digest])
+	}
+	return fmt.Sprintf("Impossible to remove %d layers: %s", len(digests), strings.Join(digests, "; "))
+}
+
+// remove several layers using as few transactions as possible, at most
+// MaxLayersPerTransaction layers are removed in each transaction
+// the layers are checked as in RemoveDirectory before to open any transaction
+// if some layer is not removed a *RemoveLayersError is returned
+func RemoveLayers(CVMFSRepo string, layerDigests []string) error {
+	return removeLayers(CVMFSRepo, repositoryRoot(CVMFSRepo), layerDigests)
+}
+
+func removeLayers(CVMFSRepo, repoRoot string, layerDigests []string) error {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "removing layers", "repo": CVMFSRepo})
+	}
+	failed := make(map[string]error)
+	type layerToRemove struct {
+		digest string
+		dir    string
+	}
+	var toRemove []layerToRemove
+	for _, digest := range layerDigests {
+		if len(digest) < 2 || strings.Contains(digest, string(os.PathSeparator)) || strings.HasPrefix(digest, ".") {
+			failed[digest] = fmt.Errorf("Invalid layer digest")
+			continue
+		}
+		dir := filepath.Join(repoRoot, subDirInsideRepo, digest[0:2], digest)
+		stat, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			llog(Log()).WithFields(log.Fields{"layer": digest}).Warning("Layer not existing")
+			continue
+		}
+		if err == nil && !stat.IsDir() {
+			err = fmt.Errorf("Trying to remove something different from a directory")
+		}
+		if err == nil {
+			err = checkDirectoryBeforeRemoval(dir, MaxRemoveDepth)
+		}
+		if err != nil {
+			llog(LogE(err)).WithFields(log.Fields{"layer": digest}).Error("Refusing to remove the layer")
+			failed[digest] = err
+			continue
+		}
+		toRemove = append(toRemove, layerToRemove{digest: digest, dir: dir})
+	}
+
+	batchSize := MaxLayersPerTransaction
+	if batchSize <= 0 {
+		batchSize = len(toRemove)
+	}
+	for start := 0; start < len(toRemove); start += batchSize {
+		end := start + batchSize
+		if end > len(toRemove) {
+			end = len(toRemove)
+		}
+		batch := toRemove[start:end]
+
+		err := currentPublisher().Transaction(CVMFSRepo)
+		if err != nil {
+			llog(LogE(err)).Error("Error in opening the transaction")
+			for _, layer := range batch {
+				failed[layer.digest] = err
+			}
+			continue
+		}
+		removed := make([]string, 0, len(batch))
+		audit := make([]AuditEntry, 0, len(batch))
+		for _, layer := range batch {
+			err = os.RemoveAll(layer.dir)
+			if err != nil {
+				llog(LogE(err)).WithFields(log.Fields{"layer": layer.digest}).Error("Error in removing the layer")
+				failed[layer.digest] = err
+				continue
+			}
+			removed = append(removed, layer.digest)
+			reference, _ := filepath.Rel(repoRoot, layer.dir)
+			audit = append(audit, NewAuditEntry(AuditActionRemoved, reference))
+		}
+		err = appendAuditEntries(auditLogLocation(repoRoot), audit...)
+		if err != nil {
+			llog(LogE(err)).Error("Error in writing the audit log, aborting the transaction")
+			currentPublisher().Abort(CVMFSRepo)
+			for _, digest := range removed {
+				failed[digest] = err
+			}
+			continue
+		}
+		err = currentPublisher().Publish(CVMFSRepo)
+		if err != nil {
+			llog(LogE(err)).Error("Error in publishing after removing the layers")
+			currentPublisher().Abort(CVMFSRepo)
+			for _, digest := range removed {
+				failed[digest] = err
+			}
+			continue
+		}
+		llog(Log()).WithFields(log.Fields{"layers": len(removed)}).Info("Removed layers")
+	}
+
+	if len(failed) > 0 {
+		return &RemoveLayersError{Errors: failed}
+	}
+	return nil
+}
+
+// remove, in its own transaction, a directory under /cvmfs/$REPO
 func RemoveDirectory(directory string) error {
+	dirsSplitted := strings.Split(directory, string(os.PathSeparator))
+	if len(dirsSplitted) <= 3 || dirsSplitted[1] != "cvmfs" {
+		err := fmt.Errorf("Directory not in the CVMFS repo")
+		LogE(err).WithFields(log.Fields{"action": "removing directory", "directory": directory}).Error("Error in opening the transaction")
+		return err
+	}
+	return removeDirectory(dirsSplitted[2], directory)
+}
+
+// the directory is inside the root of CVMFSRepo, see repositoryRoot
+func removeDirectory(CVMFSRepo, directory string) error {
 	llog := func(l *log.Entry) *log.Entry {
 		return l.WithFields(log.Fields{
 			"action": "removing directory", "directory": directory})
 	}
+	if _, err := TrimRepositoryRoot(CVMFSRepo, directory); err != nil {
+		llog(LogE(err)).Error("Error in opening the transaction")
+		return err
+	}
 	stat, err := os.Stat(directory)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -459,14 +833,13 @@ func RemoveDirectory(directory string) error {
 		return err
 	}
 
-	dirsSplitted := strings.Split(directory, string(os.PathSeparator))
-	if len(dirsSplitted) <= 3 || dirsSplitted[1] != "cvmfs" {
-		err := fmt.Errorf("Directory not in the CVMFS repo")
-		llog(LogE(err)).Error("Error in opening the transaction")
+	err = checkDirectoryBeforeRemoval(directory, MaxRemoveDepth)
+	if err != nil {
+		llog(LogE(err)).Error("Refusing to remove the directory")
 		return err
 	}
-	CVMFSRepo := dirsSplitted[2]
-	err = ExecCommand("cvmfs_server", "transaction", CVMFSRepo).Start()
+
+	err = currentPublisher().Transaction(CVMFSRepo)
 	if err != nil {
 		llog(LogE(err)).Error("Error in opening the transaction")
 		return err
@@ -475,11 +848,19 @@ func RemoveDirectory(directory string) error {
 	err = os.RemoveAll(directory)
 	if err != nil {
 		llog(LogE(err)).Error("Error in publishing after adding the backlinks")
-		ExecCommand("cvmfs_server", "abort", "-f", CVMFSRepo).Start()
+		currentPublisher().Abort(CVMFSRepo)
 		return err
 	}
 
-	err = ExecCommand("cvmfs_server", "publish", CVMFSRepo).Start()
+	reference, _ := TrimRepositoryRoot(CVMFSRepo, directory)
+	err = appendAuditEntries(AuditLogLocation(CVMFSRepo), NewAuditEntry(AuditActionRemoved, reference))
+	if err != nil {
+		llog(LogE(err)).Error("Error in writing the audit log, aborting the transaction")
+		currentPublisher().Abort(CVMFSRepo)
+		return err
+	}
+
+	err = currentPublisher().Publish(CVMFSRepo)
 	if err != nil {
 		llog(LogE(err)).Error("Error in publishing after adding the backlinks")
 		return err
@@ -488,15 +869,125 @@ func RemoveDirectory(directory string) error {
 	return nil
 }
 
+// maximum depth of the directory tree that RemoveDirectory accepts to remove
+var MaxRemoveDepth = 256
+
+// maximum number of symlinks to follow before to consider the chain a loop
+var maxSymlinkHops = 40
+
+var (
+	ErrSymlinkLoop   = fmt.Errorf("Too many levels of symbolic links")
+	ErrSymlinkEscape = fmt.Errorf("Symbolic link points outside of the allowed directory")
+)
+
+// walk the directory that we are about to remove, without following symlinks,
+// and make sure that the tree is not deeper than maxDepth and that no chain
+// of symlinks loops.
+// symlinks that point outside the directory are fine, os.RemoveAll removes
+// the link and never follows it, and absolute links are common in the layers.
+// for the same reason symlinks to an ancestor (`usr/bin/X11 -> .`) are fine
+func checkDirectoryBeforeRemoval(directory string, maxDepth int) error {
+	directory = filepath.Clean(directory)
+	rootDepth := len(strings.Split(directory, string(os.PathSeparator)))
+	return filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if depth := len(strings.Split(path, string(os.PathSeparator))) - rootDepth; depth > maxDepth {
+			return fmt.Errorf("Directory tree deeper than %d levels at: %s", maxDepth, path)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		_, err = resolveSymlinkWithin(directory, path, maxSymlinkHops)
+		if err == ErrSymlinkEscape {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, path)
+		}
+		return nil
+	})
+}
+
+// follows lexically the symlink at path, until it reaches something that is
+// not a symlink, making sure that every step stays inside root
+// returns the final target, or ErrSymlinkEscape if the chain escapes root
+// and ErrSymlinkLoop if it is longer than maxHops
+func resolveSymlinkWithin(root, path string, maxHops int) (string, error) {
+	return followSymlinks(root, path, maxHops, false)
+}
+
+// if rooted the absolute symlinks are relative to root, as they are inside
+// the layers
+func followSymlinks(root, path string, maxHops int, rooted bool) (string, error) {
+	root = filepath.Clean(root)
+	current := filepath.Clean(path)
+	for hops := 0; ; hops++ {
+		info, err := os.Lstat(current)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// dangling symlink, still inside the root
+				return current, nil
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return current, nil
+		}
+		if hops >= maxHops {
+			return "", ErrSymlinkLoop
+		}
+		link, err := os.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+		if rooted && filepath.IsAbs(link) {
+			link = filepath.Join(root, link)
+		} else if !filepath.IsAbs(link) {
+			link = filepath.Join(filepath.Dir(current), link)
+		}
+		link = filepath.Clean(link)
+		if link != root && !strings.HasPrefix(link, root+string(os.PathSeparator)) {
+			return "", ErrSymlinkEscape
+		}
+		current = link
+	}
+}
+
+// follows the chain of symlinks at linkPath (ex: latest -> v2 -> actual), as
+// created by CreateSymlinkIntoCVMFS, and returns the final target
+// linkPath can be the full path (/cvmfs/$REPO/foo/bar) or the path inside the
+// repository (foo/bar), it returns ErrSymlinkLoop for chains too long and
+// ErrSymlinkEscape for chains leaving the repository
+func ResolveSymlink(CVMFSRepo, linkPath string) (string, error) {
+	return resolveSymlink(repositoryRoot(CVMFSRepo), linkPath)
+}
+
+func resolveSymlink(root, linkPath string) (string, error) {
+	if !filepath.IsAbs(linkPath) {
+		linkPath = filepath.Join(root, linkPath)
+	}
+	linkPath = filepath.Clean(linkPath)
+	if linkPath != root && !strings.HasPrefix(linkPath, root+string(os.PathSeparator)) {
+		return "", ErrSymlinkEscape
+	}
+	return resolveSymlinkWithin(root, linkPath, maxSymlinkHops)
+}
+
 func CreateCatalogIntoDir(CVMFSRepo, dir string) (err error) {
-	catalogPath := filepath.Join("/", "cvmfs", CVMFSRepo, dir, ".cvmfscatalog")
+	catalogPath := filepath.Join(repositoryRoot(CVMFSRepo), dir, catalogMarker)
 	if _, err := os.Stat(catalogPath); os.IsNotExist(err) {
-		tmpFile, err := ioutil.TempFile("", "tempCatalog")
+		tmpFile, err := UserDefinedTempFile("", "tempCatalog")
+		if err != nil {
+			return err
+		}
 		tmpFile.Close()
+		target, err := TrimRepositoryRoot(CVMFSRepo, catalogPath)
 		if err != nil {
 			return err
 		}
-		err = IngestIntoCVMFS(CVMFSRepo, TrimCVMFSRepoPrefix(catalogPath), tmpFile.Name())
+		err = IngestIntoCVMFS(CVMFSRepo, target, tmpFile.Name())
 		if err != nil {
 			return err
 		}
@@ -506,7 +997,7 @@ func CreateCatalogIntoDir(CVMFSRepo, dir string) (err error) {
 }
 
 func RepositoryExists(CVMFSRepo string) bool {
-	cmd := ExecCommand("cvmfs_server", "list")
+	cmd := ExecCommand(CvmfsServerBinary, "list")
 	err, stdout, _ := cmd.StartWithOutput()
 	if err != nil {
 		LogE(fmt.Errorf("Error in listing the repository")).Error("Repo not present")
@@ -0,0 +1,321 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckDirectoryBeforeRemoval(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_remove")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "a", "b"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "a", "file"), []byte("foo"), 0644)
+	os.Symlink("../file", filepath.Join(root, "a", "b", "link"))
+
+	err = checkDirectoryBeforeRemoval(root, MaxRemoveDepth)
+	if err != nil {
+		t.Errorf("Error in checking a valid directory: %s", err)
+	}
+
+	err = checkDirectoryBeforeRemoval(root, 1)
+	if err == nil {
+		t.Errorf("Directory deeper than the limit not detected")
+	}
+}
+
+func TestCheckDirectoryBeforeRemovalCycle(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_remove")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	// symlinks to an ancestor are common in the layers, RemoveAll does not
+	// follow them
+	os.MkdirAll(filepath.Join(root, "a"), 0755)
+	os.Symlink("..", filepath.Join(root, "a", "parent"))
+	os.Symlink(".", filepath.Join(root, "a", "X11"))
+	err = checkDirectoryBeforeRemoval(root, MaxRemoveDepth)
+	if err != nil {
+		t.Errorf("Symlink to an ancestor should not stop the removal: %s", err)
+	}
+
+	os.Symlink("second", filepath.Join(root, "a", "first"))
+	os.Symlink("first", filepath.Join(root, "a", "second"))
+	err = checkDirectoryBeforeRemoval(root, MaxRemoveDepth)
+	if err == nil {
+		t.Errorf("Symlink loop not detected")
+	}
+}
+
+func TestCheckDirectoryBeforeRemovalEscape(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_remove")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	// absolute symlinks are common in the layers, RemoveAll does not follow them
+	os.Symlink("/etc", filepath.Join(root, "etc"))
+	err = checkDirectoryBeforeRemoval(root, MaxRemoveDepth)
+	if err != nil {
+		t.Errorf("Symlink pointing outside the directory should not stop the removal: %s", err)
+	}
+
+	_, err = resolveSymlinkWithin(root, filepath.Join(root, "etc"), maxSymlinkHops)
+	if err != ErrSymlinkEscape {
+		t.Errorf("Symlink pointing outside the directory not detected: %v", err)
+	}
+}
+
+func TestSwapSymlinkNeverMissing(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_symlink")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "v1"), 0755)
+	os.MkdirAll(filepath.Join(root, "v2"), 0755)
+	latest := filepath.Join(root, "latest")
+	err = swapSymlink("v1", latest)
+	if err != nil {
+		t.Fatalf("Error in creating the symlink: %s", err)
+	}
+
+	stop := make(chan bool)
+	missing := make(chan string, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				close(missing)
+				return
+			default:
+			}
+			link, err := os.Readlink(latest)
+			if err != nil || (link != "v1" && link != "v2") {
+				missing <- fmt.Sprintf("%s %v", link, err)
+				close(missing)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		target := []string{"v1", "v2"}[i%2]
+		err = swapSymlink(target, latest)
+		if err != nil {
+			t.Fatalf("Error in swapping the symlink: %s", err)
+		}
+	}
+	close(stop)
+	if m, ok := <-missing; ok {
+		t.Errorf("The symlink was not resolvable during the swap: %s", m)
+	}
+}
+
+func TestSwapSymlinkRemovesStrayTemporaryLink(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_symlink")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	latest := filepath.Join(root, "latest")
+	// left by a run that died in the middle of the swap
+	os.Symlink("v0", latest+"~ducc-tmp")
+	err = swapSymlink("v1", latest)
+	if err != nil {
+		t.Fatalf("Error in creating the symlink: %s", err)
+	}
+	if link, err := os.Readlink(latest); err != nil || link != "v1" {
+		t.Errorf("Error, wrong symlink: %s %v", link, err)
+	}
+	files, _ := ioutil.ReadDir(root)
+	if len(files) != 1 {
+		t.Errorf("Error, stray temporary link left in the directory: %d files", len(files))
+	}
+
+	// the rename fails, since a directory is in the way
+	busy := filepath.Join(root, "busy")
+	os.MkdirAll(filepath.Join(busy, "content"), 0755)
+	if err = swapSymlink("v1", busy); err == nil {
+		t.Errorf("Error, the symlink replaced a directory")
+	}
+	if _, err = os.Lstat(busy + "~ducc-tmp"); !os.IsNotExist(err) {
+		t.Errorf("Error, temporary link left after a failed swap: %v", err)
+	}
+}
+
+func countOperations(local *LocalPublisher, operation string) int {
+	n := 0
+	for _, executed := range local.Operations {
+		if strings.HasPrefix(executed, operation+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRemoveLayersSingleTransaction(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+
+	repo := "test.cern.ch"
+	root := local.RepositoryRoot(repo)
+	layers := []string{"aa1111", "aa2222", "bb3333"}
+	for _, layer := range layers {
+		os.MkdirAll(filepath.Join(root, ".layers", layer[0:2], layer, "layerfs", "etc"), 0755)
+	}
+	os.MkdirAll(filepath.Join(root, ".layers", "cc"), 0755)
+	ioutil.WriteFile(filepath.Join(root, ".layers", "cc", "cc4444"), []byte("not a layer"), 0644)
+
+	err := RemoveLayers(repo, append(layers, "cc4444", "dd5555", "../etc"))
+	removeErr, ok := err.(*RemoveLayersError)
+	if !ok {
+		t.Fatalf("Error, expected a RemoveLayersError, got %v", err)
+	}
+	if len(removeErr.Errors) != 2 || removeErr.Errors["cc4444"] == nil || removeErr.Errors["../etc"] == nil {
+		t.Errorf("Error in the per layer errors: %s", removeErr)
+	}
+	for _, layer := range layers {
+		if _, err := os.Stat(filepath.Join(root, ".layers", layer[0:2], layer)); !os.IsNotExist(err) {
+			t.Errorf("Error, layer %s not removed", layer)
+		}
+	}
+	if n := countOperations(local, "transaction"); n != 1 {
+		t.Errorf("Error, expected a single transaction, got %d", n)
+	}
+	if n := countOperations(local, "publish"); n != 1 {
+		t.Errorf("Error, expected a single publish, got %d", n)
+	}
+}
+
+func TestRemoveLayersBoundedTransactions(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	defer func(max int) { MaxLayersPerTransaction = max }(MaxLayersPerTransaction)
+	MaxLayersPerTransaction = 2
+
+	repo := "test.cern.ch"
+	layers := []string{"aa1111", "aa2222", "bb3333"}
+	for _, layer := range layers {
+		os.MkdirAll(filepath.Join(local.RepositoryRoot(repo), ".layers", layer[0:2], layer), 0755)
+	}
+	if err := RemoveLayers(repo, layers); err != nil {
+		t.Errorf("Error in removing the layers: %s", err)
+	}
+	if n := countOperations(local, "publish"); n != 2 {
+		t.Errorf("Error, expected 2 publishes, got %d", n)
+	}
+}
+
+func TestIngestVerifyChecksum(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	dir, err := ioutil.TempDir("", "test_ingest_verify")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	newTarget := func() string {
+		target := filepath.Join(dir, "target")
+		os.MkdirAll(filepath.Join(target, "etc"), 0755)
+		ioutil.WriteFile(filepath.Join(target, "etc", "config"), []byte("config"), 0644)
+		return target
+	}
+	defer func(verify bool) { VerifyIngestChecksum = verify }(VerifyIngestChecksum)
+	VerifyIngestChecksum = true
+	defer func(method CopyMethod) { DefaultCopyMethod = method }(DefaultCopyMethod)
+	DefaultCopyMethod = CopyMethodCopy
+
+	err = IngestIntoCVMFS("test.cern.ch", "image", newTarget())
+	if err != nil {
+		t.Fatalf("Error in ingesting with verification: %s", err)
+	}
+	if countOperations(local, "publish") != 1 || countOperations(local, "abort") != 0 {
+		t.Errorf("Error, expected the ingestion to be published: %v", local.Operations)
+	}
+
+	defer func() { afterIngestCopy = func(string) {} }()
+	afterIngestCopy = func(path string) {
+		ioutil.WriteFile(filepath.Join(path, "etc", "config"), []byte("CONFIG"), 0644)
+	}
+	target := newTarget()
+	err = IngestIntoCVMFS("test.cern.ch", "image", target)
+	if err != ErrChecksumMismatch {
+		t.Errorf("Error, corruption not detected: %v", err)
+	}
+	if countOperations(local, "publish") != 1 || countOperations(local, "abort") != 1 {
+		t.Errorf("Error, expected the corrupted ingestion to be aborted: %v", local.Operations)
+	}
+	if _, err = os.Stat(target); err != nil {
+		t.Errorf("Error, the target was removed after a failed ingestion")
+	}
+}
+
+func TestTrimCVMFSRepoPrefix(t *testing.T) {
+	valid := map[string]string{
+		"/cvmfs/unpacked.cern.ch/.layers/ab/abcd": ".layers/ab/abcd",
+		"/cvmfs/unpacked.cern.ch/foo/":            "foo",
+		"/cvmfs/unpacked.cern.ch":                 "",
+	}
+	for path, expected := range valid {
+		trimmed, err := TrimCVMFSRepoPrefix(path)
+		if err != nil || trimmed != expected {
+			t.Errorf("Error in trimming %s: got %q, %v, expected %q", path, trimmed, err, expected)
+		}
+	}
+	for _, path := range []string{"", "/", "/cvmfs", "/cvmfs/", "cvmfs/unpacked.cern.ch/foo", "/tmp/unpacked.cern.ch/foo", "/cvmfs/../tmp/foo"} {
+		if trimmed, err := TrimCVMFSRepoPrefix(path); err == nil {
+			t.Errorf("Error, path %q not inside a repository accepted as %q", path, trimmed)
+		}
+	}
+}
+
+func TestResolveSymlink(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_resolve")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	actual := filepath.Join(root, ".flat", "ab", "abcd")
+	os.MkdirAll(actual, 0755)
+	os.MkdirAll(filepath.Join(root, "image"), 0755)
+	os.Symlink(actual, filepath.Join(root, "image", "v2"))
+	os.Symlink("v2", filepath.Join(root, "image", "latest"))
+
+	target, err := resolveSymlink(root, "image/v2")
+	if err != nil || target != actual {
+		t.Errorf("Error in resolving a single symlink: %s, %v", target, err)
+	}
+	target, err = resolveSymlink(root, filepath.Join(root, "image", "latest"))
+	if err != nil || target != actual {
+		t.Errorf("Error in resolving a chain of symlinks: %s, %v", target, err)
+	}
+
+	os.Symlink("loop-b", filepath.Join(root, "image", "loop-a"))
+	os.Symlink("loop-a", filepath.Join(root, "image", "loop-b"))
+	if _, err = resolveSymlink(root, "image/loop-a"); err != ErrSymlinkLoop {
+		t.Errorf("Symlink loop not detected: %v", err)
+	}
+
+	os.Symlink("../../etc", filepath.Join(root, "image", "escape"))
+	if _, err = resolveSymlink(root, "image/escape"); err != ErrSymlinkEscape {
+		t.Errorf("Symlink escaping the repository not detected: %v", err)
+	}
+	if _, err = resolveSymlink(root, "/etc/passwd"); err != ErrSymlinkEscape {
+		t.Errorf("Path outside the repository not detected: %v", err)
+	}
+}
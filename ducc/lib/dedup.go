@@ -0,0 +1,232 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// DedupLayers replaces the files with identical content in different layers
+// of the repository with reflinks to a single copy, returning the bytes saved.
+// The files are replaced inside a transaction. The hardlinks are not an
+// option, since CVMFS does not support hardlinks across directories: if the
+// filesystem does not support reflinks nothing is done.
+// The bytes saved are the sizes of the files replaced with a reflink, an upper
+// bound of the space actually reclaimed: the files that already shared their
+// blocks are counted as well.
+// CVMFSRepo: just the name of the repository (ex: unpacked.cern.ch)
+func DedupLayers(CVMFSRepo string) (bytesSaved int64, err error) {
+	return dedupLayers(repositoryRoot(CVMFSRepo), CVMFSRepo)
+}
+
+func dedupLayers(repoRoot, CVMFSRepo string) (bytesSaved int64, err error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "dedup layers", "repo": CVMFSRepo})
+	}
+	unlock := lockRepository(CVMFSRepo)
+	defer unlock()
+
+	layersRoot := filepath.Join(repoRoot, subDirInsideRepo)
+	duplicates, err := findDuplicateFiles(layersRoot)
+	if err != nil {
+		llog(LogE(err)).Error("Error in looking for the duplicated files")
+		return 0, err
+	}
+	if len(duplicates) == 0 {
+		return 0, nil
+	}
+
+	if !supportsReflink(layersRoot) {
+		llog(Log()).Warning("The filesystem does not support reflinks, not deduplicating the layers")
+		return 0, nil
+	}
+	err = currentPublisher().Transaction(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Error in opening the transaction")
+		return 0, err
+	}
+	for _, files := range duplicates {
+		for _, file := range files[1:] {
+			size, err := reflinkReplace(files[0], file)
+			if err != nil {
+				llog(LogE(err)).WithFields(log.Fields{"file": file, "copy": files[0]}).Error("Error in replacing the file with a reflink")
+				currentPublisher().Abort(CVMFSRepo)
+				return 0, err
+			}
+			bytesSaved += size
+		}
+	}
+	err = publishWithRetry(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Error in publishing the repository")
+		currentPublisher().Abort(CVMFSRepo)
+		return 0, err
+	}
+	llog(Log()).WithFields(log.Fields{"bytes saved": bytesSaved}).Info("Deduplicated the layers")
+	return bytesSaved, nil
+}
+
+// the regular, non empty, files under the layerfs of the layers in
+// layersRoot, grouped by content, only the groups with files from more
+// than one layer are returned, each group is sorted
+func findDuplicateFiles(layersRoot string) ([][]string, error) {
+	bySize := make(map[int64][]string)
+	layerDirs, err := filepath.Glob(filepath.Join(layersRoot, "*", "*", "layerfs"))
+	if err != nil {
+		return nil, err
+	}
+	for _, layerfs := range layerDirs {
+		err = filepath.Walk(layerfs, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() && info.Size() > 0 {
+				bySize[info.Size()] = append(bySize[info.Size()], path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var duplicates [][]string
+	for _, candidates := range bySize {
+		if len(candidates) < 2 {
+			continue
+		}
+		byDigest := make(map[string][]string)
+		for _, path := range candidates {
+			digest, err := fileDigest(path)
+			if err != nil {
+				return nil, err
+			}
+			byDigest[digest] = append(byDigest[digest], path)
+		}
+		for _, files := range byDigest {
+			if len(files) > 1 && spansLayers(layersRoot, files) {
+				sort.Strings(files)
+				duplicates = append(duplicates, files)
+			}
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool { return duplicates[i][0] < duplicates[j][0] })
+	return duplicates, nil
+}
+
+// true if the files are not all in the same layer
+func spansLayers(layersRoot string, files []string) bool {
+	// from layersRoot/ab/abcd/layerfs/... to abcd
+	layerOf := func(path string) string {
+		rel, _ := filepath.Rel(layersRoot, path)
+		components := strings.SplitN(rel, string(os.PathSeparator), 3)
+		if len(components) < 2 {
+			return rel
+		}
+		return components[1]
+	}
+	first := layerOf(files[0])
+	for _, file := range files[1:] {
+		if layerOf(file) != first {
+			return true
+		}
+	}
+	return false
+}
+
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// replace dest with a reflink of src, keeping the mode, the owner, the
+// extended attributes and the modification time of dest, the reflink is
+// created aside, in the same directory, and renamed over dest, so dest is
+// never lost
+func reflinkReplace(src, dest string) (int64, error) {
+	info, err := os.Stat(dest)
+	if err != nil {
+		return 0, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".dedup")
+	if err != nil {
+		return 0, err
+	}
+	tmp.Close()
+	err = func() error {
+		if err := reflinkFile(src, tmp.Name(), info.Mode().Perm()); err != nil {
+			return err
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(tmp.Name(), int(stat.Uid), int(stat.Gid)); err != nil {
+				return err
+			}
+		}
+		if err := copyXattrs(dest, tmp.Name()); err != nil {
+			return err
+		}
+		// the umask applies when the file is created, and the chown may
+		// clear the setuid and setgid bits
+		if err := os.Chmod(tmp.Name(), info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+		if err := os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), dest)
+	}()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// copy the extended attributes of src to dest, nothing to do if the
+// filesystem does not support them
+func copyXattrs(src, dest string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	list := make([]byte, size)
+	size, err = unix.Llistxattr(src, list)
+	if err != nil {
+		return err
+	}
+	for _, name := range strings.Split(strings.TrimRight(string(list[:size]), "\x00"), "\x00") {
+		valueSize, err := unix.Lgetxattr(src, name, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = unix.Lgetxattr(src, name, value)
+		if err != nil {
+			return err
+		}
+		if err = unix.Lsetxattr(dest, name, value[:valueSize], 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
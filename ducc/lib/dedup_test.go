@@ -0,0 +1,151 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func writeLayerFile(t *testing.T, repoRoot, layer, name, content string) string {
+	path := filepath.Join(repoRoot, subDirInsideRepo, layer[0:2], layer, "layerfs", name)
+	os.MkdirAll(filepath.Dir(path), 0755)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Error in writing the file of the layer: %s", err)
+	}
+	return path
+}
+
+func TestDedupLayers(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	repo := "test.cern.ch"
+	repoRoot := local.RepositoryRoot(repo)
+
+	libA := writeLayerFile(t, repoRoot, "aa1111", "usr/lib/libc.so", "the same library")
+	libB := writeLayerFile(t, repoRoot, "bb2222", "lib/libc.so", "the same library")
+	libC := writeLayerFile(t, repoRoot, "cc3333", "opt/libc.so", "the same library")
+	writeLayerFile(t, repoRoot, "aa1111", "etc/hostname", "different")
+	writeLayerFile(t, repoRoot, "bb2222", "etc/hostname", "differenT")
+	// duplicates inside the same layer are left alone
+	writeLayerFile(t, repoRoot, "cc3333", "a/same", "same layer")
+	writeLayerFile(t, repoRoot, "cc3333", "b/same", "same layer")
+
+	duplicates, err := findDuplicateFiles(filepath.Join(repoRoot, subDirInsideRepo))
+	if err != nil {
+		t.Fatalf("Error in finding the duplicates: %s", err)
+	}
+	if expected := [][]string{{libA, libB, libC}}; !reflect.DeepEqual(duplicates, expected) {
+		t.Errorf("Error in the duplicates, expected %v, got %v", expected, duplicates)
+	}
+
+	saved, err := dedupLayers(repoRoot, repo)
+	if err != nil {
+		t.Fatalf("Error in deduplicating the layers: %s", err)
+	}
+	if local.InTransaction(repo) {
+		t.Errorf("Error, transaction left open")
+	}
+	expectedSaved := int64(0)
+	if supportsReflink(repoRoot) {
+		expectedSaved = 2 * int64(len("the same library"))
+	}
+	if saved != expectedSaved {
+		t.Errorf("Error in the bytes saved, expected %d, got %d", expectedSaved, saved)
+	}
+	for _, path := range []string{libA, libB, libC} {
+		if content, err := ioutil.ReadFile(path); err != nil || string(content) != "the same library" {
+			t.Errorf("Error, content of %s changed: %q %v", path, content, err)
+		}
+	}
+}
+
+func TestDedupLayersWithoutReflinks(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	repo := "test.cern.ch"
+	repoRoot := local.RepositoryRoot(repo)
+	if supportsReflink(repoRoot) {
+		t.Skip("The filesystem supports reflinks")
+	}
+	writeLayerFile(t, repoRoot, "aa1111", "usr/lib/libc.so", "the same library")
+	writeLayerFile(t, repoRoot, "bb2222", "lib/libc.so", "the same library")
+
+	if saved, err := dedupLayers(repoRoot, repo); err != nil || saved != 0 {
+		t.Errorf("Error in deduplicating the layers: %d %v", saved, err)
+	}
+	// the capability is checked before to open a transaction
+	if n := countOperations(local, "transaction"); n != 0 {
+		t.Errorf("Error, transaction opened without reflinks: %v", local.Operations)
+	}
+}
+
+func TestReflinkReplaceKeepsMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_reflink_replace")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if !supportsReflink(dir) {
+		t.Skip("The filesystem does not support reflinks")
+	}
+	src := filepath.Join(dir, "src")
+	dest := filepath.Join(dir, "dest")
+	ioutil.WriteFile(src, []byte("content"), 0644)
+	ioutil.WriteFile(dest, []byte("content"), 0750)
+	if err = unix.Lsetxattr(dest, "user.origin", []byte("layer"), 0); err != nil {
+		t.Skipf("The filesystem does not support extended attributes: %s", err)
+	}
+	os.Lchown(dest, 1234, 1234)
+	before, _ := os.Stat(dest)
+
+	if _, err = reflinkReplace(src, dest); err != nil {
+		t.Fatalf("Error in replacing the file: %s", err)
+	}
+	after, _ := os.Stat(dest)
+	if after.Mode() != before.Mode() {
+		t.Errorf("Error, mode changed: %v %v", before.Mode(), after.Mode())
+	}
+	if b, a := before.Sys().(*syscall.Stat_t), after.Sys().(*syscall.Stat_t); b.Uid != a.Uid || b.Gid != a.Gid {
+		t.Errorf("Error, owner changed: %d:%d %d:%d", b.Uid, b.Gid, a.Uid, a.Gid)
+	}
+	value := make([]byte, 16)
+	if n, err := unix.Lgetxattr(dest, "user.origin", value); err != nil || string(value[:n]) != "layer" {
+		t.Errorf("Error, extended attribute not copied: %q %v", value[:n], err)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("Error, temporary files left in the directory: %v", entries)
+	}
+}
+
+func TestCopyXattrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_copy_xattrs")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dest := filepath.Join(dir, "dest")
+	ioutil.WriteFile(src, []byte("content"), 0644)
+	ioutil.WriteFile(dest, []byte("content"), 0644)
+	if err = copyXattrs(src, dest); err != nil {
+		t.Errorf("Error in copying no extended attributes: %s", err)
+	}
+	if err = unix.Lsetxattr(src, "user.first", []byte("1"), 0); err != nil {
+		t.Skipf("The filesystem does not support extended attributes: %s", err)
+	}
+	unix.Lsetxattr(src, "user.second", []byte("22"), 0)
+	if err = copyXattrs(src, dest); err != nil {
+		t.Fatalf("Error in copying the extended attributes: %s", err)
+	}
+	for name, expected := range map[string]string{"user.first": "1", "user.second": "22"} {
+		value := make([]byte, 16)
+		if n, err := unix.Lgetxattr(dest, name, value); err != nil || string(value[:n]) != expected {
+			t.Errorf("Error in the extended attribute %s: %q %v", name, value[:n], err)
+		}
+	}
+}
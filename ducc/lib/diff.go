@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+// compare the layers of two manifests, returns the digests of the layers in
+// both, the ones only in new and the ones only in old
+// the digests are returned in the order they appear in the manifests
+func DiffManifests(old, new da.Manifest) (sharedLayers, addedLayers, removedLayers []string) {
+	oldLayers := make(map[string]bool)
+	for _, layer := range old.Layers {
+		oldLayers[layer.Digest] = true
+	}
+	newLayers := make(map[string]bool)
+	for _, layer := range new.Layers {
+		if newLayers[layer.Digest] {
+			continue
+		}
+		newLayers[layer.Digest] = true
+		if oldLayers[layer.Digest] {
+			sharedLayers = append(sharedLayers, layer.Digest)
+		} else {
+			addedLayers = append(addedLayers, layer.Digest)
+		}
+	}
+	for _, layer := range old.Layers {
+		if !newLayers[layer.Digest] {
+			removedLayers = append(removedLayers, layer.Digest)
+			// avoid reporting twice a layer repeated in the old manifest
+			newLayers[layer.Digest] = true
+		}
+	}
+	return
+}
+
+// log how much the new manifest reuses the one already stored at manifestPath
+func logManifestReuse(manifestPath string, manifest da.Manifest) {
+	bytes, err := readMetadataFile(manifestPath)
+	if err != nil {
+		return
+	}
+	var old da.Manifest
+	if err = json.Unmarshal(bytes, &old); err != nil {
+		return
+	}
+	shared, added, removed := DiffManifests(old, manifest)
+	Log().WithFields(log.Fields{
+		"shared":  len(shared),
+		"layers":  len(manifest.Layers),
+		"added":   len(added),
+		"removed": len(removed)}).
+		Infof("New image reuses %d of %d layers, %d new layers", len(shared), len(shared)+len(added), len(added))
+}
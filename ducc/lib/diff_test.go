@@ -0,0 +1,29 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+func TestDiffManifests(t *testing.T) {
+	old := manifestWithConfig("sha256:old", "sha256:a", "sha256:b", "sha256:c")
+	new := manifestWithConfig("sha256:new", "sha256:a", "sha256:c", "sha256:d", "sha256:e")
+
+	shared, added, removed := DiffManifests(old, new)
+	if !reflect.DeepEqual(shared, []string{"sha256:a", "sha256:c"}) {
+		t.Errorf("Error in the shared layers: %v", shared)
+	}
+	if !reflect.DeepEqual(added, []string{"sha256:d", "sha256:e"}) {
+		t.Errorf("Error in the added layers: %v", added)
+	}
+	if !reflect.DeepEqual(removed, []string{"sha256:b"}) {
+		t.Errorf("Error in the removed layers: %v", removed)
+	}
+
+	shared, added, removed = DiffManifests(da.Manifest{}, new)
+	if len(shared) != 0 || len(added) != 4 || len(removed) != 0 {
+		t.Errorf("Error in diffing against an empty manifest: %v %v %v", shared, added, removed)
+	}
+}
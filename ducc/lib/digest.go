@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// DigestMismatchError is returned reading a blob whose content does not match
+// the digest announced in the manifest
+type DigestMismatchError struct {
+	Expected string
+	Got      string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("Digest mismatch, expected %s got %s", e.Expected, e.Got)
+}
+
+// hashes the blob while it is read, so that the download is written and
+// verified in a single pass, at the end of the stream the digest is checked
+// and on mismatch a *DigestMismatchError is returned instead of io.EOF
+type digestVerifier struct {
+	reader   io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+// wrap r to verify it against digest (ex: sha256:abcd...), only sha256 is supported
+func newDigestVerifier(r io.Reader, digest string) (io.Reader, error) {
+	split := strings.SplitN(digest, ":", 2)
+	if len(split) != 2 || split[0] != "sha256" {
+		return nil, fmt.Errorf("Unsupported digest: %s", digest)
+	}
+	h := sha256.New()
+	return &digestVerifier{reader: io.TeeReader(r, h), hash: h, expected: strings.ToLower(split[1])}, nil
+}
+
+func (v *digestVerifier) Read(p []byte) (int, error) {
+	n, err := v.reader.Read(p)
+	if err == io.EOF {
+		if got := hex.EncodeToString(v.hash.Sum(nil)); got != v.expected {
+			return n, &DigestMismatchError{Expected: "sha256:" + v.expected, Got: "sha256:" + got}
+		}
+	}
+	return n, err
+}
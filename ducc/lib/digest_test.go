@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"testing"
+)
+
+type countingReader struct {
+	reader io.Reader
+	read   int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+func gzipTestLayer(t *testing.T, headers ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	io.Copy(gw, buildTestTar(t, headers...))
+	gw.Close()
+	return buf.Bytes()
+}
+
+func TestDigestVerifierSinglePass(t *testing.T) {
+	blob := gzipTestLayer(t, &tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10})
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+
+	counter := &countingReader{reader: bytes.NewReader(blob)}
+	verified, err := newDigestVerifier(counter, digest)
+	if err != nil {
+		t.Fatalf("Error in creating the verifier: %s", err)
+	}
+	gread, err := gzip.NewReader(verified)
+	if err != nil {
+		t.Fatalf("Error in opening the gzip stream: %s", err)
+	}
+	spooled, stats, err := spoolAndValidateLayer(gread, Limits{})
+	if err != nil {
+		t.Fatalf("Error in spooling a valid layer: %s", err)
+	}
+	spooled.Close()
+	if stats.Files != 1 {
+		t.Errorf("Error in the stats of the layer: %+v", stats)
+	}
+	if counter.read != len(blob) {
+		t.Errorf("Error, the blob was read %d bytes instead of %d", counter.read, len(blob))
+	}
+}
+
+func TestDigestVerifierMismatch(t *testing.T) {
+	blob := gzipTestLayer(t, &tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10})
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob))
+	corrupted := gzipTestLayer(t, &tar.Header{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0644, Size: 10})
+
+	verified, err := newDigestVerifier(bytes.NewReader(corrupted), digest)
+	if err != nil {
+		t.Fatalf("Error in creating the verifier: %s", err)
+	}
+	gread, err := gzip.NewReader(verified)
+	if err != nil {
+		t.Fatalf("Error in opening the gzip stream: %s", err)
+	}
+	_, _, err = spoolAndValidateLayer(gread, Limits{})
+	if _, ok := err.(*DigestMismatchError); !ok {
+		t.Errorf("Error, corrupted download not rejected: %v", err)
+	}
+
+	if _, err = newDigestVerifier(bytes.NewReader(blob), "md5:abcd"); err == nil {
+		t.Errorf("Error, unsupported digest accepted")
+	}
+}
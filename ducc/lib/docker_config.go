@@ -0,0 +1,167 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+// path of the docker configuration file where to look for the credentials
+// of the registries, if empty we use $DOCKER_CONFIG/config.json or
+// ~/.docker/config.json
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var DockerConfigPath string
+
+// the subset of the docker configuration file (~/.docker/config.json) that
+// deals with the credentials
+type DockerConfig struct {
+	Auths       map[string]DockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+type DockerAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+var (
+	dockerConfig     *DockerConfig
+	dockerConfigErr  error
+	dockerConfigOnce sync.Once
+)
+
+func defaultDockerConfigPath() string {
+	if DockerConfigPath != "" {
+		return DockerConfigPath
+	}
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+func LoadDockerConfig(path string) (*DockerConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config DockerConfig
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return nil, fmt.Errorf("Impossible to parse the docker configuration file %s: %s", path, err)
+	}
+	return &config, nil
+}
+
+// look for the credentials of the registry in the docker configuration file
+func CredentialsFromDockerConfig(registry string) (user, pass string, err error) {
+	dockerConfigOnce.Do(func() {
+		dockerConfig, dockerConfigErr = LoadDockerConfig(defaultDockerConfigPath())
+	})
+	if dockerConfigErr != nil {
+		return "", "", dockerConfigErr
+	}
+	return dockerConfig.GetCredentials(registry)
+}
+
+// from `https://index.docker.io/v1/` to `index.docker.io`, the keys of the
+// configuration file may or may not have the scheme and the path
+func normalizeRegistryHost(registry string) string {
+	if i := strings.Index(registry, "://"); i >= 0 {
+		registry = registry[i+3:]
+	}
+	return da.NormalizeRegistry(strings.SplitN(registry, "/", 2)[0])
+}
+
+// resolve the credentials for the registry, first from the credential helper
+// specific for the registry, then from the inline auths and finally from the
+// default credentials store
+func (c *DockerConfig) GetCredentials(registry string) (user, pass string, err error) {
+	host := normalizeRegistryHost(registry)
+
+	for key, helper := range c.CredHelpers {
+		if normalizeRegistryHost(key) == host {
+			return credentialsFromHelper(helper, key)
+		}
+	}
+
+	for key, auth := range c.Auths {
+		if normalizeRegistryHost(key) != host {
+			continue
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return "", "", fmt.Errorf("Impossible to decode the auth field for %s: %s", key, err)
+			}
+			splitted := strings.SplitN(string(decoded), ":", 2)
+			if len(splitted) != 2 {
+				return "", "", fmt.Errorf("Wrong format of the auth field for %s, expected user:password", key)
+			}
+			return splitted[0], splitted[1], nil
+		}
+		if auth.Username != "" {
+			return auth.Username, auth.Password, nil
+		}
+		if c.CredsStore != "" {
+			return credentialsFromHelper(c.CredsStore, key)
+		}
+	}
+
+	if c.CredsStore != "" {
+		return credentialsFromHelper(c.CredsStore, registry)
+	}
+	return "", "", fmt.Errorf("No credentials for %s in the docker configuration", registry)
+}
+
+// invoke `docker-credential-$helper get` passing the server on stdin
+func credentialsFromHelper(helper, server string) (user, pass string, err error) {
+	command := "docker-credential-" + helper
+	input := ioutil.NopCloser(bytes.NewBufferString(server))
+	err, stdout, stderr := ExecCommand(command, "get").StdIn(input).StartWithOutput()
+	if err != nil {
+		LogE(err).WithFields(log.Fields{"helper": command, "server": server, "stderr": stderr.String()}).
+			Warning("Error in getting the credentials from the helper")
+		return "", "", err
+	}
+	var credentials struct {
+		Username string
+		Secret   string
+	}
+	err = json.Unmarshal(stdout.Bytes(), &credentials)
+	if err != nil {
+		return "", "", fmt.Errorf("Impossible to parse the output of %s: %s", command, err)
+	}
+	return credentials.Username, credentials.Secret, nil
+}
+
+// credentials to use against the registry of the image, the password from
+// $DUCC_DOCKER_REGISTRY_PASS, together with the user of the image, has the
+// precedence, otherwise we look into the docker configuration file
+func (img *Image) getCredentials() (user, pass string, err error) {
+	pass, err = GetPassword()
+	if err == nil {
+		return img.User, pass, nil
+	}
+	user, pass, errConfig := CredentialsFromDockerConfig(img.Registry)
+	if errConfig == nil {
+		return user, pass, nil
+	}
+	return "", "", err
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeDockerConfig(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Error in writing the docker config: %s", err)
+	}
+	return path
+}
+
+func TestDockerConfigInlineAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker_config")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pa:ss"))
+	path := writeDockerConfig(t, dir, `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+auth+`"},
+		"gitlab-registry.cern.ch": {"username": "foo", "password": "bar"}
+	}}`)
+	config, err := LoadDockerConfig(path)
+	if err != nil {
+		t.Fatalf("Error in loading the docker config: %s", err)
+	}
+
+	user, pass, err := config.GetCredentials("registry.hub.docker.com")
+	if err != nil || user != "user" || pass != "pa:ss" {
+		t.Errorf("Error in getting the docker hub credentials: %s %s %v", user, pass, err)
+	}
+	user, pass, err = config.GetCredentials("gitlab-registry.cern.ch")
+	if err != nil || user != "foo" || pass != "bar" {
+		t.Errorf("Error in getting the gitlab credentials: %s %s %v", user, pass, err)
+	}
+	if _, _, err = config.GetCredentials("quay.io"); err == nil {
+		t.Errorf("Error, got credentials for a registry not in the config")
+	}
+}
+
+func TestDockerConfigCredentialHelper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker_config")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	helper := "#!/bin/sh\nread server\necho \"{\\\"Username\\\": \\\"helper\\\", \\\"Secret\\\": \\\"$server\\\"}\"\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(helper), 0755); err != nil {
+		t.Fatalf("Error in writing the credential helper: %s", err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	path := writeDockerConfig(t, dir, `{"credHelpers": {"quay.io": "test"}}`)
+	config, err := LoadDockerConfig(path)
+	if err != nil {
+		t.Fatalf("Error in loading the docker config: %s", err)
+	}
+	user, pass, err := config.GetCredentials("quay.io")
+	if err != nil || user != "helper" || pass != "quay.io" {
+		t.Errorf("Error in getting the credentials from the helper: %s %s %v", user, pass, err)
+	}
+}
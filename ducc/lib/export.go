@@ -0,0 +1,266 @@
+package lib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+	opaqueXattr    = "trusted.overlay.opaque"
+)
+
+// export the content of a subpath of the repository as a layer tar
+// CVMFSRepo: just the name of the repository (ex: unpacked.cern.ch)
+// subpath: the path inside the repository, without the prefix (ex: .layers/ab/abcd/layerfs)
+// w: where to write the tar stream
+// compress: if true the tar stream is gzip compressed, as the layers in the registries
+// overlay whiteouts (character devices 0/0) and opaque directories (trusted.overlay.opaque xattr)
+// are converted back into the `.wh.` entries used in the layer tars
+func ExportPathAsTar(CVMFSRepo, subpath string, w io.Writer, compress bool) error {
+	root := filepath.Join(repositoryRoot(CVMFSRepo), subpath)
+	return exportDirectoryAsTar(root, w, compress)
+}
+
+func exportDirectoryAsTar(root string, w io.Writer, compress bool) (err error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "export directory as tar", "directory": root})
+	}
+	stat, err := os.Stat(root)
+	if err != nil {
+		llog(LogE(err)).Error("Impossible to stat the directory to export")
+		return err
+	}
+	if !stat.IsDir() {
+		err = fmt.Errorf("Trying to export something different from a directory")
+		llog(LogE(err)).Error("Error, input is not a directory")
+		return err
+	}
+
+	if compress {
+		gzipWriter := gzip.NewWriter(w)
+		defer func() {
+			errClose := gzipWriter.Close()
+			if err == nil {
+				err = errClose
+			}
+		}()
+		w = gzipWriter
+	}
+	tarWriter := tar.NewWriter(w)
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root || isCatalogMarker(info) {
+			return nil
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		return writeTarEntry(tarWriter, path, name, info, true)
+	})
+	if err != nil {
+		llog(LogE(err)).Error("Error in exporting the directory")
+		return err
+	}
+	return tarWriter.Close()
+}
+
+// if markers is false the opaque directories are written as normal directories
+func writeTarEntry(tarWriter *tar.Writer, path, name string, info os.FileInfo, markers bool) error {
+	if isOverlayWhiteout(info) {
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.Join(filepath.Dir(name), whiteoutPrefix+info.Name()),
+			Mode:     0644,
+			ModTime:  info.ModTime(),
+		}
+		return tarWriter.WriteHeader(header)
+	}
+
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(path)
+		if err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name = name + "/"
+	}
+	if err = tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		if markers && isOverlayOpaque(path) {
+			opaque := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     filepath.Join(name, whiteoutOpaque),
+				Mode:     0644,
+				ModTime:  info.ModTime(),
+			}
+			return tarWriter.WriteHeader(opaque)
+		}
+		return nil
+	}
+
+	if info.Mode().IsRegular() {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tarWriter, file)
+		return err
+	}
+	return nil
+}
+
+// ExportFlattenedLayersAsTar exports the layers of an image as a single tar, applying
+// the whiteouts instead of exporting them, so that the result can be consumed
+// by clients that do not understand the overlay, nor the `.wh.`, markers
+// CVMFSRepo: just the name of the repository (ex: unpacked.cern.ch)
+// layerDigests: the digests of the layers, without the sha256: prefix, from
+// the lowest to the topmost, as in the manifest
+func ExportFlattenedLayersAsTar(CVMFSRepo string, layerDigests []string, w io.Writer, compress bool) error {
+	roots := make([]string, 0, len(layerDigests))
+	for _, digest := range layerDigests {
+		roots = append(roots, LayerRootfsPath(CVMFSRepo, digest))
+	}
+	return flattenDirectoriesAsTar(roots, w, compress)
+}
+
+// roots goes from the lowest to the topmost layer, we walk them from the top,
+// each path is exported only from the topmost layer that contains it, and
+// the whiteouts and the opaque directories of a layer hide the paths of the
+// layers below
+func flattenDirectoriesAsTar(roots []string, w io.Writer, compress bool) (err error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "flatten directories as tar", "layers": len(roots)})
+	}
+	if compress {
+		gzipWriter := gzip.NewWriter(w)
+		defer func() {
+			errClose := gzipWriter.Close()
+			if err == nil {
+				err = errClose
+			}
+		}()
+		w = gzipWriter
+	}
+	tarWriter := tar.NewWriter(w)
+
+	// paths already exported
+	exported := make(map[string]bool)
+	// paths hidden, together with their content, to the lower layers
+	hidden := make(map[string]bool)
+	isHidden := func(name string) bool {
+		for ; name != "." && name != "/"; name = filepath.Dir(name) {
+			if hidden[name] {
+				return true
+			}
+		}
+		return false
+	}
+
+	for i := len(roots) - 1; i >= 0; i-- {
+		root := roots[i]
+		// what this layer hides applies only to the layers below
+		hiddenByLayer := make(map[string]bool)
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if path == root || isCatalogMarker(info) {
+				return nil
+			}
+			name, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if isHidden(name) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			base := filepath.Base(name)
+			switch {
+			case base == whiteoutOpaque:
+				hiddenByLayer[filepath.Dir(name)] = true
+				return nil
+			case strings.HasPrefix(base, whiteoutPrefix):
+				hiddenByLayer[filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, whiteoutPrefix))] = true
+				return nil
+			case isOverlayWhiteout(info):
+				hiddenByLayer[name] = true
+				return nil
+			}
+
+			if !info.IsDir() || isOverlayOpaque(path) {
+				hiddenByLayer[name] = true
+			}
+			if exported[name] {
+				return nil
+			}
+			exported[name] = true
+			return writeTarEntry(tarWriter, path, name, info, false)
+		})
+		if err != nil {
+			llog(LogE(err)).WithFields(log.Fields{"layer": root}).Error("Error in flattening the layer")
+			return err
+		}
+		for name := range hiddenByLayer {
+			hidden[name] = true
+		}
+	}
+	return tarWriter.Close()
+}
+
+// the nested catalogs created in the layers are not part of the images
+func isCatalogMarker(info os.FileInfo) bool {
+	return info.Name() == catalogMarker && info.Mode().IsRegular()
+}
+
+// overlay represents a deleted file with a character device with 0/0 as device number
+func isOverlayWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return stat.Rdev == 0
+}
+
+// overlay represents an opaque directory with the trusted.overlay.opaque xattr set to `y`
+func isOverlayOpaque(path string) bool {
+	value := make([]byte, 1)
+	n, err := unix.Lgetxattr(path, opaqueXattr, value)
+	if err != nil || n != 1 {
+		return false
+	}
+	return value[0] == 'y'
+}
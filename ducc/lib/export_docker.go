@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+// an entry of the manifest.json of a `docker save` archive
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// ExportDockerImage writes into w an archive in the `docker save` format
+// (manifest.json, configuration and one tar for each layer) that can be
+// imported with `docker load`.
+// The layers are re-created from the layerfs directories of the repository,
+// converting the overlay whiteouts back into `.wh.` entries, so their digests
+// differ from the original ones. The repository does not store the original
+// configuration, the platform is taken from source, the configuration of the
+// image as downloaded with GetImageConfig, while the rest of the configuration
+// written only describes the layers, so the image does not carry env, cmd and
+// the like.
+// CVMFSRepo: just the name of the repository (ex: unpacked.cern.ch)
+func ExportDockerImage(CVMFSRepo string, manifest da.Manifest, source ImageConfig, w io.Writer) error {
+	roots := make([]string, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		roots = append(roots, LayerRootfsPath(CVMFSRepo, strings.TrimPrefix(layer.Digest, "sha256:")))
+	}
+	return exportDockerImage(roots, source, w)
+}
+
+func exportDockerImage(layerRoots []string, source ImageConfig, w io.Writer) (err error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "export docker image", "layers": len(layerRoots)})
+	}
+	tarWriter := tar.NewWriter(w)
+	now := time.Now()
+	writeFile := func(name string, size int64, content io.Reader) error {
+		header := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size, ModTime: now}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := io.Copy(tarWriter, content)
+		return err
+	}
+
+	if source.Architecture == "" || source.OS == "" {
+		err = fmt.Errorf("Missing the platform in the configuration of the image, architecture: %q os: %q",
+			source.Architecture, source.OS)
+		llog(LogE(err)).Error("Impossible to export the image")
+		return err
+	}
+	config := ImageConfig{Architecture: source.Architecture, OS: source.OS, Variant: source.Variant}
+	config.RootFS.Type = "layers"
+	saveManifest := dockerSaveManifest{RepoTags: []string{}}
+	for _, root := range layerRoots {
+		layerTar, size, diffID, err := stageLayerTar(root)
+		if err != nil {
+			llog(LogE(err)).WithFields(log.Fields{"layer": root}).Error("Error in exporting the layer")
+			return err
+		}
+		name := filepath.Join(diffID, "layer.tar")
+		err = writeFile(name, size, layerTar)
+		layerTar.Close()
+		if err != nil {
+			return err
+		}
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, "sha256:"+diffID)
+		saveManifest.Layers = append(saveManifest.Layers, name)
+	}
+
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	saveManifest.Config = fmt.Sprintf("%x.json", sha256.Sum256(configBytes))
+	if err = writeFile(saveManifest.Config, int64(len(configBytes)), bytes.NewReader(configBytes)); err != nil {
+		return err
+	}
+	manifestBytes, err := json.Marshal([]dockerSaveManifest{saveManifest})
+	if err != nil {
+		return err
+	}
+	if err = writeFile("manifest.json", int64(len(manifestBytes)), bytes.NewReader(manifestBytes)); err != nil {
+		return err
+	}
+	return tarWriter.Close()
+}
+
+// the size of an entry must be known before to write it into the archive, so
+// each layer is first exported into a temporary file, positioned at its
+// beginning, and hashed
+func stageLayerTar(root string) (layerTar TempFile, size int64, diffID string, err error) {
+	layerTar, err = TempFiles.CreateTemp("export_layer")
+	if err != nil {
+		return
+	}
+	hash := sha256.New()
+	err = exportDirectoryAsTar(root, io.MultiWriter(layerTar, hash), false)
+	if err == nil {
+		size, err = layerTar.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = layerTar.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		layerTar.Close()
+		return nil, 0, "", err
+	}
+	return layerTar, size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,256 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func readTarEntries(t *testing.T, r io.Reader) map[string]string {
+	entries := make(map[string]string)
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error in reading the tar: %s", err)
+		}
+		content, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			t.Fatalf("Error in reading the tar entry %s: %s", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeSymlink {
+			content = []byte(header.Linkname)
+		}
+		entries[header.Name] = string(content)
+	}
+	return entries
+}
+
+func TestExportDirectoryAsTar(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_export")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "etc", "empty"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "etc", "os-release"), []byte("ID=test"), 0644)
+	os.Symlink("os-release", filepath.Join(root, "etc", "release"))
+	// the markers of the nested catalogs are not exported
+	ioutil.WriteFile(filepath.Join(root, ".cvmfscatalog"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(root, "etc", ".cvmfscatalog"), []byte{}, 0644)
+
+	var buffer bytes.Buffer
+	err = exportDirectoryAsTar(root, &buffer, true)
+	if err != nil {
+		t.Fatalf("Error in exporting the directory: %s", err)
+	}
+	gzipReader, err := gzip.NewReader(&buffer)
+	if err != nil {
+		t.Fatalf("Exported tar is not compressed: %s", err)
+	}
+	entries := readTarEntries(t, gzipReader)
+
+	expected := map[string]string{
+		"etc/":           "",
+		"etc/empty/":     "",
+		"etc/os-release": "ID=test",
+		"etc/release":    "os-release",
+	}
+	for name, content := range expected {
+		got, ok := entries[name]
+		if !ok {
+			t.Errorf("Missing entry in the exported tar: %s", name)
+			continue
+		}
+		if got != content {
+			t.Errorf("Wrong content for %s: %s", name, got)
+		}
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("Expected %d entries, got %d", len(expected), len(entries))
+	}
+}
+
+func TestExportDirectoryAsTarWhiteouts(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_export")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "opaque"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "opaque", "file"), []byte("new"), 0644)
+	err = syscall.Mknod(filepath.Join(root, "deleted"), syscall.S_IFCHR|0000, 0)
+	if err != nil {
+		t.Skipf("Impossible to create overlay whiteouts: %s", err)
+	}
+	err = unix.Lsetxattr(filepath.Join(root, "opaque"), opaqueXattr, []byte("y"), 0)
+	if err != nil {
+		t.Skipf("Impossible to create overlay opaque directories: %s", err)
+	}
+
+	var buffer bytes.Buffer
+	err = exportDirectoryAsTar(root, &buffer, false)
+	if err != nil {
+		t.Fatalf("Error in exporting the directory: %s", err)
+	}
+	entries := readTarEntries(t, &buffer)
+
+	for _, name := range []string{".wh.deleted", "opaque/", "opaque/.wh..wh..opq", "opaque/file"} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("Missing entry in the exported tar: %s", name)
+		}
+	}
+	if _, ok := entries["deleted"]; ok {
+		t.Errorf("The whiteout device was exported as is")
+	}
+}
+
+func TestFlattenDirectoriesAsTar(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_flatten")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	lower := filepath.Join(dir, "lower")
+	upper := filepath.Join(dir, "upper")
+
+	os.MkdirAll(filepath.Join(lower, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(lower, "a", "deleted"), []byte("deleted"), 0644)
+	ioutil.WriteFile(filepath.Join(lower, "a", "kept"), []byte("kept"), 0644)
+	ioutil.WriteFile(filepath.Join(lower, "a", "replaced"), []byte("old"), 0644)
+	os.MkdirAll(filepath.Join(lower, "b"), 0755)
+	ioutil.WriteFile(filepath.Join(lower, "b", "inside"), []byte("inside"), 0644)
+	os.MkdirAll(filepath.Join(lower, "opaque"), 0755)
+	ioutil.WriteFile(filepath.Join(lower, "opaque", "lower"), []byte("lower"), 0644)
+
+	os.MkdirAll(filepath.Join(upper, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(upper, "a", ".wh.deleted"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(upper, "a", "replaced"), []byte("new"), 0644)
+	// a directory replaced by a file
+	ioutil.WriteFile(filepath.Join(upper, "b"), []byte("file"), 0644)
+	os.MkdirAll(filepath.Join(upper, "opaque"), 0755)
+	ioutil.WriteFile(filepath.Join(upper, "opaque", ".wh..wh..opq"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(upper, "opaque", "upper"), []byte("upper"), 0644)
+	// every layer has its own catalog markers, none of them is exported
+	ioutil.WriteFile(filepath.Join(lower, ".cvmfscatalog"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(lower, "a", ".cvmfscatalog"), []byte{}, 0644)
+	ioutil.WriteFile(filepath.Join(upper, ".cvmfscatalog"), []byte{}, 0644)
+
+	var buffer bytes.Buffer
+	if err = flattenDirectoriesAsTar([]string{lower, upper}, &buffer, false); err != nil {
+		t.Fatalf("Error in flattening the layers: %s", err)
+	}
+	entries := readTarEntries(t, &buffer)
+	expected := map[string]string{
+		"a/":           "",
+		"a/kept":       "kept",
+		"a/replaced":   "new",
+		"b":            "file",
+		"opaque/":      "",
+		"opaque/upper": "upper",
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("Error, expected entries %v, got %v", expected, entries)
+	}
+	for name, content := range expected {
+		if got, ok := entries[name]; !ok || got != content {
+			t.Errorf("Error in the flattened entry %s: %q (present: %v)", name, got, ok)
+		}
+	}
+}
+
+func TestFlattenDirectoriesAsTarOverlayWhiteout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_flatten")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	lower := filepath.Join(dir, "lower")
+	upper := filepath.Join(dir, "upper")
+	os.MkdirAll(lower, 0755)
+	os.MkdirAll(upper, 0755)
+	ioutil.WriteFile(filepath.Join(lower, "deleted"), []byte("deleted"), 0644)
+	if err = unix.Mknod(filepath.Join(upper, "deleted"), unix.S_IFCHR|0000, 0); err != nil {
+		t.Skipf("Impossible to create the overlay whiteout: %s", err)
+	}
+
+	var buffer bytes.Buffer
+	if err = flattenDirectoriesAsTar([]string{lower, upper}, &buffer, false); err != nil {
+		t.Fatalf("Error in flattening the layers: %s", err)
+	}
+	if entries := readTarEntries(t, &buffer); len(entries) != 0 {
+		t.Errorf("Error, overlay whiteout not applied: %v", entries)
+	}
+}
+
+func TestExportDockerImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_export_docker")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "base")
+	top := filepath.Join(dir, "top")
+	os.MkdirAll(filepath.Join(base, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(base, "etc", "passwd"), []byte("root"), 0644)
+	os.MkdirAll(filepath.Join(top, "app"), 0755)
+	ioutil.WriteFile(filepath.Join(top, "app", "run.sh"), []byte("#!/bin/sh"), 0755)
+
+	var archive bytes.Buffer
+	if err = exportDockerImage([]string{base, top}, ImageConfig{}, &archive); err == nil {
+		t.Errorf("Error, image exported without a platform")
+	}
+	archive.Reset()
+	source := ImageConfig{Architecture: "arm64", OS: "linux", Variant: "v8"}
+	if err = exportDockerImage([]string{base, top}, source, &archive); err != nil {
+		t.Fatalf("Error in exporting the image: %s", err)
+	}
+	entries := readTarEntries(t, &archive)
+
+	var manifests []dockerSaveManifest
+	if err = json.Unmarshal([]byte(entries["manifest.json"]), &manifests); err != nil || len(manifests) != 1 {
+		t.Fatalf("Error in the manifest.json of the archive: %v %s", err, entries["manifest.json"])
+	}
+	manifest := manifests[0]
+	if len(manifest.Layers) != 2 {
+		t.Fatalf("Error, expected 2 layers in the archive: %v", manifest.Layers)
+	}
+	var config ImageConfig
+	if err = json.Unmarshal([]byte(entries[manifest.Config]), &config); err != nil {
+		t.Fatalf("Error in the configuration %s: %v", manifest.Config, err)
+	}
+	if config.Architecture != "arm64" || config.OS != "linux" || config.Variant != "v8" {
+		t.Errorf("Error, platform not taken from the source image: %+v", config)
+	}
+	for i, layer := range manifest.Layers {
+		content, ok := entries[layer]
+		if !ok {
+			t.Errorf("Error, layer %s missing from the archive", layer)
+			continue
+		}
+		// docker load checks the diff_ids against the layer tars
+		if diffID := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content))); config.RootFS.DiffIDs[i] != diffID {
+			t.Errorf("Error, diff_id of layer %d does not match: %s %s", i, config.RootFS.DiffIDs[i], diffID)
+		}
+	}
+	if layer := readTarEntries(t, strings.NewReader(entries[manifest.Layers[1]])); layer["app/run.sh"] != "#!/bin/sh" {
+		t.Errorf("Error in the content of the top layer: %v", layer)
+	}
+}
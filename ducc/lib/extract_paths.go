@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ExtractPathsFromLayer unpacks in destDir only the entries of the layer tar
+// that are in wanted, or below a wanted directory, without extracting the
+// whole layer.
+// The wanted paths are relative to the root of the layer, with or without the
+// leading slash (ex: /etc/os-release, etc/yum.repos.d), the paths not present
+// in the layer are simply not extracted, since they may come from other layers.
+func ExtractPathsFromLayer(r io.Reader, wanted []string, destDir string) error {
+	wantedNames := make([]string, 0, len(wanted))
+	for _, w := range wanted {
+		name := cleanEntryName(w)
+		if name == "" || name == "." {
+			// the root of the layer, we want everything
+			return extractTar(r, destDir)
+		}
+		wantedNames = append(wantedNames, name)
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	// the hardlinks can only point to entries that we extracted
+	extraction := newTarExtraction(destDir)
+	defer extraction.logDuplicates()
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanEntryName(header.Name)
+		if !isWantedPath(name, wantedNames) {
+			continue
+		}
+		if header.Typeflag == tar.TypeLink && !extraction.extracted[cleanEntryName(header.Linkname)] {
+			Log().WithFields(log.Fields{"entry": name, "target": header.Linkname}).Warning("Skipping hardlink to an entry not extracted")
+			continue
+		}
+		if err = extraction.unpack(tarReader, header, name); err != nil {
+			return err
+		}
+	}
+}
+
+// either the path itself or one of its parent directories is wanted
+func isWantedPath(name string, wanted []string) bool {
+	for _, w := range wanted {
+		if name == w || strings.HasPrefix(name, w+"/") {
+			return true
+		}
+	}
+	return false
+}
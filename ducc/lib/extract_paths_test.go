@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestExtractPathsFromLayer(t *testing.T) {
+	dest, err := ioutil.TempDir("", "test_extract_paths")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dest)
+
+	layer := buildTestTar(t,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10},
+		&tar.Header{Name: "etc/yum.repos.d/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/yum.repos.d/base.repo", Typeflag: tar.TypeReg, Mode: 0644, Size: 3},
+		&tar.Header{Name: "etc/yum.repos.d/epel.repo", Typeflag: tar.TypeLink, Linkname: "etc/yum.repos.d/base.repo"},
+		&tar.Header{Name: "etc/yum.repos.d.bak", Typeflag: tar.TypeReg, Mode: 0644, Size: 3},
+		&tar.Header{Name: "etc/os-release.link", Typeflag: tar.TypeLink, Linkname: "etc/passwd"},
+		&tar.Header{Name: "usr/bin/bash", Typeflag: tar.TypeReg, Mode: 0755, Size: 100},
+	)
+	err = ExtractPathsFromLayer(layer, []string{"/etc/os-release", "etc/yum.repos.d/", "/missing"}, dest)
+	if err != nil {
+		t.Fatalf("Error in extracting the paths from the layer: %s", err)
+	}
+
+	var extracted []string
+	filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			extracted = append(extracted, strings.TrimPrefix(path, dest+"/"))
+		}
+		return nil
+	})
+	sort.Strings(extracted)
+	expected := []string{"etc/os-release", "etc/yum.repos.d/base.repo", "etc/yum.repos.d/epel.repo"}
+	if strings.Join(extracted, ",") != strings.Join(expected, ",") {
+		t.Errorf("Error, expected the files %v, got %v", expected, extracted)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dest, "etc", "os-release")); string(content) != "aaaaa" {
+		t.Errorf("Error in the content of the extracted file: %q", content)
+	}
+}
+
+func TestExtractPathsBelowSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_extract_paths")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dest := filepath.Join(dir, "dest")
+	outside := filepath.Join(dir, "outside")
+	os.MkdirAll(outside, 0755)
+	ioutil.WriteFile(filepath.Join(outside, "passwd"), []byte("root"), 0644)
+
+	layers := map[string][]*tar.Header{
+		"file": {
+			&tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: outside},
+			&tar.Header{Name: "etc/os-release", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		},
+		"directory": {
+			&tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "../outside"},
+			&tar.Header{Name: "etc/yum.repos.d/base.repo", Typeflag: tar.TypeReg, Mode: 0644, Size: 3},
+		},
+		"hardlink": {
+			&tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: outside},
+			&tar.Header{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "etc/passwd"},
+		},
+	}
+	for name, headers := range layers {
+		os.RemoveAll(dest)
+		if err = extractTar(buildTestTar(t, headers...), dest); err == nil {
+			t.Errorf("Error, %s below a symlink extracted", name)
+		}
+		// the target of the hardlink is not extracted, so the hardlink is
+		// skipped
+		err = ExtractPathsFromLayer(buildTestTar(t, headers...), []string{"etc", "passwd"}, dest)
+		if err == nil && name != "hardlink" {
+			t.Errorf("Error, %s below a symlink extracted from the wanted paths", name)
+		}
+		entries, _ := ioutil.ReadDir(outside)
+		if len(entries) != 1 {
+			t.Errorf("Error, %s written outside of the destination: %v", name, entries)
+		}
+		if content, _ := ioutil.ReadFile(filepath.Join(outside, "passwd")); string(content) != "root" {
+			t.Errorf("Error, %s overwrote a file outside of the destination: %q", name, content)
+		}
+	}
+}
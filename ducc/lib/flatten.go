@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// an entry of the flattened image, the content of the regular files is kept
+// in a temporary file, at offset
+type flattenedEntry struct {
+	header *tar.Header
+	offset int64
+}
+
+// FlattenLayersToTar merges the (uncompressed) tar layers, from the lowest to
+// the topmost as in the manifest, into a single tar written into w.
+// The whiteouts (`.wh.` entries) and the opaque directories (`.wh..wh..opq`)
+// of a layer remove the files of the layers below and are not written in the
+// output, they are recognized by DefaultWhiteoutHandler. The content of the
+// files is staged in TempFiles.
+func FlattenLayersToTar(layers []io.Reader, w io.Writer) error {
+	return flattenLayersToTar(layers, w, DefaultWhiteoutHandler)
+}
+
+func flattenLayersToTar(layers []io.Reader, w io.Writer, whiteouts WhiteoutHandler) error {
+	content, err := TempFiles.CreateTemp("flatten")
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	var size int64
+
+	entries := make(map[string]*flattenedEntry)
+	// the names directly inside each directory, so that a subtree is removed
+	// without looking at all the entries, the directories without an entry
+	// of their own are indexed as well
+	children := make(map[string]map[string]bool)
+	index := func(name string) {
+		for name != "." {
+			parent := filepath.Dir(name)
+			if children[parent] == nil {
+				children[parent] = make(map[string]bool)
+			}
+			if children[parent][name] {
+				return
+			}
+			children[parent][name] = true
+			name = parent
+		}
+	}
+	// drop from the index a name without an entry nor children
+	prune := func(name string) {
+		if _, ok := entries[name]; !ok && len(children[name]) == 0 {
+			delete(children, name)
+			delete(children[filepath.Dir(name)], name)
+		}
+	}
+	// remove everything below dir, except the entries of the current layer
+	var removeChildren func(dir string, current map[string]bool)
+	removeChildren = func(dir string, current map[string]bool) {
+		for child := range children[dir] {
+			removeChildren(child, current)
+			if !current[child] {
+				delete(entries, child)
+			}
+			prune(child)
+		}
+	}
+	remove := func(name string, current map[string]bool) {
+		if !current[name] {
+			delete(entries, name)
+		}
+		removeChildren(name, current)
+		prune(name)
+	}
+
+	for _, layer := range layers {
+		current := make(map[string]bool)
+		tarReader := tar.NewReader(layer)
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			name := cleanEntryName(header.Name)
+			if name == "" {
+				continue
+			}
+			if whiteouts.IsWhiteout(name, header) {
+				if path, opaque := whiteouts.Apply(name, header); opaque {
+					removeChildren(path, current)
+				} else {
+					remove(path, current)
+				}
+				continue
+			}
+
+			if header.Typeflag != tar.TypeDir {
+				// a file, or a link, replaces the whole subtree
+				remove(name, current)
+			}
+			entry := &flattenedEntry{header: header, offset: size}
+			if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+				n, err := io.Copy(content, tarReader)
+				if err != nil {
+					return err
+				}
+				size += n
+			}
+			header.Name = name
+			entries[name] = entry
+			index(name)
+			current[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	// the parents come before their content
+	sort.Strings(names)
+
+	tarWriter := tar.NewWriter(w)
+	written := make(map[string]bool)
+	// the hardlinks waiting for their target to be written, by target
+	pending := make(map[string][]string)
+	var write func(name string) error
+	write = func(name string) error {
+		entry := entries[name]
+		header := entry.header
+		if header.Typeflag == tar.TypeDir {
+			header.Name = name + "/"
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+			if _, err := content.Seek(entry.offset, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(tarWriter, content, header.Size); err != nil {
+				return err
+			}
+		}
+		written[name] = true
+		links := pending[name]
+		delete(pending, name)
+		for _, link := range links {
+			if err := write(link); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, name := range names {
+		header := entries[name].header
+		if header.Typeflag == tar.TypeLink {
+			header.Linkname = cleanEntryName(header.Linkname)
+			if _, ok := entries[header.Linkname]; !ok {
+				Log().WithFields(log.Fields{"entry": name}).Warning("Skipping hardlink to a file removed by an upper layer")
+				continue
+			}
+			// a hardlink can only refer to an entry already in the tar
+			if !written[header.Linkname] {
+				pending[header.Linkname] = append(pending[header.Linkname], name)
+				continue
+			}
+		}
+		if err = write(name); err != nil {
+			return err
+		}
+	}
+	for target, links := range pending {
+		Log().WithFields(log.Fields{"entries": links, "target": target}).Warning("Skipping hardlinks to an entry not written")
+	}
+	return tarWriter.Close()
+}
+
+// from `./usr/bin/` to `usr/bin`
+func cleanEntryName(name string) string {
+	name = filepath.Clean("/" + name)
+	return strings.TrimPrefix(name, "/")
+}
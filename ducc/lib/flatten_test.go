@@ -0,0 +1,155 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFlattenLayersToTar(t *testing.T) {
+	file := func(name, content string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content)), Linkname: content}
+	}
+	dir := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+	}
+	// the content of the files is passed in Linkname, and written by buildLayer
+	buildLayer := func(headers ...*tar.Header) io.Reader {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, header := range headers {
+			content := ""
+			if header.Typeflag == tar.TypeReg {
+				content = header.Linkname
+				header.Linkname = ""
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				t.Fatalf("Error in writing the header: %s", err)
+			}
+			tw.Write([]byte(content))
+		}
+		tw.Close()
+		return &buf
+	}
+
+	lower := buildLayer(
+		dir("./etc/"),
+		file("./etc/passwd", "root"),
+		file("./etc/shadow", "secret"),
+		dir("./opt/"),
+		file("./opt/old", "old"),
+		dir("./var/"),
+		file("./var/log", "log"),
+	)
+	upper := buildLayer(
+		file("etc/.wh.shadow", ""),
+		file("etc/passwd", "root,user"),
+		dir("opt/"),
+		file("opt/.wh..wh..opq", ""),
+		file("opt/new", "new"),
+		// a directory replaced by a file
+		file("var", "file"),
+	)
+
+	var out bytes.Buffer
+	if err := FlattenLayersToTar([]io.Reader{lower, upper}, &out); err != nil {
+		t.Fatalf("Error in flattening the layers: %s", err)
+	}
+	entries := readTarEntries(t, &out)
+	expected := map[string]string{
+		"etc/":       "",
+		"etc/passwd": "root,user",
+		"opt/":       "",
+		"opt/new":    "new",
+		"var":        "file",
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("Error, expected entries %v, got %v", expected, entries)
+	}
+	for name, content := range expected {
+		if got, ok := entries[name]; !ok || got != content {
+			t.Errorf("Error in the flattened entry %s: %q (present: %v)", name, got, ok)
+		}
+	}
+}
+
+// the overlay convention: a character device 0/0 in place of the removed path
+type overlayDeviceWhiteouts struct{}
+
+func (overlayDeviceWhiteouts) IsWhiteout(name string, header *tar.Header) bool {
+	return header.Typeflag == tar.TypeChar && header.Devmajor == 0 && header.Devminor == 0
+}
+
+func (overlayDeviceWhiteouts) Apply(name string, header *tar.Header) (string, bool) {
+	return name, false
+}
+
+func TestFlattenLayersToTarCustomWhiteouts(t *testing.T) {
+	lower := buildTestTar(t,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+		&tar.Header{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0644, Size: 6},
+	)
+	upper := buildTestTar(t,
+		&tar.Header{Name: "etc/shadow", Typeflag: tar.TypeChar, Mode: 0},
+		// not a whiteout for this handler
+		&tar.Header{Name: "etc/.wh.passwd", Typeflag: tar.TypeReg, Mode: 0644},
+	)
+	var out bytes.Buffer
+	if err := flattenLayersToTar([]io.Reader{lower, upper}, &out, overlayDeviceWhiteouts{}); err != nil {
+		t.Fatalf("Error in flattening the layers: %s", err)
+	}
+	entries := readTarEntries(t, &out)
+	for _, name := range []string{"etc/", "etc/passwd", "etc/.wh.passwd"} {
+		if _, ok := entries[name]; !ok {
+			t.Errorf("Error, missing entry %s from the flattened tar: %v", name, entries)
+		}
+	}
+	if _, ok := entries["etc/shadow"]; ok || len(entries) != 3 {
+		t.Errorf("Error, the custom whiteout was not applied: %v", entries)
+	}
+}
+
+func TestFlattenLayersToTarHardlinksAndSubtrees(t *testing.T) {
+	buildLayer := func(headers ...*tar.Header) io.Reader {
+		return buildTestTar(t, headers...)
+	}
+	lower := buildLayer(
+		&tar.Header{Name: "z/target", Typeflag: tar.TypeReg, Mode: 0644, Size: 3},
+		// no entries for the directories
+		&tar.Header{Name: "x/y/z/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		&tar.Header{Name: "o/p/old", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+	)
+	upper := buildLayer(
+		// the target is in the lower layer, but sorts after the link
+		&tar.Header{Name: "a/link", Typeflag: tar.TypeLink, Linkname: "z/target"},
+		&tar.Header{Name: ".wh.x", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "o/p/new", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		&tar.Header{Name: "o/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644},
+	)
+
+	var out bytes.Buffer
+	if err := FlattenLayersToTar([]io.Reader{lower, upper}, &out); err != nil {
+		t.Fatalf("Error in flattening the layers: %s", err)
+	}
+	var names []string
+	tarReader := tar.NewReader(&out)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error in reading the flattened tar: %s", err)
+		}
+		names = append(names, header.Name)
+	}
+	// the hardlink comes after its target, the whiteout removes the whole
+	// subtree, and the opaque directory keeps only the entries of its layer
+	expected := "o/p/new z/target a/link"
+	if got := strings.Join(names, " "); got != expected {
+		t.Errorf("Error in the flattened entries, expected %q got %q", expected, got)
+	}
+}
@@ -2,10 +2,13 @@ package lib
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -13,7 +16,7 @@ import (
 )
 
 func FindAllUsedFlatImages(CVMFSRepo string) ([]string, error) {
-	root := filepath.Join("/", "cvmfs", CVMFSRepo)
+	root := repositoryRoot(CVMFSRepo)
 	root_components := strings.Split(root, string(os.PathSeparator))
 	result := make([]string, 0)
 	walker := func(path string, info os.FileInfo, err error) error {
@@ -53,7 +56,7 @@ func FindAllUsedFlatImages(CVMFSRepo string) ([]string, error) {
 }
 
 func FindAllFlatImages(CVMFSRepo string) ([]string, error) {
-	root := filepath.Join("/", "cvmfs", CVMFSRepo, ".flat")
+	root := filepath.Join(repositoryRoot(CVMFSRepo), ".flat")
 	root_components := strings.Split(root, string(os.PathSeparator))
 	result := make([]string, 0)
 	walker := func(path string, info os.FileInfo, err error) error {
@@ -80,7 +83,7 @@ func FindAllFlatImages(CVMFSRepo string) ([]string, error) {
 }
 
 func FindAllLayers(CVMFSRepo string) ([]string, error) {
-	root := filepath.Join("/", "cvmfs", CVMFSRepo, ".layers")
+	root := filepath.Join(repositoryRoot(CVMFSRepo), ".layers")
 	root_components := strings.Split(root, string(os.PathSeparator))
 	result := make([]string, 0)
 	walker := func(path string, info os.FileInfo, err error) error {
@@ -107,7 +110,7 @@ func FindAllLayers(CVMFSRepo string) ([]string, error) {
 }
 
 func FindAllUsedLayers(CVMFSRepo string) ([]string, error) {
-	root := filepath.Join("/", "cvmfs", CVMFSRepo, ".metadata")
+	root := filepath.Join(repositoryRoot(CVMFSRepo), ".metadata")
 	result := make([]string, 0)
 	walker := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -126,7 +129,7 @@ func FindAllUsedLayers(CVMFSRepo string) ([]string, error) {
 			}
 			for _, layerStruct := range manifest.Layers {
 				layer := strings.Split(layerStruct.Digest, ":")[1]
-				layerPath := filepath.Join("/", "cvmfs", CVMFSRepo, ".layers", layer[0:2], layer)
+				layerPath := filepath.Join(repositoryRoot(CVMFSRepo), ".layers", layer[0:2], layer)
 				result = append(result, layerPath)
 			}
 			return filepath.SkipDir
@@ -138,7 +141,10 @@ func FindAllUsedLayers(CVMFSRepo string) ([]string, error) {
 }
 
 func FindImageToGarbageCollect(CVMFSRepo string) ([]da.Manifest, error) {
-	removeSchedulePath := RemoveScheduleLocation(CVMFSRepo)
+	return readRemoveSchedule(RemoveScheduleLocation(CVMFSRepo))
+}
+
+func readRemoveSchedule(removeSchedulePath string) ([]da.Manifest, error) {
 	llog := func(l *log.Entry) *log.Entry {
 		return l.WithFields(log.Fields{
 			"action": "find image to garbage collect in schedule file",
@@ -147,32 +153,15 @@ func FindImageToGarbageCollect(CVMFSRepo string) ([]da.Manifest, error) {
 
 	var schedule []da.Manifest
 
-	_, err := os.Stat(removeSchedulePath)
-	if os.IsNotExist(err) {
+	if !metadataFileExists(removeSchedulePath) {
 		return schedule, nil
 	}
-	if err != nil {
-		llog(LogE(err)).Error("Error in stating the schedule file")
-		return schedule, err
-	}
-	scheduleFileRO, err := os.Open(removeSchedulePath)
-	if err != nil {
-		llog(LogE(err)).Error("Error in opening the schedule file")
-		return schedule, err
-	}
-
-	scheduleBytes, err := ioutil.ReadAll(scheduleFileRO)
+	scheduleBytes, err := readMetadataFile(removeSchedulePath)
 	if err != nil {
 		llog(LogE(err)).Error("Impossible to read the schedule file")
 		return schedule, err
 	}
 
-	err = scheduleFileRO.Close()
-	if err != nil {
-		llog(LogE(err)).Error("Impossible to close the schedule file")
-		return schedule, err
-	}
-
 	err = json.Unmarshal(scheduleBytes, &schedule)
 	if err != nil {
 		llog(LogE(err)).Error("Impossible to unmarshal the schedule file")
@@ -182,9 +171,91 @@ func FindImageToGarbageCollect(CVMFSRepo string) ([]da.Manifest, error) {
 	return schedule, nil
 }
 
+// a manifest in the remove schedule of a repository
+type ScheduledRemoval struct {
+	Repository string
+	Manifest   da.Manifest
+}
+
+// CollectRemoveSchedules reads the remove schedules of all the repositories
+// and returns the pending removals, each attributed to its repository, sorted
+// by repository and by image.
+// A manifest scheduled in several repositories is returned once for each of
+// them. The repositories whose schedule can not be read are skipped, and
+// their errors returned indexed by repository.
+func CollectRemoveSchedules(CVMFSRepos []string) ([]ScheduledRemoval, map[string]error) {
+	return collectRemoveSchedules(RemoveScheduleLocation, CVMFSRepos)
+}
+
+func collectRemoveSchedules(location func(CVMFSRepo string) string, CVMFSRepos []string) ([]ScheduledRemoval, map[string]error) {
+	removals := make([]ScheduledRemoval, 0)
+	errs := make(map[string]error)
+	for _, repo := range dedupStrings(CVMFSRepos) {
+		schedule, err := readRemoveSchedule(location(repo))
+		if err != nil {
+			errs[repo] = err
+			continue
+		}
+		for _, manifest := range schedule {
+			removals = append(removals, ScheduledRemoval{Repository: repo, Manifest: manifest})
+		}
+	}
+	sort.SliceStable(removals, func(i, j int) bool {
+		if removals[i].Repository != removals[j].Repository {
+			return removals[i].Repository < removals[j].Repository
+		}
+		return removals[i].Manifest.Config.Digest < removals[j].Manifest.Config.Digest
+	})
+	return removals, errs
+}
+
+// ExecuteRemoveSchedules garbage collects the layers of the removals,
+// repository by repository. After the first failure in a repository its
+// other removals are skipped, while the other repositories go on, the errors
+// are returned indexed by repository.
+// The schedule files are not rewritten, the layers already removed are
+// simply skipped if the removals are executed again.
+func ExecuteRemoveSchedules(removals []ScheduledRemoval) map[string]error {
+	return executeRemovals(removals, garbageCollectManifest)
+}
+
+func executeRemovals(removals []ScheduledRemoval, collect func(CVMFSRepo string, manifest da.Manifest) error) map[string]error {
+	errs := make(map[string]error)
+	for _, removal := range removals {
+		if errs[removal.Repository] != nil {
+			continue
+		}
+		if err := collect(removal.Repository, removal.Manifest); err != nil {
+			LogE(err).WithFields(log.Fields{"repo": removal.Repository, "image": removal.Manifest.Config.Digest}).
+				Error("Error in executing the scheduled removal, skipping the rest of the repository")
+			errs[removal.Repository] = err
+		}
+	}
+	return errs
+}
+
+// drop the image from the backlinks of its layers, the layers not used by
+// any other image are removed
+func garbageCollectManifest(CVMFSRepo string, manifest da.Manifest) error {
+	image := strings.TrimPrefix(manifest.Config.Digest, "sha256:")
+	for _, layer := range manifest.Layers {
+		digest := strings.TrimPrefix(layer.Digest, "sha256:")
+		if _, err := os.Stat(LayerPath(CVMFSRepo, digest)); os.IsNotExist(err) {
+			continue
+		}
+		if err := GarbageCollectSingleLayer(CVMFSRepo, image, digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // with image and layer we pass the digest of the layer and the digest of the image,
 // both without the sha256: prefix
 func GarbageCollectSingleLayer(CVMFSRepo, image, layer string) error {
+	// the backlink is rewritten, see saveLayersBacklink
+	unlock := lockRepository(CVMFSRepo)
+	defer unlock()
 	backlink, err := getBacklinkFromLayer(CVMFSRepo, layer)
 	llog := func(l *log.Entry) *log.Entry {
 		return l.WithFields(log.Fields{"action": "garbage collect layer",
@@ -213,7 +284,7 @@ func GarbageCollectSingleLayer(CVMFSRepo, image, layer string) error {
 
 		backlinkPath := getBacklinkPath(CVMFSRepo, layer)
 
-		err = ExecCommand("cvmfs_server", "transaction", CVMFSRepo).Start()
+		err = currentPublisher().Transaction(CVMFSRepo)
 		if err != nil {
 			llog(LogE(err)).Error("Error in opening the transaction")
 			return err
@@ -229,14 +300,14 @@ func GarbageCollectSingleLayer(CVMFSRepo, image, layer string) error {
 			}
 		}
 
-		err = ioutil.WriteFile(backlinkPath, backLinkMarshall, 0666)
+		err = writeMetadataFile(backlinkPath, backLinkMarshall, 0666)
 		if err != nil {
 			llog(LogE(err)).WithFields(log.Fields{"file": backlinkPath}).Error(
 				"Error in writing the backlink file, skipping...")
 			return err
 		}
 
-		err = ExecCommand("cvmfs_server", "publish", CVMFSRepo).Start()
+		err = currentPublisher().Publish(CVMFSRepo)
 		if err != nil {
 			llog(LogE(err)).Error("Error in publishing after adding the backlinks")
 			return err
@@ -251,3 +322,250 @@ func GarbageCollectSingleLayer(CVMFSRepo, image, layer string) error {
 		return err
 	}
 }
+
+// walk the .metadata directory of the repository and return the manifests of
+// all the images converted, indexed by the name of the image
+// (ex: registry.hub.docker.com/library/redis:5)
+func LoadManifestIndex(CVMFSRepo string) (map[string]da.Manifest, error) {
+	root := filepath.Join(repositoryRoot(CVMFSRepo), ".metadata")
+	index := make(map[string]da.Manifest)
+	walker := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			LogE(err).WithFields(log.Fields{"path": path}).Warning("Error in opening the path, moving on.")
+			return nil
+		}
+		if info.Name() != "manifest.json" {
+			return nil
+		}
+		bytes, err := readMetadataFile(path)
+		if err != nil {
+			return nil
+		}
+		var manifest da.Manifest
+		if err = json.Unmarshal(bytes, &manifest); err != nil {
+			return nil
+		}
+		name, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil {
+			return nil
+		}
+		index[name] = manifest
+		return nil
+	}
+	err := filepath.Walk(root, walker)
+	return index, err
+}
+
+// return the name of the images that use the layer, the origins in the
+// backlink of the layer (config digests) are mapped back to the image names
+// using the manifestIndex, as returned by LoadManifestIndex.
+// origins not present in the index are returned as they are.
+func ImagesReferencingLayer(CVMFSRepo, layerDigest string, manifestIndex map[string]da.Manifest) ([]string, error) {
+	layerDigest = strings.TrimPrefix(layerDigest, "sha256:")
+	backlink, err := getBacklinkFromLayer(CVMFSRepo, layerDigest)
+	if err != nil {
+		LogE(err).WithFields(log.Fields{"repo": CVMFSRepo, "layer": layerDigest}).Error(
+			"Impossible to retrieve the backlink information")
+		return nil, err
+	}
+	return imagesReferencingBacklink(backlink, manifestIndex), nil
+}
+
+func imagesReferencingBacklink(backlink Backlink, manifestIndex map[string]da.Manifest) []string {
+	imagesByConfig := make(map[string][]string)
+	for name, manifest := range manifestIndex {
+		imagesByConfig[manifest.Config.Digest] = append(imagesByConfig[manifest.Config.Digest], name)
+	}
+	result := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, origin := range backlink.Origin {
+		names, ok := imagesByConfig[origin]
+		if !ok {
+			names = []string{origin}
+		}
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				result = append(result, name)
+			}
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// RemovePaths removes the paths, relative to the root of the repository,
+// with `cvmfs_server ingest --delete`, at most batchSize paths in each
+// invocation. The removals of each batch are then recorded in the audit log,
+// in a transaction of their own.
+// It returns the paths actually removed: the paths that could not be removed
+// are not among them.
+func RemovePaths(CVMFSRepo string, paths []string, batchSize int) ([]string, error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "removing paths", "repo": CVMFSRepo})
+	}
+	if batchSize <= 0 {
+		batchSize = len(paths)
+	}
+	root := repositoryRoot(CVMFSRepo)
+	removed := make([]string, 0, len(paths))
+	failed := 0
+	unrecorded := 0
+	for start := 0; start < len(paths); start += batchSize {
+		end := start + batchSize
+		if end > len(paths) {
+			end = len(paths)
+		}
+
+		batch := make([]string, 0, end-start)
+		for _, path := range paths[start:end] {
+			path = cleanEntryName(path)
+			if path == "" {
+				llog(Log()).Error("Refusing to remove the root of the repository")
+				failed++
+				continue
+			}
+			if _, err := os.Lstat(filepath.Join(root, path)); os.IsNotExist(err) {
+				llog(Log()).WithFields(log.Fields{"path": path}).Warning("Path not existing")
+				continue
+			}
+			if err := checkDirectoryBeforeRemoval(filepath.Join(root, path), MaxRemoveDepth); err != nil {
+				llog(LogE(err)).WithFields(log.Fields{"path": path}).Error("Refusing to remove the path")
+				failed++
+				continue
+			}
+			batch = append(batch, path)
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		err := currentPublisher().IngestDelete(CVMFSRepo, batch...)
+		if err != nil {
+			llog(LogE(err)).WithFields(log.Fields{"paths": batch}).Error("Error in removing the paths")
+			failed += len(batch)
+			continue
+		}
+		removed = append(removed, batch...)
+
+		if err = recordRemovals(CVMFSRepo, batch); err != nil {
+			llog(LogE(err)).WithFields(log.Fields{"paths": batch}).Error("Error in recording the removed paths in the audit log")
+			unrecorded += len(batch)
+		}
+	}
+	if failed > 0 {
+		return removed, fmt.Errorf("Impossible to remove %d paths out of %d", failed, len(paths))
+	}
+	if unrecorded > 0 {
+		return removed, fmt.Errorf("Impossible to record %d removed paths in the audit log", unrecorded)
+	}
+	return removed, nil
+}
+
+// record in the audit log, in its own transaction, that the paths have been
+// removed
+func recordRemovals(CVMFSRepo string, paths []string) error {
+	entries := make([]AuditEntry, 0, len(paths))
+	for _, path := range paths {
+		entries = append(entries, NewAuditEntry(AuditActionRemoved, path))
+	}
+	if err := currentPublisher().Transaction(CVMFSRepo); err != nil {
+		return err
+	}
+	err := appendAuditEntries(AuditLogLocation(CVMFSRepo), entries...)
+	if err == nil {
+		err = currentPublisher().Publish(CVMFSRepo)
+	}
+	if err != nil {
+		currentPublisher().Abort(CVMFSRepo)
+		return err
+	}
+	return nil
+}
+
+// paths not used anymore are kept for this long after their last modification
+// before to be garbage collected
+var GarbageCollectionGracePeriod = 30 * 24 * time.Hour
+
+// returns true if the path was modified less than gracePeriod ago, according
+// to clock, and so it should not be garbage collected yet
+func PathInGracePeriod(path string, gracePeriod time.Duration, clock Clock) (bool, time.Time, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	modTime := stat.ModTime()
+	return modTime.Add(gracePeriod).After(clock.Now()), modTime, nil
+}
+
+// the digests (without the sha256: prefix) of all the layers in the repository
+// not used by any of the liveManifests, the images that should remain, they
+// can be passed to RemoveLayers.
+// as a safety net a layer whose backlink still lists one of the live images
+// is never returned, nor is a layer whose backlink can not be read
+func ComputeDeletableLayers(CVMFSRepo string, liveManifests []da.Manifest) ([]string, error) {
+	return computeDeletableLayers(repositoryRoot(CVMFSRepo), liveManifests)
+}
+
+func computeDeletableLayers(repoRoot string, liveManifests []da.Manifest) ([]string, error) {
+	liveLayers := make(map[string]bool)
+	liveImages := make(map[string]bool)
+	for _, manifest := range liveManifests {
+		liveImages[manifest.Config.Digest] = true
+		for _, layer := range manifest.Layers {
+			liveLayers[strings.TrimPrefix(layer.Digest, "sha256:")] = true
+		}
+	}
+
+	layersDir := filepath.Join(repoRoot, subDirInsideRepo)
+	prefixes, err := ioutil.ReadDir(layersDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	deletable := make([]string, 0)
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() || strings.HasPrefix(prefix.Name(), ".") {
+			continue
+		}
+		layers, err := ioutil.ReadDir(filepath.Join(layersDir, prefix.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range layers {
+			digest := layer.Name()
+			if !layer.IsDir() || liveLayers[digest] {
+				continue
+			}
+			llog := func(l *log.Entry) *log.Entry {
+				return l.WithFields(log.Fields{"action": "compute deletable layers", "layer": digest})
+			}
+			backlinkPath := filepath.Join(layersDir, prefix.Name(), digest, ".metadata", "origin.json")
+			if metadataFileExists(backlinkPath) {
+				var backlink Backlink
+				content, err := readMetadataFile(backlinkPath)
+				if err == nil {
+					err = json.Unmarshal(content, &backlink)
+				}
+				if err != nil {
+					llog(LogE(err)).Warning("Impossible to read the backlink, keeping the layer")
+					continue
+				}
+				used := false
+				for _, origin := range backlink.Origin {
+					used = used || liveImages[origin]
+				}
+				if used {
+					llog(Log()).WithFields(log.Fields{"origin": backlink.Origin}).
+						Warning("Layer not in the live manifests but its backlink references a live image, keeping it")
+					continue
+				}
+			}
+			deletable = append(deletable, digest)
+		}
+	}
+	sort.Strings(deletable)
+	return deletable, nil
+}
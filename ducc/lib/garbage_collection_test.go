@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+func manifestWithConfig(config string, layers ...string) da.Manifest {
+	manifest := da.Manifest{Config: da.ConfigType{Digest: config}}
+	for _, layer := range layers {
+		manifest.Layers = append(manifest.Layers, da.Layer{Digest: layer})
+	}
+	return manifest
+}
+
+func TestImagesReferencingBacklink(t *testing.T) {
+	index := map[string]da.Manifest{
+		"registry.hub.docker.com/library/redis:5":     manifestWithConfig("sha256:redis", "sha256:base", "sha256:redis-layer"),
+		"registry.hub.docker.com/library/postgres:12": manifestWithConfig("sha256:postgres", "sha256:base", "sha256:postgres-layer"),
+		"registry.hub.docker.com/library/ubuntu:20":   manifestWithConfig("sha256:ubuntu", "sha256:ubuntu-layer"),
+	}
+	backlink := Backlink{Origin: []string{"sha256:redis", "sha256:postgres", "sha256:gone"}}
+
+	images := imagesReferencingBacklink(backlink, index)
+	expected := []string{
+		"registry.hub.docker.com/library/postgres:12",
+		"registry.hub.docker.com/library/redis:5",
+		"sha256:gone",
+	}
+	if !reflect.DeepEqual(images, expected) {
+		t.Errorf("Wrong images referencing the layer, expected %v, got %v", expected, images)
+	}
+}
+
+func TestComputeDeletableLayers(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_deletable_layers")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	addLayer := func(digest string, origin ...string) {
+		dir := filepath.Join(root, ".layers", digest[0:2], digest)
+		os.MkdirAll(filepath.Join(dir, "layerfs"), 0755)
+		if len(origin) > 0 {
+			os.MkdirAll(filepath.Join(dir, ".metadata"), 0755)
+			content, _ := json.Marshal(Backlink{Origin: origin})
+			ioutil.WriteFile(filepath.Join(dir, ".metadata", "origin.json"), content, 0644)
+		}
+	}
+	addLayer("aa1111", "sha256:redis", "sha256:postgres")
+	addLayer("aa2222", "sha256:redis")
+	addLayer("bb3333", "sha256:gone")
+	addLayer("cc4444")
+	// not in the live manifests, but its backlink says it is used by redis
+	addLayer("dd5555", "sha256:redis")
+
+	live := []da.Manifest{
+		manifestWithConfig("sha256:redis", "sha256:aa1111", "sha256:aa2222"),
+		manifestWithConfig("sha256:postgres", "sha256:aa1111"),
+	}
+	deletable, err := computeDeletableLayers(root, live)
+	if err != nil {
+		t.Fatalf("Error in computing the deletable layers: %s", err)
+	}
+	if !reflect.DeepEqual(deletable, []string{"bb3333", "cc4444"}) {
+		t.Errorf("Error in the deletable layers: %v", deletable)
+	}
+
+	deletable, err = computeDeletableLayers(filepath.Join(root, "missing"), live)
+	if err != nil || len(deletable) != 0 {
+		t.Errorf("Error with a repository without layers: %v %v", deletable, err)
+	}
+}
+
+func TestCollectRemoveSchedules(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_remove_schedules")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+	location := func(CVMFSRepo string) string {
+		return removeScheduleLocation(filepath.Join(root, CVMFSRepo))
+	}
+	schedules := map[string][]da.Manifest{
+		"a.cern.ch": {manifestWithConfig("sha256:shared", "sha256:base"), manifestWithConfig("sha256:only-a", "sha256:a-layer")},
+		"b.cern.ch": {manifestWithConfig("sha256:only-b", "sha256:b-layer"), manifestWithConfig("sha256:shared", "sha256:base")},
+	}
+	for repo, schedule := range schedules {
+		data, _ := json.Marshal(schedule)
+		os.MkdirAll(filepath.Dir(location(repo)), 0755)
+		ioutil.WriteFile(location(repo), data, 0644)
+	}
+	os.MkdirAll(filepath.Dir(location("broken.cern.ch")), 0755)
+	ioutil.WriteFile(location("broken.cern.ch"), []byte("not json"), 0644)
+
+	removals, errs := collectRemoveSchedules(location, []string{"b.cern.ch", "broken.cern.ch", "a.cern.ch", "empty.cern.ch"})
+	var got []string
+	for _, removal := range removals {
+		got = append(got, removal.Repository+" "+removal.Manifest.Config.Digest)
+	}
+	expected := []string{
+		"a.cern.ch sha256:only-a",
+		"a.cern.ch sha256:shared",
+		"b.cern.ch sha256:only-b",
+		"b.cern.ch sha256:shared",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Error in the collected removals, expected %v, got %v", expected, got)
+	}
+	if len(errs) != 1 || errs["broken.cern.ch"] == nil {
+		t.Errorf("Error, expected only the broken schedule to fail: %v", errs)
+	}
+}
+
+func TestExecuteRemovalsIsolatesRepositories(t *testing.T) {
+	removals := []ScheduledRemoval{
+		{Repository: "a.cern.ch", Manifest: manifestWithConfig("sha256:first")},
+		{Repository: "a.cern.ch", Manifest: manifestWithConfig("sha256:second")},
+		{Repository: "b.cern.ch", Manifest: manifestWithConfig("sha256:first")},
+	}
+	var executed []string
+	errs := executeRemovals(removals, func(CVMFSRepo string, manifest da.Manifest) error {
+		executed = append(executed, CVMFSRepo+" "+manifest.Config.Digest)
+		if CVMFSRepo == "a.cern.ch" {
+			return os.ErrPermission
+		}
+		return nil
+	})
+	expected := []string{"a.cern.ch sha256:first", "b.cern.ch sha256:first"}
+	if !reflect.DeepEqual(executed, expected) {
+		t.Errorf("Error in the removals executed, expected %v, got %v", expected, executed)
+	}
+	if len(errs) != 1 || errs["a.cern.ch"] != os.ErrPermission {
+		t.Errorf("Error in the errors of the removals: %v", errs)
+	}
+}
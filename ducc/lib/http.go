@@ -0,0 +1,83 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+// knobs of the transport shared by all the requests to the registries
+// those flags are populated in the main `rootCmd` (cmd/root.go)
+var (
+	MaxIdleConnsPerHost = 16
+	IdleConnTimeout     = 90 * time.Second
+)
+
+// the client used for all the requests to the registries, sharing the same
+// transport we reuse the connections, and multiplex over HTTP/2 when the
+// registry supports it
+// it is re-created in the main `rootCmd` (cmd/root.go) after parsing the flags
+var RegistryClient = NewRegistryClient(MaxIdleConnsPerHost, IdleConnTimeout)
+
+// the parsed manifests, shared by all the images, so that the conversions of
+// the same image, running concurrently, download the manifest only once
+var ManifestCache = da.NewManifestCache(256, 5*time.Minute)
+
+// the digests the tags point to, with the same TTL of the manifests, so that
+// a tag is resolved against the registry at most once per TTL
+var TagCache = da.NewTagCache(256, 5*time.Minute)
+
+func NewRegistryClient(maxIdleConnsPerHost int, idleConnTimeout time.Duration) *http.Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	return &http.Client{Transport: transport}
+}
+
+// maximum time to pull an image, manifest and content of all the layers,
+// zero means no deadline
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var PullTimeout time.Duration
+
+// PullTimeoutError is returned when the pull of an image exceeds PullTimeout
+type PullTimeoutError struct {
+	Image   string
+	Timeout time.Duration
+}
+
+func (e *PullTimeoutError) Error() string {
+	return fmt.Sprintf("Pull of the image %s did not complete within %s", e.Image, e.Timeout)
+}
+
+// the context to bind all the requests of the pull of an image, it expires
+// after timeout, if positive
+func PullContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// replace err with a *PullTimeoutError if the pull failed because ctx expired
+func pullError(ctx context.Context, image string, timeout time.Duration, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return &PullTimeoutError{Image: image, Timeout: timeout}
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistryClientReusesConnections(t *testing.T) {
+	var mutex sync.Mutex
+	connections := 0
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mutex.Lock()
+			connections++
+			mutex.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	client := NewRegistryClient(4, time.Minute)
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Error in the request: %s", err)
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if connections != 1 {
+		t.Errorf("Error, expected a single connection reused, got %d connections", connections)
+	}
+}
+
+func TestPullTimeout(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a registry that got stuck
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		case <-time.After(10 * time.Second):
+		}
+		w.Write([]byte(testManifest))
+	}))
+	defer server.Close()
+	img := testImageFromServer(t, server)
+
+	ctx, cancel := PullContext(100 * time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := img.GetManifestWithContext(ctx)
+	err = pullError(ctx, img.GetSimpleName(), 100*time.Millisecond, err)
+	if _, ok := err.(*PullTimeoutError); !ok {
+		t.Errorf("Error, expected a PullTimeoutError, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Error, the deadline did not stop the pull, took %s", elapsed)
+	}
+
+	// other failures are not reported as timeouts
+	ctx, cancel = PullContext(0)
+	defer cancel()
+	err = pullError(ctx, img.GetSimpleName(), 0, fmt.Errorf("Got error status code (404)"))
+	if _, ok := err.(*PullTimeoutError); ok {
+		t.Errorf("Error, failure reported as a timeout: %v", err)
+	}
+}
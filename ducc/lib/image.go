@@ -14,6 +14,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/docker/image"
 	"github.com/olekukonko/tablewriter"
@@ -38,6 +39,9 @@ type Image struct {
 	IsThin      bool
 	TagWildcard bool
 	Manifest    *da.Manifest
+	// the OCI layout directory the image is read from, empty for the images
+	// in a registry
+	Layout string
 }
 
 func (i *Image) GetSimpleName() string {
@@ -126,28 +130,124 @@ func (img *Image) PrintImage(machineFriendly, csv_header bool) {
 }
 
 func (img *Image) GetManifest() (da.Manifest, error) {
+	return img.GetManifestWithContext(context.Background())
+}
+
+// as GetManifest, the requests to the registry are bound to ctx
+func (img *Image) GetManifestWithContext(ctx context.Context) (da.Manifest, error) {
 	if img.Manifest != nil {
 		return *img.Manifest, nil
 	}
-	bytes, err := img.getByteManifest()
-	if err != nil {
-		return da.Manifest{}, err
+	fetch := func(ctx context.Context) (da.Manifest, error) {
+		bytes, err := img.getByteManifest(ctx)
+		if err != nil {
+			return da.Manifest{}, err
+		}
+		var manifest da.Manifest
+		err = json.Unmarshal(bytes, &manifest)
+		if err != nil {
+			return manifest, err
+		}
+		if reflect.DeepEqual(da.Manifest{}, manifest) {
+			return manifest, fmt.Errorf("Got empty manifest")
+		}
+		return manifest, nil
 	}
 	var manifest da.Manifest
-	err = json.Unmarshal(bytes, &manifest)
+	key, err := img.manifestCacheKey(ctx)
 	if err != nil {
-		return manifest, err
+		LogE(err).WithFields(log.Fields{"image": img.GetSimpleName()}).
+			Warning("Impossible to resolve the digest of the manifest, not using the cache")
+		manifest, err = fetch(ctx)
+	} else {
+		manifest, err = ManifestCache.Get(ctx, key, fetch)
 	}
-	if reflect.DeepEqual(da.Manifest{}, manifest) {
-		return manifest, fmt.Errorf("Got empty manifest")
+	if err != nil {
+		return manifest, err
 	}
 	img.Manifest = &manifest
 	return manifest, nil
 }
 
+// the manifests are cached by digest, the tags can be moved, so they are
+// first resolved against the registry, the resolution is cached in TagCache.
+// the manifests of the OCI layouts depend also on the platform selected
+func (img *Image) manifestCacheKey(ctx context.Context) (string, error) {
+	if img.Layout != "" {
+		return fmt.Sprintf("%s %s/%s", img.WholeName(), OCIPlatformOS, OCIPlatformArchitecture), nil
+	}
+	if img.Digest != "" {
+		return fmt.Sprintf("%s/%s@%s", img.Registry, img.Repository, img.Digest), nil
+	}
+	tag := fmt.Sprintf("%s/%s:%s", img.Registry, img.Repository, img.Tag)
+	digest, ok := TagCache.Get(tag)
+	if !ok {
+		var err error
+		digest, err = img.resolveManifestDigest(ctx)
+		if err != nil {
+			return "", err
+		}
+		TagCache.Add(tag, digest)
+	}
+	return fmt.Sprintf("%s/%s@%s", img.Registry, img.Repository, digest), nil
+}
+
+// ask the registry, or its mirrors, the digest of the manifest the tag points
+// to, a HEAD request is cheaper than the download of the manifest
+func (img *Image) resolveManifestDigest(ctx context.Context) (digest string, err error) {
+	user, pass, err := img.getCredentials()
+	if err != nil {
+		LogE(err).Warning("Unable to retrieve the password, trying to resolve the tag anonymously.")
+		user, pass = "", ""
+	}
+	for _, endpoint := range img.getEndpoints() {
+		digest, err = headManifestFromEndpoint(ctx, endpoint, user, pass)
+		if err == nil {
+			return digest, nil
+		}
+		if img.isMirror(endpoint) {
+			LogE(err).WithFields(log.Fields{"mirror": endpoint.Registry, "image": img.GetSimpleName()}).
+				Warning("Error in resolving the tag with the mirror, trying next endpoint")
+		}
+	}
+	return "", err
+}
+
+func headManifestFromEndpoint(ctx context.Context, img *Image, user, pass string) (string, error) {
+	url := img.GetManifestUrl()
+
+	token, err := firstRequestForAuth(ctx, url, user, pass)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", token)
+	// the same media type we ask when getting the manifest
+	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+
+	release := Downloads.Acquire(img.Registry)
+	defer release()
+	resp, err := RegistryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("Got error status code (%d) trying to resolve the tag", resp.StatusCode)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("The registry did not return the digest of the manifest")
+	}
+	return digest, nil
+}
+
 func (img *Image) GetChanges() (changes []string, err error) {
-	user := img.User
-	pass, err := GetPassword()
+	user, pass, err := img.getCredentials()
 	if err != nil {
 		LogE(err).Warning("Unable to get the credential for downloading the configuration blog, trying anonymously")
 		user = ""
@@ -160,28 +260,50 @@ func (img *Image) GetChanges() (changes []string, err error) {
 		LogE(err).Warning("Impossible to retrieve the manifest of the image, not changes set")
 		return
 	}
-	configUrl := fmt.Sprintf("%s://%s/v2/%s/blobs/%s",
-		img.Scheme, img.Registry, img.Repository, manifest.Config.Digest)
-	token, err := firstRequestForAuth(configUrl, user, pass)
-	if err != nil {
-		LogE(err).Warning("Impossible to retrieve the token for getting the changes from the repository, not changes set")
-		return
-	}
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", configUrl, nil)
-	if err != nil {
-		LogE(err).Warning("Impossible to create a request for getting the changes no chnages set.")
-		return
-	}
-	req.Header.Set("Authorization", token)
-	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	var body []byte
+	if img.Layout != "" {
+		body, err = readOCIBlob(img.Layout, manifest.Config.Digest)
+		if err != nil {
+			LogE(err).Warning("Error in reading the configuration from the OCI layout, no change set")
+			return
+		}
+	} else {
+		configUrl := fmt.Sprintf("%s://%s/v2/%s/blobs/%s",
+			img.Scheme, img.Registry, img.Repository, manifest.Config.Digest)
+		var token string
+		var req *http.Request
+		var resp *http.Response
+		token, err = firstRequestForAuth(context.Background(), configUrl, user, pass)
+		if err != nil {
+			LogE(err).Warning("Impossible to retrieve the token for getting the changes from the repository, not changes set")
+			return
+		}
+		client := RegistryClient
+		req, err = http.NewRequest("GET", configUrl, nil)
+		if err != nil {
+			LogE(err).Warning("Impossible to create a request for getting the changes no chnages set.")
+			return
+		}
+		req.Header.Set("Authorization", token)
+		req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
 
-	resp, err := client.Do(req)
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		LogE(err).Warning("Error in reading the body from the configuration, no change set")
-		return
+		resp, err = client.Do(req)
+		if err != nil {
+			LogE(err).Warning("Error in getting the configuration of the image, no change set")
+			return
+		}
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			resp.Body.Close()
+			err = fmt.Errorf("Got error status code (%d) trying to retrieve the configuration", resp.StatusCode)
+			LogE(err).WithFields(log.Fields{"status code": resp.StatusCode, "url": configUrl}).Warning("Error in getting the configuration of the image, no change set")
+			return
+		}
+		defer resp.Body.Close()
+		body, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			LogE(err).Warning("Error in reading the body from the configuration, no change set")
+			return
+		}
 	}
 
 	var config image.Image
@@ -217,6 +339,12 @@ func (img *Image) GetChanges() (changes []string, err error) {
 }
 
 func (img *Image) GetSingularityLocation() string {
+	if img.Layout != "" {
+		if img.Tag != "" {
+			return fmt.Sprintf("oci:%s:%s", img.Layout, img.Tag)
+		}
+		return fmt.Sprintf("oci:%s", img.Layout)
+	}
 	return fmt.Sprintf("docker://%s/%s%s", img.Registry, img.Repository, img.GetReference())
 }
 
@@ -241,46 +369,12 @@ func (img *Image) ExpandWildcard() (<-chan *Image, <-chan *Image, error) {
 		r2 <- img
 		return r1, r2, nil
 	}
-	var tagsList struct {
-		Tags []string
-	}
-	pass, err := GetPassword()
-	if err != nil {
-		LogE(err).Warning("Unable to retrieve the password, trying to get the manifest anonymously.")
-		pass = ""
-	}
-	user := img.User
-	url := img.GetTagListUrl()
-	token, err := firstRequestForAuth(url, user, pass)
+	tags, err := img.ListTags()
 	if err != nil {
-		errF := fmt.Errorf("Error in authenticating for retrieving the tags: %s", err)
-		LogE(err).Error(errF)
-		return r1, r2, errF
-	}
-
-	client := http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	req.Header.Set("Authorization", token)
-
-	resp, err := client.Do(req)
-	if err != nil {
-		errF := fmt.Errorf("Error in making the request for retrieving the tags: %s", err)
-		LogE(err).WithFields(log.Fields{"url": url}).Error(errF)
-		return r1, r2, errF
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 400 {
-		errF := fmt.Errorf("Got error status code (%d) trying to retrieve the tags", resp.StatusCode)
-		LogE(err).WithFields(log.Fields{"status code": resp.StatusCode, "url": url}).Error(errF)
-		return r1, r2, errF
-	}
-	if err = json.NewDecoder(resp.Body).Decode(&tagsList); err != nil {
-		errF := fmt.Errorf("Error in decoding the tags from the server: %s", err)
-		LogE(err).Error(errF)
-		return r1, r2, errF
+		return r1, r2, err
 	}
 	pattern := img.Tag
-	filteredTags, err := filterUsingGlob(pattern, tagsList.Tags)
+	filteredTags, err := filterUsingGlob(pattern, tags)
 	if err != nil {
 		return r1, r2, nil
 	}
@@ -353,8 +447,7 @@ func (img *Image) DownloadSingularityDirectory(rootPath string) (sing Singularit
 	defer os.RemoveAll(singularityTempCache)
 	// we first try to download the image with the credentials
 	// if we fail, we try again without the credentials
-	user := img.User
-	pass, _ := GetPassword()
+	user, pass, _ := img.getCredentials()
 	err = ExecCommand("singularity", "build", "--force", "--fix-perms",
 		"--sandbox", dir, img.GetSingularityLocation()).
 		Env("SINGULARITY_CACHEDIR", singularityTempCache).
@@ -432,49 +525,72 @@ func (s Singularity) IngestIntoCVMFS(CVMFSRepo string) error {
 	return nil
 }
 
-func (img *Image) getByteManifest() ([]byte, error) {
-	pass, err := GetPassword()
+func (img *Image) getByteManifest(ctx context.Context) ([]byte, error) {
+	if img.Layout != "" {
+		return img.getOCILayoutManifest()
+	}
+	user, pass, err := img.getCredentials()
 	if err != nil {
 		LogE(err).Warning("Unable to retrieve the password, trying to get the manifest anonymously.")
-		return img.getAnonymousManifest()
+		return img.getAnonymousManifest(ctx)
 	}
-	return img.getManifestWithPassword(pass)
+	return getManifestWithUsernameAndPassword(ctx, img, user, pass)
 }
 
-func (img *Image) getAnonymousManifest() ([]byte, error) {
-	return getManifestWithUsernameAndPassword(img, "", "")
+func (img *Image) getAnonymousManifest(ctx context.Context) ([]byte, error) {
+	return getManifestWithUsernameAndPassword(ctx, img, "", "")
 }
 
-func (img *Image) getManifestWithPassword(password string) ([]byte, error) {
-	return getManifestWithUsernameAndPassword(img, img.User, password)
+func getManifestWithUsernameAndPassword(ctx context.Context, img *Image, user, pass string) (body []byte, err error) {
+	// we try first all the mirrors of the registry, if any, and as last
+	// resort the registry itself
+	for _, endpoint := range img.getEndpoints() {
+		body, err = getManifestFromEndpoint(ctx, endpoint, user, pass)
+		if err == nil {
+			return body, nil
+		}
+		if img.isMirror(endpoint) {
+			LogE(err).WithFields(log.Fields{"mirror": endpoint.Registry, "image": img.GetSimpleName()}).
+				Warning("Error in getting the manifest from the mirror, trying next endpoint")
+		}
+	}
+	return nil, err
 }
 
-func getManifestWithUsernameAndPassword(img *Image, user, pass string) ([]byte, error) {
+func getManifestFromEndpoint(ctx context.Context, img *Image, user, pass string) ([]byte, error) {
 
 	url := img.GetManifestUrl()
 
-	token, err := firstRequestForAuth(url, user, pass)
+	token, err := firstRequestForAuth(ctx, url, user, pass)
 	if err != nil {
 		LogE(err).Error("Error in getting the authentication token")
 		return nil, err
 	}
 
-	client := &http.Client{}
+	client := RegistryClient
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		LogE(err).Error("Impossible to create a HTTP request")
 		return nil, err
 	}
+	req = req.WithContext(ctx)
 
 	req.Header.Set("Authorization", token)
 	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
 
+	release := Downloads.Acquire(img.Registry)
+	defer release()
 	resp, err := client.Do(req)
 	if err != nil {
 		LogE(err).Error("Error in making the HTTP request")
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		err = fmt.Errorf("Got error status code (%d) trying to retrieve the manifest", resp.StatusCode)
+		LogE(err).WithFields(log.Fields{"status code": resp.StatusCode, "url": url}).Error("Error in getting the manifest")
+		return nil, err
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		LogE(err).Error("Error in reading the second http response")
@@ -483,8 +599,13 @@ func getManifestWithUsernameAndPassword(img *Image, user, pass string) ([]byte,
 	return body, nil
 }
 
-func firstRequestForAuth(url, user, pass string) (token string, err error) {
-	resp, err := http.Get(url)
+func firstRequestForAuth(ctx context.Context, url, user, pass string) (token string, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		LogE(err).Error("Impossible to create a HTTP request")
+		return "", err
+	}
+	resp, err := RegistryClient.Do(req.WithContext(ctx))
 	if err != nil {
 		LogE(err).Error("Error in making the first request for auth")
 		return "", err
@@ -505,14 +626,14 @@ func firstRequestForAuth(url, user, pass string) (token string, err error) {
 	// we first try to get the token with the authentication
 	// if we fail, and we might since the docker hub might not have our user
 	// we try again without authentication
-	token, err = requestAuthToken(WwwAuthenticate, user, pass)
+	token, err = requestAuthToken(ctx, WwwAuthenticate, user, pass)
 	if err == nil {
 		// happy path
 		return token, nil
 	}
 	// some error, we should retry without auth
 	if user != "" || pass != "" {
-		token, err = requestAuthToken(WwwAuthenticate, "", "")
+		token, err = requestAuthToken(ctx, WwwAuthenticate, "", "")
 		if err == nil {
 			// happy path without auth
 			return token, nil
@@ -530,14 +651,18 @@ func getLayerUrl(img *Image, layer da.Layer) string {
 type downloadedLayer struct {
 	Name string
 	Path io.ReadCloser
+	// from the request of the layer to the response, the content is read
+	// later from Path
+	RequestDuration time.Duration
 }
 
-func (img *Image) GetLayers(layersChan chan<- downloadedLayer, manifestChan chan<- string, stopGettingLayers <-chan bool, rootPath string) error {
+// the download of the layers, including the reading of their content, is
+// bound to ctx, as returned by PullContext
+func (img *Image) GetLayers(ctx context.Context, layersChan chan<- downloadedLayer, manifestChan chan<- string, stopGettingLayers <-chan bool, rootPath string) error {
 	defer close(layersChan)
 	defer close(manifestChan)
 
-	user := img.User
-	pass, err := GetPassword()
+	user, pass, err := img.getCredentials()
 	if err != nil {
 		LogE(err).Warning("Unable to retrieve the password, trying to get the layers anonymously.")
 		user = ""
@@ -545,24 +670,28 @@ func (img *Image) GetLayers(layersChan chan<- downloadedLayer, manifestChan chan
 	}
 
 	// then we try to get the manifest from our database
-	manifest, err := img.GetManifest()
+	manifest, err := img.GetManifestWithContext(ctx)
 	if err != nil {
 		LogE(err).Warn("Error in getting the manifest")
 		return err
 	}
 
-	// A first request is used to get the authentication
-	firstLayer := manifest.Layers[0]
-	layerUrl := getLayerUrl(img, firstLayer)
-	token, err := firstRequestForAuth(layerUrl, user, pass)
-	if err != nil {
-		return err
+	// A first request is used to get the authentication, the images in OCI
+	// layouts do not need it
+	var token string
+	if img.Layout == "" {
+		firstLayer := manifest.Layers[0]
+		layerUrl := getLayerUrl(img, firstLayer)
+		token, err = firstRequestForAuth(ctx, layerUrl, user, pass)
+		if err != nil {
+			return err
+		}
 	}
 
 	killKiller := make(chan bool, 1)
 	errorChannel := make(chan error, 1)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	go func() {
 
 		select {
@@ -587,7 +716,7 @@ func (img *Image) GetLayers(layersChan chan<- downloadedLayer, manifestChan chan
 		go func(ctx context.Context, layer da.Layer) {
 			defer wg.Done()
 			Log().WithFields(log.Fields{"layer": layer.Digest}).Info("Start working on layer")
-			toSend, err := img.downloadLayer(layer, token, rootPath)
+			toSend, err := img.downloadLayer(ctx, layer, token, rootPath)
 			if err != nil {
 				LogE(err).Error("Error in downloading a layer")
 				return
@@ -596,6 +725,8 @@ func (img *Image) GetLayers(layersChan chan<- downloadedLayer, manifestChan chan
 			case layersChan <- toSend:
 				return
 			case <-ctx.Done():
+				// nobody is going to read the layer, we release its download
+				toSend.Path.Close()
 				return
 			}
 		}(ctx, layer)
@@ -626,9 +757,32 @@ func (img *Image) GetLayers(layersChan chan<- downloadedLayer, manifestChan chan
 	}
 }
 
-func (img *Image) downloadLayer(layer da.Layer, token, rootPath string) (toSend downloadedLayer, err error) {
-	user := img.User
-	pass, err := GetPassword()
+func (img *Image) downloadLayer(ctx context.Context, layer da.Layer, token, rootPath string) (toSend downloadedLayer, err error) {
+	start := time.Now()
+	defer func() { toSend.RequestDuration = time.Since(start) }()
+	if img.Layout != "" {
+		return img.openOCILayoutLayer(layer.Digest, layer.MediaType)
+	}
+	for _, endpoint := range img.getEndpoints() {
+		endpointToken := token
+		if img.isMirror(endpoint) {
+			// the token we got is valid only for the registry
+			endpointToken = ""
+		}
+		toSend, err = endpoint.downloadLayerFromEndpoint(ctx, layer, endpointToken)
+		if err == nil {
+			return toSend, nil
+		}
+		if img.isMirror(endpoint) {
+			LogE(err).WithFields(log.Fields{"mirror": endpoint.Registry, "layer": layer.Digest}).
+				Warning("Error in downloading the layer from the mirror, trying next endpoint")
+		}
+	}
+	return
+}
+
+func (img *Image) downloadLayerFromEndpoint(ctx context.Context, layer da.Layer, token string) (toSend downloadedLayer, err error) {
+	user, pass, err := img.getCredentials()
 	if err != nil {
 		LogE(err).Warning("Unable to retrieve the password, trying to get the layers anonymously.")
 		user = ""
@@ -636,36 +790,53 @@ func (img *Image) downloadLayer(layer da.Layer, token, rootPath string) (toSend
 	}
 	layerUrl := getLayerUrl(img, layer)
 	if token == "" {
-		token, err = firstRequestForAuth(layerUrl, user, pass)
+		token, err = firstRequestForAuth(ctx, layerUrl, user, pass)
 		if err != nil {
 			return
 		}
 	}
 	for i := 0; i <= 5; i++ {
-		err = nil
-		client := &http.Client{}
-		req, err := http.NewRequest("GET", layerUrl, nil)
+		var req *http.Request
+		var resp *http.Response
+		client := RegistryClient
+		req, err = http.NewRequest("GET", layerUrl, nil)
 		if err != nil {
 			LogE(err).Error("Impossible to create the HTTP request.")
 			break
 		}
+		req = req.WithContext(ctx)
 		req.Header.Set("Authorization", token)
-		resp, err := client.Do(req)
+		// the download slot is released only when the layer is closed
+		release := Downloads.Acquire(img.Registry)
+		resp, err = client.Do(req)
 		Log().WithFields(log.Fields{"layer": layer.Digest}).Info("Make request for layer")
 		if err != nil {
+			release()
 			break
 		}
 		if 200 <= resp.StatusCode && resp.StatusCode < 300 {
-			gread, err := gzip.NewReader(resp.Body)
-			if err != nil {
-				LogE(err).Warning("Error in creating the zip to unzip the layer")
+			body := DownloadLimiter.Reader(ctx, resp.Body)
+			if verified, errDigest := newDigestVerifier(body, layer.Digest); errDigest == nil {
+				body = verified
+			} else {
+				LogE(errDigest).WithFields(log.Fields{"layer": layer.Digest}).Warning("Impossible to verify the digest of the layer")
+			}
+			gread, errGzip := gzip.NewReader(body)
+			if errGzip != nil {
+				LogE(errGzip).Warning("Error in creating the zip to unzip the layer")
+				resp.Body.Close()
+				release()
+				err = errGzip
 				continue
 			}
 
-			toSend = downloadedLayer{Name: layer.Digest, Path: gread}
+			toSend = downloadedLayer{Name: layer.Digest,
+				Path: scheduledReadCloser{ReadCloser: gread, body: resp.Body, release: release}}
 			return toSend, nil
 
 		} else {
+			resp.Body.Close()
+			release()
 			Log().Warning("Received status code ", resp.StatusCode)
 			err = fmt.Errorf("Layer not received, status code: %d", resp.StatusCode)
 		}
@@ -694,7 +865,7 @@ func parseBearerToken(token string) (realm string, options map[string]string, er
 	return
 }
 
-func requestAuthToken(token, user, pass string) (authToken string, err error) {
+func requestAuthToken(ctx context.Context, token, user, pass string) (authToken string, err error) {
 	realm, options, err := parseBearerToken(token)
 	if err != nil {
 		return
@@ -703,6 +874,7 @@ func requestAuthToken(token, user, pass string) (authToken string, err error) {
 	if err != nil {
 		return
 	}
+	req = req.WithContext(ctx)
 
 	query := req.URL.Query()
 	for k, v := range options {
@@ -714,7 +886,7 @@ func requestAuthToken(token, user, pass string) (authToken string, err error) {
 	}
 	req.URL.RawQuery = query.Encode()
 
-	client := &http.Client{}
+	client := RegistryClient
 	resp, err := client.Do(req)
 	if err != nil {
 		err = fmt.Errorf("Error in getting the token, http request failed %s", err)
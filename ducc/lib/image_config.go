@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+// the part of the configuration blob of an image that we need to check the
+// manifest against it and to export the image again
+type ImageConfig struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+	RootFS       struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// ManifestConfigMismatchError describes why a manifest does not agree with
+// the configuration of the image
+type ManifestConfigMismatchError struct {
+	Image  string
+	Reason string
+}
+
+func (e *ManifestConfigMismatchError) Error() string {
+	return fmt.Sprintf("Manifest of image %s does not match its configuration: %s", e.Image, e.Reason)
+}
+
+// check that the layers of the manifest are the ones described by the
+// rootfs of the configuration: same number, in the same order, of diff_ids.
+// the diff_ids are digests of the uncompressed layers, so they can not be
+// compared with the digests in the manifest before the download
+func ValidateManifestAgainstConfig(manifest da.Manifest, config ImageConfig) error {
+	mismatch := func(format string, args ...interface{}) error {
+		return &ManifestConfigMismatchError{Image: manifest.Config.Digest, Reason: fmt.Sprintf(format, args...)}
+	}
+	if config.RootFS.Type != "" && config.RootFS.Type != "layers" {
+		return mismatch("unknown rootfs type %q", config.RootFS.Type)
+	}
+	if len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return mismatch("%d layers in the manifest but %d diff_ids in the configuration",
+			len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+	for i, diffID := range config.RootFS.DiffIDs {
+		if !strings.HasPrefix(diffID, "sha256:") || len(diffID) != len("sha256:")+64 {
+			return mismatch("invalid diff_id %q for the layer %d (%s)", diffID, i, manifest.Layers[i].Digest)
+		}
+	}
+	return nil
+}
+
+// download the configuration blob of the image, it is verified against the
+// digest in the manifest
+func (img *Image) GetImageConfig(ctx context.Context) (config ImageConfig, err error) {
+	manifest, err := img.GetManifestWithContext(ctx)
+	if err != nil {
+		return
+	}
+	if img.Layout != "" {
+		var body []byte
+		body, err = readOCIBlob(img.Layout, manifest.Config.Digest)
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(body, &config)
+		return
+	}
+	user, pass, err := img.getCredentials()
+	if err != nil {
+		LogE(err).Warning("Unable to get the credential for downloading the configuration blob, trying anonymously")
+		user, pass = "", ""
+	}
+	// as for the manifest and the layers, first the mirrors and last the
+	// registry itself
+	for _, endpoint := range img.getEndpoints() {
+		config, err = endpoint.getImageConfigFromEndpoint(ctx, manifest.Config.Digest, user, pass)
+		if err == nil {
+			return config, nil
+		}
+		if img.isMirror(endpoint) {
+			LogE(err).WithFields(log.Fields{"mirror": endpoint.Registry, "image": img.GetSimpleName()}).
+				Warning("Error in getting the configuration from the mirror, trying next endpoint")
+		}
+	}
+	return
+}
+
+func (img *Image) getImageConfigFromEndpoint(ctx context.Context, digest, user, pass string) (config ImageConfig, err error) {
+	configUrl := fmt.Sprintf("%s://%s/v2/%s/blobs/%s",
+		img.Scheme, img.Registry, img.Repository, digest)
+	token, err := firstRequestForAuth(ctx, configUrl, user, pass)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("GET", configUrl, nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", token)
+
+	release := Downloads.Acquire(img.Registry)
+	defer release()
+	resp, err := RegistryClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		err = fmt.Errorf("Got error status code (%d) trying to retrieve the configuration", resp.StatusCode)
+		return
+	}
+	verified, err := newDigestVerifier(resp.Body, digest)
+	if err != nil {
+		return
+	}
+	body, err := ioutil.ReadAll(verified)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(body, &config)
+	return
+}
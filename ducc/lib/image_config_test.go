@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testImageConfig(t *testing.T, diffIDs ...string) ImageConfig {
+	var config ImageConfig
+	content, _ := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": diffIDs},
+	})
+	if err := json.Unmarshal(content, &config); err != nil {
+		t.Fatalf("Error in unmarshaling the test configuration: %s", err)
+	}
+	return config
+}
+
+func TestValidateManifestAgainstConfig(t *testing.T) {
+	diffID := func(c string) string { return "sha256:" + strings.Repeat(c, 64) }
+	manifest := manifestWithConfig("sha256:image", "sha256:a", "sha256:b")
+
+	err := ValidateManifestAgainstConfig(manifest, testImageConfig(t, diffID("1"), diffID("2")))
+	if err != nil {
+		t.Errorf("Error in validating a matching manifest: %s", err)
+	}
+
+	err = ValidateManifestAgainstConfig(manifest, testImageConfig(t, diffID("1")))
+	if _, ok := err.(*ManifestConfigMismatchError); !ok {
+		t.Errorf("Error, count mismatch not detected: %v", err)
+	}
+
+	err = ValidateManifestAgainstConfig(manifest, testImageConfig(t, diffID("1"), "sha256:short"))
+	if _, ok := err.(*ManifestConfigMismatchError); !ok {
+		t.Errorf("Error, invalid diff_id not detected: %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+// what to do with the images with more than MaxLayers layers
+type LayerLimitPolicy int
+
+const (
+	// the image is not converted
+	LayerLimitReject LayerLimitPolicy = iota
+	// the layers are not ingested, only the flat (singularity) image is created
+	LayerLimitFlatten
+)
+
+// maximum number of layers of an image, zero means unlimited
+// those flags are populated in the main `rootCmd` (cmd/root.go)
+var (
+	MaxLayers                        = 0
+	MaxLayersPolicy LayerLimitPolicy = LayerLimitReject
+)
+
+func (p LayerLimitPolicy) String() string {
+	switch p {
+	case LayerLimitReject:
+		return "reject"
+	case LayerLimitFlatten:
+		return "flatten"
+	}
+	return fmt.Sprintf("unknown(%d)", int(p))
+}
+
+func ParseLayerLimitPolicy(policy string) (LayerLimitPolicy, error) {
+	switch strings.ToLower(policy) {
+	case "", "reject":
+		return LayerLimitReject, nil
+	case "flatten":
+		return LayerLimitFlatten, nil
+	}
+	return LayerLimitReject, fmt.Errorf("Unknown policy for the images with too many layers: %s, expected reject or flatten", policy)
+}
+
+type TooManyLayersError struct {
+	Image  string
+	Layers int
+	Max    int
+}
+
+func (e *TooManyLayersError) Error() string {
+	return fmt.Sprintf("Image %s has %d layers, more than the limit of %d", e.Image, e.Layers, e.Max)
+}
+
+// check the number of layers of the manifest against max, if the limit is
+// exceeded under the reject policy a *TooManyLayersError is returned, under
+// the flatten policy skipLayers is true, the layers should not be ingested
+func checkLayerCount(manifest da.Manifest, max int, policy LayerLimitPolicy) (skipLayers bool, err error) {
+	if max <= 0 || len(manifest.Layers) <= max {
+		return false, nil
+	}
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"image": manifest.Config.Digest, "layers": len(manifest.Layers), "max layers": max, "policy": policy})
+	}
+	if policy == LayerLimitFlatten {
+		llog(Log()).Warning("Too many layers, the image will be available only as flat image")
+		return true, nil
+	}
+	err = &TooManyLayersError{Image: manifest.Config.Digest, Layers: len(manifest.Layers), Max: max}
+	llog(LogE(err)).Error("Too many layers, rejecting the image")
+	return false, err
+}
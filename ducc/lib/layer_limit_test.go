@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestCheckLayerCount(t *testing.T) {
+	manifest := manifestWithConfig("sha256:image", "sha256:a", "sha256:b", "sha256:c")
+
+	skip, err := checkLayerCount(manifest, 3, LayerLimitReject)
+	if skip || err != nil {
+		t.Errorf("Error, image within the limit not accepted: %v %v", skip, err)
+	}
+	skip, err = checkLayerCount(manifest, 0, LayerLimitReject)
+	if skip || err != nil {
+		t.Errorf("Error, image not accepted without a limit: %v %v", skip, err)
+	}
+
+	skip, err = checkLayerCount(manifest, 2, LayerLimitReject)
+	if _, ok := err.(*TooManyLayersError); !ok || skip {
+		t.Errorf("Error, image over the limit not rejected: %v %v", skip, err)
+	}
+	skip, err = checkLayerCount(manifest, 2, LayerLimitFlatten)
+	if err != nil || !skip {
+		t.Errorf("Error, image over the limit not flattened: %v %v", skip, err)
+	}
+}
+
+func TestParseLayerLimitPolicy(t *testing.T) {
+	for _, policy := range []LayerLimitPolicy{LayerLimitReject, LayerLimitFlatten} {
+		parsed, err := ParseLayerLimitPolicy(policy.String())
+		if err != nil || parsed != policy {
+			t.Errorf("Error in parsing the policy %s: %v %v", policy, parsed, err)
+		}
+	}
+	if _, err := ParseLayerLimitPolicy("squash"); err == nil {
+		t.Errorf("Error, unknown policy accepted")
+	}
+}
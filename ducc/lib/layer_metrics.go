@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"io"
+	"time"
+)
+
+// the timings of a layer ingested into the repository
+// the layers are decompressed while they are downloaded, so the
+// decompression is accounted in the download time, the extraction is the
+// ingestion of the layer into the repository
+type LayerMetrics struct {
+	Digest string `json:"digest"`
+	// uncompressed size of the files in the layer
+	Size              int64   `json:"size"`
+	Entries           int     `json:"entries"`
+	DownloadSeconds   float64 `json:"download_seconds"`
+	ExtractionSeconds float64 `json:"extraction_seconds"`
+}
+
+// called, if set, with the metrics of each layer ingested
+var LayerMetricsHook func(image string, metrics LayerMetrics)
+
+func recordLayerMetrics(image string, metrics LayerMetrics) {
+	if LayerMetricsHook != nil {
+		LayerMetricsHook(image, metrics)
+	}
+}
+
+// accumulates the time spent waiting on the reads of r
+type timedReader struct {
+	r       io.Reader
+	elapsed time.Duration
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.r.Read(p)
+	t.elapsed += time.Since(start)
+	return n, err
+}
+
+// validate and ingest the layer into layerSubpath, timing the download and
+// the extraction, the layer is closed
+// the layer is validated while it is ingested, so the download and the
+// extraction overlap and the extraction time is what remains of the ingestion
+// without the download, unless SpoolLayers is set, then the layer is spooled
+// into a temporary file and validated before the ingestion
+// the symlinks of the ingested layer are then checked for cycles
+func ingestLayer(repo, layerSubpath string, layer downloadedLayer) (metrics LayerMetrics, stats LayerStats, err error) {
+	metrics.Digest = layer.Name
+	timed := &timedReader{r: layer.Path}
+	var tarStream io.ReadCloser
+	var validation <-chan layerValidation
+	if !SpoolLayers {
+		tarStream, validation = streamAndValidateLayer(timed, DefaultLayerLimits)
+	} else {
+		tarStream, stats, err = spoolAndValidateLayer(timed, DefaultLayerLimits)
+		layer.Path.Close()
+		if err != nil {
+			metrics.DownloadSeconds = (layer.RequestDuration + timed.elapsed).Seconds()
+			return
+		}
+	}
+
+	start := time.Now()
+	err = currentPublisher().Ingest(repo, layerSubpath, tarStream, true)
+	extraction := time.Since(start)
+	if validation != nil {
+		tarStream.Close()
+		result := <-validation
+		layer.Path.Close()
+		stats = result.stats
+		// the rejection of the layer is the reason why the ingestion failed
+		if result.err != nil && result.err != io.ErrClosedPipe {
+			err = result.err
+		}
+		if extraction -= timed.elapsed; extraction < 0 {
+			extraction = 0
+		}
+	}
+	metrics.DownloadSeconds = (layer.RequestDuration + timed.elapsed).Seconds()
+	metrics.ExtractionSeconds = extraction.Seconds()
+	metrics.Size = stats.TotalSize
+	metrics.Entries = stats.Entries
+	if err != nil {
+		return
+	}
+	err = checkLayerSymlinks(repositoryRoot(repo), layerSubpath, SymlinkCycles)
+	return
+}
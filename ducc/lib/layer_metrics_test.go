@@ -0,0 +1,126 @@
+package lib
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIngestLayerMetrics(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+
+	layers := []struct {
+		digest  string
+		headers []*tar.Header
+	}{
+		{"sha256:aaaa", []*tar.Header{
+			{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10},
+		}},
+		{"sha256:bbbb", []*tar.Header{
+			{Name: "app/run.sh", Typeflag: tar.TypeReg, Mode: 0755, Size: 100},
+		}},
+	}
+	var metrics []LayerMetrics
+	for _, layer := range layers {
+		downloaded := downloadedLayer{
+			Name:            layer.digest,
+			Path:            ioutil.NopCloser(buildTestTar(t, layer.headers...)),
+			RequestDuration: 2 * time.Second,
+		}
+		m, _, err := ingestLayer("repo", filepath.Join(".layers", layer.digest), downloaded)
+		if err != nil {
+			t.Fatalf("Error in ingesting the layer %s: %s", layer.digest, err)
+		}
+		metrics = append(metrics, m)
+	}
+
+	expected := []LayerMetrics{
+		{Digest: "sha256:aaaa", Size: 10, Entries: 2},
+		{Digest: "sha256:bbbb", Size: 100, Entries: 1},
+	}
+	for i, m := range metrics {
+		if m.Digest != expected[i].Digest || m.Size != expected[i].Size || m.Entries != expected[i].Entries {
+			t.Errorf("Error in the metrics of the layer %d: %+v", i, m)
+		}
+		// the time of the request is part of the download
+		if m.DownloadSeconds < 2 {
+			t.Errorf("Error in the download time of the layer %d: %f", i, m.DownloadSeconds)
+		}
+		if m.ExtractionSeconds <= 0 {
+			t.Errorf("Error in the extraction time of the layer %d: %f", i, m.ExtractionSeconds)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(local.RepositoryRoot("repo"), ".layers", "sha256:bbbb", "app", "run.sh")); err != nil {
+		t.Errorf("Error, layer not ingested: %s", err)
+	}
+
+	data, err := json.Marshal(IngestResult{Layers: metrics})
+	if err != nil {
+		t.Fatalf("Error in marshaling the result: %s", err)
+	}
+	var result struct {
+		Layers []map[string]interface{} `json:"layers"`
+	}
+	json.Unmarshal(data, &result)
+	if len(result.Layers) != 2 || result.Layers[1]["digest"] != "sha256:bbbb" || result.Layers[1]["extraction_seconds"] == nil {
+		t.Errorf("Error in the layers of the JSON result: %s", data)
+	}
+}
+
+func TestIngestLayerMetricsRejected(t *testing.T) {
+	_, restore := newTestLocalPublisher(t)
+	defer restore()
+	SpoolLayers = true
+	defer func() { SpoolLayers = false }()
+
+	downloaded := downloadedLayer{
+		Name: "sha256:cccc",
+		Path: ioutil.NopCloser(buildTestTar(t, &tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})),
+	}
+	m, _, err := ingestLayer("repo", filepath.Join(".layers", "sha256:cccc"), downloaded)
+	if _, ok := err.(*LayerValidationError); !ok {
+		t.Fatalf("Error, expected the layer to be rejected: %v", err)
+	}
+	if m.ExtractionSeconds != 0 {
+		t.Errorf("Error, rejected layer was extracted: %+v", m)
+	}
+}
+
+func TestIngestLayerStreamed(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+
+	downloaded := downloadedLayer{
+		Name: "sha256:dddd",
+		Path: ioutil.NopCloser(buildTestTar(t,
+			&tar.Header{Name: "/etc/", Typeflag: tar.TypeDir, Mode: 0755},
+			&tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10})),
+	}
+	m, stats, err := ingestLayer("repo", filepath.Join(".layers", "sha256:dddd"), downloaded)
+	if err != nil {
+		t.Fatalf("Error in ingesting the streamed layer: %s", err)
+	}
+	if m.Entries != 2 || m.Size != 10 || stats.Files != 1 {
+		t.Errorf("Error in the metrics of the streamed layer: %+v %+v", m, stats)
+	}
+	if _, err = os.Stat(filepath.Join(local.RepositoryRoot("repo"), ".layers", "sha256:dddd", "etc", "passwd")); err != nil {
+		t.Errorf("Error, streamed layer not ingested: %s", err)
+	}
+
+	downloaded = downloadedLayer{
+		Name: "sha256:eeee",
+		Path: ioutil.NopCloser(buildTestTar(t,
+			&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+			&tar.Header{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})),
+	}
+	_, _, err = ingestLayer("repo", filepath.Join(".layers", "sha256:eeee"), downloaded)
+	if _, ok := err.(*LayerValidationError); !ok {
+		t.Errorf("Error, expected the streamed layer to be rejected: %v", err)
+	}
+}
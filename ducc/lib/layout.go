@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// directories of the repository that live in their own nested catalog
+var catalogDirectories = []string{subDirInsideRepo, ".flat"}
+
+// InitRepoLayout creates, inside a transaction, the directory structure used
+// by DUCC: the layers and flat directories, each with its own catalog, and the
+// metadata directory with an empty remove schedule.
+// It is idempotent, if the layout is already complete it does not even open a
+// transaction.
+func InitRepoLayout(CVMFSRepo string) error {
+	root := repositoryRoot(CVMFSRepo)
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "init repository layout", "repo": CVMFSRepo})
+	}
+	if repoLayoutComplete(root) {
+		llog(Log()).Info("Repository layout already present")
+		return nil
+	}
+
+	err := currentPublisher().Transaction(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Error in opening the transaction")
+		return err
+	}
+	err = initRepoLayout(root)
+	if err != nil {
+		llog(LogE(err)).Error("Error in creating the repository layout, aborting the transaction")
+		currentPublisher().Abort(CVMFSRepo)
+		return err
+	}
+	err = currentPublisher().Publish(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Error in publishing the repository layout")
+		currentPublisher().Abort(CVMFSRepo)
+		return err
+	}
+	llog(Log()).Info("Created repository layout")
+	return nil
+}
+
+func repoLayoutPaths(root string) (dirs, files []string) {
+	for _, dir := range catalogDirectories {
+		dirs = append(dirs, filepath.Join(root, dir))
+		files = append(files, filepath.Join(root, dir, catalogMarker))
+	}
+	dirs = append(dirs, filepath.Join(root, ".metadata"))
+	files = append(files, filepath.Join(root, ".metadata", "remove-schedule.json"))
+	return
+}
+
+func repoLayoutComplete(root string) bool {
+	dirs, files := repoLayoutPaths(root)
+	for _, path := range append(dirs, files...) {
+		if !metadataFileExists(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// create only what is missing, existing files are never overwritten
+func initRepoLayout(root string) error {
+	dirs, files := repoLayoutPaths(root)
+	for _, dir := range dirs {
+		err := os.MkdirAll(dir, dirPermision)
+		if err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		if metadataFileExists(file) {
+			continue
+		}
+		content := []byte{}
+		if filepath.Base(file) == "remove-schedule.json" {
+			content = []byte("[]")
+		}
+		err := ioutil.WriteFile(file, content, filePermision)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
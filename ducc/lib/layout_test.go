@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInitRepoLayout(t *testing.T) {
+	root, err := ioutil.TempDir("", "repo_layout")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	if repoLayoutComplete(root) {
+		t.Errorf("Error, empty directory reported as complete layout")
+	}
+	if err = initRepoLayout(root); err != nil {
+		t.Fatalf("Error in creating the layout: %s", err)
+	}
+	for _, path := range []string{
+		filepath.Join(root, ".layers", ".cvmfscatalog"),
+		filepath.Join(root, ".flat", ".cvmfscatalog"),
+		filepath.Join(root, ".metadata", "remove-schedule.json"),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Error, missing %s: %s", path, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(root, ".metadata", ".cvmfscatalog")); err == nil {
+		t.Errorf("Error, unexpected catalog in .metadata")
+	}
+	schedule, _ := ioutil.ReadFile(filepath.Join(root, ".metadata", "remove-schedule.json"))
+	if string(schedule) != "[]" {
+		t.Errorf("Error, wrong initial remove schedule: %s", schedule)
+	}
+	if !repoLayoutComplete(root) {
+		t.Errorf("Error, layout not reported as complete")
+	}
+
+	// a second run must not touch the existing files
+	ioutil.WriteFile(filepath.Join(root, ".metadata", "remove-schedule.json"), []byte("[{}]"), 0644)
+	if err = initRepoLayout(root); err != nil {
+		t.Fatalf("Error in creating the layout the second time: %s", err)
+	}
+	schedule, _ = ioutil.ReadFile(filepath.Join(root, ".metadata", "remove-schedule.json"))
+	if string(schedule) != "[{}]" {
+		t.Errorf("Error, remove schedule overwritten: %s", schedule)
+	}
+}
@@ -0,0 +1,217 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// a destination of the log messages, each with its own minimum level and format
+type LogSink struct {
+	// stderr, file or syslog
+	Kind string
+	// for the file sinks
+	Path string
+	// for the file sinks, when the file grows bigger than this it is rotated
+	// into Path.1, 0 never rotates
+	MaxSize int64
+	Level   log.Level
+	// text or json
+	Format string
+}
+
+// where the stderr sinks write, replaced in the tests
+var logStderr io.Writer = os.Stderr
+
+// parse the specification of a sink, in the form
+// kind[:path][,level=LEVEL][,format=text|json][,max-size=BYTES]
+// ex: `stderr`, `file:/var/log/ducc.log,level=debug,format=json,max-size=104857600`
+// or `syslog,level=warning`, the level defaults to defaultLevel
+func ParseLogSink(spec string, defaultLevel log.Level) (LogSink, error) {
+	options := strings.Split(spec, ",")
+	sink := LogSink{Level: defaultLevel, Format: "text"}
+	kind := strings.SplitN(options[0], ":", 2)
+	sink.Kind = kind[0]
+	switch sink.Kind {
+	case "stderr", "syslog":
+		if len(kind) == 2 {
+			return LogSink{}, fmt.Errorf("The %s log sink does not take a path: %s", sink.Kind, spec)
+		}
+	case "file":
+		if len(kind) != 2 || kind[1] == "" {
+			return LogSink{}, fmt.Errorf("Missing the path of the file log sink: %s", spec)
+		}
+		sink.Path = kind[1]
+	default:
+		return LogSink{}, fmt.Errorf("Unknown log sink %s, expected one of stderr, file, syslog", spec)
+	}
+	for _, option := range options[1:] {
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) != 2 {
+			return LogSink{}, fmt.Errorf("Impossible to parse the option %s of the log sink %s", option, spec)
+		}
+		var err error
+		switch key, value := keyValue[0], keyValue[1]; key {
+		case "level":
+			sink.Level, err = log.ParseLevel(value)
+		case "format":
+			if value != "text" && value != "json" {
+				err = fmt.Errorf("Unknown format %s, expected text or json", value)
+			}
+			sink.Format = value
+		case "max-size":
+			if sink.Kind != "file" {
+				err = fmt.Errorf("Only the file log sinks can be rotated")
+			} else {
+				sink.MaxSize, err = strconv.ParseInt(value, 10, 64)
+			}
+		default:
+			err = fmt.Errorf("Unknown option %s", key)
+		}
+		if err != nil {
+			return LogSink{}, fmt.Errorf("Error in the log sink %s: %s", spec, err)
+		}
+	}
+	return sink, nil
+}
+
+// ConfigLogging sends the log messages to all the sinks, each one receives
+// only the messages at its level or more severe, the standard output of the
+// logger is not used anymore
+func ConfigLogging(sinks []LogSink) error {
+	hooks := make(log.LevelHooks)
+	level := log.PanicLevel
+	for _, sink := range sinks {
+		hook, err := newSinkHook(sink)
+		if err != nil {
+			return err
+		}
+		hooks.Add(hook)
+		if sink.Level > level {
+			level = sink.Level
+		}
+	}
+	log.StandardLogger().ReplaceHooks(hooks)
+	log.SetOutput(ioutil.Discard)
+	log.SetLevel(level)
+	return nil
+}
+
+// a logrus hook writing the entries at its level into a sink
+type sinkHook struct {
+	levels    []log.Level
+	formatter log.Formatter
+	write     func(level log.Level, line []byte) error
+}
+
+func newSinkHook(sink LogSink) (*sinkHook, error) {
+	hook := &sinkHook{levels: make([]log.Level, 0)}
+	for _, level := range log.AllLevels {
+		if level <= sink.Level {
+			hook.levels = append(hook.levels, level)
+		}
+	}
+	if sink.Format == "json" {
+		hook.formatter = &log.JSONFormatter{}
+	} else {
+		hook.formatter = &log.TextFormatter{DisableColors: sink.Kind != "stderr", FullTimestamp: true}
+	}
+
+	switch sink.Kind {
+	case "stderr":
+		hook.write = func(level log.Level, line []byte) error {
+			_, err := logStderr.Write(line)
+			return err
+		}
+	case "file":
+		file := &rotatingFile{path: sink.Path, maxSize: sink.MaxSize}
+		if err := file.open(); err != nil {
+			return nil, err
+		}
+		hook.write = func(level log.Level, line []byte) error {
+			return file.write(line)
+		}
+	case "syslog":
+		writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "ducc")
+		if err != nil {
+			return nil, err
+		}
+		hook.write = func(level log.Level, line []byte) error {
+			return writeSyslog(writer, level, string(line))
+		}
+	default:
+		return nil, fmt.Errorf("Unknown log sink: %s", sink.Kind)
+	}
+	return hook, nil
+}
+
+func (h *sinkHook) Levels() []log.Level {
+	return h.levels
+}
+
+// the hooks are fired holding the lock of the logger, so the writes are
+// already serialized
+func (h *sinkHook) Fire(entry *log.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	return h.write(entry.Level, line)
+}
+
+func writeSyslog(writer *syslog.Writer, level log.Level, line string) error {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return writer.Crit(line)
+	case log.ErrorLevel:
+		return writer.Err(line)
+	case log.WarnLevel:
+		return writer.Warning(line)
+	case log.InfoLevel:
+		return writer.Info(line)
+	}
+	return writer.Debug(line)
+}
+
+// a file in append mode, moved into path.1 when bigger than maxSize
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, stat.Size()
+	return nil
+}
+
+func (f *rotatingFile) write(line []byte) error {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		f.file.Close()
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
@@ -0,0 +1,99 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestConfigLoggingMultipleSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_log_sinks")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	logger := log.StandardLogger()
+	previousOut, previousLevel, previousStderr := logger.Out, logger.GetLevel(), logStderr
+	defer func() {
+		logger.ReplaceHooks(make(log.LevelHooks))
+		logger.SetOutput(previousOut)
+		logger.SetLevel(previousLevel)
+		logStderr = previousStderr
+	}()
+	var stderr bytes.Buffer
+	logStderr = &stderr
+
+	logFile := filepath.Join(dir, "ducc.log")
+	var sinks []LogSink
+	for _, spec := range []string{"stderr", "file:" + logFile + ",level=debug,format=json"} {
+		sink, err := ParseLogSink(spec, log.InfoLevel)
+		if err != nil {
+			t.Fatalf("Error in parsing the log sink %s: %s", spec, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if err = ConfigLogging(sinks); err != nil {
+		t.Fatalf("Error in configuring the log sinks: %s", err)
+	}
+
+	Log().WithFields(log.Fields{"image": "redis"}).Info("Reaching both the sinks")
+	Log().Debug("Reaching only the file")
+
+	content, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("Error in reading the log file: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"msg":"Reaching both the sinks"`) || !strings.Contains(lines[0], `"image":"redis"`) || !strings.Contains(lines[1], "Reaching only the file") {
+		t.Errorf("Error in the messages of the file sink: %s", content)
+	}
+	if !strings.Contains(stderr.String(), `msg="Reaching both the sinks"`) || strings.Contains(stderr.String(), "Reaching only the file") {
+		t.Errorf("Error in the messages of the stderr sink: %s", stderr.String())
+	}
+}
+
+func TestRotatingFileLogSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_log_sinks")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ducc.log")
+	file := &rotatingFile{path: path, maxSize: 10}
+	if err = file.open(); err != nil {
+		t.Fatalf("Error in opening the log file: %s", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		if err = file.write([]byte(line)); err != nil {
+			t.Fatalf("Error in writing the log file: %s", err)
+		}
+	}
+	file.file.Close()
+	if content, _ := ioutil.ReadFile(path); string(content) != "third\n" {
+		t.Errorf("Error in the rotated log file: %q", content)
+	}
+	if content, _ := ioutil.ReadFile(path + ".1"); string(content) != "second\n" {
+		t.Errorf("Error in the previous log file: %q", content)
+	}
+}
+
+func TestParseLogSink(t *testing.T) {
+	sink, err := ParseLogSink("file:/var/log/ducc.log,level=warning,format=json,max-size=100", log.InfoLevel)
+	if err != nil {
+		t.Fatalf("Error in parsing the log sink: %s", err)
+	}
+	expected := LogSink{Kind: "file", Path: "/var/log/ducc.log", MaxSize: 100, Level: log.WarnLevel, Format: "json"}
+	if sink != expected {
+		t.Errorf("Error in parsing the log sink, expected %+v, got %+v", expected, sink)
+	}
+	for _, spec := range []string{"", "file", "file:", "stderr:/tmp/x", "kafka", "stderr,level=loud", "stderr,format=xml", "stderr,max-size=10", "syslog,color"} {
+		if _, err := ParseLogSink(spec, log.InfoLevel); err == nil {
+			t.Errorf("Error, invalid log sink %q accepted", spec)
+		}
+	}
+}
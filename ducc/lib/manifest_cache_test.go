@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+func TestManifestCacheFollowsTheTag(t *testing.T) {
+	defer func(cache *da.TagCache) { TagCache = cache }(TagCache)
+	TagCache = da.NewTagCache(256, time.Hour)
+
+	var mutex sync.Mutex
+	gets, heads := 0, 0
+	config := "sha256:aaabbbccc"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		manifest := strings.Replace(testManifest, "sha256:aaabbbccc", config, 1)
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest))))
+		if r.Method == "GET" {
+			gets++
+			w.Write([]byte(manifest))
+		}
+		if r.Method == "HEAD" {
+			heads++
+		}
+	}))
+	defer server.Close()
+	getConfig := func() string {
+		img := testImageFromServer(t, server)
+		manifest, err := img.GetManifest()
+		if err != nil {
+			t.Fatalf("Error in getting the manifest: %s", err)
+		}
+		return manifest.Config.Digest
+	}
+
+	if digest := getConfig(); digest != "sha256:aaabbbccc" {
+		t.Errorf("Got wrong manifest: %s", digest)
+	}
+	// the authentication to resolve the tag, then the authentication and the
+	// download of the manifest
+	if gets != 3 || heads != 1 {
+		t.Errorf("Error, expected 3 GET and 1 HEAD requests, got %d and %d", gets, heads)
+	}
+	// the tag is not resolved again until its resolution expires
+	getConfig()
+	if gets != 3 || heads != 1 {
+		t.Errorf("Error, the manifest was not served from the cache, got %d GET and %d HEAD requests", gets, heads)
+	}
+
+	mutex.Lock()
+	config = "sha256:dddeeefff"
+	mutex.Unlock()
+	if digest := getConfig(); digest != "sha256:aaabbbccc" {
+		t.Errorf("Error, the tag was resolved again before its expiration: %s", digest)
+	}
+
+	// as if the resolution of the tag expired
+	TagCache = da.NewTagCache(256, time.Hour)
+	if digest := getConfig(); digest != "sha256:dddeeefff" {
+		t.Errorf("Error, the cache served the manifest of the old tag: %s", digest)
+	}
+}
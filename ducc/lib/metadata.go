@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// limits applied when reading the metadata files (origin.json, remove-schedule.json)
+// a corrupted, or malicious, file should not be able to exhaust the memory
+// or to hang the process
+var (
+	MaxMetadataFileSize int64 = 64 * 1024 * 1024
+	MetadataReadTimeout       = 60 * time.Second
+)
+
+// if true the metadata files (origin.json, remove-schedule.json) are written
+// gzip compressed, with the compressedMetadataSuffix appended to their name.
+// The readers handle both the compressed and the uncompressed files.
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var CompressMetadata = false
+
+const compressedMetadataSuffix = ".gz"
+
+type MetadataTooLargeError struct {
+	Path  string
+	Limit int64
+}
+
+func (e *MetadataTooLargeError) Error() string {
+	return fmt.Sprintf("Metadata file %s is larger than the limit of %d bytes", e.Path, e.Limit)
+}
+
+type MetadataReadTimeoutError struct {
+	Path    string
+	Timeout time.Duration
+}
+
+func (e *MetadataReadTimeoutError) Error() string {
+	return fmt.Sprintf("Timeout of %s reading the metadata file %s", e.Timeout, e.Path)
+}
+
+// true if the metadata file at path exists, either compressed or not
+func metadataFileExists(path string) bool {
+	for _, candidate := range []string{path + compressedMetadataSuffix, path} {
+		if _, err := os.Lstat(candidate); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// read the whole metadata file at path, failing if the file is larger than
+// MaxMetadataFileSize or if the read takes longer than MetadataReadTimeout
+// if a compressed version of the file exists it is preferred, and the limit
+// applies to the decompressed content
+func readMetadataFile(path string) ([]byte, error) {
+	type readResult struct {
+		content []byte
+		err     error
+	}
+	limit := MaxMetadataFileSize
+	// buffered, if we time out nobody is going to read the result
+	result := make(chan readResult, 1)
+	go func() {
+		var reader io.Reader
+		file, err := os.Open(path + compressedMetadataSuffix)
+		if err == nil {
+			defer file.Close()
+			gzipReader, err := gzip.NewReader(file)
+			if err != nil {
+				result <- readResult{nil, err}
+				return
+			}
+			defer gzipReader.Close()
+			reader = gzipReader
+		} else {
+			file, err = os.Open(path)
+			if err != nil {
+				result <- readResult{nil, err}
+				return
+			}
+			defer file.Close()
+			reader = file
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+		if err == nil && int64(len(content)) > limit {
+			content, err = nil, &MetadataTooLargeError{Path: path, Limit: limit}
+		}
+		result <- readResult{content, err}
+	}()
+
+	timeout := MetadataReadTimeout
+	select {
+	case r := <-result:
+		return r.content, r.err
+	case <-time.After(timeout):
+		return nil, &MetadataReadTimeoutError{Path: path, Timeout: timeout}
+	}
+}
+
+// write the metadata file at path, compressed if CompressMetadata is set
+// the other version of the file, if any, is removed so that the readers do
+// not find stale content
+func writeMetadataFile(path string, content []byte, perm os.FileMode) error {
+	if !CompressMetadata {
+		err := ioutil.WriteFile(path, content, perm)
+		if err != nil {
+			return err
+		}
+		return removeIfExists(path + compressedMetadataSuffix)
+	}
+
+	file, err := os.OpenFile(path+compressedMetadataSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	gzipWriter := gzip.NewWriter(file)
+	_, err = gzipWriter.Write(content)
+	if errClose := gzipWriter.Close(); err == nil {
+		err = errClose
+	}
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return err
+	}
+	return removeIfExists(path)
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
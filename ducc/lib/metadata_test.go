@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadMetadataFileSizeCap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_metadata")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defaultLimit := MaxMetadataFileSize
+	defer func() { MaxMetadataFileSize = defaultLimit }()
+	MaxMetadataFileSize = 16
+
+	small := filepath.Join(dir, "small.json")
+	ioutil.WriteFile(small, []byte(`{"origin":[]}`), 0644)
+	content, err := readMetadataFile(small)
+	if err != nil {
+		t.Errorf("Error in reading a file smaller than the limit: %s", err)
+	}
+	if string(content) != `{"origin":[]}` {
+		t.Errorf("Wrong content read: %s", content)
+	}
+
+	large := filepath.Join(dir, "large.json")
+	ioutil.WriteFile(large, []byte(`{"origin":["sha256:aaabbbccc"]}`), 0644)
+	_, err = readMetadataFile(large)
+	if _, ok := err.(*MetadataTooLargeError); !ok {
+		t.Errorf("Expected MetadataTooLargeError, got: %v", err)
+	}
+}
+
+func TestMetadataCompressionRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata_compression")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(compress bool) { CompressMetadata = compress }(CompressMetadata)
+
+	path := filepath.Join(dir, "origin.json")
+	if metadataFileExists(path) {
+		t.Errorf("Error, metadata file reported as existing before being written")
+	}
+
+	// legacy, uncompressed file
+	ioutil.WriteFile(path, []byte(`{"origin":["legacy"]}`), 0644)
+	content, err := readMetadataFile(path)
+	if err != nil || string(content) != `{"origin":["legacy"]}` {
+		t.Errorf("Error in reading the legacy metadata file: %s %v", content, err)
+	}
+
+	CompressMetadata = true
+	if err = writeMetadataFile(path, []byte(`{"origin":["compressed"]}`), 0644); err != nil {
+		t.Fatalf("Error in writing the compressed metadata file: %s", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Error, the uncompressed file was not removed")
+	}
+	if !metadataFileExists(path) {
+		t.Errorf("Error, compressed metadata file not found")
+	}
+	content, err = readMetadataFile(path)
+	if err != nil || string(content) != `{"origin":["compressed"]}` {
+		t.Errorf("Error in reading the compressed metadata file: %s %v", content, err)
+	}
+
+	CompressMetadata = false
+	if err = writeMetadataFile(path, []byte(`{"origin":["plain"]}`), 0644); err != nil {
+		t.Fatalf("Error in writing the uncompressed metadata file: %s", err)
+	}
+	if _, err = os.Stat(path + compressedMetadataSuffix); !os.IsNotExist(err) {
+		t.Errorf("Error, the compressed file was not removed")
+	}
+	content, err = readMetadataFile(path)
+	if err != nil || string(content) != `{"origin":["plain"]}` {
+		t.Errorf("Error in reading back the uncompressed metadata file: %s %v", content, err)
+	}
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// map from the registry (ex: registry.hub.docker.com) to the list of mirrors
+// to try, in order, before to contact the registry itself.
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var (
+	RegistryMirrors = make(map[string][]string)
+)
+
+// parse a list of mirrors specification and add them to the RegistryMirrors
+// each specification has the form `registry=mirror`, for instance:
+// registry.hub.docker.com=https://docker-mirror.example.com
+// if the mirror does not specify the scheme we assume https
+func AddRegistryMirrors(specs []string) error {
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		splitted := strings.SplitN(spec, "=", 2)
+		if len(splitted) != 2 || splitted[0] == "" || splitted[1] == "" {
+			return fmt.Errorf("Wrong format of the registry mirror, expected `registry=mirror`: %s", spec)
+		}
+		registry := splitted[0]
+		mirror := splitted[1]
+		if !strings.Contains(mirror, "://") {
+			mirror = "https://" + mirror
+		}
+		mirrorUrl, err := url.Parse(mirror)
+		if err != nil {
+			return fmt.Errorf("Impossible to parse the registry mirror %s: %s", spec, err)
+		}
+		if mirrorUrl.Host == "" {
+			return fmt.Errorf("Impossible to identify the host of the registry mirror: %s", spec)
+		}
+		RegistryMirrors[registry] = append(RegistryMirrors[registry],
+			fmt.Sprintf("%s://%s", mirrorUrl.Scheme, mirrorUrl.Host))
+	}
+	return nil
+}
+
+// return the list of endpoints where to look for the image, first the
+// mirrors, in the order they were configured, and last the registry of the
+// image itself. Each endpoint is a copy of the image where only the scheme and
+// the registry are changed.
+func (img *Image) getEndpoints() []*Image {
+	endpoints := make([]*Image, 0, len(RegistryMirrors[img.Registry])+1)
+	for _, mirror := range RegistryMirrors[img.Registry] {
+		mirrorUrl, err := url.Parse(mirror)
+		if err != nil {
+			LogE(err).WithFields(log.Fields{"mirror": mirror}).Warning("Impossible to parse the mirror, skipping")
+			continue
+		}
+		endpoint := *img
+		endpoint.Scheme = mirrorUrl.Scheme
+		endpoint.Registry = mirrorUrl.Host
+		endpoints = append(endpoints, &endpoint)
+	}
+	return append(endpoints, img)
+}
+
+// isMirror returns true if the endpoint is not the registry of the image
+func (img *Image) isMirror(endpoint *Image) bool {
+	return img.Scheme != endpoint.Scheme || img.Registry != endpoint.Registry
+}
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testManifest = `{"SchemaVersion": 2, "Config": {"Digest": "sha256:aaabbbccc"}, "Layers": [{"Digest": "sha256:dddeeefff"}]}`
+
+func newTestRegistry(status int, hits *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*hits++
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(testManifest))))
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			w.Write([]byte(testManifest))
+		}
+	}))
+}
+
+func testImageFromServer(t *testing.T, server *httptest.Server) Image {
+	img, err := ParseImage(server.URL + "/library/redis:5")
+	if err != nil {
+		t.Fatalf("Error in parsing the test image: %s", err)
+	}
+	return img
+}
+
+func TestAddRegistryMirrors(t *testing.T) {
+	defer func() { RegistryMirrors = make(map[string][]string) }()
+
+	err := AddRegistryMirrors([]string{"registry.hub.docker.com=mirror.example.com", "registry.hub.docker.com=http://mirror2.example.com:5000/"})
+	if err != nil {
+		t.Errorf("Error in adding the mirrors: %s", err)
+	}
+	mirrors := RegistryMirrors["registry.hub.docker.com"]
+	if len(mirrors) != 2 {
+		t.Fatalf("Expected 2 mirrors, got %d", len(mirrors))
+	}
+	if mirrors[0] != "https://mirror.example.com" {
+		t.Errorf("Error in parsing the first mirror: %s", mirrors[0])
+	}
+	if mirrors[1] != "http://mirror2.example.com:5000" {
+		t.Errorf("Error in parsing the second mirror: %s", mirrors[1])
+	}
+
+	err = AddRegistryMirrors([]string{"mirror.example.com"})
+	if err == nil {
+		t.Errorf("Mirror without registry should return an error")
+	}
+}
+
+func TestManifestFromMirrorFirst(t *testing.T) {
+	defer func() { RegistryMirrors = make(map[string][]string) }()
+
+	mirrorHits, originHits := 0, 0
+	mirror := newTestRegistry(http.StatusOK, &mirrorHits)
+	defer mirror.Close()
+	origin := newTestRegistry(http.StatusOK, &originHits)
+	defer origin.Close()
+
+	img := testImageFromServer(t, origin)
+	RegistryMirrors[img.Registry] = []string{mirror.URL}
+
+	manifest, err := img.GetManifest()
+	if err != nil {
+		t.Fatalf("Error in getting the manifest: %s", err)
+	}
+	if manifest.Config.Digest != "sha256:aaabbbccc" {
+		t.Errorf("Got wrong manifest: %s", manifest.Config.Digest)
+	}
+	if mirrorHits == 0 {
+		t.Errorf("The mirror was not contacted")
+	}
+	if originHits != 0 {
+		t.Errorf("The origin was contacted even if the mirror had the manifest")
+	}
+}
+
+func TestManifestFallbackToOrigin(t *testing.T) {
+	defer func() { RegistryMirrors = make(map[string][]string) }()
+
+	mirrorHits, originHits := 0, 0
+	mirror := newTestRegistry(http.StatusInternalServerError, &mirrorHits)
+	defer mirror.Close()
+	origin := newTestRegistry(http.StatusOK, &originHits)
+	defer origin.Close()
+
+	img := testImageFromServer(t, origin)
+	RegistryMirrors[img.Registry] = []string{mirror.URL}
+
+	manifest, err := img.GetManifest()
+	if err != nil {
+		t.Fatalf("Error in getting the manifest: %s", err)
+	}
+	if manifest.Config.Digest != "sha256:aaabbbccc" {
+		t.Errorf("Got wrong manifest: %s", manifest.Config.Digest)
+	}
+	if mirrorHits == 0 {
+		t.Errorf("The mirror was not contacted")
+	}
+	if originHits == 0 {
+		t.Errorf("The origin was not contacted after the mirror failure")
+	}
+}
+
+func TestImageConfigFromMirror(t *testing.T) {
+	defer func() { RegistryMirrors = make(map[string][]string) }()
+
+	config := `{"architecture": "arm64", "rootfs": {"type": "layers", "diff_ids": ["sha256:` + strings.Repeat("1", 64) + `"]}}`
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(config)))
+	manifest := `{"SchemaVersion": 2, "Config": {"Digest": "` + configDigest + `"}, "Layers": [{"Digest": "sha256:dddeeefff"}]}`
+
+	mirrorHits, originHits := 0, 0
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrorHits++
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest))))
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			w.Write([]byte(config))
+			return
+		}
+		w.Write([]byte(manifest))
+	}))
+	defer mirror.Close()
+	origin := newTestRegistry(http.StatusInternalServerError, &originHits)
+	defer origin.Close()
+
+	img := testImageFromServer(t, origin)
+	RegistryMirrors[img.Registry] = []string{mirror.URL}
+
+	imageConfig, err := img.GetImageConfig(context.Background())
+	if err != nil {
+		t.Fatalf("Error in getting the configuration: %s", err)
+	}
+	if len(imageConfig.RootFS.DiffIDs) != 1 {
+		t.Errorf("Got wrong configuration: %+v", imageConfig)
+	}
+	if originHits != 0 {
+		t.Errorf("The origin was contacted even if the mirror had the configuration")
+	}
+}
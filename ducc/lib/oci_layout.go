@@ -0,0 +1,236 @@
+package lib
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// images can also be read from an OCI layout directory (index.json plus the
+// blobs/ store) instead of a registry, they are written as
+// oci:/path/to/layout[:tag][@digest]
+const ociLayoutPrefix = "oci:"
+
+// the fake registry of the images from OCI layouts, it only shows up in the
+// paths and in the names of those images
+const ociLayoutRegistry = "oci-layout"
+
+// the platform picked from the multi-arch images in the OCI layouts
+// those flags are populated in the main `rootCmd` (cmd/root.go)
+var (
+	OCIPlatformOS           = "linux"
+	OCIPlatformArchitecture = "amd64"
+)
+
+const (
+	ociImageIndexMediaType        = "application/vnd.oci.image.index.v1+json"
+	dockerManifestListMediaType   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ociImageRefNameAnnotation     = "org.opencontainers.image.ref.name"
+	ociUncompressedLayerMediaType = "application/vnd.oci.image.layer.v1.tar"
+)
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// parse oci:/path/to/layout[:tag][@digest], a relative path is relative to
+// the current directory, the WholeName of the images, as
+// oci://oci-layout/path/to/layout:tag, is accepted as well.
+// The path may contain `:` and `@` as well, so the digest and the tag are
+// looked for from the right, and only where they can not be part of the path,
+// without any `/` after them. Among the possible splits the one where the path
+// is an existing directory wins, if none of them is we take the tag and the
+// digest whenever possible.
+func parseOCILayoutImage(image string) (Image, error) {
+	ref := strings.TrimPrefix(image, ociLayoutPrefix)
+	ref = strings.TrimPrefix(ref, "//"+ociLayoutRegistry)
+	type split struct{ dir, tag, digest string }
+	splitTag := func(s split) (split, bool) {
+		i := strings.LastIndex(s.dir, ":")
+		if i < 0 || strings.Contains(s.dir[i+1:], "/") {
+			return s, false
+		}
+		return split{dir: s.dir[:i], tag: s.dir[i+1:], digest: s.digest}, true
+	}
+	splits := []split{{dir: ref}}
+	// the digest and the tag whenever possible
+	chosen := split{dir: ref}
+	if i := strings.LastIndex(ref, "@"); i >= 0 && strings.Contains(ref[i+1:], ":") && !strings.Contains(ref[i+1:], "/") {
+		chosen = split{dir: ref[:i], digest: ref[i+1:]}
+		splits = append(splits, chosen)
+	}
+	if withTag, ok := splitTag(chosen); ok {
+		chosen = withTag
+		splits = append(splits, chosen)
+	}
+	// what looked like a digest may be a part of the path followed by a tag
+	if withTag, ok := splitTag(split{dir: ref}); ok && chosen.digest != "" {
+		splits = append(splits, withTag)
+	}
+	for _, s := range splits {
+		if info, err := os.Stat(s.dir); err == nil && info.IsDir() {
+			chosen = s
+			break
+		}
+	}
+	dir, tag, digest := chosen.dir, chosen.tag, chosen.digest
+	if dir == "" {
+		return Image{}, fmt.Errorf("Impossible to find the directory of the OCI layout: %s", image)
+	}
+	if strings.Contains(tag, "*") {
+		return Image{}, fmt.Errorf("Wildcards are not supported for the images in OCI layouts: %s", image)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{
+		Scheme:     strings.TrimSuffix(ociLayoutPrefix, ":"),
+		Registry:   ociLayoutRegistry,
+		Repository: strings.TrimPrefix(dir, "/"),
+		Tag:        tag,
+		Digest:     digest,
+		Layout:     dir,
+	}, nil
+}
+
+// the path of the blob with the digest provided inside the layout
+func ociBlobPath(layout, digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(digest, "/\\") {
+		return "", fmt.Errorf("Malformed digest of blob: %s", digest)
+	}
+	return filepath.Join(layout, "blobs", parts[0], parts[1]), nil
+}
+
+// read the whole blob, verifying its digest
+func readOCIBlob(layout, digest string) ([]byte, error) {
+	path, err := ociBlobPath(layout, digest)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	verified, err := newDigestVerifier(file, digest)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(verified)
+}
+
+// return the manifest of the image, following the index.json of the layout
+// and, for the multi-arch images, the index of the image itself
+func (img *Image) getOCILayoutManifest() ([]byte, error) {
+	data, err := ioutil.ReadFile(filepath.Join(img.Layout, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	var index ociIndex
+	if err = json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("Error in parsing the index.json of the OCI layout %s: %s", img.Layout, err)
+	}
+	descriptor, err := img.selectOCIManifest(index)
+	if err != nil {
+		return nil, err
+	}
+	// the nested indexes are the multi-arch images
+	for depth := 0; descriptor.MediaType == ociImageIndexMediaType || descriptor.MediaType == dockerManifestListMediaType; depth++ {
+		if depth > 1 {
+			return nil, fmt.Errorf("Too many nested indexes in the OCI layout %s", img.Layout)
+		}
+		data, err = readOCIBlob(img.Layout, descriptor.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var platforms ociIndex
+		if err = json.Unmarshal(data, &platforms); err != nil {
+			return nil, fmt.Errorf("Error in parsing the index %s of the OCI layout %s: %s", descriptor.Digest, img.Layout, err)
+		}
+		descriptor, err = selectOCIPlatform(platforms, OCIPlatformOS, OCIPlatformArchitecture)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return readOCIBlob(img.Layout, descriptor.Digest)
+}
+
+// pick, from the index.json, the manifest by digest or by tag, if the image
+// has neither of them the index must contain a single manifest
+func (img *Image) selectOCIManifest(index ociIndex) (ociDescriptor, error) {
+	for _, descriptor := range index.Manifests {
+		if img.Digest != "" {
+			if descriptor.Digest == img.Digest {
+				return descriptor, nil
+			}
+			continue
+		}
+		if img.Tag != "" && descriptor.Annotations[ociImageRefNameAnnotation] == img.Tag {
+			return descriptor, nil
+		}
+	}
+	if img.Digest == "" && img.Tag == "" && len(index.Manifests) == 1 {
+		return index.Manifests[0], nil
+	}
+	return ociDescriptor{}, fmt.Errorf("Image %s not found in the OCI layout %s", img.GetReference(), img.Layout)
+}
+
+func selectOCIPlatform(index ociIndex, os, architecture string) (ociDescriptor, error) {
+	for _, descriptor := range index.Manifests {
+		if descriptor.Platform != nil && descriptor.Platform.OS == os && descriptor.Platform.Architecture == architecture {
+			return descriptor, nil
+		}
+	}
+	return ociDescriptor{}, fmt.Errorf("No image for the platform %s/%s in the index", os, architecture)
+}
+
+// open the layer from the blobs of the layout, the stream returned is the
+// uncompressed tar, verified against the digest of the layer
+func (img *Image) openOCILayoutLayer(digest, mediaType string) (downloadedLayer, error) {
+	path, err := ociBlobPath(img.Layout, digest)
+	if err != nil {
+		return downloadedLayer{}, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return downloadedLayer{}, err
+	}
+	verified, err := newDigestVerifier(file, digest)
+	if err != nil {
+		file.Close()
+		return downloadedLayer{}, err
+	}
+	var layer io.ReadCloser = ioutil.NopCloser(verified)
+	if mediaType != ociUncompressedLayerMediaType {
+		gread, err := gzip.NewReader(verified)
+		if err != nil {
+			file.Close()
+			return downloadedLayer{}, err
+		}
+		layer = gread
+	}
+	return downloadedLayer{Name: digest,
+		Path: scheduledReadCloser{ReadCloser: layer, body: file, release: func() {}}}, nil
+}
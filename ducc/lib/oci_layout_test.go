@@ -0,0 +1,195 @@
+package lib
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// write the blob in the layout, returning its digest
+func writeOCIBlob(t *testing.T, layout string, blob []byte) string {
+	sum := fmt.Sprintf("%x", sha256.Sum256(blob))
+	os.MkdirAll(filepath.Join(layout, "blobs", "sha256"), 0755)
+	if err := ioutil.WriteFile(filepath.Join(layout, "blobs", "sha256", sum), blob, 0644); err != nil {
+		t.Fatalf("Error in writing the blob: %s", err)
+	}
+	return "sha256:" + sum
+}
+
+func writeOCIJSON(t *testing.T, layout string, v interface{}) string {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Error in marshaling the blob: %s", err)
+	}
+	return writeOCIBlob(t, layout, blob)
+}
+
+// a layout with a multi-arch image, tagged v1, with an image for amd64 and
+// one for arm64, each of a single layer
+func newTestOCILayout(t *testing.T) string {
+	layout, err := ioutil.TempDir("", "test_oci_layout")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	var platforms []ociDescriptor
+	for _, arch := range []string{"arm64", "amd64"} {
+		layerTar := buildTestTar(t, &tar.Header{Name: "etc/arch", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(arch))})
+		diffID := fmt.Sprintf("sha256:%x", sha256.Sum256(layerTar.Bytes()))
+		layerDigest := writeOCIBlob(t, layout, gzipTestLayer(t, &tar.Header{Name: "etc/arch", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(arch))}))
+
+		config := map[string]interface{}{
+			"architecture": arch,
+			"os":           "linux",
+			"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{diffID}},
+		}
+		manifest := map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+			"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": writeOCIJSON(t, layout, config)},
+			"layers":        []map[string]interface{}{{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": layerDigest}},
+		}
+		platforms = append(platforms, ociDescriptor{
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Digest:    writeOCIJSON(t, layout, manifest),
+			Platform:  &ociPlatform{OS: "linux", Architecture: arch},
+		})
+	}
+	imageIndex := writeOCIJSON(t, layout, ociIndex{SchemaVersion: 2, MediaType: ociImageIndexMediaType, Manifests: platforms})
+	index := ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{{
+		MediaType:   ociImageIndexMediaType,
+		Digest:      imageIndex,
+		Annotations: map[string]string{ociImageRefNameAnnotation: "v1"},
+	}}}
+	data, _ := json.Marshal(index)
+	ioutil.WriteFile(filepath.Join(layout, "index.json"), data, 0644)
+	return layout
+}
+
+func TestOCILayoutImage(t *testing.T) {
+	layout := newTestOCILayout(t)
+	defer os.RemoveAll(layout)
+
+	img, err := ParseImage("oci:" + layout + ":v1")
+	if err != nil {
+		t.Fatalf("Error in parsing the image in the OCI layout: %s", err)
+	}
+	if img.Layout != layout || img.Tag != "v1" {
+		t.Errorf("Error in parsing the image in the OCI layout: %+v", img)
+	}
+	// the wishes parse again the WholeName of the images
+	if again, err := ParseImage(img.WholeName()); err != nil || again.Layout != layout || again.Tag != "v1" {
+		t.Errorf("Error in parsing the WholeName of the image in the OCI layout: %+v %v", again, err)
+	}
+	manifest, err := img.GetManifest()
+	if err != nil {
+		t.Fatalf("Error in getting the manifest from the OCI layout: %s", err)
+	}
+	config, err := img.GetImageConfig(context.Background())
+	if err != nil {
+		t.Fatalf("Error in getting the configuration from the OCI layout: %s", err)
+	}
+	if err = ValidateManifestAgainstConfig(manifest, config); err != nil {
+		t.Errorf("Error, manifest and configuration from the OCI layout do not match: %s", err)
+	}
+
+	rootPath, err := ioutil.TempDir("", "test_oci_layout_layers")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(rootPath)
+	layersChan := make(chan downloadedLayer, 3)
+	manifestChan := make(chan string, 1)
+	if err = img.GetLayers(context.Background(), layersChan, manifestChan, make(chan bool), rootPath); err != nil {
+		t.Fatalf("Error in getting the layers from the OCI layout: %s", err)
+	}
+	layers := 0
+	for layer := range layersChan {
+		layers++
+		entries := readTarEntries(t, layer.Path)
+		layer.Path.Close()
+		// the content of the test layers is the size of the name of the arch
+		if content := entries["etc/arch"]; len(content) != len("amd64") {
+			t.Errorf("Error, wrong layer for the platform: %q", content)
+		}
+		if layer.Name != manifest.Layers[0].Digest {
+			t.Errorf("Error in the name of the layer: %s", layer.Name)
+		}
+	}
+	if layers != 1 {
+		t.Errorf("Error, expected 1 layer from the OCI layout, got %d", layers)
+	}
+}
+
+func TestOCILayoutImagePlatformSelection(t *testing.T) {
+	layout := newTestOCILayout(t)
+	defer os.RemoveAll(layout)
+	defer func(os, arch string) { OCIPlatformOS, OCIPlatformArchitecture = os, arch }(OCIPlatformOS, OCIPlatformArchitecture)
+
+	for _, arch := range []string{"amd64", "arm64"} {
+		OCIPlatformArchitecture = arch
+		img, _ := ParseImage("oci:" + layout + ":v1")
+		config, err := img.GetImageConfig(context.Background())
+		if err != nil {
+			t.Fatalf("Error in getting the configuration for %s: %s", arch, err)
+		}
+		var platform ociPlatform
+		blob, _ := readOCIBlob(layout, img.Manifest.Config.Digest)
+		json.Unmarshal(blob, &platform)
+		if platform.Architecture != arch || len(config.RootFS.DiffIDs) != 1 {
+			t.Errorf("Error, selected the image for %s instead of %s", platform.Architecture, arch)
+		}
+	}
+
+	OCIPlatformArchitecture = "s390x"
+	img, _ := ParseImage("oci:" + layout + ":v1")
+	if _, err := img.GetManifest(); err == nil {
+		t.Errorf("Error, got a manifest for a platform not in the index")
+	}
+	img, _ = ParseImage("oci:" + layout + ":v2")
+	if _, err := img.GetManifest(); err == nil {
+		t.Errorf("Error, got a manifest for a tag not in the layout")
+	}
+}
+
+func TestOCILayoutImagePathWithColon(t *testing.T) {
+	layout := newTestOCILayout(t)
+	defer os.RemoveAll(layout)
+	withColon := layout + ":2020-05-01@10:00"
+	if err := os.Rename(layout, withColon); err != nil {
+		t.Fatalf("Error in renaming the OCI layout: %s", err)
+	}
+	defer os.RemoveAll(withColon)
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+	for ref, expected := range map[string]Image{
+		withColon + ":v1":             {Layout: withColon, Tag: "v1"},
+		withColon + "@" + digest:      {Layout: withColon, Digest: digest},
+		withColon + ":v1@" + digest:   {Layout: withColon, Tag: "v1", Digest: digest},
+		withColon:                     {Layout: withColon},
+		layout + ":2020-05-01:latest": {Layout: layout + ":2020-05-01", Tag: "latest"},
+	} {
+		img, err := ParseImage("oci:" + ref)
+		if err != nil {
+			t.Errorf("Error in parsing the image %s: %s", ref, err)
+			continue
+		}
+		if img.Layout != expected.Layout || img.Tag != expected.Tag || img.Digest != expected.Digest {
+			t.Errorf("Error in parsing the image %s: %+v", ref, img)
+		}
+		if again, err := ParseImage(img.WholeName()); err != nil || again.Layout != img.Layout || again.Tag != img.Tag || again.Digest != img.Digest {
+			t.Errorf("Error in parsing the WholeName of the image %s: %+v %v", ref, again, err)
+		}
+	}
+
+	img, _ := ParseImage("oci:" + withColon + ":v1")
+	if _, err := img.GetManifest(); err != nil {
+		t.Errorf("Error in getting the manifest from the OCI layout: %s", err)
+	}
+}
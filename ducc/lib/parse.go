@@ -4,9 +4,57 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+
+	da "github.com/cvmfs/ducc/docker-api"
 )
 
+// docker.io does not serve the registry API, the images in the docker hub are
+// requested to this host
+const dockerHubRegistry = "registry.hub.docker.com"
+
 func ParseImage(image string) (img Image, err error) {
+	if strings.HasPrefix(image, ociLayoutPrefix) {
+		return parseOCILayoutImage(image)
+	}
+	if !strings.Contains(image, "://") {
+		return parseImageReference(image)
+	}
+	return parseImageURL(image)
+}
+
+// the images without the scheme are references in the docker syntax, like
+// `ubuntu` or `registry:5000/foo/bar@sha256:...`, they are normalized with
+// the docker defaults
+func parseImageReference(image string) (Image, error) {
+	// the wildcards are not valid tags for docker, we expand them later
+	var wildcard string
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") && strings.Contains(image[i:], "*") {
+		wildcard = image[i+1:]
+		image = image[:i]
+	}
+	ref, err := da.ParseImageReference(image)
+	if err != nil {
+		return Image{}, err
+	}
+	registry := ref.Registry
+	if registry == da.DefaultRegistry {
+		registry = dockerHubRegistry
+	}
+	img := Image{
+		Scheme:     "https",
+		Registry:   registry,
+		Repository: ref.Repository,
+		Tag:        ref.Tag,
+		Digest:     ref.Digest,
+	}
+	if wildcard != "" {
+		img.Tag = wildcard
+		img.TagWildcard = true
+	}
+	return img, nil
+}
+
+func parseImageURL(image string) (img Image, err error) {
 	url, err := url.Parse(image)
 	if err != nil {
 		return Image{}, err
@@ -1,7 +1,10 @@
 package lib
 
 import (
+	"strings"
 	"testing"
+
+	da "github.com/cvmfs/ducc/docker-api"
 )
 
 func TestParseImageSimple(t *testing.T) {
@@ -138,3 +141,107 @@ func TestParseImageWithoutProtocol(t *testing.T) {
 	// this call might panic if we are not able to manage the string
 	image.GetReference()
 }
+
+func TestParseImageReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	// registry, repository, tag and digest
+	cases := map[string][4]string{
+		"ubuntu":                              {"docker.io", "library/ubuntu", "latest", ""},
+		"ubuntu:20.04":                        {"docker.io", "library/ubuntu", "20.04", ""},
+		"docker.io/library/ubuntu:latest":     {"docker.io", "library/ubuntu", "latest", ""},
+		"index.docker.io/ubuntu":              {"docker.io", "library/ubuntu", "latest", ""},
+		"registry.hub.docker.com/foo/bar":     {"docker.io", "foo/bar", "latest", ""},
+		"https://docker.io/library/redis:5":   {"docker.io", "library/redis", "5", ""},
+		"foo/bar":                             {"docker.io", "foo/bar", "latest", ""},
+		"registry:5000/foo/bar@" + digest:     {"registry:5000", "foo/bar", "", digest},
+		"registry:5000/foo/bar:1.0@" + digest: {"registry:5000", "foo/bar", "1.0", digest},
+		"localhost/foo":                       {"localhost", "foo", "latest", ""},
+		"gitlab.example.com/a/b/c:v_1-2":      {"gitlab.example.com", "a/b/c", "v_1-2", ""},
+		"[::1]:5000/foo":                      {"[::1]:5000", "foo", "latest", ""},
+		"ubuntu@" + digest:                    {"docker.io", "library/ubuntu", "", digest},
+		// the URLs get neither the namespace nor the tag
+		"https://registry.hub.docker.com/ubuntu": {"docker.io", "ubuntu", "", ""},
+		"http://registry/foo/bar:1.0":            {"registry", "foo/bar", "1.0", ""},
+	}
+	for input, expected := range cases {
+		ref, err := da.ParseImageReference(input)
+		if err != nil {
+			t.Errorf("Error in parsing %s: %s", input, err)
+			continue
+		}
+		if got := [4]string{ref.Registry, ref.Repository, ref.Tag, ref.Digest}; got != expected {
+			t.Errorf("Error in parsing %s: %+v, expected %+v", input, ref, expected)
+		}
+	}
+
+	if ref, _ := da.ParseImageReference("ubuntu"); ref.String() != "docker.io/library/ubuntu:latest" {
+		t.Errorf("Error in the canonical form of the reference: %s", ref.String())
+	}
+	if ref, _ := da.ParseImageReference("registry:5000/foo@" + digest); ref.String() != "registry:5000/foo@"+digest {
+		t.Errorf("Error in the canonical form of the reference: %s", ref.String())
+	}
+}
+
+func TestParseImageReferenceInvalid(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"   ",
+		"Ubuntu",
+		"docker.io/",
+		"foo//bar",
+		"foo/bar:",
+		"foo/bar:-tag",
+		"foo/bar:" + strings.Repeat("a", 129),
+		"foo/bar@sha256:abc",
+		"foo/bar@sha256:" + strings.Repeat("A", 64),
+		"foo/bar@notadigest",
+		"foo/bar@sha256:" + strings.Repeat("a", 64) + "@sha256:" + strings.Repeat("b", 64),
+		"reg_istry.com/foo",
+		"foo/-bar",
+		"foo/bar:tag:again",
+		"https://ubuntu",
+	} {
+		if ref, err := da.ParseImageReference(input); err == nil {
+			t.Errorf("Error, invalid reference %q accepted as %+v", input, ref)
+		}
+	}
+}
+
+func TestParseImageNormalizesReferences(t *testing.T) {
+	image, err := ParseImage("ubuntu")
+	if err != nil {
+		t.Fatalf("Error in parsing ubuntu: %s", err)
+	}
+	if image.Scheme != "https" || image.Registry != dockerHubRegistry || image.Repository != "library/ubuntu" || image.Tag != "latest" {
+		t.Errorf("Error in normalizing the image: %+v", image)
+	}
+	// the same image, the registry with the scheme is used as is
+	again, err := ParseImage(image.WholeName())
+	if err != nil || again != image {
+		t.Errorf("Error in parsing again the normalized image: %+v %v", again, err)
+	}
+
+	image, err = ParseImage("library/redis:5.*")
+	if err != nil {
+		t.Fatalf("Error in parsing the image with a wildcard: %s", err)
+	}
+	if image.Tag != "5.*" || !image.TagWildcard || image.Repository != "library/redis" {
+		t.Errorf("Error in parsing the image with a wildcard: %+v", image)
+	}
+
+	if _, err = ParseImage("Ubuntu:latest"); err == nil {
+		t.Errorf("Error, invalid image reference accepted")
+	}
+}
+
+func TestParseImageURLWithoutDefaults(t *testing.T) {
+	// the images already in the recipes keep their names, and so their paths
+	// in the repository
+	image, err := ParseImage("https://registry.hub.docker.com/ubuntu")
+	if err != nil {
+		t.Fatalf("Error in parsing the image: %s", err)
+	}
+	if image.Registry != "registry.hub.docker.com" || image.Repository != "ubuntu" || image.Tag != "" {
+		t.Errorf("Error, defaults applied to the image URL: %+v", image)
+	}
+}
@@ -0,0 +1,102 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the permissions that a tree inside the repository should have
+type PermissionSpec struct {
+	// zero leaves the mode of the directories unchanged
+	DirMode os.FileMode
+	// zero leaves the mode of the files unchanged, executable files stay
+	// executable for whoever can read them, as in the ingestion
+	FileMode os.FileMode
+	// if SetOwner is false the ownership is left unchanged
+	SetOwner bool
+	Uid      int
+	Gid      int
+}
+
+// fix in place, in a single transaction, the permissions of the tree at
+// subpath, without ingesting it again.
+// CVMFSRepo: just the name of the repository (ex: unpacked.cern.ch)
+// subpath: the path inside the repository, without the prefix (ex: .flat/ab/abcd)
+func RepairPermissions(CVMFSRepo, subpath string, spec PermissionSpec) error {
+	return repairPermissions(repositoryRoot(CVMFSRepo), CVMFSRepo, subpath, spec)
+}
+
+func repairPermissions(repoRoot, CVMFSRepo, subpath string, spec PermissionSpec) (err error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "repair permissions", "repo": CVMFSRepo, "subpath": subpath})
+	}
+	clean := filepath.Clean(subpath)
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		err = fmt.Errorf("Path %s is outside of the repository", subpath)
+		llog(LogE(err)).Error("Refusing to repair the permissions")
+		return err
+	}
+	root := filepath.Join(repoRoot, clean)
+	if _, err = os.Lstat(root); err != nil {
+		llog(LogE(err)).Error("Impossible to find the tree to repair")
+		return err
+	}
+	modes := treeModes{dir: spec.DirMode, file: spec.FileMode}
+
+	unlock := lockRepository(CVMFSRepo)
+	defer unlock()
+
+	err = currentPublisher().Transaction(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Error in opening the transaction")
+		return err
+	}
+	repaired := 0
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if spec.SetOwner {
+				return os.Lchown(path, spec.Uid, spec.Gid)
+			}
+			return nil
+		}
+		var mode os.FileMode
+		switch {
+		case info.IsDir():
+			mode = modes.dirMode(info.Mode())
+		case info.Mode().IsRegular():
+			mode = modes.fileMode(info.Mode())
+		default:
+			return nil
+		}
+		if mode != info.Mode().Perm() {
+			if err := os.Chmod(path, mode); err != nil {
+				return err
+			}
+			repaired++
+		}
+		if spec.SetOwner {
+			return os.Lchown(path, spec.Uid, spec.Gid)
+		}
+		return nil
+	})
+	if err != nil {
+		llog(LogE(err)).Error("Error in repairing the permissions, aborting the transaction")
+		currentPublisher().Abort(CVMFSRepo)
+		return err
+	}
+	err = currentPublisher().Publish(CVMFSRepo)
+	if err != nil {
+		llog(LogE(err)).Error("Error in publishing the repaired permissions")
+		currentPublisher().Abort(CVMFSRepo)
+		return err
+	}
+	llog(Log()).WithFields(log.Fields{"repaired": repaired}).Info("Repaired permissions")
+	return nil
+}
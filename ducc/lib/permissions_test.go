@@ -0,0 +1,49 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepairPermissions(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+
+	repo := "test.cern.ch"
+	root := filepath.Join(local.RepositoryRoot(repo), ".flat", "ab", "abcd")
+	os.MkdirAll(filepath.Join(root, "bin"), 0700)
+	os.Chmod(root, 0700)
+	ioutil.WriteFile(filepath.Join(root, "bin", "tool"), []byte("#!/bin/sh"), 0700)
+	ioutil.WriteFile(filepath.Join(root, "README"), []byte("readme"), 0600)
+	os.Symlink("README", filepath.Join(root, "link"))
+
+	err := repairPermissions(local.RepositoryRoot(repo), repo, ".flat/ab/abcd", PermissionSpec{DirMode: 0755, FileMode: 0644})
+	if err != nil {
+		t.Fatalf("Error in repairing the permissions: %s", err)
+	}
+	expected := map[string]os.FileMode{
+		"":         0755,
+		"bin":      0755,
+		"bin/tool": 0755,
+		"README":   0644,
+	}
+	for path, mode := range expected {
+		stat, err := os.Stat(filepath.Join(root, path))
+		if err != nil {
+			t.Errorf("Error in stating %s: %s", path, err)
+			continue
+		}
+		if stat.Mode().Perm() != mode {
+			t.Errorf("Error in the mode of %q: %o, expected %o", path, stat.Mode().Perm(), mode)
+		}
+	}
+	if len(local.Operations) != 2 || local.Operations[1] != "publish "+repo {
+		t.Errorf("Error, expected a single transaction and publish: %v", local.Operations)
+	}
+
+	if err = repairPermissions(local.RepositoryRoot(repo), repo, "../etc", PermissionSpec{DirMode: 0755}); err == nil {
+		t.Errorf("Error, path outside the repository accepted")
+	}
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// the cvmfs_server binary, either a name looked up in $PATH or a full path
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var CvmfsServerBinary = "cvmfs_server"
+
+type CvmfsServerNotFoundError struct {
+	Binary string
+	Err    error
+}
+
+func (e *CvmfsServerNotFoundError) Error() string {
+	return fmt.Sprintf("cvmfs_server not found (%s), is CVMFS server installed? %s", e.Binary, e.Err)
+}
+
+type RepositoryNotFoundError struct {
+	Repo string
+}
+
+func (e *RepositoryNotFoundError) Error() string {
+	return fmt.Sprintf("Repository %s is not listed by cvmfs_server list, is it configured on this machine?", e.Repo)
+}
+
+type RepositoryStateError struct {
+	Repo  string
+	State string
+}
+
+func (e *RepositoryStateError) Error() string {
+	return fmt.Sprintf("Repository %s is not ready to be written: %s", e.Repo, e.State)
+}
+
+// the states, as reported by cvmfs_server list, in which we can not start
+// to write into a repository
+var repositoryBadStates = []string{"in transaction", "unhealthy"}
+
+// Preflight checks, before to start ingesting anything, that cvmfs_server is
+// installed, that CVMFSRepo is one of its repositories and that the
+// repository is not left in a transaction, or otherwise broken.
+// It returns a *CvmfsServerNotFoundError, a *RepositoryNotFoundError or a
+// *RepositoryStateError, so that the operator gets the actual problem instead
+// of an error from the middle of a transaction.
+func Preflight(CVMFSRepo string) error {
+	binary, err := exec.LookPath(CvmfsServerBinary)
+	if err != nil {
+		return &CvmfsServerNotFoundError{Binary: CvmfsServerBinary, Err: err}
+	}
+	err, stdout, stderr := ExecCommand(binary, "list").StartWithOutput()
+	if err != nil {
+		return fmt.Errorf("Error in listing the repositories with cvmfs_server: %s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return checkRepositoryListed(stdout.String(), CVMFSRepo)
+}
+
+// look for CVMFSRepo in the output of cvmfs_server list, whose lines are like:
+// unpacked.cern.ch (stratum0 / local - in transaction)
+func checkRepositoryListed(list, CVMFSRepo string) error {
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != CVMFSRepo {
+			continue
+		}
+		for _, state := range repositoryBadStates {
+			if strings.Contains(line, state) {
+				return &RepositoryStateError{Repo: CVMFSRepo, State: state}
+			}
+		}
+		return nil
+	}
+	return &RepositoryNotFoundError{Repo: CVMFSRepo}
+}
@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_preflight")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(binary string) { CvmfsServerBinary = binary }(CvmfsServerBinary)
+
+	CvmfsServerBinary = filepath.Join(dir, "missing", "cvmfs_server")
+	if _, ok := Preflight("test.cern.ch").(*CvmfsServerNotFoundError); !ok {
+		t.Errorf("Error, missing cvmfs_server not detected")
+	}
+
+	script := "#!/bin/sh\n" +
+		"echo 'test.cern.ch (stratum0 / local)'\n" +
+		"echo 'test.cern.ch.old (stratum0 / local)'\n" +
+		"echo 'busy.cern.ch (stratum0 / local - in transaction)'\n"
+	CvmfsServerBinary = filepath.Join(dir, "cvmfs_server")
+	if err = ioutil.WriteFile(CvmfsServerBinary, []byte(script), 0755); err != nil {
+		t.Fatalf("Error in writing the fake cvmfs_server: %s", err)
+	}
+	if err = Preflight("test.cern.ch"); err != nil {
+		t.Errorf("Error in the preflight of a configured repository: %s", err)
+	}
+	if _, ok := Preflight("unknown.cern.ch").(*RepositoryNotFoundError); !ok {
+		t.Errorf("Error, unknown repository not detected")
+	}
+	// only the exact name of the repository counts
+	if _, ok := Preflight("test.cern").(*RepositoryNotFoundError); !ok {
+		t.Errorf("Error, prefix of a repository taken as the repository")
+	}
+	if _, ok := Preflight("busy.cern.ch").(*RepositoryStateError); !ok {
+		t.Errorf("Error, repository in transaction not detected")
+	}
+}
@@ -0,0 +1,398 @@
+package lib
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the write operations on a repository, by default they are executed with
+// cvmfs_server, the tests can replace them with SetPublisher
+type Publisher interface {
+	Transaction(CVMFSRepo string) error
+	Publish(CVMFSRepo string) error
+	Abort(CVMFSRepo string) error
+	// ingest the tar stream into the repository under base, relative to the
+	// root of the repository, optionally creating a nested catalog in base
+	Ingest(CVMFSRepo, base string, tarStream io.ReadCloser, catalog bool) error
+	// remove, in a single publication of their own, the paths relative to the
+	// root of the repository
+	IngestDelete(CVMFSRepo string, paths ...string) error
+}
+
+var (
+	publisherMutex sync.Mutex
+	publisher      Publisher = CvmfsServerPublisher{}
+)
+
+// replace the Publisher used by all the write operations, it returns the
+// previous one
+func SetPublisher(p Publisher) Publisher {
+	publisherMutex.Lock()
+	defer publisherMutex.Unlock()
+	previous := publisher
+	publisher = p
+	return previous
+}
+
+// where the content of the repository can be read, /cvmfs/$REPO unless the
+// publisher keeps the repository somewhere else
+func repositoryRoot(CVMFSRepo string) string {
+	if p, ok := currentPublisher().(interface{ RepositoryRoot(string) string }); ok {
+		return p.RepositoryRoot(CVMFSRepo)
+	}
+	return filepath.Join("/", "cvmfs", CVMFSRepo)
+}
+
+// TrimRepositoryRoot returns the path relative to the root of the
+// repository, it fails if path is not inside the repository
+func TrimRepositoryRoot(CVMFSRepo, path string) (string, error) {
+	relative, err := filepath.Rel(repositoryRoot(CVMFSRepo), filepath.Clean(path))
+	if err != nil || relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", fmt.Errorf("Path %s is not inside the repository %s", path, CVMFSRepo)
+	}
+	if relative == "." {
+		return "", nil
+	}
+	return relative, nil
+}
+
+func currentPublisher() Publisher {
+	publisherMutex.Lock()
+	defer publisherMutex.Unlock()
+	return publisher
+}
+
+// a failed publish, usually because of a transient conflict, is attempted
+// again up to PublishAttempts times in total, waiting PublishRetryDelay
+// before the first retry and doubling the wait at every retry
+// PublishAttempts is populated in the main `rootCmd` (cmd/root.go)
+var (
+	PublishAttempts   = 3
+	PublishRetryDelay = 5 * time.Second
+)
+
+// only the tests replace it
+var retrySleep = time.Sleep
+
+// publish the transaction open on the repository, retrying on failures, the
+// transaction is left open if all the attempts fail
+func publishWithRetry(CVMFSRepo string) (err error) {
+	delay := PublishRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = currentPublisher().Publish(CVMFSRepo)
+		if err == nil || attempt >= PublishAttempts {
+			return err
+		}
+		LogE(err).WithFields(log.Fields{"repo": CVMFSRepo, "attempt": attempt, "retry in": delay}).
+			Warning("Error in publishing, retrying")
+		retrySleep(delay)
+		delay *= 2
+	}
+}
+
+// the Publisher that shells out to cvmfs_server
+type CvmfsServerPublisher struct{}
+
+func (CvmfsServerPublisher) Transaction(CVMFSRepo string) error {
+	return runCvmfsServer(nil, CVMFSRepo, "transaction", CVMFSRepo)
+}
+
+func (CvmfsServerPublisher) Publish(CVMFSRepo string) error {
+	return runCvmfsServer(nil, CVMFSRepo, "publish", CVMFSRepo)
+}
+
+func (CvmfsServerPublisher) Abort(CVMFSRepo string) error {
+	return runCvmfsServer(nil, CVMFSRepo, "abort", "-f", CVMFSRepo)
+}
+
+func (CvmfsServerPublisher) Ingest(CVMFSRepo, base string, tarStream io.ReadCloser, catalog bool) error {
+	args := []string{"ingest"}
+	if catalog {
+		args = append(args, "--catalog")
+	}
+	args = append(args, "-t", "-", "-b", base, CVMFSRepo)
+	return runCvmfsServer(tarStream, CVMFSRepo, args...)
+}
+
+func (CvmfsServerPublisher) IngestDelete(CVMFSRepo string, paths ...string) error {
+	args := []string{"ingest"}
+	for _, path := range paths {
+		args = append(args, "--delete", path)
+	}
+	args = append(args, CVMFSRepo)
+	return runCvmfsServer(nil, CVMFSRepo, args...)
+}
+
+// run cvmfs_server with the arguments provided, the first one is the
+// subcommand, the full command line is logged at debug level and on failure
+// the stderr of cvmfs_server ends up in the error returned, since it holds
+// the actual reason of the failure
+func runCvmfsServer(stdin io.ReadCloser, CVMFSRepo string, args ...string) error {
+	command := append([]string{CvmfsServerBinary}, args...)
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"binary": command[0],
+			"subcommand": args[0],
+			"args":       args[1:],
+			"repo":       CVMFSRepo,
+			"command":    strings.Join(command, " ")})
+	}
+	llog(Log()).Debug("Running cvmfs_server")
+	cmd := ExecCommand(command...)
+	if cmd == nil {
+		return fmt.Errorf("Impossible to create the command: %s", strings.Join(command, " "))
+	}
+	if stdin != nil {
+		cmd.StdIn(stdin)
+	}
+	err, _, stderr := cmd.StartWithOutput()
+	if err != nil {
+		errOutput := strings.TrimSpace(stderr.String())
+		llog(LogE(err)).WithFields(log.Fields{"stderr": errOutput}).Error("Error in running cvmfs_server")
+		if errOutput != "" {
+			return fmt.Errorf("%s: %s: %s", strings.Join(command, " "), err, errOutput)
+		}
+		return fmt.Errorf("%s: %s", strings.Join(command, " "), err)
+	}
+	return nil
+}
+
+// a Publisher working on a plain directory, the repository CVMFSRepo lives
+// in Root/CVMFSRepo, it does not need neither root nor CVMFS and it is meant
+// for the tests
+// it keeps track of the open transactions and of the operations executed
+type LocalPublisher struct {
+	Root string
+
+	mutex        sync.Mutex
+	transactions map[string]bool
+	Operations   []string
+}
+
+func NewLocalPublisher(root string) *LocalPublisher {
+	return &LocalPublisher{Root: root, transactions: make(map[string]bool)}
+}
+
+func (p *LocalPublisher) RepositoryRoot(CVMFSRepo string) string {
+	return filepath.Join(p.Root, CVMFSRepo)
+}
+
+func (p *LocalPublisher) record(operation, CVMFSRepo string) {
+	p.Operations = append(p.Operations, operation+" "+CVMFSRepo)
+}
+
+// true if there is a transaction open on the repository
+func (p *LocalPublisher) InTransaction(CVMFSRepo string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.transactions[CVMFSRepo]
+}
+
+func (p *LocalPublisher) Transaction(CVMFSRepo string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.record("transaction", CVMFSRepo)
+	if p.transactions[CVMFSRepo] {
+		return fmt.Errorf("Transaction already open on repository %s", CVMFSRepo)
+	}
+	if err := os.MkdirAll(p.RepositoryRoot(CVMFSRepo), 0755); err != nil {
+		return err
+	}
+	p.transactions[CVMFSRepo] = true
+	return nil
+}
+
+func (p *LocalPublisher) Publish(CVMFSRepo string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.record("publish", CVMFSRepo)
+	if !p.transactions[CVMFSRepo] {
+		return fmt.Errorf("No transaction open on repository %s", CVMFSRepo)
+	}
+	delete(p.transactions, CVMFSRepo)
+	return nil
+}
+
+// as cvmfs_server abort -f it does not fail without a transaction, the
+// changes already done to the directory are not rolled back
+func (p *LocalPublisher) Abort(CVMFSRepo string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.record("abort", CVMFSRepo)
+	delete(p.transactions, CVMFSRepo)
+	return nil
+}
+
+// as cvmfs_server ingest it must be called outside of a transaction
+func (p *LocalPublisher) Ingest(CVMFSRepo, base string, tarStream io.ReadCloser, catalog bool) error {
+	defer tarStream.Close()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.record("ingest", CVMFSRepo)
+	if p.transactions[CVMFSRepo] {
+		return fmt.Errorf("Ingesting into repository %s with a transaction open", CVMFSRepo)
+	}
+	dest := filepath.Join(p.RepositoryRoot(CVMFSRepo), cleanEntryName(base))
+	if err := extractTar(tarStream, dest); err != nil {
+		return err
+	}
+	if catalog {
+		return createCatalogFiles(p.RepositoryRoot(CVMFSRepo), []string{cleanEntryName(base)})
+	}
+	return nil
+}
+
+func (p *LocalPublisher) IngestDelete(CVMFSRepo string, paths ...string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.record("delete", CVMFSRepo)
+	if p.transactions[CVMFSRepo] {
+		return fmt.Errorf("Deleting from repository %s with a transaction open", CVMFSRepo)
+	}
+	for _, path := range paths {
+		if err := os.RemoveAll(filepath.Join(p.RepositoryRoot(CVMFSRepo), cleanEntryName(path))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unpack the tar stream into dest, the names of the entries are cleaned and
+// the entries below a symlink are refused, so nothing is written outside dest.
+// The symlinks themselves are created as they are, and may point anywhere
+func extractTar(r io.Reader, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	extraction := newTarExtraction(dest)
+	defer extraction.logDuplicates()
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanEntryName(header.Name)
+		if name == "" || name == "." {
+			continue
+		}
+		if err = extraction.unpack(tarReader, header, name); err != nil {
+			return err
+		}
+	}
+}
+
+// the entries unpacked from a tar into dest, broken layers may contain the
+// same path more than once, in that case the last entry wins
+type tarExtraction struct {
+	dest       string
+	extracted  map[string]bool
+	duplicates int
+}
+
+func newTarExtraction(dest string) *tarExtraction {
+	return &tarExtraction{dest: dest, extracted: make(map[string]bool)}
+}
+
+// unpack the entry, replacing whatever a previous entry with the same name
+// left, a directory is kept if replaced by another directory
+func (e *tarExtraction) unpack(tarReader io.Reader, header *tar.Header, name string) error {
+	if e.extracted[name] {
+		e.duplicates++
+		path := filepath.Join(e.dest, name)
+		info, err := os.Lstat(path)
+		if err == nil && !(info.IsDir() && header.Typeflag == tar.TypeDir) {
+			Log().WithFields(log.Fields{"entry": name}).Debug("Replacing duplicated entry of the tar")
+			if err = os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+	if err := unpackTarEntry(tarReader, header, e.dest, name); err != nil {
+		return err
+	}
+	e.extracted[name] = true
+	return nil
+}
+
+func (e *tarExtraction) logDuplicates() {
+	if e.duplicates > 0 {
+		Log().WithFields(log.Fields{"dest": e.dest, "duplicates": e.duplicates}).Warning(
+			"Duplicated entries in the tar, only the last one of each was extracted")
+	}
+}
+
+// materialize under dest the entry of the tar, name is the cleaned name of the
+// entry, devices, fifos and the like are skipped, the sockets as well, they
+// are counted and logged when the layer is validated
+func unpackTarEntry(tarReader io.Reader, header *tar.Header, dest, name string) (err error) {
+	if isSocketEntry(header) {
+		return nil
+	}
+	// a previous entry may have left a symlink where we expect a directory,
+	// following it would write outside dest
+	if err = checkNoSymlinkInParents(dest, name); err != nil {
+		return err
+	}
+	path := filepath.Join(dest, name)
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	mode := os.FileMode(header.Mode).Perm()
+	switch header.Typeflag {
+	case tar.TypeDir:
+		err = os.MkdirAll(path, mode|0700)
+	case tar.TypeReg, tar.TypeRegA:
+		// nor we follow a symlink in place of the file
+		os.Remove(path)
+		var file *os.File
+		file, err = os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tarReader)
+		file.Close()
+	case tar.TypeSymlink:
+		os.Remove(path)
+		err = os.Symlink(header.Linkname, path)
+	case tar.TypeLink:
+		linkName := cleanEntryName(header.Linkname)
+		if err = checkNoSymlinkInParents(dest, linkName); err != nil {
+			return err
+		}
+		os.Remove(path)
+		err = os.Link(filepath.Join(dest, linkName), path)
+	}
+	return err
+}
+
+// return an error if any of the parent directories of name, already created
+// under dest, is a symlink
+func checkNoSymlinkInParents(dest, name string) error {
+	parent := dest
+	components := strings.Split(name, "/")
+	for _, component := range components[:len(components)-1] {
+		parent = filepath.Join(parent, component)
+		info, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Entry %s of the tar is below the symlink %s", name, strings.TrimPrefix(parent, dest+"/"))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,573 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func newTestLocalPublisher(t *testing.T) (*LocalPublisher, func()) {
+	dir, err := ioutil.TempDir("", "test_publisher")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	local := NewLocalPublisher(dir)
+	previous := SetPublisher(local)
+	return local, func() {
+		SetPublisher(previous)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestLocalPublisherIngestIntoRepository(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+
+	target, err := ioutil.TempDir("", "test_publisher_target")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(target)
+	ioutil.WriteFile(filepath.Join(target, "file"), []byte("content"), 0644)
+
+	repo := "test.cern.ch"
+	err = ingestIntoRepository(local.RepositoryRoot(repo), repo, ".flat/ab/abcd", target, IngestOptions{CopyMethod: CopyMethodCopy})
+	if err != nil {
+		t.Fatalf("Error in ingesting with the local publisher: %s", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(local.RepositoryRoot(repo), ".flat", "ab", "abcd", "file"))
+	if err != nil || string(content) != "content" {
+		t.Errorf("Error, content not ingested: %q %v", content, err)
+	}
+	if local.InTransaction(repo) {
+		t.Errorf("Error, transaction left open")
+	}
+	if len(local.Operations) != 2 || local.Operations[0] != "transaction "+repo || local.Operations[1] != "publish "+repo {
+		t.Errorf("Error in the operations executed: %v", local.Operations)
+	}
+}
+
+func TestLocalPublisherRemoveLayers(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+
+	repo := "test.cern.ch"
+	root := local.RepositoryRoot(repo)
+	os.MkdirAll(filepath.Join(root, ".layers", "aa", "aa1111", "layerfs"), 0755)
+	if err := removeLayers(repo, root, []string{"aa1111"}); err != nil {
+		t.Fatalf("Error in removing the layer with the local publisher: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".layers", "aa", "aa1111")); !os.IsNotExist(err) {
+		t.Errorf("Error, layer not removed")
+	}
+	if local.InTransaction(repo) {
+		t.Errorf("Error, transaction left open")
+	}
+}
+
+func TestLocalPublisherIngestTar(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+
+	layer := buildTestTar(t,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10},
+		&tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "passwd"},
+		&tar.Header{Name: "../../escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+	)
+	repo := "test.cern.ch"
+	if err := local.Transaction(repo); err != nil {
+		t.Fatalf("Error in opening the transaction: %s", err)
+	}
+	if err := local.Ingest(repo, ".layers/ab/abcd/layerfs", ioutil.NopCloser(layer), true); err == nil {
+		t.Errorf("Error, ingest accepted inside a transaction")
+	}
+	local.Abort(repo)
+
+	layer = buildTestTar(t,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10},
+		&tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "passwd"},
+		&tar.Header{Name: "../../escape", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+	)
+	if err := local.Ingest(repo, ".layers/ab/abcd/layerfs", ioutil.NopCloser(layer), true); err != nil {
+		t.Fatalf("Error in ingesting the tar: %s", err)
+	}
+	layerfs := filepath.Join(local.RepositoryRoot(repo), ".layers", "ab", "abcd", "layerfs")
+	for _, path := range []string{"etc/passwd", "etc/link", ".cvmfscatalog", "escape"} {
+		if _, err := os.Lstat(filepath.Join(layerfs, path)); err != nil {
+			t.Errorf("Error, %s not ingested: %s", path, err)
+		}
+	}
+
+	if err := local.IngestDelete(repo, ".layers/ab/abcd"); err != nil {
+		t.Errorf("Error in deleting the layer: %s", err)
+	}
+	if _, err := os.Stat(layerfs); !os.IsNotExist(err) {
+		t.Errorf("Error, layer not deleted")
+	}
+}
+
+func TestExtractTarDuplicatedEntries(t *testing.T) {
+	dest, err := ioutil.TempDir("", "test_duplicates")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dest)
+
+	layer := buildTestTar(t,
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10},
+		&tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "passwd"},
+		&tar.Header{Name: "etc/outside", Typeflag: tar.TypeSymlink, Linkname: "../../outside"},
+		&tar.Header{Name: "etc/dir/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/dir/file", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0600, Size: 3},
+		&tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "group"},
+		// a file over a symlink must not be written through the symlink
+		&tar.Header{Name: "etc/outside", Typeflag: tar.TypeReg, Mode: 0644, Size: 2},
+		&tar.Header{Name: "etc/dir", Typeflag: tar.TypeReg, Mode: 0644, Size: 4},
+	)
+	if err = extractTar(layer, dest); err != nil {
+		t.Fatalf("Error in extracting the tar with duplicated entries: %s", err)
+	}
+	for path, expected := range map[string]string{"etc/passwd": "aaa", "etc/outside": "aa", "etc/dir": "aaaa"} {
+		content, err := ioutil.ReadFile(filepath.Join(dest, path))
+		if err != nil || string(content) != expected {
+			t.Errorf("Error, the last entry %s was not extracted: %q %v", path, content, err)
+		}
+	}
+	if info, err := os.Lstat(filepath.Join(dest, "etc", "passwd")); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Error in the mode of the last entry: %v %v", info, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dest, "etc", "link")); err != nil || link != "group" {
+		t.Errorf("Error, the last symlink was not extracted: %s %v", link, err)
+	}
+	if _, err := os.Lstat(filepath.Join(filepath.Dir(dest), "outside")); !os.IsNotExist(err) {
+		t.Errorf("Error, the duplicated entry was written through the symlink")
+	}
+}
+
+func TestSaveLayersBacklinkConcurrent(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+
+	repo := "test.cern.ch"
+	root := local.RepositoryRoot(repo)
+	shared := "aa1111"
+	images := []string{"sha256:redis", "sha256:postgres", "sha256:ubuntu", "sha256:alpine"}
+
+	var wg sync.WaitGroup
+	errors := make(chan error, len(images))
+	for _, image := range images {
+		wg.Add(1)
+		go func(image string) {
+			defer wg.Done()
+			errors <- saveLayersBacklink(root, repo, image, []string{shared})
+		}(image)
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		if err != nil {
+			t.Errorf("Error in saving the backlink: %s", err)
+		}
+	}
+
+	backlink, err := readBacklink(filepath.Join(root, ".layers", "aa", shared, ".metadata", "origin.json"))
+	if err != nil {
+		t.Fatalf("Error in reading the backlink: %s", err)
+	}
+	sort.Strings(backlink.Origin)
+	expected := append([]string{}, images...)
+	sort.Strings(expected)
+	if !reflect.DeepEqual(backlink.Origin, expected) {
+		t.Errorf("Error, some backlinks lost: %v", backlink.Origin)
+	}
+
+	// saving again the same image does not duplicate it
+	saveLayersBacklink(root, repo, "sha256:redis", []string{shared})
+	backlink, _ = readBacklink(filepath.Join(root, ".layers", "aa", shared, ".metadata", "origin.json"))
+	if len(backlink.Origin) != len(images) {
+		t.Errorf("Error, backlink duplicated: %v", backlink.Origin)
+	}
+}
+
+func TestSaveLayersBacklinkDuplicatedOrigin(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+
+	repo := "test.cern.ch"
+	root := local.RepositoryRoot(repo)
+	layer := "aa1111"
+	dir := filepath.Join(root, ".layers", "aa", layer, ".metadata")
+	os.MkdirAll(dir, 0755)
+	// a backlink written before the origins were deduplicated
+	ioutil.WriteFile(filepath.Join(dir, "origin.json"), []byte(`{"origin":["sha256:redis","sha256:redis"]}`), 0644)
+
+	if err := saveLayersBacklink(root, repo, "sha256:ubuntu", []string{layer}); err != nil {
+		t.Fatalf("Error in saving the backlink: %s", err)
+	}
+	backlink, err := readBacklink(filepath.Join(dir, "origin.json"))
+	if err != nil {
+		t.Fatalf("Error in reading the backlink: %s", err)
+	}
+	if !reflect.DeepEqual(backlink.Origin, []string{"sha256:redis", "sha256:ubuntu"}) {
+		t.Errorf("Error, new origin not saved: %v", backlink.Origin)
+	}
+}
+
+func TestSaveLayersBacklinkDeterministic(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	var logs bytes.Buffer
+	level := log.GetLevel()
+	log.SetOutput(&logs)
+	log.SetLevel(log.InfoLevel)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(level)
+	}()
+
+	// the same images, with the layers in different orders
+	ingests := map[string][][]string{
+		"a.cern.ch": {{"cc3333", "aa1111", "bb2222", "aa1111"}, {"bb2222", "cc3333"}},
+		"b.cern.ch": {{"aa1111", "bb2222", "cc3333"}, {"cc3333", "bb2222"}},
+	}
+	written := make(map[string][]string)
+	for repo, layers := range ingests {
+		logs.Reset()
+		for i, image := range []string{"sha256:redis", "sha256:postgres"} {
+			if err := saveLayersBacklink(local.RepositoryRoot(repo), repo, image, layers[i]); err != nil {
+				t.Fatalf("Error in saving the backlinks: %s", err)
+			}
+		}
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if i := strings.Index(line, "file="); i >= 0 && strings.Contains(line, "Wrote backlink") {
+				rel, _ := filepath.Rel(local.RepositoryRoot(repo), strings.Fields(line[i+len("file="):])[0])
+				written[repo] = append(written[repo], rel)
+			}
+		}
+	}
+	if !reflect.DeepEqual(written["a.cern.ch"], written["b.cern.ch"]) || !sort.StringsAreSorted(written["a.cern.ch"][:3]) {
+		t.Errorf("Error, the backlinks were not written in the same order: %v", written)
+	}
+
+	for _, layer := range []string{"aa1111", "bb2222", "cc3333"} {
+		path := filepath.Join(".layers", layer[0:2], layer, ".metadata", "origin.json")
+		a, errA := ioutil.ReadFile(filepath.Join(local.RepositoryRoot("a.cern.ch"), path))
+		b, errB := ioutil.ReadFile(filepath.Join(local.RepositoryRoot("b.cern.ch"), path))
+		if errA != nil || errB != nil || !bytes.Equal(a, b) {
+			t.Errorf("Error, the backlinks of %s differ: %s %s %v %v", layer, a, b, errA, errB)
+		}
+	}
+}
+
+func TestDeduplicateBacklinks(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+
+	repo := "test.cern.ch"
+	root := local.RepositoryRoot(repo)
+	writeBacklink := func(layer string, origin ...string) string {
+		dir := filepath.Join(root, ".layers", layer[0:2], layer, ".metadata")
+		os.MkdirAll(dir, 0755)
+		content, _ := json.Marshal(Backlink{Origin: origin})
+		ioutil.WriteFile(filepath.Join(dir, "origin.json"), content, 0644)
+		return filepath.Join(dir, "origin.json")
+	}
+	duplicated := writeBacklink("aa1111", "sha256:redis", "sha256:postgres", "sha256:redis", "sha256:redis")
+	clean := writeBacklink("bb2222", "sha256:redis")
+
+	n, err := deduplicateBacklinks(root, repo)
+	if err != nil || n != 1 {
+		t.Fatalf("Error in deduplicating the backlinks: %d %v", n, err)
+	}
+	backlink, _ := readBacklink(duplicated)
+	if !reflect.DeepEqual(backlink.Origin, []string{"sha256:redis", "sha256:postgres"}) {
+		t.Errorf("Error, backlink not deduplicated: %v", backlink.Origin)
+	}
+	backlink, _ = readBacklink(clean)
+	if !reflect.DeepEqual(backlink.Origin, []string{"sha256:redis"}) {
+		t.Errorf("Error, clean backlink modified: %v", backlink.Origin)
+	}
+
+	// ingesting the same image twice keeps a single origin
+	saveLayersBacklink(root, repo, "sha256:ubuntu", []string{"cc3333"})
+	saveLayersBacklink(root, repo, "sha256:ubuntu", []string{"cc3333"})
+	backlink, _ = readBacklink(filepath.Join(root, ".layers", "cc", "cc3333", ".metadata", "origin.json"))
+	if !reflect.DeepEqual(backlink.Origin, []string{"sha256:ubuntu"}) {
+		t.Errorf("Error, origin duplicated by a second ingestion: %v", backlink.Origin)
+	}
+}
+
+// fails the first publishes, as a transient conflict would
+type flakyPublisher struct {
+	*LocalPublisher
+	failures int
+}
+
+func (p *flakyPublisher) Publish(CVMFSRepo string) error {
+	if p.failures > 0 {
+		p.failures--
+		return fmt.Errorf("Transient failure in publishing %s", CVMFSRepo)
+	}
+	return p.LocalPublisher.Publish(CVMFSRepo)
+}
+
+func TestIngestRetriesTransientPublishFailures(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	flaky := &flakyPublisher{LocalPublisher: local, failures: 1}
+	SetPublisher(flaky)
+	var slept []time.Duration
+	defer func(sleep func(time.Duration)) { retrySleep = sleep }(retrySleep)
+	retrySleep = func(d time.Duration) { slept = append(slept, d) }
+
+	ingestFile := func() (string, error) {
+		target, err := ioutil.TempFile("", "test_publish_retry")
+		if err != nil {
+			t.Fatalf("Error in creating the temporary file: %s", err)
+		}
+		target.WriteString("metadata")
+		target.Close()
+		repo := "test.cern.ch"
+		return target.Name(), ingestIntoRepository(local.RepositoryRoot(repo), repo, ".metadata/file.json", target.Name(), IngestOptions{CopyMethod: CopyMethodCopy})
+	}
+
+	target, err := ingestFile()
+	if err != nil {
+		t.Fatalf("Error, transient publish failure not retried: %s", err)
+	}
+	if len(slept) != 1 || slept[0] != PublishRetryDelay {
+		t.Errorf("Error in the backoff before the retry: %v", slept)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("Error, temporary file not removed after the publish")
+	}
+
+	// every attempt fails, the temporary file must still be there
+	flaky.failures = PublishAttempts
+	target, err = ingestFile()
+	defer os.Remove(target)
+	if err == nil {
+		t.Errorf("Error, persistent publish failure not reported")
+	}
+	if _, err := os.Stat(target); err != nil {
+		t.Errorf("Error, temporary file removed without a successful publish: %s", err)
+	}
+}
+
+func TestIngestPreservesEmptyDirectories(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+
+	for _, method := range []CopyMethod{CopyMethodCopy, CopyMethodHardlink} {
+		target, err := ioutil.TempDir("", "test_empty_dirs")
+		if err != nil {
+			t.Fatalf("Error in creating the temporary directory: %s", err)
+		}
+		defer os.RemoveAll(target)
+		os.MkdirAll(filepath.Join(target, "mnt", "data"), 0755)
+		os.MkdirAll(filepath.Join(target, "proc"), 0555)
+		ioutil.WriteFile(filepath.Join(target, "file"), []byte("content"), 0644)
+
+		repo := "test.cern.ch"
+		err = ingestIntoRepository(local.RepositoryRoot(repo), repo, ".flat/ab/abcd", target, IngestOptions{CopyMethod: method})
+		if err != nil {
+			t.Fatalf("Error in ingesting the tree: %s", err)
+		}
+		for _, dir := range []string{"mnt", "mnt/data", "proc"} {
+			stat, err := os.Stat(filepath.Join(local.RepositoryRoot(repo), ".flat", "ab", "abcd", dir))
+			if err != nil || !stat.IsDir() {
+				t.Errorf("Error, empty directory %s not ingested with method %d: %v", dir, method, err)
+			}
+		}
+	}
+}
+
+func TestIngestIntoRepositoryAbortsOnFailures(t *testing.T) {
+	repo := "test.cern.ch"
+	cases := []struct {
+		name   string
+		path   string
+		target func(t *testing.T, repoRoot string) string
+	}{
+		{"stat", ".flat/ab/abcd", func(t *testing.T, repoRoot string) string {
+			return filepath.Join(repoRoot, "missing-target")
+		}},
+		{"mkdir", ".flat/ab/abcd", func(t *testing.T, repoRoot string) string {
+			// a file where the parent directory should be
+			os.MkdirAll(repoRoot, 0755)
+			ioutil.WriteFile(filepath.Join(repoRoot, ".flat"), []byte{}, 0644)
+			target, _ := ioutil.TempDir("", "test_abort_target")
+			ioutil.WriteFile(filepath.Join(target, "file"), []byte("content"), 0644)
+			return target
+		}},
+		{"copy", ".metadata/file.json", func(t *testing.T, repoRoot string) string {
+			// a non empty directory can not be replaced by the file
+			os.MkdirAll(filepath.Join(repoRoot, ".metadata", "file.json", "inside"), 0755)
+			target, _ := ioutil.TempFile("", "test_abort_target")
+			target.Close()
+			return target.Name()
+		}},
+	}
+	for _, c := range cases {
+		local, restore := newTestLocalPublisher(t)
+		target := c.target(t, local.RepositoryRoot(repo))
+
+		err := ingestIntoRepository(local.RepositoryRoot(repo), repo, c.path, target, IngestOptions{CopyMethod: CopyMethodCopy})
+		if err == nil {
+			t.Errorf("Error, failure at the %s step not reported", c.name)
+		}
+		for _, operation := range local.Operations {
+			if operation == "publish "+repo {
+				t.Errorf("Error, published after a failure at the %s step", c.name)
+			}
+		}
+		if last := local.Operations[len(local.Operations)-1]; last != "abort "+repo {
+			t.Errorf("Error, transaction not aborted after a failure at the %s step: %v", c.name, local.Operations)
+		}
+		if local.InTransaction(repo) {
+			t.Errorf("Error, transaction left open after a failure at the %s step", c.name)
+		}
+		if _, err := os.Stat(target); c.name != "stat" && err != nil {
+			t.Errorf("Error, target removed after a failure at the %s step", c.name)
+		}
+		os.RemoveAll(target)
+		restore()
+	}
+}
+
+func TestCvmfsServerPublisherLogsFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cvmfs_server_logs")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	script := "#!/bin/sh\necho \"Repository test.cern.ch is not in a transaction\" >&2\nexit 1\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "cvmfs_server"), []byte(script), 0755); err != nil {
+		t.Fatalf("Error in writing the fake cvmfs_server: %s", err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+":"+path)
+	defer os.Setenv("PATH", path)
+
+	var logs bytes.Buffer
+	level := log.GetLevel()
+	log.SetOutput(&logs)
+	log.SetLevel(log.DebugLevel)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetLevel(level)
+	}()
+
+	err = CvmfsServerPublisher{}.Publish("test.cern.ch")
+	if err == nil {
+		t.Fatalf("Error, failure of cvmfs_server not reported")
+	}
+	if !strings.Contains(err.Error(), "is not in a transaction") {
+		t.Errorf("Error, the stderr of cvmfs_server is not in the error: %s", err)
+	}
+	for _, expected := range []string{"cvmfs_server publish test.cern.ch", "subcommand=publish", "is not in a transaction"} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Errorf("Error, %q missing from the logs: %s", expected, logs.String())
+		}
+	}
+}
+
+func TestIngestIntoRepositorySymlinkTarget(t *testing.T) {
+	repo := "test.cern.ch"
+	newSymlinkTarget := func() (string, string) {
+		dir, err := ioutil.TempDir("", "test_symlink_target")
+		if err != nil {
+			t.Fatalf("Error in creating the temporary directory: %s", err)
+		}
+		ioutil.WriteFile(filepath.Join(dir, "content"), []byte("content"), 0644)
+		os.Symlink("content", filepath.Join(dir, "link"))
+		return dir, filepath.Join(dir, "link")
+	}
+
+	for _, policy := range []TargetSymlinkPolicy{TargetSymlinkFollow, TargetSymlinkPreserve} {
+		local, restore := newTestLocalPublisher(t)
+		dir, target := newSymlinkTarget()
+		err := ingestIntoRepository(local.RepositoryRoot(repo), repo, ".metadata/link", target, IngestOptions{CopyMethod: CopyMethodCopy, TargetSymlink: policy})
+		if err != nil {
+			t.Fatalf("Error in ingesting the symlink target with policy %d: %s", policy, err)
+		}
+		path := filepath.Join(local.RepositoryRoot(repo), ".metadata", "link")
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("Error, the symlink target was not ingested with policy %d: %s", policy, err)
+		}
+		if policy == TargetSymlinkFollow {
+			if content, _ := ioutil.ReadFile(path); !info.Mode().IsRegular() || string(content) != "content" {
+				t.Errorf("Error, the content of the symlink was not ingested: %v %q", info.Mode(), content)
+			}
+		} else if link, err := os.Readlink(path); err != nil || link != "content" {
+			t.Errorf("Error, the symlink was not preserved: %s %v", link, err)
+		}
+		if last := local.Operations[len(local.Operations)-1]; last != "publish "+repo {
+			t.Errorf("Error, the symlink target was not published: %v", local.Operations)
+		}
+		if _, err = os.Lstat(target); !os.IsNotExist(err) {
+			t.Errorf("Error, the symlink target was not removed after the ingestion")
+		}
+		os.RemoveAll(dir)
+		restore()
+	}
+
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	dir, target := newSymlinkTarget()
+	defer os.RemoveAll(dir)
+	err := ingestIntoRepository(local.RepositoryRoot(repo), repo, ".metadata/link", target, IngestOptions{CopyMethod: CopyMethodCopy, TargetSymlink: TargetSymlinkReject})
+	if err != ErrTargetIsSymlink {
+		t.Errorf("Error, expected the symlink target to be rejected: %v", err)
+	}
+	if last := local.Operations[len(local.Operations)-1]; last != "abort "+repo {
+		t.Errorf("Error, transaction not aborted after rejecting the symlink: %v", local.Operations)
+	}
+	if _, err = os.Lstat(filepath.Join(local.RepositoryRoot(repo), ".metadata", "link")); !os.IsNotExist(err) {
+		t.Errorf("Error, the rejected symlink was ingested")
+	}
+}
+
+func TestLocalPublisherRepositoryRoot(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	repo := "test.cern.ch"
+	root := local.RepositoryRoot(repo)
+
+	os.MkdirAll(filepath.Join(root, ".flat", "ab", "abcd"), 0755)
+	err := CreateSymlinkIntoCVMFS(repo, filepath.Join("library", "ubuntu:20.04"), filepath.Join(".flat", "ab", "abcd"))
+	if err != nil {
+		t.Fatalf("Error in creating the symlink: %s", err)
+	}
+	if target, err := filepath.EvalSymlinks(filepath.Join(root, "library", "ubuntu:20.04")); err != nil || target != filepath.Join(root, ".flat", "ab", "abcd") {
+		t.Errorf("Error in the symlink created in the repository: %s %v", target, err)
+	}
+
+	err = AddManifestToRemoveScheduler(repo, manifestWithConfig("sha256:abcd", "sha256:layer"))
+	if err != nil {
+		t.Fatalf("Error in scheduling the removal: %s", err)
+	}
+	schedule, err := readRemoveSchedule(removeScheduleLocation(root))
+	if err != nil || len(schedule) != 1 || schedule[0].Config.Digest != "sha256:abcd" {
+		t.Errorf("Error in the remove schedule of the repository: %v %v", schedule, err)
+	}
+	if local.InTransaction(repo) {
+		t.Errorf("Error, transaction left open: %v", local.Operations)
+	}
+}
@@ -15,11 +15,14 @@ type YamlRecipeV1 struct {
 	CVMFSRepo    string   `yaml:"cvmfs_repo"`
 	OutputFormat string   `yaml:"output_format"`
 	Input        []string `yaml:"input"`
+	// optional, the representations to produce: layers, flat and thin
+	Representations []string `yaml:"representations"`
 }
 
 type Recipe struct {
-	Repo   string
-	Wishes chan WishFriendly
+	Repo            string
+	Representations Representations
+	Wishes          chan WishFriendly
 }
 
 func ParseYamlRecipeV1(data []byte) (Recipe, error) {
@@ -38,6 +41,10 @@ func ParseYamlRecipeV1(data []byte) (Recipe, error) {
 	if err != nil {
 		return recipe, err
 	}
+	recipe.Representations, err = ParseRepresentations(recipeYamlV1.Representations)
+	if err != nil {
+		return recipe, err
+	}
 	for _, inputImage := range recipeYamlV1.Input {
 		wg.Add(1)
 		go func(inputImage string) {
@@ -52,6 +59,7 @@ func ParseYamlRecipeV1(data []byte) (Recipe, error) {
 			if err != nil {
 				LogE(err).Warning("Error in creating the wish")
 			} else {
+				wish.Representations = recipe.Representations
 				recipe.Wishes <- wish
 			}
 		}(inputImage)
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// cvmfs_server allows a single transaction per repository, the goroutines of
+// this process that need to read-modify-write the repository serialize on
+// this lock, so that what they read is still valid when they publish
+var (
+	repoLocksMutex sync.Mutex
+	repoLocks      = make(map[string]*repoLock)
+)
+
+type repoLock struct {
+	lock sync.Mutex
+
+	// protected by repoLocksMutex
+	waiters      int
+	acquisitions int
+	totalWait    time.Duration
+}
+
+// how much the lock of a repository is contended
+type RepoLockStats struct {
+	// goroutines currently waiting for the lock
+	Waiters int
+	// times the lock was acquired
+	Acquisitions int
+	// cumulative time spent waiting for the lock
+	TotalWait time.Duration
+}
+
+// acquire the lock of the repository, the returned function releases it
+func lockRepository(CVMFSRepo string) (unlock func()) {
+	repoLocksMutex.Lock()
+	lock, ok := repoLocks[CVMFSRepo]
+	if !ok {
+		lock = &repoLock{}
+		repoLocks[CVMFSRepo] = lock
+	}
+	lock.waiters++
+	repoLocksMutex.Unlock()
+
+	start := time.Now()
+	lock.lock.Lock()
+	waited := time.Since(start)
+
+	repoLocksMutex.Lock()
+	lock.waiters--
+	lock.acquisitions++
+	lock.totalWait += waited
+	repoLocksMutex.Unlock()
+	return lock.lock.Unlock
+}
+
+// the contention of the locks of all the repositories used so far
+func RepositoryLockStats() map[string]RepoLockStats {
+	repoLocksMutex.Lock()
+	defer repoLocksMutex.Unlock()
+	stats := make(map[string]RepoLockStats, len(repoLocks))
+	for repo, lock := range repoLocks {
+		stats[repo] = RepoLockStats{Waiters: lock.waiters, Acquisitions: lock.acquisitions, TotalWait: lock.totalWait}
+	}
+	return stats
+}
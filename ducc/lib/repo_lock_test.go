@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRepositoryLockStats(t *testing.T) {
+	repo := "test-lock-stats.cern.ch"
+	unlock := lockRepository(repo)
+
+	const waiting = 3
+	acquired := make(chan bool, waiting)
+	for i := 0; i < waiting; i++ {
+		go func() {
+			release := lockRepository(repo)
+			acquired <- true
+			release()
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for RepositoryLockStats()[repo].Waiters != waiting {
+		if time.Now().After(deadline) {
+			t.Fatalf("Error, the waiters are not reported: %+v", RepositoryLockStats()[repo])
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	unlock()
+	for i := 0; i < waiting; i++ {
+		<-acquired
+	}
+
+	stats := RepositoryLockStats()[repo]
+	if stats.Waiters != 0 || stats.Acquisitions != waiting+1 {
+		t.Errorf("Error in the stats after releasing the lock: %+v", stats)
+	}
+	if stats.TotalWait < 10*time.Millisecond {
+		t.Errorf("Error, waiting time not accounted: %s", stats.TotalWait)
+	}
+}
@@ -0,0 +1,159 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+// aggregated numbers about the structures managed by DUCC in a repository
+type RepositoryStats struct {
+	// layers in .layers
+	Layers int `json:"layers"`
+	// images with a manifest in .metadata
+	Images int `json:"images"`
+	// flat images in .flat
+	FlatImages int `json:"flat_images"`
+	// size of the regular files in the layers and in the flat images
+	TotalBytes int64 `json:"total_bytes"`
+	// layers not used by any of the images
+	OrphanedLayers int `json:"orphaned_layers"`
+	// images in the remove schedule, not yet garbage collected
+	PendingRemovals int `json:"pending_removals"`
+}
+
+// RepoStats walks the layers, the flat images, the metadata and the remove
+// schedule of the repository and aggregates them, nothing is modified
+func RepoStats(CVMFSRepo string) (RepositoryStats, error) {
+	return repoStats(repositoryRoot(CVMFSRepo))
+}
+
+func repoStats(repoRoot string) (stats RepositoryStats, err error) {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "repository stats", "root": repoRoot})
+	}
+
+	usedLayers, err := manifestsLayers(filepath.Join(repoRoot, ".metadata"), &stats.Images)
+	if err != nil {
+		llog(LogE(err)).Error("Impossible to read the manifests of the images")
+		return
+	}
+
+	layers, err := listDigestDirectories(filepath.Join(repoRoot, subDirInsideRepo))
+	if err != nil {
+		llog(LogE(err)).Error("Impossible to list the layers")
+		return
+	}
+	stats.Layers = len(layers)
+	for _, layer := range layers {
+		if !usedLayers[filepath.Base(layer)] {
+			stats.OrphanedLayers++
+		}
+	}
+
+	flatImages, err := listDigestDirectories(filepath.Join(repoRoot, ".flat"))
+	if err != nil {
+		llog(LogE(err)).Error("Impossible to list the flat images")
+		return
+	}
+	stats.FlatImages = len(flatImages)
+
+	for _, dir := range append(layers, flatImages...) {
+		size, err := regularFilesSize(dir)
+		if err != nil {
+			llog(LogE(err)).WithFields(log.Fields{"path": dir}).Error("Impossible to compute the size")
+			return stats, err
+		}
+		stats.TotalBytes += size
+	}
+
+	schedule, err := readRemoveSchedule(removeScheduleLocation(repoRoot))
+	if err != nil {
+		return
+	}
+	stats.PendingRemovals = len(schedule)
+	return
+}
+
+// the digests, without the sha256: prefix, of the layers used by the
+// manifests under metadataDir, the manifests are counted in images
+func manifestsLayers(metadataDir string, images *int) (map[string]bool, error) {
+	used := make(map[string]bool)
+	seen := make(map[string]bool)
+	err := filepath.Walk(metadataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// the manifests may be compressed
+		path = strings.TrimSuffix(path, compressedMetadataSuffix)
+		if info.IsDir() || filepath.Base(path) != "manifest.json" || seen[path] {
+			return nil
+		}
+		seen[path] = true
+		content, err := readMetadataFile(path)
+		if err != nil {
+			return err
+		}
+		var manifest da.Manifest
+		if err = json.Unmarshal(content, &manifest); err != nil {
+			LogE(err).WithFields(log.Fields{"path": path}).Warning("Impossible to parse the manifest, skipping it")
+			return nil
+		}
+		*images++
+		for _, layer := range manifest.Layers {
+			used[strings.TrimPrefix(layer.Digest, "sha256:")] = true
+		}
+		return nil
+	})
+	return used, err
+}
+
+// the directories `root/xx/xxyyzz...` as created for the layers and the flat
+// images
+func listDigestDirectories(root string) ([]string, error) {
+	prefixes, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	dirs := make([]string, 0)
+	for _, prefix := range prefixes {
+		if !prefix.IsDir() || strings.HasPrefix(prefix.Name(), ".") {
+			continue
+		}
+		entries, err := ioutil.ReadDir(filepath.Join(root, prefix.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				dirs = append(dirs, filepath.Join(root, prefix.Name(), entry.Name()))
+			}
+		}
+	}
+	return dirs, nil
+}
+
+func regularFilesSize(dir string) (size int64, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
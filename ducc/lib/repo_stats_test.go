@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+func TestRepoStats(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_repo_stats")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFile := func(path string, content []byte) {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, path)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(root, path), content, 0644); err != nil {
+			t.Fatalf("Error in writing %s: %s", path, err)
+		}
+	}
+	writeFile(".layers/ab/abcd/layerfs/etc/passwd", []byte("root"))
+	writeFile(".layers/ab/abcd/.metadata/origin.json", []byte(`{"origin":["sha256:config"]}`))
+	writeFile(".layers/cd/cdef/layerfs/orphan", []byte("orphan"))
+	writeFile(".layers/ef/efab/layerfs/shared", []byte("s"))
+	os.Symlink("passwd", filepath.Join(root, ".layers/ab/abcd/layerfs/etc/link"))
+	writeFile(".flat/12/1234/etc/passwd", []byte("root"))
+
+	used, _ := json.Marshal(manifestWithConfig("sha256:config", "sha256:abcd", "sha256:efab"))
+	writeFile(".metadata/registry.example.com/foo:1/manifest.json", used)
+	other, _ := json.Marshal(manifestWithConfig("sha256:other", "sha256:efab"))
+	writeFile(".metadata/registry.example.com/bar:2/manifest.json", other)
+
+	schedule, _ := json.Marshal([]da.Manifest{manifestWithConfig("sha256:removed", "sha256:cdef")})
+	writeFile(removeScheduleLocation(root)[len(root):], schedule)
+
+	stats, err := repoStats(root)
+	if err != nil {
+		t.Fatalf("Error in computing the stats of the repository: %s", err)
+	}
+	expected := RepositoryStats{
+		Layers:          3,
+		Images:          2,
+		FlatImages:      1,
+		TotalBytes:      int64(len("root") + len(`{"origin":["sha256:config"]}`) + len("orphan") + len("s") + len("root")),
+		OrphanedLayers:  1,
+		PendingRemovals: 1,
+	}
+	if stats != expected {
+		t.Errorf("Error in the stats of the repository, expected %+v, got %+v", expected, stats)
+	}
+
+	empty, err := ioutil.TempDir("", "test_repo_stats_empty")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(empty)
+	if stats, err = repoStats(empty); err != nil || stats != (RepositoryStats{}) {
+		t.Errorf("Error in the stats of an empty repository: %+v %v", stats, err)
+	}
+}
@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// which representations of the images a recipe asks to produce
+type Representations struct {
+	// the layers unpacked under .layers
+	Layers bool
+	// the flat image under .flat, used by singularity
+	Flat bool
+	// the thin image pushed to the registry, it requires the layers
+	Thin bool
+}
+
+// what DUCC always produced, used when a recipe does not say otherwise
+var DefaultRepresentations = Representations{Layers: true, Flat: true, Thin: true}
+
+// parse the list of representations of a recipe (ex: [layers, flat]), an
+// empty list means DefaultRepresentations
+func ParseRepresentations(names []string) (Representations, error) {
+	if len(names) == 0 {
+		return DefaultRepresentations, nil
+	}
+	var r Representations
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "layers":
+			r.Layers = true
+		case "flat", "singularity":
+			r.Flat = true
+		case "thin":
+			r.Thin = true
+		default:
+			return r, fmt.Errorf("Unknown representation: %s, expected layers, flat (or singularity) or thin", name)
+		}
+	}
+	if r.Thin && !r.Layers {
+		return r, fmt.Errorf("The thin image requires the layers representation")
+	}
+	return r, nil
+}
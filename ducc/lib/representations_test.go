@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestParseRepresentations(t *testing.T) {
+	r, err := ParseRepresentations(nil)
+	if err != nil || r != DefaultRepresentations {
+		t.Errorf("Error, empty list should give the default representations: %+v %v", r, err)
+	}
+	r, err = ParseRepresentations([]string{"layers", "Thin"})
+	if err != nil || r != (Representations{Layers: true, Thin: true}) {
+		t.Errorf("Error in parsing the representations without singularity: %+v %v", r, err)
+	}
+	r, err = ParseRepresentations([]string{"singularity"})
+	if err != nil || r != (Representations{Flat: true}) {
+		t.Errorf("Error in parsing only the singularity representation: %+v %v", r, err)
+	}
+	if _, err = ParseRepresentations([]string{"thin"}); err == nil {
+		t.Errorf("Error, thin image without layers accepted")
+	}
+	if _, err = ParseRepresentations([]string{"chains"}); err == nil {
+		t.Errorf("Error, unknown representation accepted")
+	}
+}
+
+func TestRecipeRepresentations(t *testing.T) {
+	recipe, err := ParseYamlRecipeV1([]byte(`
+version: 1
+user: cvmfsunpacker
+cvmfs_repo: unpacked.cern.ch
+output_format: '$(scheme)://registry.example.com/$(image)'
+representations: [layers, thin]
+input: []
+`))
+	if err != nil {
+		t.Fatalf("Error in parsing the recipe: %s", err)
+	}
+	if recipe.Representations.Flat {
+		t.Errorf("Error, flat image not disabled by the recipe: %+v", recipe.Representations)
+	}
+
+	recipe, err = ParseYamlRecipeV1([]byte(`
+version: 1
+cvmfs_repo: unpacked.cern.ch
+input: []
+`))
+	if err != nil || recipe.Representations != DefaultRepresentations {
+		t.Errorf("Error, recipe without representations: %+v %v", recipe.Representations, err)
+	}
+}
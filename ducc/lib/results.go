@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// where to write, one JSON object per line, the result of the conversion of
+// each image, nil disables it
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var IngestResults io.Writer
+
+var ingestResultsMutex sync.Mutex
+
+const (
+	IngestStatusConverted = "converted"
+	IngestStatusUpToDate  = "up-to-date"
+	IngestStatusFlattened = "flattened"
+	IngestStatusFailed    = "failed"
+)
+
+// the outcome of the conversion of a single image, meant to be parsed by the
+// automation, it is not a log line
+type IngestResult struct {
+	Image      string `json:"image"`
+	Repository string `json:"repository"`
+	Status     string `json:"status"`
+	// layers downloaded and ingested, the ones already in the repository are not counted
+	LayersIngested int            `json:"layers_ingested"`
+	Layers         []LayerMetrics `json:"layers,omitempty"`
+	Duration       float64        `json:"duration_seconds"`
+	Error          string         `json:"error,omitempty"`
+}
+
+func (r *IngestResult) finish(err error, duration time.Duration) {
+	r.Duration = duration.Seconds()
+	if err != nil {
+		r.Status = IngestStatusFailed
+		r.Error = err.Error()
+	} else if r.Status == "" {
+		r.Status = IngestStatusConverted
+	}
+}
+
+// write the result into IngestResults, if set
+func RecordIngestResult(result IngestResult) {
+	if IngestResults == nil {
+		return
+	}
+	if err := writeIngestResult(IngestResults, result); err != nil {
+		LogE(err).Warning("Error in writing the result of the conversion")
+	}
+}
+
+func writeIngestResult(w io.Writer, result IngestResult) error {
+	line, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	ingestResultsMutex.Lock()
+	defer ingestResultsMutex.Unlock()
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
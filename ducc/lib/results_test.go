@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestIngestResultsJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	defer func() { IngestResults = nil }()
+	IngestResults = &buf
+
+	converted := IngestResult{Image: "https://registry.hub.docker.com/library/redis:5", Repository: "unpacked.cern.ch", LayersIngested: 3}
+	converted.finish(nil, 1500*time.Millisecond)
+	RecordIngestResult(converted)
+
+	failed := IngestResult{Image: "https://registry.hub.docker.com/library/broken:1", Repository: "unpacked.cern.ch"}
+	failed.finish(fmt.Errorf("Layer not received, status code: 404"), time.Second)
+	RecordIngestResult(failed)
+
+	var results []IngestResult
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var result IngestResult
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatalf("Error, line is not a JSON object: %q %s", scanner.Text(), err)
+		}
+		results = append(results, result)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Error, expected 2 results, got %d", len(results))
+	}
+	if results[0].Status != IngestStatusConverted || results[0].LayersIngested != 3 || results[0].Duration != 1.5 || results[0].Error != "" {
+		t.Errorf("Error in the result of the converted image: %+v", results[0])
+	}
+	if results[1].Status != IngestStatusFailed || results[1].Error == "" {
+		t.Errorf("Error in the result of the failed image: %+v", results[1])
+	}
+}
@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+// a version of an image, with the time used to decide which versions are the
+// most recent
+type TaggedManifest struct {
+	Tag      string
+	Manifest da.Manifest
+	Created  time.Time
+}
+
+// keep the `keep` most recent tags and schedule all the others for removal
+// the tags are ordered by Created, ties are broken by the name of the tag, the
+// greater name is considered the most recent, and then by the digest of the
+// image
+func ApplyRetentionPolicy(CVMFSRepo string, tags []TaggedManifest, keep int) error {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "apply retention policy", "repo": CVMFSRepo, "keep": keep})
+	}
+	for _, tag := range tagsToRemove(tags, keep) {
+		err := AddManifestToRemoveScheduler(CVMFSRepo, tag.Manifest)
+		if err != nil {
+			llog(LogE(err)).WithFields(log.Fields{"tag": tag.Tag}).Error("Error in scheduling the removal of the tag")
+			return err
+		}
+		llog(Log()).WithFields(log.Fields{"tag": tag.Tag}).Info("Scheduled the removal of the tag")
+	}
+	return nil
+}
+
+// the tags that are not among the `keep` most recent, from the most recent
+func tagsToRemove(tags []TaggedManifest, keep int) []TaggedManifest {
+	if keep < 0 {
+		keep = 0
+	}
+	if len(tags) <= keep {
+		return nil
+	}
+	sorted := make([]TaggedManifest, len(tags))
+	copy(sorted, tags)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if !a.Created.Equal(b.Created) {
+			return a.Created.After(b.Created)
+		}
+		if a.Tag != b.Tag {
+			return a.Tag > b.Tag
+		}
+		return a.Manifest.Config.Digest > b.Manifest.Config.Digest
+	})
+	return sorted[keep:]
+}
@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTagsToRemove(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2020, 1, d, 0, 0, 0, 0, time.UTC) }
+	tags := []TaggedManifest{
+		{Tag: "1.0", Manifest: manifestWithConfig("sha256:10"), Created: day(1)},
+		{Tag: "1.2", Manifest: manifestWithConfig("sha256:12"), Created: day(3)},
+		{Tag: "1.1", Manifest: manifestWithConfig("sha256:11"), Created: day(2)},
+		// same time of 1.2, the greater tag wins
+		{Tag: "1.2-fix", Manifest: manifestWithConfig("sha256:12f"), Created: day(3)},
+		{Tag: "0.9", Manifest: manifestWithConfig("sha256:09"), Created: day(1)},
+	}
+
+	toRemove := tagsToRemove(tags, 2)
+	expected := []string{"1.1", "1.0", "0.9"}
+	if len(toRemove) != len(expected) {
+		t.Fatalf("Error, expected to remove %v, got %v", expected, toRemove)
+	}
+	for i, tag := range expected {
+		if toRemove[i].Tag != tag {
+			t.Errorf("Error in the tag to remove %d, expected %s got %s", i, tag, toRemove[i].Tag)
+		}
+	}
+	if tags[0].Tag != "1.0" {
+		t.Errorf("Error, the input slice was reordered")
+	}
+
+	if toRemove = tagsToRemove(tags[:2], 2); len(toRemove) != 0 {
+		t.Errorf("Error, removing tags when there are fewer than keep: %v", toRemove)
+	}
+	if toRemove = tagsToRemove(tags, 0); len(toRemove) != len(tags) {
+		t.Errorf("Error, keep=0 should remove all the tags: %v", toRemove)
+	}
+}
@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"io"
+	"sync"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+// limits of concurrent downloads, zero means unlimited
+// those flags are populated in the main `rootCmd` (cmd/root.go)
+var (
+	MaxConcurrentDownloads        = 10
+	MaxConcurrentDownloadsPerHost = 5
+)
+
+// the scheduler shared by all the requests to the registries
+// it is re-created in the main `rootCmd` (cmd/root.go) after parsing the flags
+var Downloads = NewDownloadScheduler(MaxConcurrentDownloads, MaxConcurrentDownloadsPerHost)
+
+// limit, in bytes per second, of the throughput of all the layer downloads
+// together, zero means unlimited
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var DownloadRateLimit int64
+
+// the limiter shared by all the layer downloads, nil when unlimited
+// it is re-created in the main `rootCmd` (cmd/root.go) after parsing the flags
+var DownloadLimiter *da.RateLimiter
+
+// DownloadScheduler gates the downloads, allowing at most `global`
+// concurrent downloads and at most `perHost` concurrent downloads against the
+// same host
+type DownloadScheduler struct {
+	global  chan bool
+	perHost int
+
+	mutex sync.Mutex
+	hosts map[string]chan bool
+}
+
+func NewDownloadScheduler(global, perHost int) *DownloadScheduler {
+	s := &DownloadScheduler{perHost: perHost, hosts: make(map[string]chan bool)}
+	if global > 0 {
+		s.global = make(chan bool, global)
+	}
+	return s
+}
+
+func (s *DownloadScheduler) hostSlots(host string) chan bool {
+	if s.perHost <= 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	slots, ok := s.hosts[host]
+	if !ok {
+		slots = make(chan bool, s.perHost)
+		s.hosts[host] = slots
+	}
+	return slots
+}
+
+// Acquire blocks until a download against host is allowed, the caller must
+// call the returned function once the download is completed
+func (s *DownloadScheduler) Acquire(host string) (release func()) {
+	hostSlots := s.hostSlots(host)
+	// we take first the host slot, so that goroutines waiting on a busy host
+	// do not hold a global slot
+	if hostSlots != nil {
+		hostSlots <- true
+	}
+	if s.global != nil {
+		s.global <- true
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if s.global != nil {
+				<-s.global
+			}
+			if hostSlots != nil {
+				<-hostSlots
+			}
+		})
+	}
+}
+
+// scheduledReadCloser keeps the download slot until the stream is closed,
+// closing also the underneath body of the response
+type scheduledReadCloser struct {
+	io.ReadCloser
+	body    io.Closer
+	release func()
+}
+
+func (r scheduledReadCloser) Close() error {
+	defer r.release()
+	err := r.ReadCloser.Close()
+	errBody := r.body.Close()
+	if err != nil {
+		return err
+	}
+	return errBody
+}
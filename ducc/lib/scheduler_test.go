@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func maxConcurrentAcquire(s *DownloadScheduler, hosts []string) int {
+	var mutex sync.Mutex
+	current, max := 0, 0
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			release := s.Acquire(host)
+			defer release()
+			mutex.Lock()
+			current++
+			if current > max {
+				max = current
+			}
+			mutex.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mutex.Lock()
+			current--
+			mutex.Unlock()
+		}(host)
+	}
+	wg.Wait()
+	return max
+}
+
+func TestDownloadSchedulerGlobalLimit(t *testing.T) {
+	hosts := make([]string, 0)
+	for i := 0; i < 30; i++ {
+		hosts = append(hosts, []string{"a", "b", "c"}[i%3])
+	}
+	max := maxConcurrentAcquire(NewDownloadScheduler(4, 0), hosts)
+	if max > 4 {
+		t.Errorf("Run %d concurrent downloads, limit was 4", max)
+	}
+	if max < 2 {
+		t.Errorf("Downloads were not concurrent, max concurrency %d", max)
+	}
+}
+
+func TestDownloadSchedulerPerHostLimit(t *testing.T) {
+	hosts := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		hosts = append(hosts, "registry.example.com")
+	}
+	max := maxConcurrentAcquire(NewDownloadScheduler(10, 2), hosts)
+	if max > 2 {
+		t.Errorf("Run %d concurrent downloads against the same host, limit was 2", max)
+	}
+}
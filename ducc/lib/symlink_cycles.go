@@ -0,0 +1,111 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// what to do with the layers whose symlinks create cycles
+type SymlinkCyclePolicy int
+
+const (
+	// the layers are not checked
+	SymlinkCyclesIgnore SymlinkCyclePolicy = iota
+	// the cycles are logged, the layer is kept
+	SymlinkCyclesWarn
+	// the layer is removed and the conversion fails
+	SymlinkCyclesReject
+)
+
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var SymlinkCycles = SymlinkCyclesIgnore
+
+func (p SymlinkCyclePolicy) String() string {
+	switch p {
+	case SymlinkCyclesIgnore:
+		return "ignore"
+	case SymlinkCyclesWarn:
+		return "warn"
+	case SymlinkCyclesReject:
+		return "reject"
+	}
+	return fmt.Sprintf("unknown(%d)", int(p))
+}
+
+func ParseSymlinkCyclePolicy(policy string) (SymlinkCyclePolicy, error) {
+	switch strings.ToLower(policy) {
+	case "", "ignore":
+		return SymlinkCyclesIgnore, nil
+	case "warn":
+		return SymlinkCyclesWarn, nil
+	case "reject":
+		return SymlinkCyclesReject, nil
+	}
+	return SymlinkCyclesIgnore, fmt.Errorf("Unknown policy for the symlink cycles: %s, expected ignore, warn or reject", policy)
+}
+
+type SymlinkCycleError struct {
+	Layer    string
+	Symlinks []string
+}
+
+func (e *SymlinkCycleError) Error() string {
+	return fmt.Sprintf("Symlinks creating cycles in the layer %s: %s", e.Layer, strings.Join(e.Symlinks, ", "))
+}
+
+// FindSymlinkCycles walks root, the root of an extracted layer, without
+// following the symlinks and returns, relative to root, the symlinks that
+// never reach a target (ex: a -> b, b -> a) and the ones pointing to one of
+// their ancestors, that loop whoever traverses the layer following them.
+// The absolute symlinks are resolved inside root, the symlinks that leave
+// root are not considered.
+func FindSymlinkCycles(root string) ([]string, error) {
+	root = filepath.Clean(root)
+	cycles := make([]string, 0)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		target, err := followSymlinks(root, path, maxSymlinkHops, true)
+		switch {
+		case err == ErrSymlinkLoop:
+			cycles = append(cycles, rel)
+		case err == ErrSymlinkEscape:
+		case err != nil:
+			return err
+		case target == root || strings.HasPrefix(path, target+string(os.PathSeparator)):
+			cycles = append(cycles, rel)
+		}
+		return nil
+	})
+	return cycles, err
+}
+
+// look for symlink cycles in the layer at layerSubpath, according to policy,
+// a *SymlinkCycleError is returned only under the reject policy
+func checkLayerSymlinks(repoRoot, layerSubpath string, policy SymlinkCyclePolicy) error {
+	if policy == SymlinkCyclesIgnore {
+		return nil
+	}
+	cycles, err := FindSymlinkCycles(filepath.Join(repoRoot, layerSubpath))
+	if err != nil {
+		return err
+	}
+	if len(cycles) == 0 {
+		return nil
+	}
+	if policy == SymlinkCyclesReject {
+		return &SymlinkCycleError{Layer: layerSubpath, Symlinks: cycles}
+	}
+	Log().WithFields(log.Fields{"layer": layerSubpath, "symlinks": cycles}).Warning(
+		"Symlinks creating cycles in the layer")
+	return nil
+}
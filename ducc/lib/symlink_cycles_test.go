@@ -0,0 +1,79 @@
+package lib
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindSymlinkCycles(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_symlink_cycles")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, "etc", "conf.d"), 0755)
+	os.MkdirAll(filepath.Join(root, "usr", "lib"), 0755)
+	// the cyclic pair
+	os.Symlink("pong", filepath.Join(root, "etc", "ping"))
+	os.Symlink("ping", filepath.Join(root, "etc", "pong"))
+	// pointing to their ancestors
+	os.Symlink("..", filepath.Join(root, "etc", "conf.d", "parent"))
+	os.Symlink("/usr", filepath.Join(root, "usr", "lib", "usr"))
+	// harmless
+	os.Symlink("/usr/lib", filepath.Join(root, "lib"))
+	os.Symlink("conf.d", filepath.Join(root, "etc", "conf"))
+	os.Symlink("missing", filepath.Join(root, "etc", "dangling"))
+	os.Symlink("../../../../outside", filepath.Join(root, "etc", "outside"))
+
+	cycles, err := FindSymlinkCycles(root)
+	if err != nil {
+		t.Fatalf("Error in looking for the symlink cycles: %s", err)
+	}
+	expected := []string{"etc/conf.d/parent", "etc/ping", "etc/pong", "usr/lib/usr"}
+	if !reflect.DeepEqual(cycles, expected) {
+		t.Errorf("Error in the symlink cycles, expected %v, got %v", expected, cycles)
+	}
+}
+
+func TestIngestLayerSymlinkCyclesPolicy(t *testing.T) {
+	local, restore := newTestLocalPublisher(t)
+	defer restore()
+	defer func(previous SymlinkCyclePolicy) { SymlinkCycles = previous }(SymlinkCycles)
+
+	ingest := func(policy SymlinkCyclePolicy) error {
+		SymlinkCycles = policy
+		layer := buildTestTar(t,
+			&tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+			&tar.Header{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a"},
+		)
+		_, _, err := ingestLayer("repo", ".layers/ab/abcd/layerfs", downloadedLayer{Name: "sha256:abcd", Path: ioutil.NopCloser(layer)})
+		return err
+	}
+	if err := ingest(SymlinkCyclesWarn); err != nil {
+		t.Errorf("Error, layer with a cycle rejected under the warn policy: %s", err)
+	}
+	err := ingest(SymlinkCyclesReject)
+	cycleErr, ok := err.(*SymlinkCycleError)
+	if !ok || !reflect.DeepEqual(cycleErr.Symlinks, []string{"a", "b"}) {
+		t.Errorf("Error, expected the cycle to be rejected: %v", err)
+	}
+	if _, err = os.Lstat(filepath.Join(local.RepositoryRoot("repo"), ".layers/ab/abcd/layerfs/a")); err != nil {
+		t.Errorf("Error, the layer was not ingested: %s", err)
+	}
+}
+
+func TestParseSymlinkCyclePolicy(t *testing.T) {
+	for input, expected := range map[string]SymlinkCyclePolicy{"": SymlinkCyclesIgnore, "warn": SymlinkCyclesWarn, "Reject": SymlinkCyclesReject} {
+		if policy, err := ParseSymlinkCyclePolicy(input); err != nil || policy != expected {
+			t.Errorf("Error in parsing the policy %q: %s %v", input, policy, err)
+		}
+	}
+	if _, err := ParseSymlinkCyclePolicy("fail"); err == nil {
+		t.Errorf("Error, unknown policy accepted")
+	}
+}
@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ListTags returns all the tags of repository in registry, following the
+// pagination of the registry
+// registry: the host of the registry (ex: registry.hub.docker.com)
+// repository: the name of the repository (ex: library/redis)
+func ListTags(registry, repository string) ([]string, error) {
+	img := &Image{Scheme: "https", Registry: registry, Repository: repository}
+	return img.ListTags()
+}
+
+// ListTags returns all the tags of the repository of the image, the
+// authentication is handled as for the manifests
+func (img *Image) ListTags() ([]string, error) {
+	user, pass, err := img.getCredentials()
+	if err != nil {
+		LogE(err).Warning("Unable to retrieve the password, trying to get the tags anonymously.")
+		user = ""
+		pass = ""
+	}
+	tagsUrl := img.GetTagListUrl()
+	token, err := firstRequestForAuth(context.Background(), tagsUrl, user, pass)
+	if err != nil {
+		errF := fmt.Errorf("Error in authenticating for retrieving the tags: %s", err)
+		LogE(err).Error(errF)
+		return nil, errF
+	}
+
+	tags := make([]string, 0)
+	visited := make(map[string]bool)
+	for tagsUrl != "" && !visited[tagsUrl] {
+		visited[tagsUrl] = true
+		page, next, err := getTagsPage(tagsUrl, token)
+		if err != nil {
+			LogE(err).WithFields(log.Fields{"url": tagsUrl}).Error("Error in retrieving the tags")
+			return nil, err
+		}
+		tags = append(tags, page...)
+		tagsUrl = next
+	}
+	return tags, nil
+}
+
+// return the tags in the page at pageUrl and the url of the next page, empty
+// if this is the last page
+func getTagsPage(pageUrl, token string) (tags []string, next string, err error) {
+	req, err := http.NewRequest("GET", pageUrl, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := RegistryClient.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error in making the request for retrieving the tags: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return nil, "", fmt.Errorf("Got error status code (%d) trying to retrieve the tags", resp.StatusCode)
+	}
+	var tagsList struct {
+		Tags []string
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&tagsList); err != nil {
+		return nil, "", fmt.Errorf("Error in decoding the tags from the server: %s", err)
+	}
+	next, err = nextPageUrl(pageUrl, resp.Header.Get("Link"))
+	return tagsList.Tags, next, err
+}
+
+var linkNextRegex = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// resolve the `rel="next"` url of the Link header against the current url
+// ex: </v2/library/redis/tags/list?last=5&n=100>; rel="next"
+func nextPageUrl(current, link string) (string, error) {
+	match := linkNextRegex.FindStringSubmatch(link)
+	if match == nil {
+		return "", nil
+	}
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	next, err := url.Parse(match[1])
+	if err != nil {
+		return "", fmt.Errorf("Impossible to parse the Link header %s: %s", link, err)
+	}
+	return base.ResolveReference(next).String(), nil
+}
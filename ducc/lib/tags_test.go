@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestListTagsPagination(t *testing.T) {
+	pages := map[string][]string{
+		"":  {"1.0", "1.1"},
+		"b": {"2.0", "2.1"},
+		"c": {"latest"},
+	}
+	next := map[string]string{"": "b", "b": "c"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/library/redis/tags/list" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		last := r.URL.Query().Get("last")
+		if n, ok := next[last]; ok {
+			w.Header().Set("Link", `</v2/library/redis/tags/list?n=2&last=`+n+`>; rel="next"`)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": "library/redis", "tags": pages[last]})
+	}))
+	defer server.Close()
+
+	img := testImageFromServer(t, server)
+	tags, err := img.ListTags()
+	if err != nil {
+		t.Fatalf("Error in listing the tags: %s", err)
+	}
+	expected := []string{"1.0", "1.1", "2.0", "2.1", "latest"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("Error in the tags, expected %v got %v", expected, tags)
+	}
+}
+
+func TestNextPageUrl(t *testing.T) {
+	next, err := nextPageUrl("https://registry.example.com/v2/foo/tags/list",
+		`<https://other.example.com/v2/foo/tags/list?last=a>; rel="next"`)
+	if err != nil || next != "https://other.example.com/v2/foo/tags/list?last=a" {
+		t.Errorf("Error with an absolute Link: %s %v", next, err)
+	}
+	next, err = nextPageUrl("https://registry.example.com/v2/foo/tags/list", "")
+	if err != nil || next != "" {
+		t.Errorf("Error without Link: %s %v", next, err)
+	}
+}
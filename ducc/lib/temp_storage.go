@@ -0,0 +1,192 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// a temporary file, removed when closed
+type TempFile interface {
+	io.ReadWriteSeeker
+	io.Closer
+}
+
+// where the temporary files are staged
+type TempStorage interface {
+	CreateTemp(prefix string) (TempFile, error)
+}
+
+// the storage used for the temporary files, selected in the main `rootCmd` (cmd/root.go)
+var TempFiles TempStorage = DiskTempStorage{}
+
+// parse the name of a storage: disk or memory, for memory limit is the
+// maximum size kept in memory by all the files together, the files that do
+// not fit are spilled on disk
+func ParseTempStorage(name string, limit int64) (TempStorage, error) {
+	switch strings.ToLower(name) {
+	case "", "disk":
+		return DiskTempStorage{}, nil
+	case "memory":
+		return NewMemoryTempStorage(limit, DiskTempStorage{}), nil
+	}
+	return nil, fmt.Errorf("Unknown temporary storage: %s, expected disk or memory", name)
+}
+
+// temporary files in the TemporaryBaseDir, it can be a tmpfs
+type DiskTempStorage struct{}
+
+func (DiskTempStorage) CreateTemp(prefix string) (TempFile, error) {
+	file, err := UserDefinedTempFile("", prefix)
+	if err != nil {
+		return nil, err
+	}
+	return diskTempFile{file}, nil
+}
+
+type diskTempFile struct {
+	*os.File
+}
+
+func (f diskTempFile) Close() error {
+	defer os.Remove(f.Name())
+	return f.File.Close()
+}
+
+// temporary files kept in memory as long as all of them together take less
+// than Limit bytes, a file that does not fit anymore is moved into the Spill
+// storage
+type MemoryTempStorage struct {
+	Limit int64
+	Spill TempStorage
+
+	mutex sync.Mutex
+	// bytes currently kept in memory by all the files
+	used int64
+}
+
+func NewMemoryTempStorage(limit int64, spill TempStorage) *MemoryTempStorage {
+	return &MemoryTempStorage{Limit: limit, Spill: spill}
+}
+
+func (s *MemoryTempStorage) CreateTemp(prefix string) (TempFile, error) {
+	return &memoryTempFile{prefix: prefix, storage: s}, nil
+}
+
+// reserve n more bytes of memory, false if they would exceed the limit
+func (s *MemoryTempStorage) reserve(n int64) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.used+n > s.Limit {
+		return false
+	}
+	s.used += n
+	return true
+}
+
+func (s *MemoryTempStorage) release(n int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.used -= n
+}
+
+// bytes kept in memory by all the files of the storage
+func (s *MemoryTempStorage) Used() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.used
+}
+
+type memoryTempFile struct {
+	prefix  string
+	storage *MemoryTempStorage
+	content []byte
+	offset  int64
+	// once spilled all the operations go to the spilled file
+	spilled TempFile
+}
+
+func (f *memoryTempFile) Write(p []byte) (int, error) {
+	if f.spilled != nil {
+		return f.spilled.Write(p)
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.content)) {
+		if !f.storage.reserve(end - int64(len(f.content))) {
+			if err := f.spillToStorage(); err != nil {
+				return 0, err
+			}
+			return f.spilled.Write(p)
+		}
+		f.content = append(f.content, make([]byte, end-int64(len(f.content)))...)
+	}
+	copy(f.content[f.offset:], p)
+	f.offset = end
+	return len(p), nil
+}
+
+func (f *memoryTempFile) spillToStorage() error {
+	spilled, err := f.storage.Spill.CreateTemp(f.prefix)
+	if err != nil {
+		return err
+	}
+	if _, err = spilled.Write(f.content); err == nil {
+		_, err = spilled.Seek(f.offset, io.SeekStart)
+	}
+	if err != nil {
+		spilled.Close()
+		return err
+	}
+	Log().WithFields(log.Fields{"prefix": f.prefix, "limit": f.storage.Limit}).Debug("Temporary file does not fit in the memory, spilled")
+	f.spilled = spilled
+	f.storage.release(int64(len(f.content)))
+	f.content = nil
+	return nil
+}
+
+func (f *memoryTempFile) Read(p []byte) (int, error) {
+	if f.spilled != nil {
+		return f.spilled.Read(p)
+	}
+	if f.offset >= int64(len(f.content)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.content[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memoryTempFile) Seek(offset int64, whence int) (int64, error) {
+	if f.spilled != nil {
+		return f.spilled.Seek(offset, whence)
+	}
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = f.offset + offset
+	case io.SeekEnd:
+		position = int64(len(f.content)) + offset
+	default:
+		return 0, fmt.Errorf("Invalid whence: %d", whence)
+	}
+	if position < 0 {
+		return 0, fmt.Errorf("Negative position: %d", position)
+	}
+	f.offset = position
+	return position, nil
+}
+
+func (f *memoryTempFile) Close() error {
+	f.storage.release(int64(len(f.content)))
+	f.content = nil
+	if f.spilled != nil {
+		return f.spilled.Close()
+	}
+	return nil
+}
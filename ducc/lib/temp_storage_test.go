@@ -0,0 +1,101 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testTempStorage(t *testing.T, storage TempStorage, content []byte) TempFile {
+	file, err := storage.CreateTemp("test")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary file: %s", err)
+	}
+	// written in pieces, as done by io.Copy
+	for i := 0; i < len(content); i += 3 {
+		end := i + 3
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, err = file.Write(content[i:end]); err != nil {
+			t.Fatalf("Error in writing the temporary file: %s", err)
+		}
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("Error in seeking the temporary file: %s", err)
+	}
+	read, err := ioutil.ReadAll(file)
+	if err != nil || !bytes.Equal(read, content) {
+		t.Errorf("Error in reading back the temporary file: %q %v", read, err)
+	}
+	return file
+}
+
+func TestDiskTempStorage(t *testing.T) {
+	file := testTempStorage(t, DiskTempStorage{}, []byte("some content"))
+	name := file.(diskTempFile).Name()
+	file.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Error, temporary file not removed on close")
+	}
+}
+
+func TestMemoryTempStorage(t *testing.T) {
+	storage := NewMemoryTempStorage(16, DiskTempStorage{})
+
+	file := testTempStorage(t, storage, []byte("small"))
+	if file.(*memoryTempFile).spilled != nil {
+		t.Errorf("Error, small file spilled on disk")
+	}
+	file.Close()
+
+	file = testTempStorage(t, storage, []byte("a content bigger than the limit"))
+	spilled, ok := file.(*memoryTempFile).spilled.(diskTempFile)
+	if !ok {
+		t.Fatalf("Error, big file not spilled on disk")
+	}
+	file.Close()
+	if _, err := os.Stat(spilled.Name()); !os.IsNotExist(err) {
+		t.Errorf("Error, spilled file not removed on close")
+	}
+}
+
+func TestMemoryTempStorageSharedLimit(t *testing.T) {
+	storage := NewMemoryTempStorage(16, DiskTempStorage{})
+
+	// each file is below the limit, but together they are not
+	first := testTempStorage(t, storage, []byte("0123456789"))
+	second := testTempStorage(t, storage, []byte("0123456789"))
+	if first.(*memoryTempFile).spilled != nil {
+		t.Errorf("Error, first file spilled on disk")
+	}
+	if second.(*memoryTempFile).spilled == nil {
+		t.Errorf("Error, second file kept in memory over the limit of the storage")
+	}
+	if used := storage.Used(); used != 10 {
+		t.Errorf("Error in the memory used, expected 10 got %d", used)
+	}
+
+	// the memory is given back once the file is closed
+	first.Close()
+	second.Close()
+	if used := storage.Used(); used != 0 {
+		t.Errorf("Error, memory not released on close: %d", used)
+	}
+	third := testTempStorage(t, storage, []byte("0123456789"))
+	if third.(*memoryTempFile).spilled != nil {
+		t.Errorf("Error, file spilled after the memory was released")
+	}
+	third.Close()
+}
+
+func TestParseTempStorage(t *testing.T) {
+	if storage, err := ParseTempStorage("memory", 10); err != nil || storage.(*MemoryTempStorage).Limit != 10 {
+		t.Errorf("Error in parsing the memory storage: %v %v", storage, err)
+	}
+	if _, err := ParseTempStorage("ramdisk", 10); err == nil {
+		t.Errorf("Error, unknown storage accepted")
+	}
+}
@@ -2,8 +2,13 @@ package lib
 
 import (
 	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // this flag is populated in the main `rootCmd` (cmd/root.go)
@@ -11,9 +16,59 @@ var (
 	TemporaryBaseDir string
 )
 
+// all the temporary files and directories created by DUCC start with this
+// prefix, so that we can recognize them when cleaning up
+const tempPrefix = "ducc_"
+
 func UserDefinedTempDir(dir, prefix string) (name string, err error) {
 	if strings.HasPrefix(dir, TemporaryBaseDir) {
-		return ioutil.TempDir(dir, prefix)
+		return ioutil.TempDir(dir, tempPrefix+prefix)
+	}
+	return ioutil.TempDir(path.Join(TemporaryBaseDir, dir), tempPrefix+prefix)
+}
+
+func UserDefinedTempFile(dir, prefix string) (f *os.File, err error) {
+	if strings.HasPrefix(dir, TemporaryBaseDir) {
+		return ioutil.TempFile(dir, tempPrefix+prefix)
+	}
+	return ioutil.TempFile(path.Join(TemporaryBaseDir, dir), tempPrefix+prefix)
+}
+
+// remove the temporary files and directories left behind by DUCC, usually by
+// a crash, that are older than maxAge, returns how many were removed
+func CleanStaleTempFiles(maxAge time.Duration) (int, error) {
+	dir := TemporaryBaseDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return cleanStaleTempFiles(dir, maxAge, DefaultClock.Now())
+}
+
+func cleanStaleTempFiles(dir string, maxAge time.Duration, now time.Time) (int, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	var firstError error
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), tempPrefix) {
+			continue
+		}
+		if now.Sub(entry.ModTime()) < maxAge {
+			continue
+		}
+		stale := filepath.Join(dir, entry.Name())
+		err = os.RemoveAll(stale)
+		if err != nil {
+			LogE(err).WithFields(log.Fields{"path": stale}).Warning("Impossible to remove stale temporary file")
+			if firstError == nil {
+				firstError = err
+			}
+			continue
+		}
+		Log().WithFields(log.Fields{"path": stale, "modified": entry.ModTime()}).Info("Removed stale temporary file")
+		removed++
 	}
-	return ioutil.TempDir(path.Join(TemporaryBaseDir, dir), prefix)
+	return removed, firstError
 }
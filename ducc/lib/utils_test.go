@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCleanStaleTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clean_temp")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	create := func(name string, isDir bool, modified time.Time) {
+		path := filepath.Join(dir, name)
+		if isDir {
+			os.MkdirAll(filepath.Join(path, "content"), 0755)
+		} else {
+			ioutil.WriteFile(path, []byte("data"), 0644)
+		}
+		os.Chtimes(path, modified, modified)
+	}
+	create(tempPrefix+"conversion123", true, old)
+	create(tempPrefix+"layer456", false, old)
+	create(tempPrefix+"conversion789", true, now)
+	create("not_ducc", false, old)
+
+	removed, err := cleanStaleTempFiles(dir, 24*time.Hour, now)
+	if err != nil {
+		t.Fatalf("Error in cleaning the stale files: %s", err)
+	}
+	if removed != 2 {
+		t.Errorf("Error, expected 2 stale files removed, got %d", removed)
+	}
+	for name, shouldExist := range map[string]bool{
+		tempPrefix + "conversion123": false,
+		tempPrefix + "layer456":      false,
+		tempPrefix + "conversion789": true,
+		"not_ducc":                   true,
+	} {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if (err == nil) != shouldExist {
+			t.Errorf("Error with %s, expected to exist: %v", name, shouldExist)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package lib
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// limits enforced on the layers before to ingest them, zero means unlimited
+type Limits struct {
+	MaxEntries   int
+	MaxEntrySize int64
+	MaxTotalSize int64
+	// if true the entries of unsupported types are not a violation, they are
+	// only counted and logged, since the ingestion will skip them
+	SkipUnsupported bool
+}
+
+// the limits used when ingesting the layers
+// all the fields are populated in the main `rootCmd` (cmd/root.go), by
+// default there are no limits
+var DefaultLayerLimits = Limits{}
+
+// what we found scanning a layer
+type LayerStats struct {
+	Entries     int
+	Files       int
+	Directories int
+	Symlinks    int
+	Hardlinks   int
+	Others      int
+	TotalSize   int64
+	// entries of unsupported types, allowed only with Limits.SkipUnsupported
+	Skipped        int
+	SkippedEntries []string
+	// entries with an empty or "." name, they would be applied to the root of
+	// the layer so they are not taken into account nor ingested
+	Unnamed int
+	// unix sockets are meaningless outside of the running container, they
+	// are always skipped
+	Sockets int
+	// number of entries directly inside each directory of the layer, the root
+	// of the layer is "."
+	EntriesPerDirectory map[string]int
+}
+
+// LayerValidationError lists all the policy violations found in a layer
+type LayerValidationError struct {
+	Violations []string
+}
+
+func (e *LayerValidationError) Error() string {
+	return fmt.Sprintf("Layer violates the ingestion policy: %s", strings.Join(e.Violations, "; "))
+}
+
+// ValidateLayerTar scans the (uncompressed) tar stream r without writing
+// anything and checks that it respects the limits, that no entry escapes the
+// root of the layer and that there are no entries of types we would silently
+// skip during the ingestion.
+// All the violations are reported together in a *LayerValidationError, a
+// stream that is not a valid tar returns the error of the tar reader.
+func ValidateLayerTar(r io.Reader, limits Limits) (LayerStats, error) {
+	return filterLayerTar(r, nil, limits)
+}
+
+// filterLayerTar validates r as ValidateLayerTar does and, if w is not nil,
+// writes into w the tar that we ingest: the leading "/" is stripped from the
+// names, the pax global headers, the unnamed entries, the sockets and the
+// skipped entries are dropped and the sparse files become regular files.
+// The entries that violate the policy are never written and, on a violation,
+// w does not get the end of the archive.
+func filterLayerTar(r io.Reader, w io.Writer, limits Limits) (LayerStats, error) {
+	stats := LayerStats{EntriesPerDirectory: make(map[string]int)}
+	var violations []string
+	// the entries of unsupported types, left out of the ingested tar
+	skipped := make(map[string]bool)
+	var tarWriter *tar.Writer
+	if w != nil {
+		tarWriter = tar.NewWriter(w)
+	}
+	write := func(header *tar.Header, data io.Reader) error {
+		if tarWriter == nil {
+			return nil
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := io.Copy(tarWriter, data)
+		return err
+	}
+
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			// metadata of the whole archive, as the commit written by
+			// `git archive`, there is nothing to ingest
+			continue
+		}
+		stats.Entries++
+		if limits.MaxEntries > 0 && stats.Entries > limits.MaxEntries {
+			violations = append(violations, fmt.Sprintf("more than %d entries", limits.MaxEntries))
+			break
+		}
+		// the absolute names are relative to the root of the layer, as docker
+		// and tar do
+		header.Name = stripLeadingSlash(header.Name)
+
+		if clean := filepath.Clean(header.Name); clean == "." {
+			// the "./" directory is common and harmless, anything else
+			// without a name is a broken image
+			if header.Typeflag != tar.TypeDir {
+				Log().WithFields(log.Fields{"entry": header.Name, "typeflag": string(header.Typeflag)}).
+					Warning("Entry without a name in the layer, skipping it")
+			}
+			stats.Unnamed++
+			continue
+		}
+
+		if isSocketEntry(header) {
+			Log().WithFields(log.Fields{"entry": header.Name}).
+				Warning("Socket in the layer, it will be skipped")
+			stats.Sockets++
+			continue
+		}
+
+		violation := false
+		if escapesLayerRoot(header.Name) {
+			violations = append(violations, fmt.Sprintf("path traversal in %s", header.Name))
+			violation = true
+		} else {
+			stats.EntriesPerDirectory[filepath.Dir(filepath.Clean(header.Name))]++
+		}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			stats.Files++
+		case tar.TypeGNUSparse:
+			// the tar reader fills the holes, so we ingest the whole file
+			header.Typeflag = tar.TypeReg
+			stats.Files++
+		case tar.TypeDir:
+			stats.Directories++
+		case tar.TypeSymlink:
+			stats.Symlinks++
+		case tar.TypeLink:
+			stats.Hardlinks++
+			header.Linkname = stripLeadingSlash(header.Linkname)
+			if escapesLayerRoot(header.Linkname) {
+				violations = append(violations, fmt.Sprintf("hardlink %s points outside the layer: %s", header.Name, header.Linkname))
+				violation = true
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			stats.Others++
+		default:
+			if !limits.SkipUnsupported {
+				violations = append(violations, fmt.Sprintf("unsupported type %q of %s", header.Typeflag, header.Name))
+				violation = true
+				break
+			}
+			Log().WithFields(log.Fields{"entry": header.Name, "typeflag": string(header.Typeflag)}).
+				Warning("Entry of unsupported type in the layer, it will be skipped")
+			stats.Skipped++
+			stats.SkippedEntries = append(stats.SkippedEntries, header.Name)
+			skipped[filepath.Clean(header.Name)] = true
+		}
+		if header.Typeflag == tar.TypeLink && skipped[filepath.Clean(header.Linkname)] {
+			Log().WithFields(log.Fields{"entry": header.Name, "target": header.Linkname}).
+				Warning("Hardlink to a skipped entry in the layer, it will be skipped")
+			stats.Skipped++
+			stats.SkippedEntries = append(stats.SkippedEntries, header.Name)
+			skipped[filepath.Clean(header.Name)] = true
+		}
+
+		if limits.MaxEntrySize > 0 && header.Size > limits.MaxEntrySize {
+			violations = append(violations, fmt.Sprintf("%s is %d bytes, more than the limit of %d", header.Name, header.Size, limits.MaxEntrySize))
+			violation = true
+		}
+		stats.TotalSize += header.Size
+		if limits.MaxTotalSize > 0 && stats.TotalSize > limits.MaxTotalSize {
+			violations = append(violations, fmt.Sprintf("more than %d bytes in total", limits.MaxTotalSize))
+			break
+		}
+		if !violation && len(violations) == 0 && !skipped[filepath.Clean(header.Name)] {
+			if err = write(ingestedHeader(header), tarReader); err != nil {
+				return stats, err
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return stats, &LayerValidationError{Violations: violations}
+	}
+	if tarWriter != nil {
+		return stats, tarWriter.Close()
+	}
+	return stats, nil
+}
+
+func stripLeadingSlash(name string) string {
+	return strings.TrimLeft(name, "/")
+}
+
+// the header as written in the ingested tar, the tar writer picks the format
+// and the records that describe the sparse files are not needed anymore,
+// since the file is written whole
+func ingestedHeader(header *tar.Header) *tar.Header {
+	ingested := *header
+	ingested.Format = tar.FormatUnknown
+	if header.Typeflag == tar.TypeRegA {
+		ingested.Typeflag = tar.TypeReg
+	}
+	if len(header.PAXRecords) > 0 {
+		ingested.PAXRecords = make(map[string]string)
+		for key, value := range header.PAXRecords {
+			if !strings.HasPrefix(key, "GNU.sparse.") {
+				ingested.PAXRecords[key] = value
+			}
+		}
+	}
+	return &ingested
+}
+
+// the socket type bit (c_ISSOCK) in the mode of the entry, tar has no type
+// for the sockets but some tools archive them anyway
+func isSocketEntry(header *tar.Header) bool {
+	return header.FileInfo().Mode()&os.ModeSocket != 0
+}
+
+func escapesLayerRoot(name string) bool {
+	clean := filepath.Clean(name)
+	return clean == ".." || strings.HasPrefix(clean, "../")
+}
+
+// save the filtered layer into a temporary file while validating it, so that
+// it can be rejected before to start the ingestion, the returned layer is
+// positioned at the beginning of the file
+func spoolAndValidateLayer(layer io.Reader, limits Limits) (io.ReadCloser, LayerStats, error) {
+	spooled, err := TempFiles.CreateTemp("layer")
+	if err != nil {
+		return nil, LayerStats{}, err
+	}
+	stats, err := filterLayerTar(layer, spooled, limits)
+	if err == nil {
+		// the tar reader may not consume the padding at the end of the
+		// stream, the digest is verified only reading it all
+		_, err = io.Copy(ioutil.Discard, layer)
+	}
+	if err == nil {
+		_, err = spooled.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		spooled.Close()
+		return nil, stats, err
+	}
+	return spooled, stats, nil
+}
+
+// if true the layers are saved in a temporary file and validated before the
+// ingestion, instead of being validated while they are ingested, it needs
+// temporary space as big as the biggest uncompressed layer
+// this flag is populated in the main `rootCmd` (cmd/root.go)
+var SpoolLayers = false
+
+// the outcome of the validation of a streamed layer
+type layerValidation struct {
+	stats LayerStats
+	err   error
+}
+
+// validate the layer while the returned reader consumes it, without any
+// temporary copy, the outcome of the validation is sent on the channel once
+// the layer has been read
+// if the layer is rejected the reader fails instead of reaching the end of
+// the archive, so the ingestion fails as well
+// the reader must be closed, the validation ends with io.ErrClosedPipe if it
+// is closed before the end of the archive
+func streamAndValidateLayer(layer io.Reader, limits Limits) (io.ReadCloser, <-chan layerValidation) {
+	pipeReader, pipeWriter := io.Pipe()
+	result := make(chan layerValidation, 1)
+	go func() {
+		stats, err := filterLayerTar(layer, pipeWriter, limits)
+		if err == nil || err == io.ErrClosedPipe {
+			// the reader may stop before the end of the archive, we still
+			// need to read all the layer to verify its digest
+			if _, errDrain := io.Copy(ioutil.Discard, layer); errDrain != nil {
+				err = errDrain
+			}
+		}
+		pipeWriter.CloseWithError(err)
+		result <- layerValidation{stats: stats, err: err}
+	}()
+	return pipeReader, result
+}
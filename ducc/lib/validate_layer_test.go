@@ -0,0 +1,309 @@
+package lib
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func buildTestTar(t *testing.T, headers ...*tar.Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, header := range headers {
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatalf("Error in writing the tar header: %s", err)
+		}
+		if header.Size > 0 {
+			tw.Write(bytes.Repeat([]byte("a"), int(header.Size)))
+		}
+	}
+	tw.Close()
+	return &buf
+}
+
+func TestValidateLayerTarClean(t *testing.T) {
+	layer := buildTestTar(t,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10},
+		&tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+		&tar.Header{Name: "etc/hard", Typeflag: tar.TypeLink, Linkname: "etc/passwd"},
+		&tar.Header{Name: "etc/.wh.shadow", Typeflag: tar.TypeReg, Mode: 0644},
+	)
+	stats, err := ValidateLayerTar(layer, Limits{MaxEntries: 10, MaxEntrySize: 100, MaxTotalSize: 100})
+	if err != nil {
+		t.Fatalf("Error in validating a clean layer: %s", err)
+	}
+	if stats.Entries != 5 || stats.Files != 2 || stats.Directories != 1 ||
+		stats.Symlinks != 1 || stats.Hardlinks != 1 || stats.TotalSize != 10 {
+		t.Errorf("Error in the stats of the layer: %+v", stats)
+	}
+}
+
+func TestValidateLayerTarViolations(t *testing.T) {
+	cases := []struct {
+		name      string
+		headers   []*tar.Header
+		limits    Limits
+		violation string
+	}{
+		{"traversal",
+			[]*tar.Header{{Name: "a/../../etc/passwd", Typeflag: tar.TypeReg}},
+			Limits{}, "path traversal"},
+		{"absolute traversal",
+			[]*tar.Header{{Name: "/../etc/passwd", Typeflag: tar.TypeReg}},
+			Limits{}, "path traversal"},
+		{"hardlink escape",
+			[]*tar.Header{{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../outside"}},
+			Limits{}, "points outside"},
+		{"too many entries",
+			[]*tar.Header{{Name: "a", Typeflag: tar.TypeReg}, {Name: "b", Typeflag: tar.TypeReg}},
+			Limits{MaxEntries: 1}, "more than 1 entries"},
+		{"entry too big",
+			[]*tar.Header{{Name: "big", Typeflag: tar.TypeReg, Size: 20}},
+			Limits{MaxEntrySize: 10}, "more than the limit"},
+		{"total too big",
+			[]*tar.Header{{Name: "a", Typeflag: tar.TypeReg, Size: 8}, {Name: "b", Typeflag: tar.TypeReg, Size: 8}},
+			Limits{MaxTotalSize: 10}, "bytes in total"},
+		{"unsupported type",
+			[]*tar.Header{{Name: "cont", Typeflag: tar.TypeCont}},
+			Limits{}, "unsupported type"},
+	}
+	for _, c := range cases {
+		layer := buildTestTar(t, c.headers...)
+		_, err := ValidateLayerTar(layer, c.limits)
+		validationErr, ok := err.(*LayerValidationError)
+		if !ok {
+			t.Errorf("Error in %s, expected a validation error, got: %v", c.name, err)
+			continue
+		}
+		if !strings.Contains(validationErr.Error(), c.violation) {
+			t.Errorf("Error in %s, unexpected violation: %s", c.name, validationErr)
+		}
+	}
+}
+
+func TestSpoolAndValidateLayer(t *testing.T) {
+	layer := buildTestTar(t, &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	spooled, _, err := spoolAndValidateLayer(layer, DefaultLayerLimits)
+	if err != nil {
+		t.Fatalf("Error in spooling the layer: %s", err)
+	}
+	defer spooled.Close()
+	entries := readTarEntries(t, spooled)
+	if len(entries) != 1 || entries["file"] != "aaaaa" {
+		t.Errorf("Error, spooled layer differs from the original: %v", entries)
+	}
+}
+
+func TestFilterLayerTar(t *testing.T) {
+	var layer bytes.Buffer
+	tw := tar.NewWriter(&layer)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header",
+		PAXRecords: map[string]string{"comment": "0123456789abcdef"}})
+	tw.WriteHeader(&tar.Header{Name: "/etc/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 4})
+	tw.Write([]byte("root"))
+	tw.WriteHeader(&tar.Header{Name: "/etc/hard", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"})
+	tw.Close()
+
+	var filtered bytes.Buffer
+	stats, err := filterLayerTar(&layer, &filtered, Limits{})
+	if err != nil {
+		t.Fatalf("Error in filtering the layer: %s", err)
+	}
+	if stats.Entries != 3 || stats.Files != 1 || stats.Hardlinks != 1 {
+		t.Errorf("Error in the stats of the layer: %+v", stats)
+	}
+	tarReader := tar.NewReader(&filtered)
+	var names []string
+	for {
+		header, err := tarReader.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+		if header.Typeflag == tar.TypeLink && header.Linkname != "etc/passwd" {
+			t.Errorf("Error, leading slash not stripped from the hardlink: %s", header.Linkname)
+		}
+	}
+	if strings.Join(names, " ") != "etc/ etc/passwd etc/hard" {
+		t.Errorf("Error in the filtered entries: %v", names)
+	}
+}
+
+func TestFilterLayerTarSparse(t *testing.T) {
+	// an old GNU sparse file, 4096 bytes of which only the first 512 are data
+	header := make([]byte, 512)
+	copy(header, "sparse")
+	copy(header[100:], "0000644\x00")
+	copy(header[108:], "0000000\x00")
+	copy(header[116:], "0000000\x00")
+	copy(header[124:], "00000001000\x00")
+	copy(header[136:], "00000000000\x00")
+	header[156] = tar.TypeGNUSparse
+	copy(header[257:], "ustar  \x00")
+	// first sparse entry: offset 0, 512 bytes
+	copy(header[386:], "00000000000\x00")
+	copy(header[398:], "00000001000\x00")
+	// real size
+	copy(header[483:], "00000010000\x00")
+	copy(header[148:], "        ")
+	var sum int64
+	for _, b := range header {
+		sum += int64(b)
+	}
+	copy(header[148:], fmt.Sprintf("%06o\x00 ", sum))
+	layer := append(header, bytes.Repeat([]byte("a"), 512)...)
+	layer = append(layer, make([]byte, 1024)...)
+
+	var filtered bytes.Buffer
+	stats, err := filterLayerTar(bytes.NewReader(layer), &filtered, Limits{})
+	if err != nil {
+		t.Fatalf("Error in filtering a layer with a sparse file: %s", err)
+	}
+	if stats.Files != 1 || stats.TotalSize != 4096 {
+		t.Errorf("Error in the stats of the sparse file: %+v", stats)
+	}
+	entries := readTarEntries(t, &filtered)
+	expected := string(bytes.Repeat([]byte("a"), 512)) + string(make([]byte, 4096-512))
+	if content, ok := entries["sparse"]; !ok || content != expected {
+		t.Errorf("Error, sparse file not expanded: %d bytes", len(content))
+	}
+}
+
+func TestStreamAndValidateLayer(t *testing.T) {
+	layer := buildTestTar(t, &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	stream, validation := streamAndValidateLayer(layer, DefaultLayerLimits)
+	entries := readTarEntries(t, stream)
+	stream.Close()
+	if result := <-validation; result.err != nil || result.stats.Files != 1 {
+		t.Errorf("Error in validating the streamed layer: %+v", result)
+	}
+	if len(entries) != 1 || entries["file"] != "aaaaa" {
+		t.Errorf("Error, streamed layer differs from the original: %v", entries)
+	}
+
+	layer = buildTestTar(t,
+		&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		&tar.Header{Name: "../outside", Typeflag: tar.TypeReg, Mode: 0644, Size: 5})
+	stream, validation = streamAndValidateLayer(layer, DefaultLayerLimits)
+	_, err := ioutil.ReadAll(stream)
+	stream.Close()
+	if _, ok := err.(*LayerValidationError); !ok {
+		t.Errorf("Error, the stream of a rejected layer does not fail: %v", err)
+	}
+	if result := <-validation; result.err != err {
+		t.Errorf("Error, unexpected outcome of the validation: %v", result.err)
+	}
+}
+
+func TestValidateLayerTarSkipUnsupported(t *testing.T) {
+	layer := buildTestTar(t,
+		&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "cont", Typeflag: tar.TypeCont},
+	)
+	stats, err := ValidateLayerTar(layer, Limits{SkipUnsupported: true})
+	if err != nil {
+		t.Fatalf("Error, unsupported entry not skipped: %s", err)
+	}
+	if stats.Skipped != 1 || len(stats.SkippedEntries) != 1 || stats.SkippedEntries[0] != "cont" {
+		t.Errorf("Error in reporting the skipped entries: %+v", stats)
+	}
+}
+
+func TestFilterLayerTarSkipUnsupported(t *testing.T) {
+	layer := buildTestTar(t,
+		&tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0644, Size: 1},
+		&tar.Header{Name: "cont", Typeflag: tar.TypeCont, Mode: 0644, Size: 1},
+		&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "cont"},
+	)
+	var filtered bytes.Buffer
+	stats, err := filterLayerTar(layer, &filtered, Limits{SkipUnsupported: true})
+	if err != nil {
+		t.Fatalf("Error, unsupported entry not skipped: %s", err)
+	}
+	if stats.Skipped != 2 {
+		t.Errorf("Error in counting the skipped entries: %+v", stats)
+	}
+	entries := readTarEntries(t, &filtered)
+	if len(entries) != 1 || entries["file"] != "a" {
+		t.Errorf("Error, skipped entries in the ingested layer: %v", entries)
+	}
+}
+
+func TestValidateLayerTarUnnamedEntries(t *testing.T) {
+	layer := buildTestTar(t,
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "", Typeflag: tar.TypeReg, Mode: 0644, Size: 10},
+		&tar.Header{Name: ".", Typeflag: tar.TypeSymlink, Linkname: "/"},
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10},
+	)
+	stats, err := ValidateLayerTar(layer, Limits{})
+	if err != nil {
+		t.Fatalf("Error in validating a layer with unnamed entries: %s", err)
+	}
+	if stats.Unnamed != 3 || stats.Entries != 4 {
+		t.Errorf("Error in counting the unnamed entries: %+v", stats)
+	}
+	if stats.Files != 1 || stats.Symlinks != 0 || stats.Directories != 0 {
+		t.Errorf("Error, unnamed entries counted as content: %+v", stats)
+	}
+	if stats.EntriesPerDirectory["."] != 0 {
+		t.Errorf("Error, unnamed entries counted in the root: %v", stats.EntriesPerDirectory)
+	}
+
+	var filtered bytes.Buffer
+	layer = buildTestTar(t,
+		&tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "", Typeflag: tar.TypeReg, Mode: 0644, Size: 10},
+		&tar.Header{Name: ".", Typeflag: tar.TypeSymlink, Linkname: "/"},
+		&tar.Header{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644, Size: 10},
+	)
+	if _, err = filterLayerTar(layer, &filtered, Limits{}); err != nil {
+		t.Fatalf("Error in filtering a layer with unnamed entries: %s", err)
+	}
+	if entries := readTarEntries(t, &filtered); len(entries) != 1 || entries["etc/passwd"] == "" {
+		t.Errorf("Error, unnamed entries in the ingested layer: %v", entries)
+	}
+}
+
+func TestLayerWithSocketEntries(t *testing.T) {
+	headers := []*tar.Header{
+		{Name: "run/", Typeflag: tar.TypeDir, Mode: 0755},
+		// as archived by the tools that do not refuse the sockets, with the
+		// c_ISSOCK bit in the mode
+		{Name: "run/app.sock", Typeflag: tar.TypeReg, Mode: 0140000 | 0755},
+		{Name: "run/app.pid", Typeflag: tar.TypeReg, Mode: 0644, Size: 2},
+	}
+	var filtered bytes.Buffer
+	stats, err := filterLayerTar(buildTestTar(t, headers...), &filtered, Limits{})
+	if err != nil {
+		t.Fatalf("Error, layer with a socket rejected: %s", err)
+	}
+	if entries := readTarEntries(t, &filtered); len(entries) != 2 || entries["run/app.pid"] != "aa" {
+		t.Errorf("Error, socket in the ingested layer: %v", entries)
+	}
+	if stats.Sockets != 1 || stats.Files != 1 || stats.Entries != 3 || stats.EntriesPerDirectory["run"] != 1 {
+		t.Errorf("Error in counting the socket entries: %+v", stats)
+	}
+
+	dest, err := ioutil.TempDir("", "test_sockets")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dest)
+	if err = extractTar(buildTestTar(t, headers...), dest); err != nil {
+		t.Fatalf("Error in extracting the layer with a socket: %s", err)
+	}
+	if _, err = os.Lstat(filepath.Join(dest, "run", "app.sock")); !os.IsNotExist(err) {
+		t.Errorf("Error, the socket was extracted: %v", err)
+	}
+	if _, err = os.Lstat(filepath.Join(dest, "run", "app.pid")); err != nil {
+		t.Errorf("Error, the file next to the socket was not extracted: %s", err)
+	}
+}
@@ -0,0 +1,77 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	da "github.com/cvmfs/ducc/docker-api"
+)
+
+// files that must be present in every flat (singularity) image
+var FlatImageSentinels = []string{".singularity.d"}
+
+// SmokeTestError lists everything that is missing, or broken, in a published image
+type SmokeTestError struct {
+	Image   string
+	Missing []string
+}
+
+func (e *SmokeTestError) Error() string {
+	return fmt.Sprintf("Image %s not consumable, missing or broken: %s", e.Image, strings.Join(e.Missing, ", "))
+}
+
+// check, through the CVMFS client, that an image already published is actually
+// consumable: all the layers are present and listable and the flat image
+// exists and contains the FlatImageSentinels
+// if something is missing it returns a *SmokeTestError listing all the problems
+func SmokeTestImage(CVMFSRepo string, manifest da.Manifest) error {
+	return smokeTestImage(repositoryRoot(CVMFSRepo), CVMFSRepo, manifest)
+}
+
+func smokeTestImage(repoRoot, CVMFSRepo string, manifest da.Manifest) error {
+	llog := func(l *log.Entry) *log.Entry {
+		return l.WithFields(log.Fields{"action": "smoke test image",
+			"repo":  CVMFSRepo,
+			"image": manifest.Config.Digest})
+	}
+	missing := make([]string, 0)
+	checkDirectory := func(path string) {
+		_, err := ioutil.ReadDir(path)
+		if err != nil {
+			llog(LogE(err)).WithFields(log.Fields{"path": path}).Warning("Impossible to list directory")
+			missing = append(missing, path)
+		}
+	}
+
+	for _, layer := range manifest.Layers {
+		digest := strings.TrimPrefix(layer.Digest, "sha256:")
+		layerfs, err := TrimRepositoryRoot(CVMFSRepo, LayerRootfsPath(CVMFSRepo, digest))
+		if err != nil {
+			llog(LogE(err)).WithFields(log.Fields{"layer": layer.Digest}).Warning("Impossible to find the layer path")
+			missing = append(missing, layer.Digest)
+			continue
+		}
+		checkDirectory(filepath.Join(repoRoot, layerfs))
+	}
+
+	flatPath := filepath.Join(repoRoot, GetSingularityPathFromManifest(manifest))
+	checkDirectory(flatPath)
+	for _, sentinel := range FlatImageSentinels {
+		path := filepath.Join(flatPath, sentinel)
+		if _, err := os.Lstat(path); err != nil {
+			missing = append(missing, path)
+		}
+	}
+
+	if len(missing) > 0 {
+		err := &SmokeTestError{Image: manifest.Config.Digest, Missing: missing}
+		llog(LogE(err)).Error("Image failed the smoke test")
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSmokeTestImage(t *testing.T) {
+	root, err := ioutil.TempDir("", "test_smoke")
+	if err != nil {
+		t.Fatalf("Error in creating the temporary directory: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	repo := "test.cern.ch"
+	manifest := manifestWithConfig("sha256:ccddeeff", "sha256:aabb0011", "sha256:aabb0022")
+	os.MkdirAll(filepath.Join(root, ".layers", "aa", "aabb0011", "layerfs", "etc"), 0755)
+	os.MkdirAll(filepath.Join(root, ".layers", "aa", "aabb0022", "layerfs"), 0755)
+	os.MkdirAll(filepath.Join(root, ".flat", "cc", "ccddeeff", ".singularity.d"), 0755)
+
+	err = smokeTestImage(root, repo, manifest)
+	if err != nil {
+		t.Errorf("Error in smoke testing a complete image: %s", err)
+	}
+
+	os.RemoveAll(filepath.Join(root, ".layers", "aa", "aabb0022"))
+	os.RemoveAll(filepath.Join(root, ".flat", "cc", "ccddeeff", ".singularity.d"))
+	err = smokeTestImage(root, repo, manifest)
+	smokeErr, ok := err.(*SmokeTestError)
+	if !ok {
+		t.Fatalf("Expected SmokeTestError, got: %v", err)
+	}
+	if len(smokeErr.Missing) != 2 {
+		t.Errorf("Expected 2 missing paths, got: %v", smokeErr.Missing)
+	}
+}
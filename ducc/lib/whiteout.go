@@ -0,0 +1,38 @@
+package lib
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"strings"
+)
+
+// WhiteoutHandler recognizes, among the entries of a layer tar, the
+// whiteouts: the markers that remove paths of the layers below.
+type WhiteoutHandler interface {
+	// IsWhiteout reports whether the entry, whose cleaned name is name, is a
+	// whiteout, the whiteouts are not content of the image
+	IsWhiteout(name string, header *tar.Header) bool
+	// Apply returns the path removed by the whiteout; if opaque is true only
+	// the content of the directory at path is removed, not the directory
+	Apply(name string, header *tar.Header) (path string, opaque bool)
+}
+
+// the whiteouts of the docker images, inherited from aufs: `dir/.wh.name`
+// removes `dir/name` and `dir/.wh..wh..opq` removes the content of `dir`
+type AufsWhiteoutHandler struct{}
+
+func (AufsWhiteoutHandler) IsWhiteout(name string, header *tar.Header) bool {
+	return strings.HasPrefix(filepath.Base(name), whiteoutPrefix)
+}
+
+func (AufsWhiteoutHandler) Apply(name string, header *tar.Header) (string, bool) {
+	base := filepath.Base(name)
+	if base == whiteoutOpaque {
+		return filepath.Dir(name), true
+	}
+	return filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, whiteoutPrefix)), false
+}
+
+// the handler used when the layers are flattened, sites with images using
+// other conventions can replace it
+var DefaultWhiteoutHandler WhiteoutHandler = AufsWhiteoutHandler{}
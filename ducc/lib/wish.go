@@ -25,6 +25,7 @@ type WishFriendly struct {
 	OutputImage            *Image
 	ExpandedTagImagesLayer <-chan *Image
 	ExpandedTagImagesFlat  <-chan *Image
+	Representations        Representations
 }
 
 func CreateWish(inputImage, outputImage, cvmfsRepo, userInput, userOutput string) (wish WishFriendly, err error) {
@@ -51,6 +52,7 @@ func CreateWish(inputImage, outputImage, cvmfsRepo, userInput, userOutput string
 	wish.CvmfsRepo = cvmfsRepo
 	wish.UserInput = userInput
 	wish.UserOutput = userOutput
+	wish.Representations = DefaultRepresentations
 
 	iImage, errI := ParseImage(wish.InputName)
 	wish.InputImage = &iImage